@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ReadAccess controls who may read a class of objects through the public read endpoints.
+type ReadAccess string
+
+const (
+	ReadAccessPublic ReadAccess = "public"
+	// Requires the API token or a client certificate, like the /api endpoints.
+	ReadAccessToken ReadAccess = "token"
+	ReadAccessDeny  ReadAccess = "deny"
+)
+
+// Object classes of the read endpoints.
+const (
+	ReadClassNar       = "nar"        // files inside of NARs from /serve
+	ReadClassLog       = "log"        // build logs from /log
+	ReadClassCacheInfo = "cache-info" // /cache-info.json
+)
+
+// parseReadAccess parses a comma separated list of class=access, e.g. "log=token,nar=public".
+// Classes that are not listed are public.
+func parseReadAccess(spec string) (map[string]ReadAccess, error) {
+	access := map[string]ReadAccess{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry == "" {
+			continue
+		}
+
+		class, value, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid read access %q, expected class=access", entry)
+		}
+
+		switch class {
+		case ReadClassNar, ReadClassLog, ReadClassCacheInfo:
+		default:
+			return nil, fmt.Errorf("unknown object class %q, expected %s, %s or %s",
+				class, ReadClassNar, ReadClassLog, ReadClassCacheInfo)
+		}
+
+		switch ReadAccess(value) {
+		case ReadAccessPublic, ReadAccessToken, ReadAccessDeny:
+		default:
+			return nil, fmt.Errorf("unknown access %q for %s, expected %s, %s or %s",
+				value, class, ReadAccessPublic, ReadAccessToken, ReadAccessDeny)
+		}
+
+		access[class] = ReadAccess(value)
+	}
+
+	return access, nil
+}
+
+// ReadAccessMiddleware enforces the configured access of an object class before anything is fetched from S3.
+func (s *Service) ReadAccessMiddleware(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch s.ReadAccess[class] {
+		case ReadAccessDeny:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		case ReadAccessToken:
+			s.AuthMiddleware(next)(w, r)
+		case ReadAccessPublic, "":
+			next(w, r)
+		}
+	}
+}
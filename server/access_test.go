@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_ReadAccessMiddleware(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	service.ReadAccess = map[string]server.ReadAccess{
+		server.ReadClassLog:       server.ReadAccessToken,
+		server.ReadClassCacheInfo: server.ReadAccessDeny,
+	}
+
+	for _, tc := range []struct {
+		class  string
+		header map[string]string
+		status int
+	}{
+		// nar is not configured and stays public
+		{server.ReadClassNar, nil, http.StatusOK},
+		{server.ReadClassLog, nil, http.StatusUnauthorized},
+		{server.ReadClassLog, map[string]string{"Authorization": "Bearer wrongtoken"}, http.StatusUnauthorized},
+		{server.ReadClassLog, map[string]string{"Authorization": "Bearer " + service.APIToken}, http.StatusOK},
+		{server.ReadClassCacheInfo, map[string]string{"Authorization": "Bearer " + service.APIToken}, http.StatusForbidden},
+	} {
+		called := false
+		next := func(w http.ResponseWriter, _ *http.Request) {
+			called = true
+
+			w.WriteHeader(http.StatusOK)
+		}
+
+		checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != tc.status {
+				t.Errorf("%s: expected status %d, got %d", tc.class, tc.status, rr.Code)
+			}
+		}
+
+		testRequest(t, &TestRequest{
+			method:        "GET",
+			path:          "/",
+			handler:       service.ReadAccessMiddleware(tc.class, next),
+			header:        tc.header,
+			checkResponse: &checkResponse,
+		})
+
+		// the object must not be fetched unless access is granted
+		if called != (tc.status == http.StatusOK) {
+			t.Errorf("%s: handler called: %v, expected status %d", tc.class, called, tc.status)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// ansiPalette are the 16 basic terminal colors, the normal ones followed by the bright ones.
+var ansiPalette = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+// ansiColor256 returns the color of the xterm 256 color palette.
+func ansiColor256(n int) string {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		n -= 16
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	default:
+		gray := 8 + (n-232)*10
+
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+// ansiState is the graphic rendition that applies to the following text.
+type ansiState struct {
+	fg, bg                         string
+	bold, faint, italic, underline bool
+}
+
+func (a *ansiState) style() string {
+	var style []string
+
+	if a.fg != "" {
+		style = append(style, "color:"+a.fg)
+	}
+
+	if a.bg != "" {
+		style = append(style, "background-color:"+a.bg)
+	}
+
+	if a.bold {
+		style = append(style, "font-weight:bold")
+	}
+
+	if a.faint {
+		style = append(style, "opacity:0.7")
+	}
+
+	if a.italic {
+		style = append(style, "font-style:italic")
+	}
+
+	if a.underline {
+		style = append(style, "text-decoration:underline")
+	}
+
+	return strings.Join(style, ";")
+}
+
+// extendedColor parses the arguments of 38 and 48, i.e. 5;n or 2;r;g;b.
+// It returns the color and the number of consumed parameters.
+func extendedColor(params []int) (string, int) {
+	switch {
+	case len(params) >= 2 && params[0] == 5 && params[1] >= 0 && params[1] < 256:
+		return ansiColor256(params[1]), 2
+	case len(params) >= 4 && params[0] == 2:
+		return fmt.Sprintf("#%02x%02x%02x", params[1]&0xff, params[2]&0xff, params[3]&0xff), 4
+	default:
+		return "", len(params)
+	}
+}
+
+// apply updates the state with the parameters of a SGR (select graphic rendition) sequence.
+func (a *ansiState) apply(params []int) {
+	if len(params) == 0 {
+		*a = ansiState{}
+
+		return
+	}
+
+	for i := 0; i < len(params); i++ {
+		switch p := params[i]; {
+		case p == 0:
+			*a = ansiState{}
+		case p == 1:
+			a.bold = true
+		case p == 2:
+			a.faint = true
+		case p == 3:
+			a.italic = true
+		case p == 4:
+			a.underline = true
+		case p == 22:
+			a.bold, a.faint = false, false
+		case p == 23:
+			a.italic = false
+		case p == 24:
+			a.underline = false
+		case p >= 30 && p <= 37:
+			a.fg = ansiPalette[p-30]
+		case p == 38:
+			color, n := extendedColor(params[i+1:])
+			a.fg = color
+			i += n
+		case p == 39:
+			a.fg = ""
+		case p >= 40 && p <= 47:
+			a.bg = ansiPalette[p-40]
+		case p == 48:
+			color, n := extendedColor(params[i+1:])
+			a.bg = color
+			i += n
+		case p == 49:
+			a.bg = ""
+		case p >= 90 && p <= 97:
+			a.fg = ansiPalette[p-90+8]
+		case p >= 100 && p <= 107:
+			a.bg = ansiPalette[p-100+8]
+		}
+	}
+}
+
+// parseCSI splits a control sequence after "ESC [" into its parameters and final byte.
+// It returns the length of the sequence, or 0 if it is incomplete.
+func parseCSI(s string) ([]int, byte, int) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x40 || c > 0x7e {
+			continue
+		}
+
+		var params []int
+
+		if i > 0 {
+			for _, field := range strings.Split(s[:i], ";") {
+				// missing or malformed parameters default to 0
+				n, _ := strconv.Atoi(field)
+				params = append(params, n)
+			}
+		}
+
+		return params, c, i + 1
+	}
+
+	return nil, 0, 0
+}
+
+// ansiLineToHTML renders one line of terminal output as HTML. The state carries colors over line breaks.
+// Colors are rendered as styled spans, all other escape sequences are dropped.
+func ansiLineToHTML(b *strings.Builder, line string, state *ansiState) {
+	// a carriage return overwrites the line on a terminal, e.g. for progress bars
+	line = strings.TrimSuffix(line, "\r")
+	if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+
+	style := state.style()
+	if style != "" {
+		fmt.Fprintf(b, `<span style="%s">`, style)
+	}
+
+	for len(line) > 0 {
+		esc := strings.IndexByte(line, '\x1b')
+		if esc < 0 {
+			b.WriteString(html.EscapeString(line))
+
+			break
+		}
+
+		b.WriteString(html.EscapeString(line[:esc]))
+		line = line[esc+1:]
+
+		if !strings.HasPrefix(line, "[") {
+			// not a control sequence, drop the escape character
+			continue
+		}
+
+		params, final, n := parseCSI(line[1:])
+		if n == 0 {
+			line = ""
+
+			break
+		}
+
+		line = line[1+n:]
+
+		if final != 'm' {
+			continue
+		}
+
+		state.apply(params)
+
+		if next := state.style(); next != style {
+			if style != "" {
+				b.WriteString("</span>")
+			}
+
+			if next != "" {
+				fmt.Fprintf(b, `<span style="%s">`, next)
+			}
+
+			style = next
+		}
+	}
+
+	if style != "" {
+		b.WriteString("</span>")
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// identity recorded for requests authenticated with the API token.
+	apiTokenIdentity = "api-token"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// statusRecorder remembers the status code and the number of body bytes written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+
+	return n, err //nolint:wrapcheck
+}
+
+// Unwrap allows http.ResponseController to reach the underlying connection.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type auditParamsContextKey struct{}
+
+// auditParams holds the decoded request body of an audited request.
+type auditParams struct {
+	body []byte
+}
+
+// recordAuditParams stores the decoded request body in the audit log entry of the request, if it is audited.
+func recordAuditParams(ctx context.Context, v any) {
+	params, ok := ctx.Value(auditParamsContextKey{}).(*auditParams)
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to encode audit log params", "error", err)
+
+		return
+	}
+
+	params.body = body
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, so that user input is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// serveAudited runs the handler with the caller attached to the request context
+// and records mutating requests in the audit log, including their decoded JSON body.
+// Read-only servers can't write the audit log, but they don't serve mutating endpoints either.
+func (s *Service) serveAudited(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, identity Identity) {
+	r = r.WithContext(withIdentity(r.Context(), identity))
+
+	if s.ReadOnly || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		next.ServeHTTP(w, r)
+
+		return
+	}
+
+	params := &auditParams{}
+	r = r.WithContext(context.WithValue(r.Context(), auditParamsContextKey{}, params))
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(recorder, r)
+
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	// The request context is canceled once the client is gone, but the call still needs to be recorded.
+	err := pg.New(s.Pool).InsertAuditLog(context.WithoutCancel(r.Context()), pg.InsertAuditLogParams{
+		Identity: identity.Name,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		Status:   int32(recorder.status), //nolint:gosec
+		Params:   params.body,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write audit log", "path", r.URL.Path, "error", err)
+	}
+}
+
+// cleanupAuditLog removes entries older than the configured retention. Zero retention keeps entries forever.
+func (s *Service) cleanupAuditLog(ctx context.Context) (int64, error) {
+	if s.AuditRetention <= 0 {
+		return 0, nil
+	}
+
+	deleted, err := pg.New(s.Pool).DeleteAuditLogOlder(ctx, pgtype.Timestamp{
+		Time:  time.Now().UTC().Add(-s.AuditRetention),
+		Valid: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to cleanup audit log: %w", err)
+	}
+
+	return deleted, nil
+}
+
+type AuditLogEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Status   int32     `json:"status"`
+	// Decoded JSON body of the request, if it had one.
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// GET /api/admin/audit?identity=ci&path=/api/closures&since=24h&limit=100
+// path is matched as a literal prefix.
+// Response body:
+//
+//	[
+//	  {
+//	    "id": 43,
+//	    "time": "2024-11-20T08:31:10Z",
+//	    "identity": "ci",
+//	    "method": "POST",
+//	    "path": "/api/pending_closures",
+//	    "params": {
+//	      "closure": "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n",
+//	      "objects": ["bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n.narinfo"]
+//	    },
+//	    "status": 200
+//	  },
+//	  {
+//	    "id": 42,
+//	    "time": "2024-11-20T08:30:05Z",
+//	    "identity": "ci",
+//	    "method": "DELETE",
+//	    "path": "/api/closures",
+//	    "query": "older-than=720h",
+//	    "status": 204
+//	  }
+//	]
+func (s *Service) AuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received audit log request", "method", r.Method, "url", r.URL)
+
+	params := pg.GetAuditLogParams{
+		RowLimit: defaultAuditLimit,
+	}
+
+	query := r.URL.Query()
+
+	if identity := query.Get("identity"); identity != "" {
+		params.Identity = pgtype.Text{String: identity, Valid: true}
+	}
+
+	if path := query.Get("path"); path != "" {
+		params.PathPrefix = pgtype.Text{String: escapeLike(path), Valid: true}
+	}
+
+	since := time.Time{}
+
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		age, err := time.ParseDuration(sinceParam)
+		if err != nil {
+			http.Error(w, "failed to parse since: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		since = time.Now().UTC().Add(-age)
+	}
+
+	params.Since = pgtype.Timestamp{Time: since, Valid: true}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit), http.StatusBadRequest)
+
+			return
+		}
+
+		params.RowLimit = int32(limit) //nolint:gosec
+	}
+
+	rows, err := pg.New(s.Pool).GetAuditLog(r.Context(), params)
+	if err != nil {
+		http.Error(w, "failed to get audit log: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	entries := make([]AuditLogEntry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, AuditLogEntry{
+			ID:       row.ID,
+			Time:     row.CreatedAt.Time,
+			Identity: row.Identity,
+			Method:   row.Method,
+			Path:     row.Path,
+			Query:    row.Query,
+			Status:   row.Status,
+			Params:   row.Params,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
@@ -0,0 +1,105 @@
+package server_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_AuditLogHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	header := map[string]string{"Authorization": "Bearer " + service.APIToken}
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/pending_closures?duration=1h",
+		handler: service.AuthMiddleware(service.CleanupPendingClosuresHandler),
+		header:  header,
+	})
+
+	// reads are not audited
+	testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/admin/status",
+		handler: service.AuthMiddleware(service.StatusHandler),
+		header:  header,
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/admin/audit?identity=api-token&path=/api/pending_closures",
+		handler: service.AuthMiddleware(service.AuditLogHandler),
+		header:  header,
+	})
+
+	var entries []server.AuditLogEntry
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit log entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Method != "DELETE" || entry.Query != "duration=1h" || entry.Status != 204 {
+		t.Errorf("unexpected audit log entry: %+v", entry)
+	}
+
+	closureKey := "00000000000000000000000000000000"
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": closureKey,
+		"objects": []string{closureKey + ".narinfo"},
+	})
+	ok(t, err)
+
+	testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.AuthMiddleware(service.CreatePendingClosureHandler),
+		header:  header,
+	})
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/admin/audit?limit=1",
+		handler: service.AuthMiddleware(service.AuditLogHandler),
+		header:  header,
+	})
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+
+	var params struct {
+		Closure string   `json:"closure"`
+		Objects []string `json:"objects"`
+	}
+
+	if len(entries) != 1 || entries[0].Params == nil {
+		t.Fatalf("expected the request body to be recorded, got %+v", entries)
+	}
+
+	ok(t, json.Unmarshal(entries[0].Params, &params))
+
+	if params.Closure != closureKey || len(params.Objects) != 1 {
+		t.Errorf("unexpected audit log params: %s", entries[0].Params)
+	}
+
+	// wildcards in the path filter are matched literally
+	for _, path := range []string{"/api/pending%25", "/api/pending_closure_"} {
+		rr = testRequest(t, &TestRequest{
+			method:  "GET",
+			path:    "/api/admin/audit?path=" + path,
+			handler: service.AuthMiddleware(service.AuditLogHandler),
+			header:  header,
+		})
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+
+		if len(entries) != 0 {
+			t.Errorf("expected no audit log entries for %s, got %+v", path, entries)
+		}
+	}
+}
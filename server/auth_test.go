@@ -1,6 +1,9 @@
 package server_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -45,3 +48,34 @@ func TestService_AuthMiddleware(t *testing.T) {
 		},
 	})
 }
+
+func TestService_AuthMiddlewareClientCert(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	service.ClientCertNames = []string{"builder.example.com"}
+
+	handler := service.AuthMiddleware(service.HealthCheckHandler)
+
+	for name, expected := range map[string]int{
+		"builder.example.com":  http.StatusOK,
+		"attacker.example.com": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: name}},
+			}},
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != expected {
+			t.Errorf("%s: expected status code %d, got %d", name, expected, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	defaultMaxRequestBodySize   = 32 << 20
+	defaultMaxClosureObjects    = 250000
+	defaultMaxNarinfoReferences = 10000
+
+	// object keys are stored as varchar(1024)
+	maxObjectKeyLength = 1024
+)
+
+var errTooManyReferences = errors.New("narinfos have too many references")
+
+// LimitError is the response body of requests that exceed a limit, with status 413 or 422.
+type LimitError struct {
+	Error string `json:"error"`
+	Limit int64  `json:"limit"`
+}
+
+func writeLimitError(w http.ResponseWriter, status int, msg string, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(LimitError{Error: msg, Limit: limit}); err != nil {
+		slog.Warn("Could not write limit error response", "error", err)
+	}
+}
+
+// decodeRequest decodes a JSON request body of at most MaxRequestBodySize bytes
+// and records it in the audit log entry of the request.
+// On failure it writes the error response and returns false.
+func (s *Service) decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	body := r.Body
+	if s.MaxRequestBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.MaxRequestBodySize)
+	}
+
+	err := json.NewDecoder(body).Decode(v)
+	if err == nil {
+		recordAuditParams(r.Context(), v)
+
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeLimitError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit), maxBytesErr.Limit)
+
+		return false
+	}
+
+	http.Error(w, "failed to decode request: "+err.Error(), http.StatusBadRequest)
+
+	return false
+}
+
+// checkObjectKeys rejects requests with more objects than a closure may have or with keys that can't be stored.
+// On failure it writes the error response and returns false.
+func (s *Service) checkObjectKeys(w http.ResponseWriter, keys []string) bool {
+	if s.MaxClosureObjects > 0 && len(keys) > s.MaxClosureObjects {
+		writeLimitError(w, http.StatusUnprocessableEntity,
+			fmt.Sprintf("request has %d objects, more than %d", len(keys), s.MaxClosureObjects),
+			int64(s.MaxClosureObjects))
+
+		return false
+	}
+
+	for _, key := range keys {
+		if key == "" || len(key) > maxObjectKeyLength {
+			writeLimitError(w, http.StatusUnprocessableEntity,
+				fmt.Sprintf("object key %.64q must be between 1 and %d bytes", key, maxObjectKeyLength),
+				maxObjectKeyLength)
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkNarInfoReferenceCounts rejects narinfos with more references than the configured maximum.
+// Each reference is checked and walked by garbage collection, so they are bounded like the objects of a closure.
+func checkNarInfoReferenceCounts(limit int, narInfos map[string]*NarInfo) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	for key, info := range narInfos {
+		if len(info.References) > limit {
+			return fmt.Errorf("%w: %s has %d, the limit is %d", errTooManyReferences, key, len(info.References), limit)
+		}
+	}
+
+	return nil
+}
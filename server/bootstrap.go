@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/cors"
+)
+
+const nixCacheInfoKey = "nix-cache-info"
+
+// defaultNixCacheInfo is uploaded by bootstrap if the bucket has no nix-cache-info yet.
+func defaultNixCacheInfo(storeDir string) string {
+	return "StoreDir: " + storeDir + "\nWantMassQuery: 1\nPriority: 40\n"
+}
+
+type bucketPolicyStatement struct {
+	Sid       string              `json:"Sid,omitempty"`
+	Effect    string              `json:"Effect"`
+	Principal map[string][]string `json:"Principal,omitempty"`
+	Action    []string            `json:"Action"`
+	Resource  []string            `json:"Resource"`
+}
+
+type bucketPolicy struct {
+	Version   string                  `json:"Version"`
+	Statement []bucketPolicyStatement `json:"Statement"`
+}
+
+// publicReadSid identifies the statement of bootstrap in bucket policies that also have statements of the operator.
+const publicReadSid = "Niks3PublicRead"
+
+// publicReadStatement allows anonymous reads of all objects, which is what nix substituters need.
+func publicReadStatement(bucketName string) bucketPolicyStatement {
+	return bucketPolicyStatement{
+		Sid:       publicReadSid,
+		Effect:    "Allow",
+		Principal: map[string][]string{"AWS": {"*"}},
+		Action:    []string{"s3:GetObject"},
+		Resource:  []string{fmt.Sprintf("arn:aws:s3:::%s/*", bucketName)},
+	}
+}
+
+func publicReadPolicy(bucketName string) (string, error) {
+	policy := bucketPolicy{
+		Version:   "2012-10-17",
+		Statement: []bucketPolicyStatement{publicReadStatement(bucketName)},
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode bucket policy: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// isPublicReadStatement reports whether a statement of an existing policy is the one of bootstrap,
+// including the one without Sid that older versions wrote.
+func isPublicReadStatement(raw json.RawMessage, want bucketPolicyStatement) bool {
+	var statement bucketPolicyStatement
+	if err := json.Unmarshal(raw, &statement); err != nil {
+		// e.g. a principal of "*" instead of {"AWS": ["*"]}, which is not ours
+		return false
+	}
+
+	if statement.Sid == publicReadSid {
+		return true
+	}
+
+	return statement.Sid == "" && statement.Effect == want.Effect &&
+		reflect.DeepEqual(statement.Principal, want.Principal) &&
+		slices.Equal(statement.Action, want.Action) && slices.Equal(statement.Resource, want.Resource)
+}
+
+// mergePublicReadPolicy adds the public read statement to an existing bucket policy and keeps all other
+// statements and fields. It returns an empty string if the policy already allows public reads.
+func mergePublicReadPolicy(existing, bucketName string) (string, error) {
+	var policy map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(existing), &policy); err != nil {
+		return "", fmt.Errorf("failed to decode existing bucket policy: %w", err)
+	}
+
+	var statements []json.RawMessage
+	if raw, ok := policy["Statement"]; ok {
+		// a single statement does not have to be wrapped in a list
+		if err := json.Unmarshal(raw, &statements); err != nil {
+			statements = []json.RawMessage{raw}
+		}
+	}
+
+	want := publicReadStatement(bucketName)
+
+	for _, statement := range statements {
+		if isPublicReadStatement(statement, want) {
+			return "", nil
+		}
+	}
+
+	statement, err := json.Marshal(want)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode bucket policy: %w", err)
+	}
+
+	statements = append(statements, statement)
+
+	if policy["Statement"], err = json.Marshal(statements); err != nil {
+		return "", fmt.Errorf("failed to encode bucket policy: %w", err)
+	}
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode bucket policy: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// presignedUploadCors allows browsers and other CORS-aware clients to use the presigned upload URLs.
+func presignedUploadCors() *cors.Config {
+	return &cors.Config{
+		CORSRules: []cors.Rule{
+			{
+				AllowedOrigin: []string{"*"},
+				AllowedMethod: []string{"GET", "HEAD", "PUT"},
+				AllowedHeader: []string{"*"},
+				ExposeHeader:  []string{"ETag"},
+				MaxAgeSeconds: 3600,
+			},
+		},
+	}
+}
+
+func (s *Service) ensureBucket(ctx context.Context) error {
+	exists, err := s.MinioClient.BucketExists(ctx, s.BucketName)
+	if err != nil {
+		return fmt.Errorf("failed to check if bucket exists: %w", err)
+	}
+
+	if exists {
+		slog.InfoContext(ctx, "Bucket already exists", "bucket", s.BucketName)
+
+		return nil
+	}
+
+	if err = s.MinioClient.MakeBucket(ctx, s.BucketName, minio.MakeBucketOptions{}); err != nil {
+		return fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Created bucket", "bucket", s.BucketName)
+
+	return nil
+}
+
+func (s *Service) ensureNixCacheInfo(ctx context.Context) error {
+	_, err := s.MinioClient.StatObject(ctx, s.BucketName, nixCacheInfoKey, minio.StatObjectOptions{})
+	if err == nil {
+		return s.checkNixCacheInfo(ctx)
+	}
+
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return fmt.Errorf("failed to stat nix-cache-info: %w", err)
+	}
+
+	cacheInfo := defaultNixCacheInfo(s.StoreDir)
+
+	_, err = s.MinioClient.PutObject(ctx, s.BucketName, nixCacheInfoKey,
+		strings.NewReader(cacheInfo), int64(len(cacheInfo)),
+		minio.PutObjectOptions{ContentType: "text/x-nix-cache-info", ServerSideEncryption: s.S3Encryption})
+	if err != nil {
+		return fmt.Errorf("failed to upload nix-cache-info: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Uploaded nix-cache-info")
+
+	return nil
+}
+
+// checkNixCacheInfo leaves an existing nix-cache-info untouched, but refuses one for another store directory,
+// since nix would not substitute from the cache.
+func (s *Service) checkNixCacheInfo(ctx context.Context) error {
+	obj, err := s.MinioClient.GetObject(ctx, s.BucketName, nixCacheInfoKey, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get nix-cache-info: %w", err)
+	}
+	defer obj.Close()
+
+	info, err := parseNixCacheInfo(obj)
+	if err != nil {
+		return err
+	}
+
+	if info.StoreDir != s.StoreDir {
+		return fmt.Errorf("nix-cache-info advertises StoreDir %s, but the store directory of the cache is %s",
+			info.StoreDir, s.StoreDir)
+	}
+
+	slog.InfoContext(ctx, "nix-cache-info already exists, leaving it untouched")
+
+	return nil
+}
+
+// validateLifecycle rejects lifecycle rules that expire objects behind the back of our garbage collector.
+func (s *Service) validateLifecycle(ctx context.Context) error {
+	config, err := s.MinioClient.GetBucketLifecycle(ctx, s.BucketName)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration" {
+			slog.InfoContext(ctx, "No lifecycle rules configured. "+
+				"Consider adding an AbortIncompleteMultipartUpload rule to clean up failed uploads.")
+
+			return nil
+		}
+
+		return fmt.Errorf("failed to get bucket lifecycle: %w", err)
+	}
+
+	var conflicting []string
+
+	for _, rule := range config.Rules {
+		if rule.Status != "Enabled" {
+			continue
+		}
+
+		if !rule.Expiration.IsNull() {
+			conflicting = append(conflicting, rule.ID)
+		}
+	}
+
+	if len(conflicting) > 0 {
+		return fmt.Errorf("lifecycle rules %v expire objects, which breaks closures tracked by niks3", conflicting)
+	}
+
+	return nil
+}
+
+// setPublicReadPolicy adds the public read statement to the bucket policy. Statements that the operator
+// added are kept, unless ForceBucketPolicy replaces the whole policy.
+func (s *Service) setPublicReadPolicy(ctx context.Context) error {
+	existing, err := s.MinioClient.GetBucketPolicy(ctx, s.BucketName)
+	if err != nil {
+		return fmt.Errorf("failed to get bucket policy: %w", err)
+	}
+
+	var policy string
+
+	if existing == "" || s.ForceBucketPolicy {
+		policy, err = publicReadPolicy(s.BucketName)
+	} else {
+		policy, err = mergePublicReadPolicy(existing, s.BucketName)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if policy == "" {
+		slog.InfoContext(ctx, "Bucket policy already allows public reads")
+
+		return nil
+	}
+
+	if err = s.MinioClient.SetBucketPolicy(ctx, s.BucketName, policy); err != nil {
+		return fmt.Errorf("failed to set bucket policy: %w", err)
+	}
+
+	return nil
+}
+
+// Bootstrap prepares the bucket to be used as a binary cache. It is safe to run repeatedly.
+func (s *Service) Bootstrap(ctx context.Context) error {
+	if err := s.ensureBucket(ctx); err != nil {
+		return err
+	}
+
+	if s.quirks.noBucketPolicy {
+		slog.InfoContext(ctx, "The S3 backend has no bucket policies, allow public reads in the console of the provider")
+	} else if err := s.setPublicReadPolicy(ctx); err != nil {
+		return err
+	}
+
+	// Not all S3 implementations support CORS, and it is only needed for browser uploads.
+	if err := s.MinioClient.SetBucketCors(ctx, s.BucketName, presignedUploadCors()); err != nil {
+		slog.WarnContext(ctx, "Failed to set bucket CORS configuration", "error", err)
+	}
+
+	if err := s.ensureNixCacheInfo(ctx); err != nil {
+		return err
+	}
+
+	if err := s.uploadCacheInfo(ctx); err != nil {
+		return err
+	}
+
+	return s.validateLifecycle(ctx)
+}
@@ -0,0 +1,121 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_Bootstrap(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	ok(t, service.Bootstrap(ctx))
+
+	info, err := service.MinioClient.StatObject(ctx, service.BucketName, "nix-cache-info", minio.StatObjectOptions{})
+	ok(t, err)
+
+	if info.Size == 0 {
+		t.Errorf("expected nix-cache-info to be non-empty")
+	}
+
+	// bootstrap must be idempotent
+	ok(t, service.Bootstrap(ctx))
+}
+
+func TestService_BootstrapKeepsBucketPolicy(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	operator := `{"Version": "2012-10-17", "Statement": [{"Sid": "Operator", "Effect": "Allow",
+		"Principal": {"AWS": ["*"]}, "Action": ["s3:GetBucketLocation"],
+		"Resource": ["arn:aws:s3:::` + service.BucketName + `"]}]}`
+	ok(t, service.MinioClient.SetBucketPolicy(ctx, service.BucketName, operator))
+
+	sids := func() []string {
+		policy, err := service.MinioClient.GetBucketPolicy(ctx, service.BucketName)
+		ok(t, err)
+
+		var decoded struct {
+			Statement []struct {
+				Sid string `json:"Sid"`
+			} `json:"Statement"`
+		}
+		ok(t, json.Unmarshal([]byte(policy), &decoded))
+
+		sids := make([]string, 0, len(decoded.Statement))
+		for _, statement := range decoded.Statement {
+			sids = append(sids, statement.Sid)
+		}
+
+		slices.Sort(sids)
+
+		return sids
+	}
+
+	// the statement of the operator is kept, the public read statement is only added once
+	ok(t, service.Bootstrap(ctx))
+	ok(t, service.Bootstrap(ctx))
+
+	if got := sids(); !reflect.DeepEqual(got, []string{"Niks3PublicRead", "Operator"}) {
+		t.Errorf("expected the existing statement to be kept, got %v", got)
+	}
+
+	service.ForceBucketPolicy = true
+	ok(t, service.Bootstrap(ctx))
+
+	if got := sids(); !reflect.DeepEqual(got, []string{"Niks3PublicRead"}) {
+		t.Errorf("expected --force-bucket-policy to replace the policy, got %v", got)
+	}
+}
+
+func TestWriteS3Policy(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+
+	ok(t, server.WriteS3Policy(&server.Options{
+		S3BucketName:        "nix-cache",
+		S3SecondaryEndpoint: "s3.eu-central-1.amazonaws.com",
+	}, &out))
+
+	var policy struct {
+		Statement []struct {
+			Sid      string   `json:"Sid"`
+			Action   []string `json:"Action"`
+			Resource []string `json:"Resource"`
+		} `json:"Statement"`
+	}
+	ok(t, json.Unmarshal(out.Bytes(), &policy))
+
+	if len(policy.Statement) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(policy.Statement))
+	}
+
+	// the secondary defaults to the bucket of the primary
+	objects := policy.Statement[0]
+	if !reflect.DeepEqual(objects.Resource, []string{"arn:aws:s3:::nix-cache/*"}) {
+		t.Errorf("unexpected object resources: %v", objects.Resource)
+	}
+
+	if !slices.Contains(objects.Action, "s3:DeleteObject") {
+		t.Errorf("expected garbage collection to be allowed to delete objects, got %v", objects.Action)
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	minio "github.com/minio/minio-go/v7"
+)
+
+const (
+	buildLogPrefix = "log/"
+	// number of lines per page of a rendered build log.
+	buildLogPageLines = 1000
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// openBuildLog returns the decompressed build log of a derivation.
+// Nix uploads logs either uncompressed or, with log-compression=zstd, zstd compressed.
+func (s *Service) openBuildLog(ctx context.Context, drv string) (io.ReadCloser, error) {
+	obj, err := s.getObject(ctx, buildLogPrefix+drv, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get log: %w", err)
+	}
+
+	reader := bufio.NewReader(obj)
+
+	magic, err := reader.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		obj.Close()
+
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+
+	if !bytes.Equal(magic, zstdMagic) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{reader, obj}, nil
+	}
+
+	decoder, err := zstd.NewReader(reader)
+	if err != nil {
+		obj.Close()
+
+		return nil, fmt.Errorf("failed to decompress log: %w", err)
+	}
+
+	return &zstdRangeReader{Reader: decoder, decoder: decoder, obj: obj}, nil
+}
+
+// renderBuildLogPage renders one page of a build log as a HTML document.
+// The lines before the page are still parsed, so colors that span pages are kept.
+func renderBuildLogPage(r io.Reader, drv string, page int) (string, error) {
+	reader := bufio.NewReader(r)
+	first := (page - 1) * buildLogPageLines
+	state := &ansiState{}
+	lines := 0
+
+	var body strings.Builder
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			line = strings.TrimSuffix(line, "\n")
+
+			if lines >= first && lines < first+buildLogPageLines {
+				ansiLineToHTML(&body, line, state)
+				body.WriteByte('\n')
+			} else {
+				ansiLineToHTML(&strings.Builder{}, line, state)
+			}
+
+			lines++
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to read log: %w", err)
+		}
+	}
+
+	pages := max(1, (lines+buildLogPageLines-1)/buildLogPageLines)
+	if page > pages {
+		return "", errNoSuchPage
+	}
+
+	title := html.EscapeString(drv)
+	pageURL := func(n int) string {
+		return "?format=html&page=" + strconv.Itoa(n)
+	}
+
+	var nav strings.Builder
+
+	fmt.Fprintf(&nav, "<nav>Page %d of %d", page, pages)
+
+	if page > 1 {
+		fmt.Fprintf(&nav, ` <a href="%s">first</a> <a href="%s">previous</a>`, pageURL(1), pageURL(page-1))
+	}
+
+	if page < pages {
+		fmt.Fprintf(&nav, ` <a href="%s">next</a> <a href="%s">last</a>`, pageURL(page+1), pageURL(pages))
+	}
+
+	nav.WriteString(` <a href="` + url.PathEscape(drv) + `">raw</a></nav>`)
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>body { background: #1e1e1e; color: #d4d4d4; } a { color: #3b8eea; } pre { white-space: pre-wrap; }</style>
+</head>
+<body>
+%s
+<pre>%s</pre>
+%s
+</body>
+</html>
+`, title, nav.String(), body.String(), nav.String()), nil
+}
+
+var errNoSuchPage = errors.New("page out of range")
+
+// GET /log/{drv}?format=html&page=2
+// Response body: the decompressed build log of a derivation, e.g. for
+// /log/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1.drv
+// With format=html, the log is rendered as HTML with ANSI colors and split into pages of 1000 lines.
+func (s *Service) BuildLogHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received build log request", "method", r.Method, "url", r.URL)
+
+	drv := r.PathValue("drv")
+	if drv == "" {
+		http.Error(w, "missing drv", http.StatusBadRequest)
+
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "html" {
+		http.Error(w, "unsupported format "+format, http.StatusBadRequest)
+
+		return
+	}
+
+	page := 1
+
+	if p := r.URL.Query().Get("page"); p != "" {
+		var err error
+
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			http.Error(w, "invalid page "+p, http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	buildLog, err := s.openBuildLog(r.Context(), drv)
+	if err != nil {
+		if isNoSuchKey(err) {
+			http.Error(w, "build log not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to get build log: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	defer buildLog.Close()
+
+	if format == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		if _, err = io.Copy(&idleTimeoutWriter{ResponseWriter: w, timeout: s.StreamIdleTimeout}, buildLog); err != nil {
+			slog.WarnContext(r.Context(), "Failed to stream build log", "url", r.URL, "error", err)
+		}
+
+		return
+	}
+
+	doc, err := renderBuildLogPage(buildLog, drv, page)
+	if err != nil {
+		if errors.Is(err, errNoSuchPage) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to render build log: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if _, err = io.WriteString(w, doc); err != nil {
+		slog.WarnContext(r.Context(), "Failed to write build log", "url", r.URL, "error", err)
+	}
+}
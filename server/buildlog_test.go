@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestService_BuildLogHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	drv := "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1.drv"
+
+	var log strings.Builder
+
+	log.WriteString("\x1b[31;1merror:\x1b[0m builder for <hello> failed\n")
+
+	for i := range 1500 {
+		fmt.Fprintf(&log, "line %d\n", i)
+	}
+
+	encoder, err := zstd.NewWriter(nil)
+	ok(t, err)
+
+	compressed := encoder.EncodeAll([]byte(log.String()), nil)
+	ok(t, encoder.Close())
+
+	pushClosure(t, service, drv, map[string]string{"log/" + drv: string(compressed)})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/log/" + drv,
+		handler:    service.BuildLogHandler,
+		pathValues: map[string]string{"drv": drv},
+	})
+
+	if rr.Body.String() != log.String() {
+		t.Errorf("unexpected raw log: %q", rr.Body.String()[:min(rr.Body.Len(), 100)])
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/log/" + drv + "?format=html",
+		handler:    service.BuildLogHandler,
+		pathValues: map[string]string{"drv": drv},
+	})
+
+	body := rr.Body.String()
+	if !strings.Contains(body, `<span style="color:#cd3131;font-weight:bold">error:</span> builder for &lt;hello&gt; failed`) {
+		t.Errorf("expected colored error, got %q", body)
+	}
+
+	if !strings.Contains(body, "Page 1 of 2") || strings.Contains(body, "line 1000\n") {
+		t.Errorf("expected the first page only, got %q", body)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/log/" + drv + "?format=html&page=2",
+		handler:    service.BuildLogHandler,
+		pathValues: map[string]string{"drv": drv},
+	})
+
+	if body = rr.Body.String(); !strings.Contains(body, "line 1499\n") || strings.Contains(body, "line 998\n") {
+		t.Errorf("expected the second page, got %q", body)
+	}
+
+	checkNotFound := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/log/" + drv + "?format=html&page=3",
+		handler:       service.BuildLogHandler,
+		pathValues:    map[string]string{"drv": drv},
+		checkResponse: &checkNotFound,
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/log/missing.drv",
+		handler:       service.BuildLogHandler,
+		pathValues:    map[string]string{"drv": "missing.drv"},
+		checkResponse: &checkNotFound,
+	})
+}
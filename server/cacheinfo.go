@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Mic92/niks3/server/pg"
+	minio "github.com/minio/minio-go/v7"
+)
+
+const cacheInfoJSONKey = "cache-info.json"
+
+// isCacheMetadata reports whether key describes the cache itself rather than a store path,
+// such objects are never garbage collected.
+func isCacheMetadata(key string) bool {
+	return key == nixCacheInfoKey || key == cacheInfoJSONKey
+}
+
+// CacheInfo is the machine-readable description of the cache served at /cache-info.json.
+type CacheInfo struct {
+	StoreDir      string   `json:"store_dir"`
+	Priority      int      `json:"priority"`
+	WantMassQuery bool     `json:"want_mass_query"`
+	PublicKeys    []string `json:"public_keys"`
+	Compressions  []string `json:"compressions"`
+	// Public keys each identity signs its narinfos with, if restricted with --identity-keys.
+	IdentityKeys map[string][]string `json:"identity_keys,omitempty"`
+	// Prefix of absolute URL fields in narinfos, if set with --nar-url-base.
+	NarURLBase string `json:"nar_url_base,omitempty"`
+	// Same as in GET /api/version, e.g. whether the server proxies uploads or serves NAR files at /serve.
+	Capabilities map[string]bool `json:"capabilities"`
+	// Signature with --signing-key-file (name:base64) of the document up to this field, which is always the last one.
+	// To verify it, replace `,"signature":"..."}` at the end of the document with `}`.
+	Signature string `json:"signature,omitempty"`
+}
+
+// parseNixCacheInfo reads the nix-cache-info format. Missing fields keep the defaults of nix.
+func parseNixCacheInfo(r io.Reader) (*CacheInfo, error) {
+	info := &CacheInfo{
+		StoreDir: "/nix/store",
+		Priority: 50,
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ": ")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "StoreDir":
+			info.StoreDir = value
+		case "WantMassQuery":
+			info.WantMassQuery = value == "1"
+		case "Priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid priority %q: %w", value, err)
+			}
+
+			info.Priority = priority
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read nix-cache-info: %w", err)
+	}
+
+	return info, nil
+}
+
+func (s *Service) cacheInfo(ctx context.Context) (*CacheInfo, error) {
+	obj, err := s.getObject(ctx, nixCacheInfoKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nix-cache-info: %w", err)
+	}
+	defer obj.Close()
+
+	info, err := parseNixCacheInfo(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// Narinfos of other store directories are rejected, so the configured one is what the cache holds.
+	info.StoreDir = s.StoreDir
+	info.PublicKeys = s.PublicKeys
+	info.NarURLBase = s.NarURLBase
+
+	if info.PublicKeys == nil {
+		info.PublicKeys = []string{}
+	}
+
+	if len(s.IdentityKeys) > 0 {
+		info.IdentityKeys = make(map[string][]string, len(s.IdentityKeys))
+		for identity, keyNames := range s.IdentityKeys {
+			for _, name := range keyNames {
+				info.IdentityKeys[identity] = append(info.IdentityKeys[identity],
+					name+":"+base64.StdEncoding.EncodeToString(s.TrustedKeys[name]))
+			}
+		}
+	}
+
+	info.Compressions, err = pg.New(s.Pool).GetNarinfoCompressions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get compressions: %w", err)
+	}
+
+	if info.Compressions == nil {
+		info.Compressions = []string{}
+	}
+
+	info.Capabilities = s.capabilities()
+
+	return info, nil
+}
+
+// encodeCacheInfo encodes the cache info and appends the signature field if the server has a signing key.
+func (s *Service) encodeCacheInfo(info *CacheInfo) ([]byte, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cache info: %w", err)
+	}
+
+	if s.SigningKey == nil {
+		return data, nil
+	}
+
+	signature, err := json.Marshal(s.SigningKeyName + ":" +
+		base64.StdEncoding.EncodeToString(ed25519.Sign(s.SigningKey, data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cache info signature: %w", err)
+	}
+
+	signed := append(data[:len(data)-1:len(data)-1], `,"signature":`...)
+	signed = append(signed, signature...)
+
+	return append(signed, '}'), nil
+}
+
+// uploadCacheInfo mirrors /cache-info.json to the bucket, so it is available without the server.
+// It runs on bootstrap and at server start, so the copy follows changes of keys and flags.
+func (s *Service) uploadCacheInfo(ctx context.Context) error {
+	info, err := s.cacheInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := s.encodeCacheInfo(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.MinioClient.PutObject(ctx, s.BucketName, cacheInfoJSONKey,
+		bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/json", ServerSideEncryption: s.S3Encryption})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", cacheInfoJSONKey, err)
+	}
+
+	slog.InfoContext(ctx, "Uploaded "+cacheInfoJSONKey)
+
+	return nil
+}
+
+// GET /cache-info.json
+// Response body:
+//
+//	{
+//	  "store_dir": "/nix/store",
+//	  "priority": 40,
+//	  "want_mass_query": true,
+//	  "public_keys": ["cache.example.com-1:6wzr1QlOPHG+knFuJIaw+85Z5ivwbdI512JikexG+nQ="],
+//	  "compressions": ["xz", "zstd"],
+//	  "identity_keys": {"team-a": ["team-a-1:Vu6zkJ4yMC+Iwy+JVIg1EtVDFu6HsAdBRiArpO8g3Uw="]},
+//	  "nar_url_base": "https://cdn.example.com/",
+//	  "capabilities": {"write": true, "upload_through_server": true, "serve": true, ...},
+//	  "signature": "cache.example.com-1:0vSmx3dPxHjJt8mVd6Y0r7WnQfz2lL...=="
+//	}
+//
+// The signature is only present if the server has a --signing-key-file, see CacheInfo.Signature.
+// Returns 404 if the bucket has no nix-cache-info yet.
+func (s *Service) CacheInfoHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received cache info request", "method", r.Method, "url", r.URL)
+
+	info, err := s.cacheInfo(r.Context())
+	if err != nil {
+		if isNoSuchKey(err) {
+			http.Error(w, "nix-cache-info not found, run bootstrap first", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to get cache info: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	data, err := s.encodeCacheInfo(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err = w.Write(data); err != nil {
+		slog.WarnContext(r.Context(), "Could not write cache info response", "error", err)
+	}
+}
+
+// refreshCacheInfo updates the bucket copy of /cache-info.json at server start.
+// Before bootstrap uploaded nix-cache-info there is nothing to describe yet.
+func (s *Service) refreshCacheInfo(ctx context.Context) {
+	if err := s.uploadCacheInfo(ctx); err != nil {
+		if isNoSuchKey(err) {
+			slog.InfoContext(ctx, "Not uploading "+cacheInfoJSONKey+", the bucket has no nix-cache-info yet")
+
+			return
+		}
+
+		slog.WarnContext(ctx, "Failed to refresh "+cacheInfoJSONKey, "error", err)
+	}
+}
@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_CacheInfoHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	publicKey := "cache.example.com-1:6wzr1QlOPHG+knFuJIaw+85Z5ivwbdI512JikexG+nQ="
+	service.PublicKeys = []string{publicKey}
+
+	checkNotFound := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rr.Code)
+		}
+	}
+
+	// without nix-cache-info there is nothing to describe
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/cache-info.json",
+		handler:       service.CacheInfoHandler,
+		checkResponse: &checkNotFound,
+	})
+
+	ok(t, service.Bootstrap(ctx))
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	pushClosure(t, service, "prod", map[string]string{
+		a + ".narinfo": testNarInfo(a),
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/cache-info.json",
+		handler: service.CacheInfoHandler,
+	})
+
+	var info server.CacheInfo
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &info))
+
+	if !info.Capabilities[server.CapabilityServe] || !info.Capabilities[server.CapabilityUploadThroughServer] {
+		t.Errorf("expected the server to serve NAR files and proxy uploads, got %v", info.Capabilities)
+	}
+
+	expected := server.CacheInfo{
+		StoreDir:      "/nix/store",
+		Priority:      40,
+		WantMassQuery: true,
+		PublicKeys:    []string{publicKey},
+		Compressions:  []string{"zstd"},
+		Capabilities:  info.Capabilities,
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Errorf("unexpected cache info: %+v", info)
+	}
+
+	// bootstrap mirrors the cache info to the bucket
+	_, err := service.MinioClient.StatObject(ctx, service.BucketName, "cache-info.json", minio.StatObjectOptions{})
+	ok(t, err)
+
+	signingPublicKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.SigningKeyName = "cache.example.com-1"
+	service.SigningKey = signingKey
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/cache-info.json",
+		handler: service.CacheInfoHandler,
+	})
+
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &info))
+
+	name, value, _ := strings.Cut(info.Signature, ":")
+	signature, err := base64.StdEncoding.DecodeString(value)
+	ok(t, err)
+
+	// the signature covers the document without the trailing signature field
+	body := rr.Body.Bytes()
+	unsigned := append(bytes.Clone(body[:bytes.LastIndex(body, []byte(`,"signature":`))]), '}')
+
+	if name != "cache.example.com-1" || !ed25519.Verify(signingPublicKey, unsigned, signature) {
+		t.Errorf("expected a valid signature, got %q for %s", info.Signature, unsigned)
+	}
+}
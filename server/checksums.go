@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	minio "github.com/minio/minio-go/v7"
+)
+
+var errChecksumMismatch = errors.New("object does not match its recorded checksum")
+
+// storeObjectChecksum records the sha256 and size that the narinfo announces for its compressed NAR.
+// Narinfos without a sha256 FileHash, e.g. from nix 2.3, leave the NAR without a checksum.
+func storeObjectChecksum(ctx context.Context, queries *pg.Queries, info *NarInfo) error {
+	if info.FileHash == "" || info.FileSize == 0 {
+		return nil
+	}
+
+	hash, err := storepath.ParseHash(info.FileHash)
+	if err != nil || hash.Algo != "sha256" {
+		return nil //nolint:nilerr
+	}
+
+	err = queries.SetObjectChecksum(ctx, pg.SetObjectChecksumParams{
+		Key:    info.URL,
+		Sha256: pgtype.Text{String: hex.EncodeToString(hash.Digest), Valid: true},
+		Size:   pgtype.Int8{Int64: int64(info.FileSize), Valid: true}, //nolint:gosec
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store checksum of '%s': %w", info.URL, err)
+	}
+
+	return nil
+}
+
+// verifyObjectChecksum compares an object in the bucket with its recorded size and,
+// if the bucket reports one, its sha256. Objects without a recorded checksum are not checked.
+func (s *Service) verifyObjectChecksum(ctx context.Context, key string) error {
+	checksum, err := pg.New(s.Pool).GetObjectChecksum(ctx, key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get checksum of '%s': %w", key, err)
+	}
+
+	opts := minio.StatObjectOptions{}
+	opts.Checksum = true
+
+	info, err := s.statObject(ctx, key, opts)
+	if err != nil {
+		return fmt.Errorf("failed to stat '%s': %w", key, err)
+	}
+
+	if info.Size != checksum.Size.Int64 {
+		return fmt.Errorf("%w: '%s' has %d bytes, expected %d", errChecksumMismatch, key, info.Size, checksum.Size.Int64)
+	}
+
+	// S3 only knows the sha256 of objects that were uploaded with it
+	if info.ChecksumSHA256 == "" {
+		return nil
+	}
+
+	digest, err := base64.StdEncoding.DecodeString(info.ChecksumSHA256)
+	if err != nil {
+		return fmt.Errorf("invalid sha256 checksum of '%s': %w", key, err)
+	}
+
+	if hex.EncodeToString(digest) != checksum.Sha256.String {
+		return fmt.Errorf("%w: '%s' has sha256 %x, expected %s", errChecksumMismatch, key, digest, checksum.Sha256.String)
+	}
+
+	return nil
+}
+
+// spotCheckObject verifies an object that is about to be served and flags mismatches
+// in the log and in /api/admin/status. The object is served anyway.
+func (s *Service) spotCheckObject(ctx context.Context, key string) {
+	err := s.verifyObjectChecksum(ctx, key)
+	if err == nil {
+		return
+	}
+
+	if errors.Is(err, errChecksumMismatch) {
+		s.checksumMismatches.Add(1)
+		slog.ErrorContext(ctx, "Detected corrupted object in bucket", "key", key, "error", err)
+
+		return
+	}
+
+	slog.WarnContext(ctx, "Failed to verify object", "key", key, "error", err)
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	"github.com/Mic92/niks3/server/storepath"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_verifyReads(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.VerifyReads = true
+
+	hash := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	contents := "hello world\n"
+	nar, offset := singleFileNar("README", contents)
+	digest := sha256.Sum256(nar)
+	fileHash := storepath.Hash{Algo: "sha256", Digest: digest[:]}
+
+	narinfo := fmt.Sprintf(`StorePath: /nix/store/%s-pkg
+URL: nar/%s.nar
+Compression: none
+FileHash: %s
+FileSize: %d
+NarHash: %s
+NarSize: %d
+References: 
+`, hash, hash, fileHash.String(), len(nar), fileHash.String(), len(nar))
+
+	listing := fmt.Sprintf(`{"version": 1, "root": {"type": "directory", "entries": {
+		"README": {"type": "regular", "size": %d, "narOffset": %d}}}}`, len(contents), offset)
+
+	pushClosure(t, service, hash, map[string]string{
+		hash + ".narinfo":      narinfo,
+		hash + ".ls":           listing,
+		"nar/" + hash + ".nar": string(nar),
+	})
+
+	mismatches := func() int64 {
+		rr := testRequest(t, &TestRequest{
+			method:  "GET",
+			path:    "/api/admin/status",
+			handler: service.StatusHandler,
+		})
+
+		var status server.StatusResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &status))
+
+		return status.ChecksumMismatches
+	}
+
+	serve := func() {
+		testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/serve/" + hash + "/README",
+			handler:    service.ServeNarFileHandler,
+			pathValues: map[string]string{"hash": hash, "path": "README"},
+		})
+	}
+
+	serve()
+
+	if n := mismatches(); n != 0 {
+		t.Errorf("expected no checksum mismatches, got %d", n)
+	}
+
+	// the bucket loses the end of the NAR
+	truncated := string(nar[:len(nar)-8])
+	_, err := service.MinioClient.PutObject(ctx, service.BucketName, "nar/"+hash+".nar",
+		strings.NewReader(truncated), int64(len(truncated)), minio.PutObjectOptions{})
+	ok(t, err)
+
+	serve()
+
+	if n := mismatches(); n != 1 {
+		t.Errorf("expected 1 checksum mismatch, got %d", n)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -12,7 +13,7 @@ import (
 
 // getClosureObjects handles the GET /closures/<key> endpoint.
 func (s *Service) GetClosureHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Received get closure request", "method", r.Method, "url", r.URL)
+	slog.InfoContext(r.Context(), "Received get closure request", "method", r.Method, "url", r.URL)
 
 	key := r.PathValue("key")
 	if key == "" {
@@ -46,9 +47,358 @@ func (s *Service) GetClosureHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+type SearchClosuresResponse struct {
+	Closures []GroupClosure `json:"closures"`
+}
+
+// GET /api/closures?revision=3f7340e
+// Response body: the closures whose last push came from the revision, newest first:
+//
+//	{
+//	  "closures": [{
+//	    "key": "prod",
+//	    "updated_at": "2021-08-31T00:00:00Z",
+//	    "provenance": {"revision": "3f7340e", "ci_job_url": "https://ci.example.com/jobs/42", "builder": "build01"}
+//	  }]
+//	}
+func (s *Service) SearchClosuresHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received search closures request", "method", r.Method, "url", r.URL)
+
+	revision := r.URL.Query().Get("revision")
+	if revision == "" {
+		http.Error(w, "missing revision", http.StatusBadRequest)
+
+		return
+	}
+
+	closures, err := getClosuresByRevision(r.Context(), s.Pool, revision)
+	if err != nil {
+		http.Error(w, "failed to search closures: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(SearchClosuresResponse{Closures: closures}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+const defaultSweepMinAge = 24 * time.Hour
+
+// GET /api/closures/{key}/store-path
+// Response body: the store paths of the closure's top-level narinfos, one per line.
+func (s *Service) GetClosureStorePathHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received closure store path request", "method", r.Method, "url", r.URL)
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	storePaths, err := getClosureStorePaths(r.Context(), s.Pool, key)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to get closure store paths: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if len(storePaths) == 0 {
+		http.Error(w, "closure has no narinfo metadata", http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if _, err = w.Write([]byte(strings.Join(storePaths, "\n") + "\n")); err != nil {
+		slog.WarnContext(r.Context(), "Could not write store path response", "error", err)
+	}
+}
+
+// POST /api/closures/{key}/verify
+// Request body: -
+// Response body:
+//
+//	{
+//	  "key": "prod",
+//	  "checked": 3,
+//	  "missing": ["nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz"],
+//	  "unreachable": ["26xbg1ndr7hbcncrlf9nhx5is2b25d13.narinfo"]
+//	}
+//
+// A closure is complete if both lists are empty.
+func (s *Service) VerifyClosureHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received verify closure request", "method", r.Method, "url", r.URL)
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	result, err := s.verifyClosure(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to verify closure: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// POST /api/closures/{key}/diff
+// Request body:
+//
+//	{
+//	  "objects": ["26xbg1ndr7hbcncrlf9nhx5is2b25d13.narinfo", "nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz"]
+//	}
+//
+// Response body:
+//
+//	{
+//	  "key": "nixos-unstable",
+//	  "added": 2,
+//	  "uploads": 1,
+//	  "removed": 4,
+//	  "garbage": 3,
+//	  "garbage_nar_size": 1048576
+//	}
+//
+// Committing a pending closure with the same objects and "replace": true
+// replaces the objects of the closure atomically.
+func (s *Service) DiffClosureHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received diff closure request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	req := &DiffClosureRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	if !s.checkObjectKeys(w, req.Objects) {
+		return
+	}
+
+	result, err := diffClosure(r.Context(), s.Pool, key, req.Objects)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// POST /api/closures/{key}/promote
+// Request body:
+//
+//	{
+//	  "group": "production"
+//	}
+//
+// Response body:
+//
+//	{
+//	  "key": "nixos-24.11",
+//	  "group": "production",
+//	  "signed": 1234
+//	}
+//
+// Adds the closure to the group. If the server has a signing key, the narinfos of the closure are signed
+// with it, so clients that only trust that key can substitute them. This requires --trusted-keys,
+// the existing signatures are verified first. The objects are not copied: all groups share one bucket,
+// so the new signature is visible to every consumer of the cache and groups are not isolated from each other.
+// The closure stays in its other groups until they are deleted.
+// Like pushes, promotions count against --max-concurrent-pushes.
+func (s *Service) PromoteClosureHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received promote closure request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	req := &PromoteClosureRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	if req.Group == "" {
+		http.Error(w, "missing group", http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := s.promoteClosure(r.Context(), key, req.Group)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		if errors.Is(err, errInvalidSignature) || errors.Is(err, errPromoteUntrusted) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+			return
+		}
+
+		http.Error(w, "failed to promote closure: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Promoted closure", "key", resp.Key, "group", resp.Group, "signed", resp.Signed)
+	s.publishEvent(r.Context(), Event{Type: eventPromoted, Closure: resp.Key, Data: map[string]any{"group": resp.Group}})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+type DeleteClosureResponse struct {
+	// Key of the deleted closure, i.e. the hash if a store path was given.
+	Key string `json:"key"`
+	// Released is the number of objects no other closure references, they are removed by the next garbage collection.
+	Released int64 `json:"released"`
+}
+
+// DELETE /api/closures/{key}
+// Deletes a single closure, e.g. an obsolete one that is too big to wait for the time-based garbage collection.
+// key can also be a store path or narinfo key of a closure registered under its hash.
+// Response body:
+//
+//	{
+//	  "key": "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n",
+//	  "released": 1234
+//	}
+func (s *Service) DeleteClosureHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received delete closure request", "method", r.Method, "url", r.URL)
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := deleteClosure(r.Context(), s.Pool, key)
+	if err != nil {
+		if errors.Is(err, errClosureNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Deleted closure", "key", resp.Key, "released", resp.Released)
+	s.publishEvent(r.Context(), Event{
+		Type: eventDeleted, Closure: resp.Key, Data: map[string]any{"released": resp.Released},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// writeGCSkipped answers a garbage collection that was skipped because of the given holds.
+func (s *Service) writeGCSkipped(w http.ResponseWriter, r *http.Request, holds []GCHold) {
+	slog.InfoContext(r.Context(), "Skipping garbage collection, it is on hold",
+		"holds", len(holds), "until", holds[0].ExpiresAt)
+	s.publishEvent(r.Context(), Event{Type: eventGCSkipped, Data: map[string]any{"holds": len(holds)}})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+
+	if err := json.NewEncoder(w).Encode(GCSkippedResponse{Skipped: true, Holds: holds}); err != nil {
+		slog.WarnContext(r.Context(), "Could not write gc skipped response", "error", err)
+	}
+}
+
+// writeGCInterrupted answers a garbage collection that stopped because a hold was created while it ran.
+// The remaining phases are skipped like for a run that was on hold from the start.
+func (s *Service) writeGCInterrupted(w http.ResponseWriter, r *http.Request) {
+	holds, err := getActiveGCHolds(r.Context(), s.Pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if len(holds) == 0 {
+		// released again in the meantime
+		http.Error(w, errGCOnHold.Error(), http.StatusConflict)
+
+		return
+	}
+
+	s.writeGCSkipped(w, r, holds)
+}
+
 // cleanupClosuresOlders handles the DELETE /closures endpoint.
+// While a gc hold is active, nothing is deleted and 409 with a GCSkippedResponse is returned.
+// Holds are checked again before every phase and batch, a hold created during a run stops it the same way.
+// With sweep=report or sweep=delete, objects in the buckets of the primary and secondary store
+// unknown to the database and older than sweep-min-age (default 24h) are reported or deleted as well.
+// Incomplete multipart uploads older than multipart-min-age (default 24h) are aborted,
+// unless a pending closure still waits for their object.
+// With max-duration, no further batches of objects are deleted or swept once it has passed.
+// The next run resumes where the previous one stopped, so huge caches are collected over several runs.
 func (s *Service) CleanupClosuresOlder(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Starting cleanup of old closures", "method", r.Method, "url", r.URL)
+	slog.InfoContext(r.Context(), "Starting cleanup of old closures", "method", r.Method, "url", r.URL)
 
 	olderThan := r.URL.Query().Get("older-than")
 	if olderThan == "" {
@@ -64,17 +414,168 @@ func (s *Service) CleanupClosuresOlder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err = cleanupClosureOlderThan(r.Context(), s.Pool, age); err != nil {
+	sweep := r.URL.Query().Get("sweep")
+	if sweep != "" && sweep != "report" && sweep != "delete" {
+		http.Error(w, "sweep must be 'report' or 'delete'", http.StatusBadRequest)
+
+		return
+	}
+
+	sweepMinAge := defaultSweepMinAge
+
+	if sweepMinAgeParam := r.URL.Query().Get("sweep-min-age"); sweepMinAgeParam != "" {
+		sweepMinAge, err = time.ParseDuration(sweepMinAgeParam)
+		if err != nil {
+			http.Error(w, "failed to parse sweep-min-age: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	multipartMinAge := defaultMultipartMinAge
+
+	if multipartMinAgeParam := r.URL.Query().Get("multipart-min-age"); multipartMinAgeParam != "" {
+		multipartMinAge, err = time.ParseDuration(multipartMinAgeParam)
+		if err != nil {
+			http.Error(w, "failed to parse multipart-min-age: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	var deadline time.Time
+
+	if maxDurationParam := r.URL.Query().Get("max-duration"); maxDurationParam != "" {
+		var maxDuration time.Duration
+
+		maxDuration, err = time.ParseDuration(maxDurationParam)
+		if err != nil || maxDuration <= 0 {
+			http.Error(w, "invalid max-duration: "+maxDurationParam, http.StatusBadRequest)
+
+			return
+		}
+
+		deadline = time.Now().Add(maxDuration)
+	}
+
+	holds, err := getActiveGCHolds(r.Context(), s.Pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if len(holds) > 0 {
+		s.writeGCSkipped(w, r, holds)
+
+		return
+	}
+
+	s.publishEvent(r.Context(), Event{Type: eventGCStarted, Data: map[string]any{"older_than": age.String()}})
+
+	if err = cleanupClosureOlderThan(r.Context(), s.Pool, age, s.LabelRetentions); err != nil {
+		if errors.Is(err, errGCOnHold) {
+			s.writeGCInterrupted(w, r)
+
+			return
+		}
+
 		http.Error(w, "failed to cleanup old closures: "+err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
-	if err = s.cleanupOrphanObjects(r.Context(), s.Pool); err != nil {
+	expired, err := s.expireObjects(r.Context())
+	if err != nil {
+		if errors.Is(err, errGCOnHold) {
+			s.writeGCInterrupted(w, r)
+
+			return
+		}
+
+		http.Error(w, "failed to expire objects: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	for prefix, count := range expired {
+		slog.InfoContext(r.Context(), "Expired objects past their retention", "prefix", prefix, "count", count)
+	}
+
+	complete, err := s.cleanupOrphanObjects(r.Context(), s.Pool, deadline)
+	if err != nil {
+		if errors.Is(err, errGCOnHold) {
+			s.writeGCInterrupted(w, r)
+
+			return
+		}
+
 		http.Error(w, "failed to cleanup orphan objects: "+err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
+	auditDeleted, err := s.cleanupAuditLog(r.Context())
+	if err != nil {
+		http.Error(w, "failed to cleanup audit log: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if auditDeleted > 0 {
+		slog.InfoContext(r.Context(), "Deleted audit log entries past their retention", "count", auditDeleted)
+	}
+
+	downloadsDeleted, err := s.cleanupDownloadLog(r.Context())
+	if err != nil {
+		http.Error(w, "failed to cleanup download log: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if downloadsDeleted > 0 {
+		slog.InfoContext(r.Context(), "Deleted downloads past their retention", "count", downloadsDeleted)
+	}
+
+	aborted, err := s.abortStaleMultipartUploads(r.Context(), multipartMinAge)
+	if err != nil {
+		http.Error(w, "failed to abort stale multipart uploads: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if aborted > 0 {
+		slog.InfoContext(r.Context(), "Aborted stale multipart uploads", "count", aborted)
+	}
+
+	if sweep != "" && complete {
+		untracked, swept, err := s.sweepUntrackedObjects(r.Context(), sweepMinAge, sweep == "report", deadline)
+		if err != nil {
+			if errors.Is(err, errGCOnHold) {
+				s.writeGCInterrupted(w, r)
+
+				return
+			}
+
+			http.Error(w, "failed to sweep untracked objects: "+err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Swept untracked objects", "count", untracked, "mode", sweep)
+
+		complete = swept
+	}
+
+	if !complete {
+		slog.InfoContext(r.Context(), "Stopped garbage collection after max-duration, the next run resumes")
+	}
+
+	s.publishEvent(r.Context(), Event{Type: eventGCFinished, Data: map[string]any{
+		"older_than": age.String(),
+		"expired":    expired,
+		"complete":   complete,
+	}})
+
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -2,18 +2,52 @@ package server
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
+	pgx "github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
+	minio "github.com/minio/minio-go/v7"
 )
 
+// Provenance describes where the last push of a closure came from.
+type Provenance struct {
+	Revision string `json:"revision,omitempty"`
+	CIJobURL string `json:"ci_job_url,omitempty"`
+	Builder  string `json:"builder,omitempty"`
+}
+
+// decodeProvenance returns nil for closures pushed without provenance.
+func decodeProvenance(data []byte) (*Provenance, error) {
+	if data == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	provenance := &Provenance{}
+	if err := json.Unmarshal(data, provenance); err != nil {
+		return nil, fmt.Errorf("failed to decode closure provenance: %w", err)
+	}
+
+	return provenance, nil
+}
+
 type ClosureResponse struct {
-	Key       string    `json:"id"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Objects   []string  `json:"objects"`
+	Key        string            `json:"key"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Labels     map[string]string `json:"labels"`
+	CreatedBy  string            `json:"created_by,omitempty"`
+	Provenance *Provenance       `json:"provenance,omitempty"`
+	Roots      int64             `json:"roots"`
+	Objects    []string          `json:"objects"`
 }
 
 func getClosure(ctx context.Context, pool *pgxpool.Pool, closureKey string) (*ClosureResponse, error) {
@@ -36,14 +70,67 @@ func getClosure(ctx context.Context, pool *pgxpool.Pool, closureKey string) (*Cl
 		return nil, fmt.Errorf("failed to get closure objects: %w", err)
 	}
 
+	labels := map[string]string{}
+	if err = json.Unmarshal(closure.Labels, &labels); err != nil {
+		return nil, fmt.Errorf("failed to decode closure labels: %w", err)
+	}
+
+	provenance, err := decodeProvenance(closure.Provenance)
+	if err != nil {
+		return nil, err
+	}
+
 	return &ClosureResponse{
-		Key:       closureKey,
-		UpdatedAt: closure.Time,
-		Objects:   objects,
+		Key:        closureKey,
+		UpdatedAt:  closure.UpdatedAt.Time,
+		Labels:     labels,
+		CreatedBy:  closure.CreatedBy.String,
+		Provenance: provenance,
+		Roots:      closure.Roots,
+		Objects:    objects,
 	}, nil
 }
 
-func cleanupClosureOlderThan(ctx context.Context, pool *pgxpool.Pool, age time.Duration) error {
+// LabelRetention is how long closures with a label are kept after their last push.
+type LabelRetention struct {
+	Label     string
+	Value     string
+	Retention time.Duration
+}
+
+// parseLabelRetentions parses a comma separated list of label=value=duration, e.g. "jobset=nixpkgs:staging=72h".
+// The value may contain "=" itself.
+func parseLabelRetentions(spec string) ([]LabelRetention, error) {
+	var retentions []LabelRetention
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry == "" {
+			continue
+		}
+
+		label, rest, found := strings.Cut(entry, "=")
+		sep := strings.LastIndex(rest, "=")
+
+		if !found || label == "" || sep < 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected label=value=duration", entry)
+		}
+
+		retention, err := time.ParseDuration(rest[sep+1:])
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("invalid duration in %q", entry)
+		}
+
+		retentions = append(retentions, LabelRetention{Label: label, Value: rest[:sep], Retention: retention})
+	}
+
+	return retentions, nil
+}
+
+// cleanupClosureOlderThan deletes closures that were not pushed for age,
+// and closures with a label retention once it has passed.
+func cleanupClosureOlderThan(
+	ctx context.Context, pool *pgxpool.Pool, age time.Duration, labelRetentions []LabelRetention,
+) error {
 	conn, err := pool.Acquire(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get database connection: %w", err)
@@ -58,10 +145,442 @@ func cleanupClosureOlderThan(ctx context.Context, pool *pgxpool.Pool, age time.D
 		Valid: true,
 	}
 
+	if err = checkGCHolds(ctx, queries); err != nil {
+		return err
+	}
+
+	if _, err = queries.DeleteExpiredRemoteRoots(ctx); err != nil {
+		return fmt.Errorf("failed to delete expired remote roots: %w", err)
+	}
+
 	err = queries.DeleteClosures(ctx, timeOlder)
 	if err != nil {
 		return fmt.Errorf("failed to delete older closures: %w", err)
 	}
 
+	for _, retention := range labelRetentions {
+		deleted, err := queries.DeleteClosuresWithLabel(ctx, pg.DeleteClosuresWithLabelParams{
+			OlderThan: pgtype.Timestamp{Time: time.Now().UTC().Add(-retention.Retention), Valid: true},
+			Label:     retention.Label,
+			Value:     retention.Value,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete closures with label %s=%s: %w", retention.Label, retention.Value, err)
+		}
+
+		slog.InfoContext(ctx, "Deleted closures by label retention",
+			"label", retention.Label, "value", retention.Value, "deleted", deleted)
+	}
+
 	return nil
 }
+
+// objectRetentions returns the retention of object key prefixes that don't follow the lifetime of their closures.
+func (s *Service) objectRetentions() map[string]time.Duration {
+	retentions := map[string]time.Duration{}
+
+	if s.LogRetention > 0 {
+		retentions[buildLogPrefix] = s.LogRetention
+	}
+
+	if s.RealisationRetention > 0 {
+		retentions["realisations/"] = s.RealisationRetention
+	}
+
+	return retentions
+}
+
+// expireObjects detaches objects from their closures once they exceed the retention of their prefix.
+// It returns the number of expired references per prefix.
+func (s *Service) expireObjects(ctx context.Context) (map[string]int64, error) {
+	queries := pg.New(s.Pool)
+	expired := map[string]int64{}
+
+	for prefix, retention := range s.objectRetentions() {
+		if err := checkGCHolds(ctx, queries); err != nil {
+			return nil, err
+		}
+
+		count, err := queries.ExpireClosureObjects(ctx, pg.ExpireClosureObjectsParams{
+			Prefix:           prefix,
+			RetentionSeconds: int64(retention.Seconds()),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to expire objects with prefix '%s': %w", prefix, err)
+		}
+
+		expired[prefix] = count
+	}
+
+	return expired, nil
+}
+
+// getClosureStorePaths returns the store paths of the top-level narinfos of a closure.
+func getClosureStorePaths(ctx context.Context, pool *pgxpool.Pool, closureKey string) ([]string, error) {
+	queries := pg.New(pool)
+
+	if _, err := queries.GetClosure(ctx, closureKey); err != nil {
+		return nil, fmt.Errorf("failed to get closure: %w", err)
+	}
+
+	storePaths, err := queries.GetClosureRootStorePaths(ctx, closureKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closure store paths: %w", err)
+	}
+
+	return storePaths, nil
+}
+
+type GroupClosure struct {
+	Key        string      `json:"key"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	CreatedBy  string      `json:"created_by,omitempty"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+func getGroupClosures(ctx context.Context, pool *pgxpool.Pool, group string) ([]GroupClosure, error) {
+	rows, err := pg.New(pool).GetGroupClosures(ctx, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get group closures: %w", err)
+	}
+
+	closures := make([]GroupClosure, 0, len(rows))
+	for _, row := range rows {
+		provenance, err := decodeProvenance(row.Provenance)
+		if err != nil {
+			return nil, err
+		}
+
+		closures = append(closures, GroupClosure{
+			Key:        row.Key,
+			UpdatedAt:  row.UpdatedAt.Time,
+			CreatedBy:  row.CreatedBy.String,
+			Provenance: provenance,
+		})
+	}
+
+	return closures, nil
+}
+
+// getClosuresByRevision returns the closures whose last push came from the given revision, newest first.
+func getClosuresByRevision(ctx context.Context, pool *pgxpool.Pool, revision string) ([]GroupClosure, error) {
+	rows, err := pg.New(pool).GetClosuresByRevision(ctx, revision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closures by revision: %w", err)
+	}
+
+	closures := make([]GroupClosure, 0, len(rows))
+	for _, row := range rows {
+		provenance, err := decodeProvenance(row.Provenance)
+		if err != nil {
+			return nil, err
+		}
+
+		closures = append(closures, GroupClosure{
+			Key:        row.Key,
+			UpdatedAt:  row.UpdatedAt.Time,
+			CreatedBy:  row.CreatedBy.String,
+			Provenance: provenance,
+		})
+	}
+
+	return closures, nil
+}
+
+// deleteGroupClosures removes all closures from a group that were not pushed to it within the given duration.
+// Closures that another group or an ungrouped push still references are retained,
+// the objects of the others are reclaimed by the next garbage collection.
+func deleteGroupClosures(
+	ctx context.Context, pool *pgxpool.Pool, group string, age time.Duration,
+) (*DeleteGroupResponse, error) {
+	row, err := pg.New(pool).DeleteGroupClosures(ctx, pg.DeleteGroupClosuresParams{
+		Root:      group,
+		UpdatedAt: pgtype.Timestamp{Time: time.Now().UTC().Add(-age), Valid: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete group closures: %w", err)
+	}
+
+	return &DeleteGroupResponse{
+		Deleted:      row.Deleted,
+		RemovedRoots: row.Removed,
+		Retained:     row.Removed - row.Deleted,
+	}, nil
+}
+
+// getGroupGCPreview computes what deleteGroupClosures would free without an age.
+func getGroupGCPreview(ctx context.Context, pool *pgxpool.Pool, group string) (*GroupGCPreviewResponse, error) {
+	row, err := pg.New(pool).GetGroupGCPreview(ctx, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute group gc preview: %w", err)
+	}
+
+	return &GroupGCPreviewResponse{
+		Closures:    row.Closures,
+		Objects:     row.Objects,
+		Bytes:       row.Bytes,
+		UnknownSize: row.UnknownSize,
+	}, nil
+}
+
+var errClosureNotFound = errors.New("closure not found")
+
+// closureKeyCandidates returns the keys a closure may be registered under: the key itself and,
+// for a store path or narinfo key, its hash.
+func closureKeyCandidates(key string) []string {
+	candidates := []string{key}
+	if hash := storepath.HashPart(strings.TrimSuffix(key, narinfoSuffix)); hash != key {
+		candidates = append(candidates, hash)
+	}
+
+	return candidates
+}
+
+// deleteClosure deletes a single closure. Besides the closure key itself, a store path or
+// narinfo key is accepted, which is resolved to its hash, the key used by import-bucket.
+// Its exclusive objects are reclaimed by the next garbage collection.
+func deleteClosure(ctx context.Context, pool *pgxpool.Pool, key string) (*DeleteClosureResponse, error) {
+	queries := pg.New(pool)
+
+	for _, candidate := range closureKeyCandidates(key) {
+		row, err := queries.DeleteClosure(ctx, candidate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete closure: %w", err)
+		}
+
+		if row.Deleted > 0 {
+			return &DeleteClosureResponse{Key: candidate, Released: row.Released}, nil
+		}
+	}
+
+	return nil, errClosureNotFound
+}
+
+// number of objects checked in parallel when verifying a closure.
+const verifyConcurrency = 16
+
+type VerifyClosureResponse struct {
+	Key     string `json:"key"`
+	Checked int    `json:"checked"`
+	// Objects tracked by the closure that do not exist in the bucket.
+	Missing []string `json:"missing"`
+	// Objects referenced by a narinfo of the closure that the closure does not track.
+	Unreachable []string `json:"unreachable"`
+}
+
+// missingObjects returns all keys that do not exist in the bucket.
+func (s *Service) missingObjects(ctx context.Context, keys []string) ([]string, error) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		missing []string
+		errs    []error
+	)
+
+	sem := make(chan struct{}, verifyConcurrency)
+
+	for _, key := range keys {
+		sem <- struct{}{}
+
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			_, err := s.statObject(ctx, key, minio.StatObjectOptions{})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil {
+				return
+			}
+
+			if isNoSuchKey(err) {
+				missing = append(missing, key)
+			} else {
+				errs = append(errs, fmt.Errorf("failed to stat object '%s': %w", key, err))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	slices.Sort(missing)
+
+	return missing, nil
+}
+
+// verifyClosure checks that every object referenced by the closure's narinfos is tracked by the closure
+// and that all tracked objects exist in the bucket.
+func (s *Service) verifyClosure(ctx context.Context, closureKey string) (*VerifyClosureResponse, error) {
+	closure, err := getClosure(ctx, s.Pool, closureKey)
+	if err != nil {
+		return nil, err
+	}
+
+	narinfos, err := pg.New(s.Pool).GetClosureNarinfos(ctx, closureKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closure narinfos: %w", err)
+	}
+
+	tracked := make(map[string]bool, len(closure.Objects))
+	for _, object := range closure.Objects {
+		tracked[object] = true
+	}
+
+	unreachable := make(map[string]bool)
+
+	for _, narinfo := range narinfos {
+		if !tracked[narinfo.Url] {
+			unreachable[narinfo.Url] = true
+		}
+
+		for _, ref := range narinfo.Refs {
+			if refKey := narInfoKey(ref); !tracked[refKey] {
+				unreachable[refKey] = true
+			}
+		}
+	}
+
+	missing, err := s.missingObjects(ctx, closure.Objects)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &VerifyClosureResponse{
+		Key:         closureKey,
+		Checked:     len(closure.Objects),
+		Missing:     missing,
+		Unreachable: make([]string, 0, len(unreachable)),
+	}
+
+	if response.Missing == nil {
+		response.Missing = []string{}
+	}
+
+	for key := range unreachable {
+		response.Unreachable = append(response.Unreachable, key)
+	}
+
+	slices.Sort(response.Unreachable)
+
+	return response, nil
+}
+
+type PromoteClosureRequest struct {
+	Group string `json:"group"`
+}
+
+type PromoteClosureResponse struct {
+	Key   string `json:"key"`
+	Group string `json:"group"`
+	// Signed is the number of narinfos signed with the signing key of the server.
+	Signed int `json:"signed"`
+}
+
+var errPromoteUntrusted = errors.New("promoting with a signing key requires trusted keys to verify the narinfos")
+
+// promoteClosure adds a group root to a closure, e.g. to move a release from staging to production.
+// With a signing key, its narinfos are signed with it first. Their existing signatures must be from
+// a trusted key, so promotion never vouches for narinfos the server could not verify.
+// All groups share one bucket, so the signature is added to the narinfo objects that every consumer
+// of the cache substitutes, not to a copy of the group. Groups don't isolate signatures from each other.
+func (s *Service) promoteClosure(ctx context.Context, closureKey, group string) (*PromoteClosureResponse, error) {
+	if s.SigningKey != nil && len(s.TrustedKeys) == 0 {
+		return nil, errPromoteUntrusted
+	}
+
+	queries := pg.New(s.Pool)
+
+	if _, err := queries.GetClosure(ctx, closureKey); err != nil {
+		return nil, fmt.Errorf("failed to get closure: %w", err)
+	}
+
+	response := &PromoteClosureResponse{Key: closureKey, Group: group}
+
+	if s.SigningKey != nil {
+		narinfos, err := queries.GetClosureNarinfoEndpoints(ctx, closureKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get closure narinfos: %w", err)
+		}
+
+		for _, narinfo := range narinfos {
+			info, err := s.fetchNarInfo(ctx, narinfo.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			if err = verifyNarInfo(info, s.TrustedKeys); err != nil {
+				return nil, err
+			}
+
+			signNarInfo(info, s.SigningKeyName, s.SigningKey)
+
+			if err = s.rewriteNarInfo(ctx, queries, narinfo.Key, narinfo.Endpoint, info); err != nil {
+				return nil, err
+			}
+
+			response.Signed++
+		}
+	}
+
+	added, err := queries.AddClosureRoot(ctx, pg.AddClosureRootParams{Root: group, ClosureKey: closureKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add closure root: %w", err)
+	}
+
+	// deleted while its narinfos were signed
+	if added == 0 {
+		return nil, fmt.Errorf("failed to add closure root: %w", pgx.ErrNoRows)
+	}
+
+	return response, nil
+}
+
+type DiffClosureRequest struct {
+	Objects []string `json:"objects"`
+}
+
+// DiffClosureResponse describes what committing the given objects as the closure would change.
+type DiffClosureResponse struct {
+	Key string `json:"key"`
+	// Objects that are not part of the closure yet.
+	Added int64 `json:"added"`
+	// Objects that are not in the cache and have to be uploaded.
+	Uploads int64 `json:"uploads"`
+	// Objects that leave the closure.
+	Removed int64 `json:"removed"`
+	// Removed objects that no other closure references and that are deleted by the next garbage collection.
+	Garbage int64 `json:"garbage"`
+	// Sum of the NarSize of the garbage narinfos.
+	GarbageNarSize int64 `json:"garbage_nar_size"`
+}
+
+// diffClosure compares a closure with the objects it is about to be updated to.
+// A closure that does not exist yet is treated as empty.
+func diffClosure(ctx context.Context, pool *pgxpool.Pool, closureKey string, objects []string) (*DiffClosureResponse, error) {
+	diff, err := pg.New(pool).GetClosureDiff(ctx, pg.GetClosureDiffParams{
+		Keys:       objects,
+		ClosureKey: closureKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff closure: %w", err)
+	}
+
+	return &DiffClosureResponse{
+		Key:            closureKey,
+		Added:          diff.Added,
+		Uploads:        diff.Uploads,
+		Removed:        diff.Removed,
+		Garbage:        diff.Garbage,
+		GarbageNarSize: diff.GarbageNarSize,
+	}, nil
+}
@@ -0,0 +1,532 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_GetClosureStorePathHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, "prod", map[string]string{
+		a + ".narinfo": testNarInfo(a, a, b),
+		b + ".narinfo": testNarInfo(b),
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/prod/store-path",
+		handler:    service.GetClosureStorePathHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	if strings.TrimSpace(rr.Body.String()) != "/nix/store/"+a+"-pkg" {
+		t.Errorf("unexpected store path: %q", rr.Body.String())
+	}
+}
+
+func TestService_VerifyClosureHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	// b is referenced, but not part of the closure
+	service.AllowMissingReferences = true
+
+	pushClosure(t, service, "prod", map[string]string{
+		a + ".narinfo":          testNarInfo(a, a, b),
+		"nar/" + a + ".nar.zst": "nar",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := service.MinioClient.RemoveObject(ctx, service.BucketName, "nar/"+a+".nar.zst", minio.RemoveObjectOptions{})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/prod/verify",
+		handler:    service.VerifyClosureHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	var response server.VerifyClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if response.Checked != 2 {
+		t.Errorf("expected 2 checked objects, got %d", response.Checked)
+	}
+
+	if !reflect.DeepEqual(response.Missing, []string{"nar/" + a + ".nar.zst"}) {
+		t.Errorf("unexpected missing objects: %v", response.Missing)
+	}
+
+	if !reflect.DeepEqual(response.Unreachable, []string{b + ".narinfo"}) {
+		t.Errorf("unexpected unreachable objects: %v", response.Unreachable)
+	}
+}
+
+func TestService_closureLabels(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	for _, labels := range []map[string]string{
+		{"jobset": "nixpkgs:trunk", "eval": "1"},
+		{"eval": "2"},
+	} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": "hydra",
+			"objects": []string{"log/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg.drv"},
+			"labels":  labels,
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       "/api/pending_closures/" + pendingClosureResponse.ID + "/complete",
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/hydra",
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": "hydra"},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	// labels of later pushes are merged into the existing ones
+	expected := map[string]string{"jobset": "nixpkgs:trunk", "eval": "2"}
+	if !reflect.DeepEqual(closure.Labels, expected) {
+		t.Errorf("unexpected labels: %v", closure.Labels)
+	}
+}
+
+func TestService_updateClosure(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	pushClosure(t, service, "pin", map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		b + ".narinfo": testNarInfo(b),
+	})
+
+	body, err := json.Marshal(server.DiffClosureRequest{Objects: []string{a + ".narinfo", c + ".narinfo"}})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/pin/diff",
+		body:       body,
+		handler:    service.DiffClosureHandler,
+		pathValues: map[string]string{"key": "pin"},
+	})
+
+	var diff server.DiffClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+
+	expected := server.DiffClosureResponse{
+		Key: "pin", Added: 1, Uploads: 1, Removed: 1, Garbage: 1, GarbageNarSize: 1024,
+	}
+	if diff != expected {
+		t.Errorf("expected diff %+v, got %+v", expected, diff)
+	}
+
+	closureObjects := func() []string {
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/api/closures/pin",
+			handler:    service.GetClosureHandler,
+			pathValues: map[string]string{"key": "pin"},
+		})
+
+		var closure server.ClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+		objects := slices.Clone(closure.Objects)
+		slices.Sort(objects)
+
+		return objects
+	}
+
+	// by default pushes add to the closure
+	pushClosure(t, service, "pin", map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		c + ".narinfo": testNarInfo(c),
+	})
+
+	if objects := closureObjects(); !reflect.DeepEqual(objects, []string{a + ".narinfo", b + ".narinfo", c + ".narinfo"}) {
+		t.Errorf("expected closure objects to be merged, got %v", objects)
+	}
+
+	body, err = json.Marshal(map[string]interface{}{
+		"closure": "pin",
+		"objects": []string{a + ".narinfo", c + ".narinfo"},
+		"replace": true,
+	})
+	ok(t, err)
+
+	rr = testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var pendingClosure server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosure))
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + pendingClosure.ID + "/complete",
+		handler:    service.CommitPendingClosureHandler,
+		pathValues: map[string]string{"id": pendingClosure.ID},
+	})
+
+	if objects := closureObjects(); !reflect.DeepEqual(objects, []string{a + ".narinfo", c + ".narinfo"}) {
+		t.Errorf("expected closure objects to be replaced, got %v", objects)
+	}
+}
+
+func TestService_closureCreatedBy(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	header := map[string]string{"Authorization": "Bearer " + service.APIToken}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": "ci",
+		"objects": []string{"log/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg.drv"},
+	})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.AuthMiddleware(service.CreatePendingClosureHandler),
+		header:  header,
+	})
+
+	var pendingClosureResponse server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + pendingClosureResponse.ID + "/complete",
+		handler:    service.AuthMiddleware(service.CommitPendingClosureHandler),
+		pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		header:     header,
+	})
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/ci",
+		handler:    service.AuthMiddleware(service.GetClosureHandler),
+		pathValues: map[string]string{"key": "ci"},
+		header:     header,
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	if closure.CreatedBy != "api-token" {
+		t.Errorf("expected closure to be created by api-token, got %q", closure.CreatedBy)
+	}
+}
+
+func TestService_closureProvenance(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	push := func(closure string, provenance *server.Provenance) {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure":    closure,
+			"objects":    []string{"log/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-pkg.drv"},
+			"provenance": provenance,
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       "/api/pending_closures/" + pendingClosureResponse.ID + "/complete",
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	first := &server.Provenance{Revision: "3f7340e", CIJobURL: "https://ci.example.com/jobs/41", Builder: "build01"}
+	second := &server.Provenance{Revision: "9604cf7", CIJobURL: "https://ci.example.com/jobs/42", Builder: "build02"}
+
+	push("prod", first)
+	push("staging", first)
+	push("prod", second)
+	// a push without provenance keeps the previous one
+	push("prod", nil)
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/prod",
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	if closure.Provenance == nil || *closure.Provenance != *second {
+		t.Errorf("expected provenance %+v, got %+v", second, closure.Provenance)
+	}
+
+	search := func(revision string) []string {
+		rr := testRequest(t, &TestRequest{
+			method:  "GET",
+			path:    "/api/closures?revision=" + revision,
+			handler: service.SearchClosuresHandler,
+		})
+
+		var resp server.SearchClosuresResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+		keys := make([]string, 0, len(resp.Closures))
+		for _, c := range resp.Closures {
+			keys = append(keys, c.Key)
+		}
+
+		return keys
+	}
+
+	if keys := search(first.Revision); !reflect.DeepEqual(keys, []string{"staging"}) {
+		t.Errorf("unexpected closures of %s: %v", first.Revision, keys)
+	}
+
+	if keys := search(second.Revision); !reflect.DeepEqual(keys, []string{"prod"}) {
+		t.Errorf("unexpected closures of %s: %v", second.Revision, keys)
+	}
+}
+
+func TestService_DeleteClosureHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo":          testNarInfo(a),
+		"nar/" + a + ".nar.zst": "nar",
+	})
+	pushClosure(t, service, b, map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		b + ".narinfo": testNarInfo(b, a),
+	})
+
+	storePath := "/nix/store/" + a + "-pkg"
+
+	rr := testRequest(t, &TestRequest{
+		method:     "DELETE",
+		path:       "/api/closures/" + url.PathEscape(storePath),
+		handler:    service.DeleteClosureHandler,
+		pathValues: map[string]string{"key": storePath},
+	})
+
+	var resp server.DeleteClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	// the narinfo is still referenced by closure b
+	if resp.Key != a || resp.Released != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	notFound := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/api/closures/" + a,
+		handler:       service.GetClosureHandler,
+		pathValues:    map[string]string{"key": a},
+		checkResponse: &notFound,
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "DELETE",
+		path:          "/api/closures/" + a,
+		handler:       service.DeleteClosureHandler,
+		pathValues:    map[string]string{"key": a},
+		checkResponse: &notFound,
+	})
+}
+
+func TestService_PromoteClosureHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	clientPublicKey, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.SigningKeyName = "production-1"
+	service.SigningKey = privateKey
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo": signNarInfo(t, testNarInfo(a, b), "staging-1", clientKey),
+		b + ".narinfo": signNarInfo(t, testNarInfo(b), "staging-1", clientKey),
+	})
+
+	// without trusted keys, the server would vouch for narinfos it can't verify
+	unprocessable := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/closures/" + a + "/promote",
+		body:          []byte(`{"group": "production"}`),
+		handler:       service.PromoteClosureHandler,
+		pathValues:    map[string]string{"key": a},
+		checkResponse: &unprocessable,
+	})
+
+	service.TrustedKeys = map[string]ed25519.PublicKey{"staging-1": clientPublicKey}
+
+	notFound := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d: %s", http.StatusNotFound, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/closures/missing/promote",
+		body:          []byte(`{"group": "production"}`),
+		handler:       service.PromoteClosureHandler,
+		pathValues:    map[string]string{"key": "missing"},
+		checkResponse: &notFound,
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/" + a + "/promote",
+		body:       []byte(`{"group": "production"}`),
+		handler:    service.PromoteClosureHandler,
+		pathValues: map[string]string{"key": a},
+	})
+
+	var promoted server.PromoteClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &promoted))
+
+	if promoted.Group != "production" || promoted.Signed != 2 {
+		t.Errorf("unexpected response: %+v", promoted)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/groups/production",
+		handler:    service.GetGroupHandler,
+		pathValues: map[string]string{"name": "production"},
+	})
+
+	var group server.GroupResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &group))
+
+	if len(group.Closures) != 1 || group.Closures[0].Key != a {
+		t.Errorf("expected the closure in the group, got %+v", group.Closures)
+	}
+
+	obj, err := service.MinioClient.GetObject(ctx, service.BucketName, b+".narinfo", minio.GetObjectOptions{})
+	ok(t, err)
+
+	defer obj.Close()
+
+	info, err := server.ParseNarInfo(obj)
+	ok(t, err)
+
+	if !slices.ContainsFunc(info.Signatures, func(sig string) bool { return strings.HasPrefix(sig, "production-1:") }) {
+		t.Errorf("expected the narinfo to be signed with the production key, got %v", info.Signatures)
+	}
+}
@@ -0,0 +1,560 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A database snapshot is a zstd compressed JSON lines file. The first line is a snapshotHeader,
+// every following line a snapshotRecord. The format is independent of the database schema,
+// so a snapshot can be imported after later migrations.
+const (
+	snapshotFormat  = "niks3-db"
+	snapshotVersion = 1
+)
+
+type snapshotHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type snapshotRecord struct {
+	Type       string              `json:"type"`
+	Object     *snapshotObject     `json:"object,omitempty"`
+	Closure    *snapshotClosure    `json:"closure,omitempty"`
+	NarInfo    *snapshotNarInfo    `json:"narinfo,omitempty"`
+	RemoteRoot *snapshotRemoteRoot `json:"remote_root,omitempty"`
+	GCHold     *snapshotGCHold     `json:"gc_hold,omitempty"`
+}
+
+type snapshotObject struct {
+	Key       string     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Endpoint  string     `json:"endpoint,omitempty"`
+	Sha256    string     `json:"sha256,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+}
+
+type snapshotRoot struct {
+	Root      string    `json:"root"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type snapshotClosure struct {
+	Key        string          `json:"key"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	Group      string          `json:"group,omitempty"`
+	Labels     json.RawMessage `json:"labels,omitempty"`
+	CreatedBy  string          `json:"created_by,omitempty"`
+	Provenance json.RawMessage `json:"provenance,omitempty"`
+	Roots      []snapshotRoot  `json:"roots"`
+	Objects    []string        `json:"objects"`
+	// When objects were last pushed with the closure, if that was before the last push of the closure.
+	// Missing in snapshots of older versions, which restore all objects with the time of the last push.
+	ObjectUpdatedAt map[string]time.Time `json:"object_updated_at,omitempty"`
+}
+
+type snapshotNarInfo struct {
+	Key         string   `json:"key"`
+	StorePath   string   `json:"store_path"`
+	URL         string   `json:"url"`
+	Compression string   `json:"compression"`
+	NarHash     string   `json:"nar_hash"`
+	NarSize     int64    `json:"nar_size"`
+	Deriver     string   `json:"deriver,omitempty"`
+	References  []string `json:"references"`
+	Signatures  []string `json:"signatures"`
+}
+
+type snapshotRemoteRoot struct {
+	Identity  string    `json:"identity"`
+	Name      string    `json:"name"`
+	Closure   string    `json:"closure"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type snapshotGCHold struct {
+	ID        int64     `json:"id"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var errDatabaseNotEmpty = errors.New("database is not empty, import-db only restores into a new database")
+
+func timestampPtr(ts pgtype.Timestamp) *time.Time {
+	if !ts.Valid {
+		return nil
+	}
+
+	return &ts.Time
+}
+
+func toTimestamp(t *time.Time) pgtype.Timestamp {
+	if t == nil {
+		return pgtype.Timestamp{}
+	}
+
+	return pgtype.Timestamp{Time: t.UTC(), Valid: true}
+}
+
+func toText(s string) pgtype.Text {
+	return pgtype.Text{String: s, Valid: s != ""}
+}
+
+// ExportDatabase writes a snapshot of all objects, closures, remote roots, gc holds and narinfos.
+// Pending closures and the audit log are not exported.
+func (s *Service) ExportDatabase(ctx context.Context, w io.Writer) error {
+	// all tables are read from the same snapshot of the database
+	tx, err := s.Pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	// nothing to commit, the transaction is always rolled back
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	encoder, err := zstd.NewWriter(w)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+
+	out := json.NewEncoder(encoder)
+
+	err = out.Encode(snapshotHeader{Format: snapshotFormat, Version: snapshotVersion, ExportedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	objects, err := queries.ExportObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get objects: %w", err)
+	}
+
+	for _, object := range objects {
+		err = out.Encode(snapshotRecord{Type: "object", Object: &snapshotObject{
+			Key:       object.Key,
+			CreatedAt: object.CreatedAt.Time,
+			DeletedAt: timestampPtr(object.DeletedAt),
+			Endpoint:  object.Endpoint,
+			Sha256:    object.Sha256.String,
+			Size:      object.Size.Int64,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to write object: %w", err)
+		}
+	}
+
+	closures, err := exportClosures(ctx, queries)
+	if err != nil {
+		return err
+	}
+
+	for _, closure := range closures {
+		if err = out.Encode(snapshotRecord{Type: "closure", Closure: closure}); err != nil {
+			return fmt.Errorf("failed to write closure: %w", err)
+		}
+	}
+
+	remoteRoots, err := queries.ExportRemoteRoots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get remote roots: %w", err)
+	}
+
+	for _, root := range remoteRoots {
+		err = out.Encode(snapshotRecord{Type: "remote_root", RemoteRoot: &snapshotRemoteRoot{
+			Identity:  root.Identity,
+			Name:      root.Name,
+			Closure:   root.ClosureKey,
+			UpdatedAt: root.UpdatedAt.Time,
+			ExpiresAt: root.ExpiresAt.Time,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to write remote root: %w", err)
+		}
+	}
+
+	gcHolds, err := queries.ExportGCHolds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get gc holds: %w", err)
+	}
+
+	for _, hold := range gcHolds {
+		err = out.Encode(snapshotRecord{Type: "gc_hold", GCHold: &snapshotGCHold{
+			ID:        hold.ID,
+			Reason:    hold.Reason,
+			CreatedAt: hold.CreatedAt.Time,
+			ExpiresAt: hold.ExpiresAt.Time,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to write gc hold: %w", err)
+		}
+	}
+
+	narinfos, err := queries.ExportNarinfos(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get narinfos: %w", err)
+	}
+
+	for _, narinfo := range narinfos {
+		err = out.Encode(snapshotRecord{Type: "narinfo", NarInfo: &snapshotNarInfo{
+			Key:         narinfo.Key,
+			StorePath:   narinfo.StorePath,
+			URL:         narinfo.Url,
+			Compression: narinfo.Compression,
+			NarHash:     narinfo.NarHash,
+			NarSize:     narinfo.NarSize,
+			Deriver:     narinfo.Deriver.String,
+			References:  narinfo.Refs,
+			Signatures:  narinfo.Signatures,
+		}})
+		if err != nil {
+			return fmt.Errorf("failed to write narinfo: %w", err)
+		}
+	}
+
+	if err = encoder.Close(); err != nil {
+		return fmt.Errorf("failed to finish zstd stream: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Exported database",
+		"objects", len(objects),
+		"closures", len(closures),
+		"remote_roots", len(remoteRoots),
+		"gc_holds", len(gcHolds),
+		"narinfos", len(narinfos))
+
+	return nil
+}
+
+func exportClosures(ctx context.Context, queries *pg.Queries) ([]*snapshotClosure, error) {
+	rows, err := queries.ExportClosures(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closures: %w", err)
+	}
+
+	closures := make([]*snapshotClosure, 0, len(rows))
+	byKey := make(map[string]*snapshotClosure, len(rows))
+
+	for _, row := range rows {
+		closure := &snapshotClosure{
+			Key:        row.Key,
+			UpdatedAt:  row.UpdatedAt.Time,
+			Group:      row.GroupName.String,
+			Labels:     row.Labels,
+			CreatedBy:  row.CreatedBy.String,
+			Provenance: row.Provenance,
+			Roots:      []snapshotRoot{},
+			Objects:    []string{},
+		}
+		closures = append(closures, closure)
+		byKey[row.Key] = closure
+	}
+
+	roots, err := queries.ExportClosureRoots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closure roots: %w", err)
+	}
+
+	for _, root := range roots {
+		closure := byKey[root.ClosureKey]
+		closure.Roots = append(closure.Roots, snapshotRoot{Root: root.Root, UpdatedAt: root.UpdatedAt.Time})
+	}
+
+	closureObjects, err := queries.ExportClosureObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get closure objects: %w", err)
+	}
+
+	for _, object := range closureObjects {
+		closure := byKey[object.ClosureKey]
+		closure.Objects = append(closure.Objects, object.ObjectKey)
+
+		if !object.UpdatedAt.Time.Equal(closure.UpdatedAt) {
+			if closure.ObjectUpdatedAt == nil {
+				closure.ObjectUpdatedAt = make(map[string]time.Time)
+			}
+
+			closure.ObjectUpdatedAt[object.ObjectKey] = object.UpdatedAt.Time
+		}
+	}
+
+	return closures, nil
+}
+
+// snapshotRows are the rows of the tables restored from a snapshot.
+type snapshotRows struct {
+	objects        []pg.ImportObjectsParams
+	closures       []pg.ImportClosuresParams
+	closureRoots   []pg.ImportClosureRootsParams
+	closureObjects []pg.ImportClosureObjectsParams
+	remoteRoots    []pg.ImportRemoteRootsParams
+	gcHolds        []pg.ImportGCHoldsParams
+	narinfos       []pg.ImportNarinfosParams
+}
+
+func (rows *snapshotRows) add(record *snapshotRecord) error {
+	switch {
+	case record.Type == "object" && record.Object != nil:
+		o := record.Object
+		rows.objects = append(rows.objects, pg.ImportObjectsParams{
+			Key:       o.Key,
+			DeletedAt: toTimestamp(o.DeletedAt),
+			CreatedAt: toTimestamp(&o.CreatedAt),
+			Endpoint:  o.Endpoint,
+			Sha256:    toText(o.Sha256),
+			Size:      pgtype.Int8{Int64: o.Size, Valid: o.Sha256 != ""},
+		})
+	case record.Type == "closure" && record.Closure != nil:
+		c := record.Closure
+		rows.closures = append(rows.closures, pg.ImportClosuresParams{
+			Key:        c.Key,
+			UpdatedAt:  toTimestamp(&c.UpdatedAt),
+			GroupName:  toText(c.Group),
+			Labels:     c.Labels,
+			CreatedBy:  toText(c.CreatedBy),
+			Provenance: c.Provenance,
+		})
+
+		for _, root := range c.Roots {
+			rows.closureRoots = append(rows.closureRoots, pg.ImportClosureRootsParams{
+				ClosureKey: c.Key,
+				Root:       root.Root,
+				UpdatedAt:  toTimestamp(&root.UpdatedAt),
+			})
+		}
+
+		for _, object := range c.Objects {
+			updatedAt, ok := c.ObjectUpdatedAt[object]
+			if !ok {
+				updatedAt = c.UpdatedAt
+			}
+
+			rows.closureObjects = append(rows.closureObjects, pg.ImportClosureObjectsParams{
+				ClosureKey: c.Key,
+				ObjectKey:  object,
+				UpdatedAt:  toTimestamp(&updatedAt),
+			})
+		}
+	case record.Type == "remote_root" && record.RemoteRoot != nil:
+		r := record.RemoteRoot
+		rows.remoteRoots = append(rows.remoteRoots, pg.ImportRemoteRootsParams{
+			Identity:   r.Identity,
+			Name:       r.Name,
+			ClosureKey: r.Closure,
+			UpdatedAt:  toTimestamp(&r.UpdatedAt),
+			ExpiresAt:  toTimestamp(&r.ExpiresAt),
+		})
+	case record.Type == "gc_hold" && record.GCHold != nil:
+		h := record.GCHold
+		rows.gcHolds = append(rows.gcHolds, pg.ImportGCHoldsParams{
+			ID:        h.ID,
+			Reason:    h.Reason,
+			CreatedAt: toTimestamp(&h.CreatedAt),
+			ExpiresAt: toTimestamp(&h.ExpiresAt),
+		})
+	case record.Type == "narinfo" && record.NarInfo != nil:
+		n := record.NarInfo
+		rows.narinfos = append(rows.narinfos, pg.ImportNarinfosParams{
+			Key:         n.Key,
+			StorePath:   n.StorePath,
+			Url:         n.URL,
+			Compression: n.Compression,
+			NarHash:     n.NarHash,
+			NarSize:     n.NarSize,
+			Deriver:     toText(n.Deriver),
+			Refs:        n.References,
+			Signatures:  n.Signatures,
+		})
+	default:
+		return fmt.Errorf("invalid record of type %q", record.Type)
+	}
+
+	return nil
+}
+
+func readSnapshot(r io.Reader) (*snapshotRows, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer decoder.Close()
+
+	in := json.NewDecoder(bufio.NewReader(decoder))
+
+	var header snapshotHeader
+	if err = in.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	if header.Format != snapshotFormat {
+		return nil, fmt.Errorf("not a niks3 database snapshot, format is %q", header.Format)
+	}
+
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", header.Version, snapshotVersion)
+	}
+
+	rows := &snapshotRows{}
+
+	for {
+		var record snapshotRecord
+
+		err = in.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+
+		if err = rows.add(&record); err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+// ImportDatabase restores a snapshot written by ExportDatabase in a single transaction.
+// The database must not contain any objects or closures yet.
+func (s *Service) ImportDatabase(ctx context.Context, r io.Reader) error {
+	rows, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	empty, err := queries.IsDatabaseEmpty(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check database: %w", err)
+	}
+
+	if !empty {
+		return errDatabaseNotEmpty
+	}
+
+	if _, err = queries.ImportObjects(ctx, rows.objects); err != nil {
+		return fmt.Errorf("failed to import objects: %w", err)
+	}
+
+	if _, err = queries.ImportClosures(ctx, rows.closures); err != nil {
+		return fmt.Errorf("failed to import closures: %w", err)
+	}
+
+	if _, err = queries.ImportClosureRoots(ctx, rows.closureRoots); err != nil {
+		return fmt.Errorf("failed to import closure roots: %w", err)
+	}
+
+	if _, err = queries.ImportClosureObjects(ctx, rows.closureObjects); err != nil {
+		return fmt.Errorf("failed to import closure objects: %w", err)
+	}
+
+	if _, err = queries.ImportRemoteRoots(ctx, rows.remoteRoots); err != nil {
+		return fmt.Errorf("failed to import remote roots: %w", err)
+	}
+
+	if _, err = queries.ImportGCHolds(ctx, rows.gcHolds); err != nil {
+		return fmt.Errorf("failed to import gc holds: %w", err)
+	}
+
+	if err = queries.ResetGCHoldIDs(ctx); err != nil {
+		return fmt.Errorf("failed to reset gc hold ids: %w", err)
+	}
+
+	if _, err = queries.ImportNarinfos(ctx, rows.narinfos); err != nil {
+		return fmt.Errorf("failed to import narinfos: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	committed = true
+
+	slog.InfoContext(ctx, "Imported database",
+		"objects", len(rows.objects),
+		"closures", len(rows.closures),
+		"remote_roots", len(rows.remoteRoots),
+		"gc_holds", len(rows.gcHolds),
+		"narinfos", len(rows.narinfos))
+
+	return nil
+}
+
+// ExportDatabaseFile writes a snapshot to path, or to stdout if path is "-".
+// The file is only replaced once the snapshot is complete.
+func (s *Service) ExportDatabaseFile(ctx context.Context, path string) error {
+	if path == "-" {
+		return s.ExportDatabase(ctx, os.Stdout)
+	}
+
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp)
+
+	if err = s.ExportDatabase(ctx, file); err != nil {
+		file.Close()
+
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// ImportDatabaseFile restores a snapshot from path, or from stdin if path is "-".
+func (s *Service) ImportDatabaseFile(ctx context.Context, path string) error {
+	if path == "-" {
+		return s.ImportDatabase(ctx, os.Stdin)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	return s.ImportDatabase(ctx, file)
+}
@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_exportImportDatabase(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	source := createTestService(t)
+	defer source.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, source, a, map[string]string{
+		a + ".narinfo":          testNarInfo(a, b),
+		b + ".narinfo":          testNarInfo(b),
+		"nar/" + a + ".nar.zst": "nar",
+		"nar/" + b + ".nar.zst": "nar",
+	})
+
+	testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/roots",
+		body:    []byte(`{"name": "web1", "closure": "` + a + `", "ttl": "1h"}`),
+		handler: source.RegisterRemoteRootHandler,
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/gc/hold",
+		body:    []byte(`{"ttl": "1h", "reason": "deploying"}`),
+		handler: source.CreateGCHoldHandler,
+	})
+
+	var hold server.GCHold
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &hold))
+
+	// b was last pushed with an earlier push of the closure
+	pushedAt := time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC)
+	_, err := source.Pool.Exec(ctx, "UPDATE closure_objects SET updated_at = $1 WHERE object_key = $2",
+		pushedAt, b+".narinfo")
+	ok(t, err)
+
+	var snapshot bytes.Buffer
+	ok(t, source.ExportDatabase(ctx, &snapshot))
+
+	target := createTestService(t)
+	defer target.Close()
+
+	ok(t, target.ImportDatabase(ctx, bytes.NewReader(snapshot.Bytes())))
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + a,
+		handler:    target.GetClosureHandler,
+		pathValues: map[string]string{"key": a},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	if len(closure.Objects) != 4 {
+		t.Errorf("expected 4 objects in restored closure, got %v", closure.Objects)
+	}
+
+	if closure.Roots != 1 {
+		t.Errorf("expected 1 root in restored closure, got %d", closure.Roots)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/roots",
+		handler: target.GetRemoteRootsHandler,
+	})
+
+	var roots server.RemoteRootsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &roots))
+
+	if len(roots.Roots) != 1 || roots.Roots[0].Name != "web1" || roots.Roots[0].Closure != a {
+		t.Errorf("expected the remote root to be restored, got %+v", roots.Roots)
+	}
+
+	var restoredAt time.Time
+	ok(t, target.Pool.QueryRow(ctx, "SELECT updated_at FROM closure_objects WHERE object_key = $1",
+		b+".narinfo").Scan(&restoredAt))
+
+	if !restoredAt.Equal(pushedAt) {
+		t.Errorf("expected the push time of b to be restored, got %v", restoredAt)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/gc/holds",
+		handler: target.GetGCHoldsHandler,
+	})
+
+	var holds server.GCHoldsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &holds))
+
+	if len(holds.Holds) != 1 || holds.Holds[0].ID != hold.ID || holds.Holds[0].Reason != "deploying" {
+		t.Errorf("expected the gc hold to be restored, got %+v", holds.Holds)
+	}
+
+	// restoring twice would mix two states of the cache
+	if err := target.ImportDatabase(ctx, bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Error("expected import into a non-empty database to fail")
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	defaultTopDownloadsLimit = 50
+	maxTopDownloadsLimit     = 1000
+	// maximum length of a recorded user agent
+	maxUserAgentLength = 256
+)
+
+// downloadSalt keeps the recorded client hashes from being reversed by hashing all addresses.
+// It is regenerated on every start, so clients can't be tracked across restarts either.
+var downloadSalt = func() []byte {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(fmt.Sprintf("failed to generate download salt: %v", err))
+	}
+
+	return salt
+}()
+
+// hashClient returns a salted hash of the client address of the request, without its port.
+func hashClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	h := sha256.New()
+	h.Write(downloadSalt)
+	h.Write([]byte(host))
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// DownloadLogMiddleware records successful reads of /serve/{hash}/... per narinfo.
+// Read-only servers can't write to the database, so nothing is recorded there.
+func (s *Service) DownloadLogMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.ReadOnly {
+			next(w, r)
+
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		if recorder.status != http.StatusOK && recorder.status != http.StatusPartialContent {
+			return
+		}
+
+		userAgent := r.UserAgent()
+		if len(userAgent) > maxUserAgentLength {
+			userAgent = userAgent[:maxUserAgentLength]
+		}
+
+		// The request context is canceled once the client is gone, but the download still needs to be recorded.
+		err := pg.New(s.Pool).InsertDownload(context.WithoutCancel(r.Context()), pg.InsertDownloadParams{
+			Key:       r.PathValue("hash") + narinfoSuffix,
+			Path:      r.PathValue("path"),
+			Bytes:     recorder.bytes,
+			Client:    hashClient(r),
+			UserAgent: userAgent,
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to record download", "path", r.URL.Path, "error", err)
+		}
+	}
+}
+
+// cleanupDownloadLog removes downloads older than the configured retention. Zero retention keeps them forever.
+func (s *Service) cleanupDownloadLog(ctx context.Context) (int64, error) {
+	if s.DownloadRetention <= 0 {
+		return 0, nil
+	}
+
+	deleted, err := pg.New(s.Pool).DeleteDownloadsOlder(ctx, pgtype.Timestamp{
+		Time:  time.Now().UTC().Add(-s.DownloadRetention),
+		Valid: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to cleanup download log: %w", err)
+	}
+
+	return deleted, nil
+}
+
+type TopDownload struct {
+	Key       string `json:"key"`
+	StorePath string `json:"store_path,omitempty"`
+	Downloads int64  `json:"downloads"`
+	Bytes     int64  `json:"bytes"`
+	Clients   int64  `json:"clients"`
+}
+
+// GET /api/stats/top-downloads?since=168h&limit=50
+// Response body:
+//
+//	[
+//	  {
+//	    "key": "26xbg1ndr7hbcncrlf9nhx5is2b25d13.narinfo",
+//	    "store_path": "/nix/store/26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1",
+//	    "downloads": 1234,
+//	    "bytes": 56789012,
+//	    "clients": 17
+//	  }
+//	]
+//
+// The store path is omitted once the narinfo has been garbage collected.
+func (s *Service) TopDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received top downloads request", "method", r.Method, "url", r.URL)
+
+	params := pg.GetTopDownloadsParams{
+		RowLimit: defaultTopDownloadsLimit,
+	}
+
+	query := r.URL.Query()
+
+	since := time.Time{}
+
+	if sinceParam := query.Get("since"); sinceParam != "" {
+		age, err := time.ParseDuration(sinceParam)
+		if err != nil {
+			http.Error(w, "failed to parse since: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		since = time.Now().UTC().Add(-age)
+	}
+
+	params.Since = pgtype.Timestamp{Time: since, Valid: true}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxTopDownloadsLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTopDownloadsLimit), http.StatusBadRequest)
+
+			return
+		}
+
+		params.RowLimit = int32(limit) //nolint:gosec
+	}
+
+	rows, err := pg.New(s.Pool).GetTopDownloads(r.Context(), params)
+	if err != nil {
+		http.Error(w, "failed to get top downloads: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	downloads := make([]TopDownload, 0, len(rows))
+	for _, row := range rows {
+		downloads = append(downloads, TopDownload{
+			Key:       row.Key,
+			StorePath: row.StorePath.String,
+			Downloads: row.Downloads,
+			Bytes:     row.Bytes,
+			Clients:   row.Clients,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(downloads); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
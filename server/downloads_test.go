@@ -0,0 +1,76 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_TopDownloadsHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	contents := "hello world\n"
+	nar, offset := singleFileNar("README", contents)
+
+	listing, err := json.Marshal(map[string]any{
+		"version": 1,
+		"root": map[string]any{
+			"type": "directory",
+			"entries": map[string]any{
+				"README": map[string]any{"type": "regular", "size": len(contents), "narOffset": offset},
+			},
+		},
+	})
+	ok(t, err)
+
+	hash := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	narinfo := fmt.Sprintf(`StorePath: /nix/store/%s-pkg
+URL: nar/%s.nar
+Compression: none
+NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80
+NarSize: %d
+References: 
+`, hash, hash, len(nar))
+
+	pushClosure(t, service, hash, map[string]string{
+		hash + ".narinfo":      narinfo,
+		hash + ".ls":           string(listing),
+		"nar/" + hash + ".nar": string(nar),
+	})
+
+	for range 2 {
+		testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/serve/" + hash + "/README",
+			handler:    service.DownloadLogMiddleware(service.ServeNarFileHandler),
+			pathValues: map[string]string{"hash": hash, "path": "README"},
+		})
+	}
+
+	rr := testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/stats/top-downloads?since=1h",
+		handler: service.TopDownloadsHandler,
+	})
+
+	var downloads []server.TopDownload
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &downloads))
+
+	if len(downloads) != 1 {
+		t.Fatalf("expected downloads of one narinfo, got %v", downloads)
+	}
+
+	top := downloads[0]
+	if top.Key != hash+".narinfo" || top.StorePath != "/nix/store/"+hash+"-pkg" {
+		t.Errorf("unexpected top download: %+v", top)
+	}
+
+	if top.Downloads != 2 || top.Clients != 1 || top.Bytes != int64(2*len(contents)) {
+		t.Errorf("unexpected download counters: %+v", top)
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption modes of uploaded objects.
+const (
+	encryptionNone = ""
+	encryptionS3   = "s3"  // SSE-S3, keys managed by the S3 service
+	encryptionKMS  = "kms" // SSE-KMS, optionally with a specific KMS key
+)
+
+// parseServerSideEncryption returns the encryption for the given mode, or nil if objects are not encrypted by us.
+func parseServerSideEncryption(mode, kmsKeyID string) (encrypt.ServerSide, error) {
+	switch mode {
+	case encryptionNone:
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("a KMS key requires server-side encryption mode %q", encryptionKMS)
+		}
+
+		return nil, nil //nolint:nilnil
+	case encryptionS3:
+		if kmsKeyID != "" {
+			return nil, fmt.Errorf("a KMS key requires server-side encryption mode %q", encryptionKMS)
+		}
+
+		return encrypt.NewSSE(), nil
+	case encryptionKMS:
+		sse, err := encrypt.NewSSEKMS(kmsKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KMS key: %w", err)
+		}
+
+		return sse, nil
+	default:
+		return nil, fmt.Errorf("unknown server-side encryption mode %q, expected %s or %s",
+			mode, encryptionS3, encryptionKMS)
+	}
+}
+
+// encryptionHeaders returns the headers uploads need to send for the configured encryption.
+// Presigned URLs are signed with these headers, so clients have to send them verbatim.
+func (s *Service) encryptionHeaders() http.Header {
+	if s.S3Encryption == nil {
+		return nil
+	}
+
+	header := http.Header{}
+	s.S3Encryption.Marshal(header)
+
+	return header
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventBufferSize   = 64
+	eventKeepalive    = 30 * time.Second
+	eventPendingOpen  = "pending_closure.created"
+	eventPendingStop  = "pending_closure.aborted"
+	eventCommitted    = "closure.committed"
+	eventDeleted      = "closure.deleted"
+	eventPromoted     = "closure.promoted"
+	eventPendingClean = "pending_closures.cleaned"
+	eventPendingAbort = "pending_closures.aborted"
+	eventGCStarted    = "gc.started"
+	eventGCFinished   = "gc.finished"
+	eventGCSkipped    = "gc.skipped"
+)
+
+// Event describes a change in the cache that is streamed to subscribers of /api/events.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Closure string    `json:"closure,omitempty"`
+	// Name of the caller whose request caused the event.
+	Identity string         `json:"identity,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
+}
+
+// eventBroker fans out events to all subscribers. The zero value is ready to use.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func (b *eventBroker) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mu.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish never blocks: slow subscribers miss events instead of stalling the API.
+func (b *eventBroker) publish(event Event) {
+	event.Time = time.Now().UTC()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropping event for slow subscriber", "type", event.Type)
+		}
+	}
+}
+
+// publishEvent publishes an event on behalf of the caller of the request.
+func (s *Service) publishEvent(ctx context.Context, event Event) {
+	if identity, ok := IdentityFromContext(ctx); ok {
+		event.Identity = identity.Name
+	}
+
+	s.events.publish(event)
+}
+
+// eventInScope reports whether a subscriber may see an event. The shared API token sees all events,
+// other identities only the events caused by their own requests.
+func eventInScope(ctx context.Context, event Event) bool {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok || identity.Provider == identityProviderAPIToken {
+		return true
+	}
+
+	return event.Identity == identity.Name
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	return nil
+}
+
+// GET /api/events?types=closure.committed,gc.finished&closure=bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n
+// Response body: a Server-Sent Events stream, one JSON encoded Event per message.
+// types and closure optionally restrict the stream to the given event types and closure.
+// Callers authenticated with a client certificate only receive the events of their own requests.
+func (s *Service) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received events subscription", "method", r.Method, "url", r.URL)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	var types map[string]bool
+
+	if typesParam := r.URL.Query().Get("types"); typesParam != "" {
+		types = make(map[string]bool)
+		for _, t := range strings.Split(typesParam, ",") {
+			types[t] = true
+		}
+	}
+
+	closure := r.URL.Query().Get("closure")
+
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if types != nil && !types[event.Type] {
+				continue
+			}
+
+			if (closure != "" && event.Closure != closure) || !eventInScope(r.Context(), event) {
+				continue
+			}
+
+			if err := writeEvent(w, event); err != nil {
+				slog.WarnContext(r.Context(), "Failed to send event", "error", err)
+
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,177 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_EventsHandler(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(service.EventsHandler))
+	defer ts.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"?types=pending_closure.created", nil)
+	ok(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	ok(t, err)
+
+	defer resp.Body.Close()
+
+	closureKey := "00000000000000000000000000000000"
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": closureKey,
+		"objects": []string{closureKey + ".narinfo"},
+	})
+	ok(t, err)
+
+	testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+
+		var event server.Event
+		ok(t, json.Unmarshal([]byte(data), &event))
+
+		if event.Type != "pending_closure.created" || event.Closure != closureKey {
+			t.Errorf("unexpected event: %v", event)
+		}
+
+		return
+	}
+
+	t.Errorf("no event received: %v", scanner.Err())
+}
+
+// subscribeEvents opens an event stream on handler and returns a function that waits for the next event.
+func subscribeEvents(ctx context.Context, t *testing.T, handler http.HandlerFunc, query string) func() server.Event {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+query, nil)
+	ok(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	ok(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	return func() server.Event {
+		t.Helper()
+
+		for scanner.Scan() {
+			data, found := strings.CutPrefix(scanner.Text(), "data: ")
+			if !found {
+				continue
+			}
+
+			var event server.Event
+			ok(t, json.Unmarshal([]byte(data), &event))
+
+			return event
+		}
+
+		t.Fatalf("no event received: %v", scanner.Err())
+
+		return server.Event{}
+	}
+}
+
+func TestService_EventsHandlerClosureFilter(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	next := subscribeEvents(ctx, t, service.EventsHandler, "?types=closure.committed&closure="+b)
+
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+	pushClosure(t, service, b, map[string]string{b + ".narinfo": testNarInfo(b)})
+
+	if event := next(); event.Type != "closure.committed" || event.Closure != b {
+		t.Errorf("unexpected event: %v", event)
+	}
+}
+
+func TestService_EventsHandlerScope(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	withClientCert := func(name string, next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: name}}}},
+			}
+			service.AuthMiddleware(next)(w, r)
+		}
+	}
+
+	next := subscribeEvents(ctx, t, withClientCert("builder-a", service.EventsHandler), "?types=pending_closure.created")
+
+	// events of other identities are not streamed
+	for _, push := range []struct{ identity, closure string }{
+		{"builder-b", "00000000000000000000000000000000"},
+		{"builder-a", "11111111111111111111111111111111"},
+	} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": push.closure,
+			"objects": []string{push.closure + ".narinfo"},
+		})
+		ok(t, err)
+
+		testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: withClientCert(push.identity, service.CreatePendingClosureHandler),
+		})
+	}
+
+	event := next()
+	if event.Closure != "11111111111111111111111111111111" || event.Identity != "builder-a" {
+		t.Errorf("unexpected event: %v", event)
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+const (
+	endpointPrimary   = "primary"
+	endpointSecondary = "secondary"
+
+	failoverCheckInterval = 10 * time.Second
+	failoverCheckTimeout  = 5 * time.Second
+)
+
+// objectStore is a bucket together with the client to reach it.
+// Objects record the name of the store they were uploaded to.
+type objectStore struct {
+	name   string
+	client *minio.Client
+	bucket string
+	quirks s3Quirks
+}
+
+func (s *Service) primaryStore() objectStore {
+	return objectStore{name: endpointPrimary, client: s.MinioClient, bucket: s.BucketName, quirks: s.quirks}
+}
+
+func (s *Service) secondaryStore() objectStore {
+	return objectStore{
+		name:   endpointSecondary,
+		client: s.SecondaryMinioClient,
+		bucket: s.SecondaryBucketName,
+		quirks: s.secondaryQuirks,
+	}
+}
+
+// stores returns all configured stores, the primary first.
+func (s *Service) stores() []objectStore {
+	if s.SecondaryMinioClient == nil {
+		return []objectStore{s.primaryStore()}
+	}
+
+	return []objectStore{s.primaryStore(), s.secondaryStore()}
+}
+
+// store returns the store objects of the given endpoint were uploaded to.
+// Objects of a secondary that is no longer configured are looked up in the primary.
+func (s *Service) store(endpoint string) objectStore {
+	if endpoint == endpointSecondary && s.SecondaryMinioClient != nil {
+		return s.secondaryStore()
+	}
+
+	return s.primaryStore()
+}
+
+// uploadStore returns the store new objects are uploaded to: the secondary while the primary is down.
+func (s *Service) uploadStore() objectStore {
+	if s.SecondaryMinioClient != nil && s.primaryDown.Load() {
+		return s.secondaryStore()
+	}
+
+	return s.primaryStore()
+}
+
+// readStores returns the stores in the order reads should try them.
+func (s *Service) readStores() []objectStore {
+	stores := s.stores()
+	if len(stores) > 1 && s.primaryDown.Load() {
+		stores[0], stores[1] = stores[1], stores[0]
+	}
+
+	return stores
+}
+
+// getObject opens an object from the first store that has it.
+// Without a secondary, the object is opened lazily and errors surface on the first read.
+func (s *Service) getObject(ctx context.Context, key string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	if s.SecondaryMinioClient == nil {
+		return s.MinioClient.GetObject(ctx, s.BucketName, key, opts) //nolint:wrapcheck
+	}
+
+	var errs error
+
+	for _, store := range s.readStores() {
+		obj, err := store.client.GetObject(ctx, store.bucket, key, opts)
+		if err == nil {
+			if _, err = obj.Stat(); err == nil {
+				return obj, nil
+			}
+
+			obj.Close()
+		}
+
+		errs = errors.Join(errs, fmt.Errorf("%s: %w", store.name, err))
+	}
+
+	return nil, errs
+}
+
+// statObject returns the object info from the first store that has the object.
+func (s *Service) statObject(ctx context.Context, key string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	var errs error
+
+	for _, store := range s.readStores() {
+		storeOpts := opts
+		if store.quirks.noChecksumMode {
+			storeOpts.Checksum = false
+		}
+
+		info, err := store.client.StatObject(ctx, store.bucket, key, storeOpts)
+		if err == nil {
+			return info, nil
+		}
+
+		errs = errors.Join(errs, fmt.Errorf("%s: %w", store.name, err))
+	}
+
+	return minio.ObjectInfo{}, errs
+}
+
+// watchPrimary checks the primary store periodically, so that uploads and reads fail over
+// to the secondary while it is unreachable.
+func (s *Service) watchPrimary(ctx context.Context) {
+	ticker := time.NewTicker(failoverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, failoverCheckTimeout)
+		_, err := s.MinioClient.BucketExists(checkCtx, s.BucketName)
+
+		cancel()
+
+		if down := err != nil; s.primaryDown.Swap(down) != down {
+			if down {
+				slog.Error("Primary S3 endpoint is unreachable, failing over to secondary", "error", err)
+			} else {
+				slog.Info("Primary S3 endpoint is reachable again")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_secondaryReads(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.SecondaryMinioClient = service.MinioClient
+	service.SecondaryBucketName = testHarness.Minio.CreateBucket(t)
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	nar := "nar/" + a + ".nar.zst"
+
+	pushClosure(t, service, "prod", map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		nar:            "nar",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the nar only survived on the secondary
+	_, err := service.MinioClient.PutObject(ctx, service.SecondaryBucketName, nar,
+		bytes.NewBufferString("nar"), int64(len("nar")), minio.PutObjectOptions{})
+	ok(t, err)
+	ok(t, service.MinioClient.RemoveObject(ctx, service.BucketName, nar, minio.RemoveObjectOptions{}))
+
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/prod/verify",
+		handler:    service.VerifyClosureHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	var response server.VerifyClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if len(response.Missing) != 0 {
+		t.Errorf("expected objects to be found on the secondary, missing: %v", response.Missing)
+	}
+}
@@ -0,0 +1,168 @@
+//go:build faults
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultConfig describes the failures injected into requests, to test how clients handle them.
+// It is only available in builds with the faults build tag.
+type FaultConfig struct {
+	// Only requests whose path starts with this prefix are affected, all requests if empty.
+	PathPrefix string `json:"path_prefix"`
+	// Probability between 0 and 1 that a request fails with 503.
+	ErrorRate float64 `json:"error_rate"`
+	// Probability between 0 and 1 that the connection is closed after the request was handled,
+	// without sending the response, e.g. to lose the response of a commit that succeeded.
+	DropRate float64 `json:"drop_rate"`
+	// Delay before every affected request is handled.
+	Delay string `json:"delay"`
+	// Seed of the random faults, the same seed and requests fail the same way.
+	Seed int64 `json:"seed"`
+}
+
+type faultInjector struct {
+	mu     sync.Mutex
+	config FaultConfig
+	delay  time.Duration
+	rand   *rand.Rand
+}
+
+// faults are shared by all services of the process, the endpoint to configure them is /api/admin/faults.
+var faults = faultInjector{rand: rand.New(rand.NewSource(0))} //nolint:gosec
+
+func (f *faultInjector) set(config FaultConfig) error {
+	var delay time.Duration
+
+	if config.Delay != "" {
+		var err error
+		if delay, err = time.ParseDuration(config.Delay); err != nil {
+			return fmt.Errorf("invalid delay: %w", err)
+		}
+	}
+
+	if config.ErrorRate < 0 || config.ErrorRate > 1 || config.DropRate < 0 || config.DropRate > 1 {
+		return fmt.Errorf("error_rate and drop_rate must be between 0 and 1")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.config = config
+	f.delay = delay
+	f.rand = rand.New(rand.NewSource(config.Seed)) //nolint:gosec
+
+	return nil
+}
+
+// decide returns the delay and the faults of the next request to path.
+func (f *faultInjector) decide(path string) (time.Duration, bool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(path, f.config.PathPrefix) {
+		return 0, false, false
+	}
+
+	fail := f.rand.Float64() < f.config.ErrorRate
+	drop := f.rand.Float64() < f.config.DropRate
+
+	return f.delay, fail, drop
+}
+
+// FaultMiddleware injects the configured faults into all requests except those configuring them.
+func (s *Service) FaultMiddleware(next http.Handler) http.Handler {
+	slog.Warn("Fault injection is compiled in, configure it with /api/admin/faults")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/admin/faults" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		delay, fail, drop := faults.decide(r.URL.Path)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fail {
+			http.Error(w, "injected fault", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		if drop {
+			next.ServeHTTP(discardResponseWriter{header: http.Header{}}, r)
+
+			// closes the connection without a response
+			panic(http.ErrAbortHandler)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// discardResponseWriter lets a request be handled without sending its response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
+// PUT /api/admin/faults
+// Request body: a FaultConfig, e.g. {"path_prefix": "/api/pending_closures", "error_rate": 0.5, "seed": 1}
+// Response body: -
+// An empty object disables all faults.
+func (s *Service) SetFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received faults request", "method", r.Method, "url", r.URL)
+
+	config := FaultConfig{}
+	if !s.decodeRequest(w, r, &config) {
+		return
+	}
+
+	if err := faults.set(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/admin/faults
+// Response body: the current FaultConfig.
+func (s *Service) GetFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received faults request", "method", r.Method, "url", r.URL)
+
+	faults.mu.Lock()
+	config := faults.config
+	faults.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		slog.WarnContext(r.Context(), "Could not write faults response", "error", err)
+	}
+}
+
+func (s *Service) registerFaultRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/admin/faults", s.AuthMiddleware(s.GetFaultsHandler))
+	mux.HandleFunc("PUT /api/admin/faults", s.AuthMiddleware(s.SetFaultsHandler))
+}
@@ -0,0 +1,12 @@
+//go:build !faults
+
+package server
+
+import "net/http"
+
+// FaultMiddleware does nothing, fault injection is only compiled in with the faults build tag, see faults.go.
+func (s *Service) FaultMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+func (s *Service) registerFaultRoutes(*http.ServeMux) {}
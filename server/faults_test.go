@@ -0,0 +1,81 @@
+//go:build faults
+
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_FaultMiddleware(t *testing.T) {
+	service := createTestService(t)
+	defer service.Close()
+
+	handled := 0
+	handler := service.FaultMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		handled++
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	checkStatus := func(status int) *func(*testing.T, *httptest.ResponseRecorder) {
+		check := func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != status {
+				t.Errorf("expected status %d, got %d: %s", status, rr.Code, rr.Body.String())
+			}
+		}
+
+		return &check
+	}
+
+	testRequest(t, &TestRequest{
+		method:  "PUT",
+		path:    "/api/admin/faults",
+		body:    []byte(`{"path_prefix": "/api/pending_closures", "error_rate": 1}`),
+		handler: service.SetFaultsHandler,
+	})
+	defer testRequest(t, &TestRequest{
+		method:  "PUT",
+		path:    "/api/admin/faults",
+		body:    []byte(`{}`),
+		handler: service.SetFaultsHandler,
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures",
+		handler:       handler.ServeHTTP,
+		checkResponse: checkStatus(http.StatusServiceUnavailable),
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/api/closures",
+		handler:       handler.ServeHTTP,
+		checkResponse: checkStatus(http.StatusOK),
+	})
+
+	testRequest(t, &TestRequest{
+		method:  "PUT",
+		path:    "/api/admin/faults",
+		body:    []byte(`{"drop_rate": 1}`),
+		handler: service.SetFaultsHandler,
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler { //nolint:errorlint
+				t.Errorf("expected the response to be dropped, got %v", r)
+			}
+		}()
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/closures", nil))
+	}()
+
+	if handled != 2 {
+		t.Errorf("expected the dropped request to be handled, handled %d requests", handled)
+	}
+}
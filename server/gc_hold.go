@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// holds can't outlive this, so a forgotten hold doesn't disable garbage collection forever.
+const maxGCHoldTTL = 7 * 24 * time.Hour
+
+type CreateGCHoldRequest struct {
+	TTL    string `json:"ttl"`
+	Reason string `json:"reason"`
+}
+
+type GCHoldsResponse struct {
+	Holds []GCHold `json:"holds"`
+}
+
+// GCSkippedResponse is returned with 409 by DELETE /api/closures while garbage collection is on hold.
+type GCSkippedResponse struct {
+	Skipped bool     `json:"skipped"`
+	Holds   []GCHold `json:"holds"`
+}
+
+// POST /api/gc/hold
+// Request body:
+//
+//	{
+//	  "ttl": "2h",
+//	  "reason": "deploying release 24.11"
+//	}
+//
+// Response body:
+//
+//	{
+//	  "id": 1,
+//	  "reason": "deploying release 24.11",
+//	  "created_at": "2024-11-23T14:00:00Z",
+//	  "expires_at": "2024-11-23T16:00:00Z"
+//	}
+func (s *Service) CreateGCHoldHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received gc hold request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	req := &CreateGCHoldRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		http.Error(w, "failed to parse ttl: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if ttl < time.Second || ttl > maxGCHoldTTL {
+		http.Error(w, fmt.Sprintf("ttl must be between 1s and %s", maxGCHoldTTL), http.StatusBadRequest)
+
+		return
+	}
+
+	hold, err := createGCHold(r.Context(), s.Pool, req.Reason, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	if err = json.NewEncoder(w).Encode(hold); err != nil {
+		slog.WarnContext(r.Context(), "Could not write gc hold response", "error", err)
+	}
+}
+
+// DELETE /api/gc/hold/{id}
+// Request body: -
+// Response body: -.
+func (s *Service) ReleaseGCHoldHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received gc hold release request", "method", r.Method, "url", r.URL)
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	released, err := releaseGCHold(r.Context(), s.Pool, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if !released {
+		http.Error(w, "gc hold not found", http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/gc/holds
+// Response body:
+//
+//	{
+//	  "holds": [{"id": 1, "reason": "deploying release 24.11", ...}]
+//	}
+func (s *Service) GetGCHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received gc holds request", "method", r.Method, "url", r.URL)
+
+	holds, err := getActiveGCHolds(r.Context(), s.Pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(GCHoldsResponse{Holds: holds}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
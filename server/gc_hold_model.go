@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type GCHold struct {
+	ID        int64     `json:"id"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func gcHoldFromRow(row pg.GcHold) GCHold {
+	return GCHold{
+		ID:        row.ID,
+		Reason:    row.Reason,
+		CreatedAt: row.CreatedAt.Time,
+		ExpiresAt: row.ExpiresAt.Time,
+	}
+}
+
+func createGCHold(ctx context.Context, pool *pgxpool.Pool, reason string, ttl time.Duration) (*GCHold, error) {
+	row, err := pg.New(pool).InsertGCHold(ctx, pg.InsertGCHoldParams{
+		Reason:     reason,
+		TtlSeconds: int64(ttl.Seconds()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gc hold: %w", err)
+	}
+
+	hold := gcHoldFromRow(row)
+
+	return &hold, nil
+}
+
+// releaseGCHold deletes a hold and reports whether it existed.
+func releaseGCHold(ctx context.Context, pool *pgxpool.Pool, id int64) (bool, error) {
+	deleted, err := pg.New(pool).DeleteGCHold(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to release gc hold: %w", err)
+	}
+
+	return deleted > 0, nil
+}
+
+// getActiveGCHolds returns all holds that have not expired yet, the longest lasting first.
+func getActiveGCHolds(ctx context.Context, pool *pgxpool.Pool) ([]GCHold, error) {
+	rows, err := pg.New(pool).GetActiveGCHolds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gc holds: %w", err)
+	}
+
+	holds := make([]GCHold, 0, len(rows))
+	for _, row := range rows {
+		holds = append(holds, gcHoldFromRow(row))
+	}
+
+	return holds, nil
+}
+
+var errGCOnHold = errors.New("garbage collection was put on hold")
+
+// checkGCHolds returns errGCOnHold if a hold is active. Garbage collection checks again before every phase
+// and batch, so that a hold created during a run stops it before anything else is deleted.
+func checkGCHolds(ctx context.Context, queries *pg.Queries) error {
+	holds, err := queries.GetActiveGCHolds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get gc holds: %w", err)
+	}
+
+	if len(holds) > 0 {
+		return errGCOnHold
+	}
+
+	return nil
+}
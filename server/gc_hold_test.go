@@ -0,0 +1,67 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_gcHold(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/gc/hold",
+		body:    []byte(`{"ttl": "1h", "reason": "release"}`),
+		handler: service.CreateGCHoldHandler,
+	})
+
+	var hold server.GCHold
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &hold))
+
+	if hold.Reason != "release" || !hold.ExpiresAt.After(hold.CreatedAt) {
+		t.Errorf("unexpected gc hold: %+v", hold)
+	}
+
+	checkConflict := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:        "DELETE",
+		path:          "/api/closures?older-than=1h",
+		handler:       service.CleanupClosuresOlder,
+		checkResponse: &checkConflict,
+	})
+
+	var skipped server.GCSkippedResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &skipped))
+
+	if !skipped.Skipped || len(skipped.Holds) != 1 || skipped.Holds[0].ID != hold.ID {
+		t.Errorf("unexpected gc skipped response: %+v", skipped)
+	}
+
+	testRequest(t, &TestRequest{
+		method:     "DELETE",
+		path:       "/api/gc/hold/" + strconv.FormatInt(hold.ID, 10),
+		handler:    service.ReleaseGCHoldHandler,
+		pathValues: map[string]string{"id": strconv.FormatInt(hold.ID, 10)},
+	})
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=1h",
+		handler: service.CleanupClosuresOlder,
+	})
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type GroupResponse struct {
+	Name     string         `json:"name"`
+	Closures []GroupClosure `json:"closures"`
+}
+
+type DeleteGroupResponse struct {
+	// Deleted is the number of closures that were deleted, i.e. that no other root or remote root kept alive.
+	Deleted int64 `json:"deleted"`
+	// RemovedRoots is the number of closures removed from the group, deleted or not.
+	RemovedRoots int64 `json:"removed_roots"`
+	// Retained is the number of closures removed from the group that other roots or remote roots still keep alive.
+	Retained int64 `json:"retained"`
+}
+
+// GroupGCPreviewResponse is what deleting a group would free.
+type GroupGCPreviewResponse struct {
+	// Closures is the number of closures that no other root keeps alive.
+	Closures int64 `json:"closures"`
+	// Objects is the number of objects that only those closures reference.
+	Objects int64 `json:"objects"`
+	// Bytes is the size of those objects, not counting the UnknownSize objects without a recorded size.
+	Bytes       int64 `json:"bytes"`
+	UnknownSize int64 `json:"unknown_size"`
+}
+
+// GET /api/groups/{name}
+// Response body:
+//
+//	{
+//	  "name": "nixos-hosts",
+//	  "closures": [{"key": "host1", "updated_at": "2021-08-31T00:00:00Z", "created_by": "ci.example.com"}]
+//	}
+func (s *Service) GetGroupHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received get group request", "method", r.Method, "url", r.URL)
+
+	name := r.PathValue("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+
+		return
+	}
+
+	closures, err := getGroupClosures(r.Context(), s.Pool, name)
+	if err != nil {
+		http.Error(w, "failed to get group: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(GroupResponse{Name: name, Closures: closures}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// DELETE /api/groups/{name}?older-than=720h
+// Deletes the closures of a group, or only those not pushed to it within older-than.
+// Closures that were also pushed to another group or without a group are kept.
+// Response body:
+//
+//	{
+//	  "deleted": 2,
+//	  "removed_roots": 3,
+//	  "retained": 1
+//	}
+func (s *Service) DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received delete group request", "method", r.Method, "url", r.URL)
+
+	name := r.PathValue("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+
+		return
+	}
+
+	age := time.Duration(0)
+
+	if olderThan := r.URL.Query().Get("older-than"); olderThan != "" {
+		var err error
+
+		age, err = time.ParseDuration(olderThan)
+		if err != nil {
+			http.Error(w, "failed to parse age: "+err.Error(), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	resp, err := deleteGroupClosures(r.Context(), s.Pool, name, age)
+	if err != nil {
+		http.Error(w, "failed to delete group: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Deleted group closures", "group", name,
+		"deleted", resp.Deleted, "removed_roots", resp.RemovedRoots, "retained", resp.Retained)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// GET /api/groups/{name}/gc-preview
+// Shows what DELETE /api/groups/{name} would free, without deleting anything.
+// Response body:
+//
+//	{
+//	  "closures": 2,
+//	  "objects": 1234,
+//	  "bytes": 5368709120,
+//	  "unknown_size": 617
+//	}
+//
+// Only NARs with a FileHash and FileSize in their narinfo have a recorded size.
+func (s *Service) GetGroupGCPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received group gc preview request", "method", r.Method, "url", r.URL)
+
+	name := r.PathValue("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+
+		return
+	}
+
+	resp, err := getGroupGCPreview(r.Context(), s.Pool, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
@@ -0,0 +1,306 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_groupHandlers(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	for _, host := range []string{"host1", "host2"} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": host,
+			"group":   "nixos-hosts",
+			"objects": []string{"log/" + host + ".drv"},
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       fmt.Sprintf("/api/pending_closures/%s/complete", pendingClosureResponse.ID),
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/groups/nixos-hosts",
+		handler:    service.GetGroupHandler,
+		pathValues: map[string]string{"name": "nixos-hosts"},
+	})
+
+	var group server.GroupResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &group))
+
+	if len(group.Closures) != 2 || group.Closures[0].Key != "host1" {
+		t.Errorf("unexpected group closures: %v", group.Closures)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "DELETE",
+		path:       "/api/groups/nixos-hosts",
+		handler:    service.DeleteGroupHandler,
+		pathValues: map[string]string{"name": "nixos-hosts"},
+	})
+
+	var deleted server.DeleteGroupResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &deleted))
+
+	if deleted.Deleted != 2 {
+		t.Errorf("expected 2 deleted closures, got %d", deleted.Deleted)
+	}
+}
+
+func TestService_sharedGroupClosure(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	// the same closure pushed by two groups and once without a group
+	for _, group := range []string{"staging", "production", ""} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": "shared",
+			"group":   group,
+			"objects": []string{"log/shared.drv"},
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       fmt.Sprintf("/api/pending_closures/%s/complete", pendingClosureResponse.ID),
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	getClosure := func() server.ClosureResponse {
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/api/closures/shared",
+			handler:    service.GetClosureHandler,
+			pathValues: map[string]string{"key": "shared"},
+		})
+
+		var closure server.ClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+		return closure
+	}
+
+	if closure := getClosure(); closure.Roots != 3 {
+		t.Errorf("expected 3 roots, got %d", closure.Roots)
+	}
+
+	for _, group := range []string{"staging", "production"} {
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/api/groups/" + group,
+			handler:    service.GetGroupHandler,
+			pathValues: map[string]string{"name": group},
+		})
+
+		var resp server.GroupResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+		if len(resp.Closures) != 1 || resp.Closures[0].Key != "shared" {
+			t.Errorf("unexpected closures in group %s: %v", group, resp.Closures)
+		}
+	}
+
+	deleteGroup := func(group string) server.DeleteGroupResponse {
+		rr := testRequest(t, &TestRequest{
+			method:     "DELETE",
+			path:       "/api/groups/" + group,
+			handler:    service.DeleteGroupHandler,
+			pathValues: map[string]string{"name": group},
+		})
+
+		var deleted server.DeleteGroupResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &deleted))
+
+		return deleted
+	}
+
+	expected := server.DeleteGroupResponse{Deleted: 0, RemovedRoots: 1, Retained: 1}
+	if deleted := deleteGroup("staging"); deleted != expected {
+		t.Errorf("expected the closure to be retained, got %+v", deleted)
+	}
+
+	if closure := getClosure(); closure.Roots != 2 {
+		t.Errorf("expected 2 roots, got %d", closure.Roots)
+	}
+
+	// the ungrouped root still keeps the closure alive
+	if deleted := deleteGroup("production"); deleted != expected {
+		t.Errorf("expected the closure to be retained, got %+v", deleted)
+	}
+
+	if closure := getClosure(); closure.Roots != 1 || len(closure.Objects) != 1 {
+		t.Errorf("unexpected closure after deleting its groups: %+v", closure)
+	}
+}
+
+func TestService_groupRemoteRoot(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	for _, host := range []string{"web", "db"} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": host,
+			"group":   "hosts",
+			"objects": []string{"log/" + host + ".drv"},
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       fmt.Sprintf("/api/pending_closures/%s/complete", pendingClosureResponse.ID),
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	// web is the running system of a host
+	testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/roots",
+		body:    []byte(`{"name": "web1", "closure": "web", "ttl": "1h"}`),
+		handler: service.RegisterRemoteRootHandler,
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/groups/hosts/gc-preview",
+		handler:    service.GetGroupGCPreviewHandler,
+		pathValues: map[string]string{"name": "hosts"},
+	})
+
+	var preview server.GroupGCPreviewResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &preview))
+
+	if preview.Closures != 1 || preview.Objects != 1 {
+		t.Errorf("expected only db to be freed, got %+v", preview)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "DELETE",
+		path:       "/api/groups/hosts",
+		handler:    service.DeleteGroupHandler,
+		pathValues: map[string]string{"name": "hosts"},
+	})
+
+	var deleted server.DeleteGroupResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &deleted))
+
+	expected := server.DeleteGroupResponse{Deleted: 1, RemovedRoots: 2, Retained: 1}
+	if deleted != expected {
+		t.Errorf("expected the closure of the remote root to be retained, got %+v", deleted)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/roots",
+		handler: service.GetRemoteRootsHandler,
+	})
+
+	var roots server.RemoteRootsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &roots))
+
+	if len(roots.Roots) != 1 || roots.Roots[0].Closure != "web" {
+		t.Errorf("expected the remote root to survive the group deletion, got %+v", roots.Roots)
+	}
+}
+
+func TestService_GetGroupGCPreviewHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	push := func(closure, group string, objects ...string) {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": closure,
+			"group":   group,
+			"objects": objects,
+		})
+		ok(t, err)
+
+		rr := testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+
+		var pendingClosureResponse server.PendingClosureResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+		testRequest(t, &TestRequest{
+			method:     "POST",
+			path:       fmt.Sprintf("/api/pending_closures/%s/complete", pendingClosureResponse.ID),
+			handler:    service.CommitPendingClosureHandler,
+			pathValues: map[string]string{"id": pendingClosureResponse.ID},
+		})
+	}
+
+	push("release-1", "releases", "log/release-1.drv", "log/shared.drv")
+	push("release-2", "releases", "log/release-2.drv", "log/shared.drv")
+	// kept alive by its ungrouped push
+	push("release-2", "", "log/release-2.drv", "log/shared.drv")
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/groups/releases/gc-preview",
+		handler:    service.GetGroupGCPreviewHandler,
+		pathValues: map[string]string{"name": "releases"},
+	})
+
+	var preview server.GroupGCPreviewResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &preview))
+
+	expected := server.GroupGCPreviewResponse{Closures: 1, Objects: 1, Bytes: 0, UnknownSize: 1}
+	if preview != expected {
+		t.Errorf("expected %+v, got %+v", expected, preview)
+	}
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 )
 
+// HealthCheckHandler only reports that the process is alive. Use ReadinessHandler for load balancers.
+
 func (s *Service) HealthCheckHandler(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
@@ -13,3 +17,35 @@ func (s *Service) HealthCheckHandler(w http.ResponseWriter, _ *http.Request) {
 		slog.Warn("Could not write health check response", "error", err)
 	}
 }
+
+// checkReady reports whether the database and the bucket are reachable.
+func (s *Service) checkReady(ctx context.Context) error {
+	if err := s.Pool.Ping(ctx); err != nil {
+		return fmt.Errorf("database unavailable: %w", err)
+	}
+
+	// the server stays ready while it can fail over to the secondary
+	if err := s.checkS3(ctx); err != nil {
+		if s.SecondaryMinioClient == nil {
+			return fmt.Errorf("s3 unavailable: %w", err)
+		}
+
+		if err = checkStore(ctx, s.secondaryStore()); err != nil {
+			return fmt.Errorf("s3 unavailable on primary and secondary: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// GET /health/ready
+// Response body: "OK" if the database and the bucket are reachable, the error otherwise (status 503).
+func (s *Service) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkReady(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	s.HealthCheckHandler(w, r)
+}
@@ -1,6 +1,8 @@
 package server_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -19,3 +21,34 @@ func TestService_healthCheckHandler(t *testing.T) {
 		handler: service.HealthCheckHandler,
 	})
 }
+
+func TestService_readinessHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/health/ready",
+		handler: service.ReadinessHandler,
+	})
+
+	// unlike the health check, readiness depends on the database
+	service.Pool.Close()
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/health/ready",
+		handler:       service.ReadinessHandler,
+		checkResponse: &checkResponse,
+	})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/Mic92/niks3/server/storepath"
+)
+
+const hydraBuildFinished = "buildFinished"
+
+// HydraBuildNotification is the build description that Hydra's RunCommand plugin writes to $HYDRA_JSON.
+// Fields that niks3 does not use are ignored.
+type HydraBuildNotification struct {
+	Event       string             `json:"event"`
+	Build       int64              `json:"build"`
+	Finished    bool               `json:"finished"`
+	BuildStatus *int               `json:"buildStatus"`
+	Project     string             `json:"project"`
+	Jobset      string             `json:"jobset"`
+	Job         string             `json:"job"`
+	Outputs     []HydraBuildOutput `json:"outputs"`
+}
+
+type HydraBuildOutput struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type HydraNotifyResponse struct {
+	// Labels recorded on the closures of the outputs. Outputs that are pushed later should carry the same labels.
+	Labels map[string]string `json:"labels"`
+	// Closure keys of the outputs that were already in the cache and got labeled.
+	Labeled []string `json:"labeled"`
+	// Store paths of the outputs that are not in the cache yet.
+	Missing []string `json:"missing"`
+}
+
+// POST /api/hydra/notify
+// Accepts the build description of Hydra's RunCommand plugin, e.g. from
+//
+//	<runcommand>
+//	  job = *:*:*
+//	  command = curl -f -H "Authorization: Bearer $TOKEN" -d @$HYDRA_JSON https://cache.example.com/api/hydra/notify
+//	</runcommand>
+//
+// The closures of the outputs are labeled with the jobset, job and build, so that they can be kept
+// for a different duration with --gc-label-retention. Outputs that are not in the cache yet
+// are returned as missing, to be pushed with the returned labels.
+// Notifications of other events or failed builds are ignored with 204.
+// Request body:
+//
+//	{
+//	  "event": "buildFinished",
+//	  "build": 4711,
+//	  "finished": true,
+//	  "buildStatus": 0,
+//	  "project": "nixpkgs",
+//	  "jobset": "trunk",
+//	  "job": "hello.x86_64-linux",
+//	  "outputs": [{"name": "out", "path": "/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1"}]
+//	}
+//
+// Response body:
+//
+//	{
+//	  "labels": {"jobset": "nixpkgs:trunk", "job": "hello.x86_64-linux", "build": "4711"},
+//	  "labeled": ["bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n"],
+//	  "missing": []
+//	}
+func (s *Service) HydraNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received hydra notification", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	req := &HydraBuildNotification{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	if req.Event != hydraBuildFinished || !req.Finished || req.BuildStatus == nil || *req.BuildStatus != 0 {
+		slog.InfoContext(r.Context(), "Ignoring hydra notification", "event", req.Event, "build", req.Build)
+		w.WriteHeader(http.StatusNoContent)
+
+		return
+	}
+
+	if req.Project == "" || req.Jobset == "" || req.Job == "" || len(req.Outputs) == 0 {
+		http.Error(w, "missing project, jobset, job or outputs", http.StatusBadRequest)
+
+		return
+	}
+
+	storePaths := make([]string, 0, len(req.Outputs))
+
+	for _, output := range req.Outputs {
+		storePath, err := storepath.Parse(output.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if storePath.StoreDir != s.StoreDir {
+			http.Error(w, fmt.Sprintf("%s is outside of the store directory %s of the cache", output.Path, s.StoreDir),
+				http.StatusBadRequest)
+
+			return
+		}
+
+		storePaths = append(storePaths, output.Path)
+	}
+
+	resp, err := labelHydraOutputs(r.Context(), s.Pool, hydraLabels(req), storePaths)
+	if err != nil {
+		http.Error(w, "failed to label outputs: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		slog.WarnContext(r.Context(), "Could not write hydra response", "error", err)
+	}
+}
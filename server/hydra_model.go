@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// hydraLabels returns the labels of the closures built by a Hydra build.
+// The jobset includes its project, like Hydra names it in the web interface.
+func hydraLabels(notification *HydraBuildNotification) map[string]string {
+	return map[string]string{
+		"jobset": notification.Project + ":" + notification.Jobset,
+		"job":    notification.Job,
+		"build":  strconv.FormatInt(notification.Build, 10),
+	}
+}
+
+// labelHydraOutputs adds the labels to the closures of the given store paths.
+// A closure can be registered under the store path or its hash. Store paths without closure are returned as missing.
+func labelHydraOutputs(
+	ctx context.Context, pool *pgxpool.Pool, labels map[string]string, storePaths []string,
+) (*HydraNotifyResponse, error) {
+	encodedLabels, err := json.Marshal(labels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode labels: %w", err)
+	}
+
+	queries := pg.New(pool)
+	resp := &HydraNotifyResponse{Labels: labels, Labeled: []string{}, Missing: []string{}}
+
+	for _, storePath := range storePaths {
+		labeled := false
+
+		for _, candidate := range closureKeyCandidates(storePath) {
+			key, err := queries.MergeClosureLabels(ctx, pg.MergeClosureLabelsParams{Labels: encodedLabels, Key: candidate})
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to label closure: %w", err)
+			}
+
+			resp.Labeled = append(resp.Labeled, key)
+			labeled = true
+
+			break
+		}
+
+		if !labeled {
+			resp.Missing = append(resp.Missing, storePath)
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,129 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_HydraNotifyHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.LabelRetentions = []server.LabelRetention{
+		{Label: "jobset", Value: "nixpkgs:staging", Retention: time.Second},
+	}
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+	pushClosure(t, service, c, map[string]string{c + ".narinfo": testNarInfo(c)})
+
+	notify := func(buildStatus int, outputs ...string) *httptest.ResponseRecorder {
+		notification := server.HydraBuildNotification{
+			Event:       "buildFinished",
+			Build:       4711,
+			Finished:    true,
+			BuildStatus: &buildStatus,
+			Project:     "nixpkgs",
+			Jobset:      "staging",
+			Job:         "hello.x86_64-linux",
+		}
+		for _, output := range outputs {
+			notification.Outputs = append(notification.Outputs, server.HydraBuildOutput{Name: "out", Path: output})
+		}
+
+		body, err := json.Marshal(notification)
+		ok(t, err)
+
+		return testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/hydra/notify",
+			body:    body,
+			handler: service.HydraNotifyHandler,
+		})
+	}
+
+	// failed builds are not labeled
+	checkNoContent := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/hydra/notify",
+		body:          []byte(`{"event": "buildFinished", "finished": true, "buildStatus": 1}`),
+		handler:       service.HydraNotifyHandler,
+		checkResponse: &checkNoContent,
+	})
+
+	rr := notify(0, "/nix/store/"+a+"-hello-2.12.1", "/nix/store/"+b+"-hello-2.12.1-man")
+
+	var resp server.HydraNotifyResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+	missing := []string{"/nix/store/" + b + "-hello-2.12.1-man"}
+	if !reflect.DeepEqual(resp.Labeled, []string{a}) || !reflect.DeepEqual(resp.Missing, missing) {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + a,
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": a},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	expected := map[string]string{"jobset": "nixpkgs:staging", "job": "hello.x86_64-linux", "build": "4711"}
+	if !reflect.DeepEqual(closure.Labels, expected) {
+		t.Errorf("unexpected labels: %v", closure.Labels)
+	}
+
+	// the staging build expires with its label retention, the other closure is kept
+	time.Sleep(2 * time.Second)
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=1h",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	checkNotFound := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/api/closures/" + a,
+		handler:       service.GetClosureHandler,
+		pathValues:    map[string]string{"key": a},
+		checkResponse: &checkNotFound,
+	})
+
+	testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + c,
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": c},
+	})
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+)
+
+const (
+	identityProviderAPIToken   = "api-token"
+	identityProviderClientCert = "client-cert"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	// Name of the caller, e.g. the client certificate name. Requests authenticated
+	// with the shared API token all have the name "api-token".
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+}
+
+type identityContextKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns the caller attached to the request context by AuthMiddleware.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+
+	return identity, ok
+}
+
+// identityLogHandler adds the caller of the request to every record logged with its context.
+type identityLogHandler struct {
+	slog.Handler
+}
+
+func (h identityLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if identity, ok := IdentityFromContext(ctx); ok {
+		record.AddAttrs(slog.String("identity", identity.Name))
+	}
+
+	return h.Handler.Handle(ctx, record) //nolint:wrapcheck
+}
+
+func (h identityLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return identityLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h identityLogHandler) WithGroup(name string) slog.Handler {
+	return identityLogHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/Mic92/niks3/server/pg"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// bucketInventory is a snapshot of an existing bucket that was not populated by niks3.
+type bucketInventory struct {
+	keys        map[string]bool
+	narinfos    map[string]*NarInfo
+	unparseable []string
+}
+
+func (s *Service) listBucket(ctx context.Context) (*bucketInventory, error) {
+	inv := &bucketInventory{
+		keys:     make(map[string]bool),
+		narinfos: make(map[string]*NarInfo),
+	}
+
+	for obj := range s.MinioClient.ListObjects(ctx, s.BucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list bucket: %w", obj.Err)
+		}
+
+		inv.keys[obj.Key] = true
+
+		if !strings.HasSuffix(obj.Key, narinfoSuffix) || strings.Contains(obj.Key, "/") {
+			continue
+		}
+
+		info, err := s.fetchNarInfo(ctx, obj.Key)
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping unparseable narinfo", "key", obj.Key, "error", err)
+			inv.unparseable = append(inv.unparseable, obj.Key)
+
+			continue
+		}
+
+		inv.narinfos[obj.Key] = info
+
+		if len(inv.narinfos)%DeletionBatchSize == 0 {
+			slog.InfoContext(ctx, "Listing bucket", "objects", len(inv.keys), "narinfos", len(inv.narinfos))
+		}
+	}
+
+	return inv, nil
+}
+
+// objectsOf returns all objects in the bucket that belong to the given narinfo.
+func (inv *bucketInventory) objectsOf(key string) []string {
+	info := inv.narinfos[key]
+	hash := strings.TrimSuffix(key, narinfoSuffix)
+
+	candidates := []string{key, info.URL, hash + ".ls"}
+	if info.Deriver != "" {
+		candidates = append(candidates, "log/"+info.Deriver)
+	}
+
+	objects := make([]string, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		if inv.keys[candidate] {
+			objects = append(objects, candidate)
+		}
+	}
+
+	return objects
+}
+
+// closure returns all objects reachable from the given narinfo.
+func (inv *bucketInventory) closure(root string) []string {
+	visited := map[string]bool{root: true}
+	queue := []string{root}
+
+	var objects []string
+
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+
+		objects = append(objects, inv.objectsOf(key)...)
+
+		for _, ref := range inv.narinfos[key].References {
+			refKey := narInfoKey(ref)
+			if _, ok := inv.narinfos[refKey]; ok && !visited[refKey] {
+				visited[refKey] = true
+				queue = append(queue, refKey)
+			}
+		}
+	}
+
+	return objects
+}
+
+// roots returns all narinfos that are not referenced by any other narinfo.
+func (inv *bucketInventory) roots() []string {
+	referenced := make(map[string]bool, len(inv.narinfos))
+
+	for key, info := range inv.narinfos {
+		for _, ref := range info.References {
+			if refKey := narInfoKey(ref); refKey != key {
+				referenced[refKey] = true
+			}
+		}
+	}
+
+	roots := make([]string, 0)
+
+	for key := range inv.narinfos {
+		if !referenced[key] {
+			roots = append(roots, key)
+		}
+	}
+
+	return roots
+}
+
+func (s *Service) importClosure(ctx context.Context, closureKey string, objects []string) error {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	if err = queries.InsertObjects(ctx, objects); err != nil {
+		return fmt.Errorf("failed to insert objects: %w", err)
+	}
+
+	if err = queries.UpsertClosure(ctx, closureKey); err != nil {
+		return fmt.Errorf("failed to insert closure: %w", err)
+	}
+
+	if err = queries.DeleteClosureObjects(ctx, closureKey); err != nil {
+		return fmt.Errorf("failed to delete closure objects: %w", err)
+	}
+
+	err = queries.InsertClosureObjects(ctx, pg.InsertClosureObjectsParams{ClosureKey: closureKey, ObjectKeys: objects})
+	if err != nil {
+		return fmt.Errorf("failed to insert closure objects: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	committed = true
+
+	return nil
+}
+
+// ImportBucket registers the contents of a bucket that was populated without niks3, e.g. with `nix copy`.
+// Every narinfo that is not referenced by another narinfo becomes a closure.
+// If epoch is not empty, all objects are registered as a single closure with that key instead.
+func (s *Service) ImportBucket(ctx context.Context, epoch string) error {
+	inv, err := s.listBucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	closures := make(map[string][]string)
+
+	if epoch != "" {
+		for key := range inv.narinfos {
+			closures[epoch] = append(closures[epoch], inv.objectsOf(key)...)
+		}
+	} else {
+		for _, root := range inv.roots() {
+			closures[strings.TrimSuffix(root, narinfoSuffix)] = inv.closure(root)
+		}
+	}
+
+	tracked := make(map[string]bool, len(inv.keys))
+
+	for closureKey, objects := range closures {
+		if err = s.importClosure(ctx, closureKey, objects); err != nil {
+			return fmt.Errorf("failed to import closure '%s': %w", closureKey, err)
+		}
+
+		for _, object := range objects {
+			tracked[object] = true
+		}
+	}
+
+	queries := pg.New(s.Pool)
+
+	for key, info := range inv.narinfos {
+		if err = upsertNarInfo(ctx, queries, key, info); err != nil {
+			return err
+		}
+	}
+
+	alien := 0
+
+	for key := range inv.keys {
+		if !tracked[key] && !isCacheMetadata(key) {
+			slog.WarnContext(ctx, "Object does not belong to any narinfo", "key", key)
+
+			alien++
+		}
+	}
+
+	slog.InfoContext(ctx, "Imported bucket",
+		"objects", len(tracked),
+		"closures", len(closures),
+		"narinfos", len(inv.narinfos),
+		"unparseable", len(inv.unparseable),
+		"alien", alien)
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_ImportBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	objects := map[string]string{
+		a + ".narinfo":          testNarInfo(a, b),
+		b + ".narinfo":          testNarInfo(b),
+		"nar/" + a + ".nar.zst": "nar",
+		"nar/" + b + ".nar.zst": "nar",
+		"unrelated-file":        "alien",
+	}
+
+	for key, content := range objects {
+		_, err := service.MinioClient.PutObject(ctx, service.BucketName, key,
+			strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+		ok(t, err)
+	}
+
+	ok(t, service.ImportBucket(ctx, ""))
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + a,
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": a},
+	})
+
+	var closureResponse server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closureResponse))
+
+	if len(closureResponse.Objects) != 4 {
+		t.Errorf("expected 4 objects in imported closure, got %v", closureResponse.Objects)
+	}
+
+	// importing twice must not duplicate anything
+	ok(t, service.ImportBucket(ctx, ""))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a push may wait for a free slot before it is rejected.
+	pushQueueTimeout = 30 * time.Second
+	// suggested delay for clients that got rejected.
+	pushRetryAfter = 5 * time.Second
+)
+
+var errQueueFull = errors.New("too many pushes in progress")
+
+// concurrencyLimiter admits a limited number of requests at a time and queues the rest in arrival order.
+// The zero value is ready to use.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	active int
+	queue  []chan struct{}
+}
+
+// acquire waits for a free slot. A limit of zero disables the limiter.
+func (l *concurrencyLimiter) acquire(ctx context.Context, limit, maxQueue int) error {
+	l.mu.Lock()
+
+	if limit <= 0 || (l.active < limit && len(l.queue) == 0) {
+		l.active++
+		l.mu.Unlock()
+
+		return nil
+	}
+
+	if len(l.queue) >= maxQueue {
+		l.mu.Unlock()
+
+		return errQueueFull
+	}
+
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, pushQueueTimeout)
+	defer cancel()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	for i, waiter := range l.queue {
+		if waiter == ready {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			l.mu.Unlock()
+
+			return errQueueFull
+		}
+	}
+	l.mu.Unlock()
+
+	// we were handed a slot while giving up, pass it on
+	l.release()
+
+	return errQueueFull
+}
+
+// release hands the slot to the longest waiting request or frees it.
+func (l *concurrencyLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.queue) > 0 {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+
+		return
+	}
+
+	l.active--
+}
+
+func (l *concurrencyLimiter) stats() (active, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.active, len(l.queue)
+}
+
+// PushLimitMiddleware limits the number of concurrent requests to expensive push endpoints.
+// Requests that cannot be admitted get 429 with a Retry-After header.
+func (s *Service) PushLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.pushes.acquire(r.Context(), s.MaxConcurrentPushes, s.MaxQueuedPushes); err != nil {
+			active, queued := s.pushes.stats()
+			slog.Warn("Rejecting push", "url", r.URL, "active", active, "queued", queued)
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(pushRetryAfter.Seconds())))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+
+			return
+		}
+		defer s.pushes.release()
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_PushLimitMiddleware(t *testing.T) {
+	t.Parallel()
+
+	service := &server.Service{MaxConcurrentPushes: 1, MaxQueuedPushes: 0}
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	done := make(chan struct{})
+
+	blocking := service.PushLimitMiddleware(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-unblock
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	go func() {
+		defer close(done)
+
+		testRequest(t, &TestRequest{method: "POST", path: "/api/pending_closures", handler: blocking})
+	}()
+
+	<-started
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("expected status %d with Retry-After, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+	}
+
+	noop := service.PushLimitMiddleware(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures",
+		handler:       noop,
+		checkResponse: &checkResponse,
+	})
+
+	close(unblock)
+	<-done
+
+	// the slot is free again
+	testRequest(t, &TestRequest{method: "POST", path: "/api/pending_closures", handler: noop})
+}
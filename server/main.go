@@ -1,11 +1,20 @@
 package server
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mic92/niks3/server/storepath"
 )
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -20,30 +29,378 @@ const (
 	minAPITokenLength = 36
 )
 
-func parseArgs() (*Options, error) {
+// commandNeedsDB reports whether a subcommand connects to the database.
+func commandNeedsDB(command string) bool {
+	return command != "verify-bucket" && command != "s3-policy"
+}
+
+// commandNeedsS3Credentials reports whether a subcommand connects to S3. s3-policy only prints a policy.
+func commandNeedsS3Credentials(command string) bool {
+	return command != "s3-policy"
+}
+
+// commandNeedsAPIToken reports whether a subcommand serves the API.
+func commandNeedsAPIToken(command string) bool {
+	return command == "serve"
+}
+
+// parseArgs parses the flags of a subcommand. Only the flags that the subcommand uses are required.
+func parseArgs(command string, args []string) (*Options, error) {
 	var opts Options
 
 	s3AccessKeyPath := ""
 	s3SecretKeyPath := ""
+	s3SecondaryAccessKeyPath := ""
+	s3SecondarySecretKeyPath := ""
 	apiTokenPath := ""
+	signingKeyPath := ""
+	clientCertNames := ""
+	readClientAuth := ""
+	writeClientAuth := ""
+	publicKeys := ""
+	trustedKeys := ""
+	serveKeys := ""
+	identityKeys := ""
+	logRetention := ""
+	realisationRetention := ""
+	labelRetentions := ""
+	auditRetention := ""
+	downloadRetention := ""
+	maxConcurrentPushes := ""
+	maxQueuedPushes := ""
+	maxRequestBodySize := ""
+	maxClosureObjects := ""
+	maxNarinfoReferences := ""
+	readTimeout := ""
+	writeTimeout := ""
+	idleTimeout := ""
+	presignTimeout := ""
+	commitTimeout := ""
+	streamIdleTimeout := ""
+	narURLBase := ""
+	deletionPollInterval := ""
+	deletionWaitWindow := ""
+	deletionWaitTimeout := ""
+	logLevelName := ""
+	readAccess := ""
+	s3Encryption := ""
+	s3KMSKeyID := ""
 
 	flag.StringVar(&opts.DBConnectionString, "db", getEnvOrDefault("NIKS3_DB", ""),
 		"Postgres connection string, see https://pkg.go.dev/github.com/lib/pq#hdr-Connection_String_Parameters")
 	flag.StringVar(&opts.HTTPAddr, "http-addr", getEnvOrDefault("NIKS3_HTTP_ADDR", ":5751"), "HTTP address to listen on")
+	flag.StringVar(&opts.HTTPReadAddr, "http-read-addr", getEnvOrDefault("NIKS3_HTTP_READ_ADDR", ""),
+		"Address for the public read endpoints (/serve, /cache-info.json), defaults to -http-addr")
+	flag.StringVar(&opts.HTTPWriteAddr, "http-write-addr", getEnvOrDefault("NIKS3_HTTP_WRITE_ADDR", ""),
+		"Address for the authenticated /api endpoints, defaults to -http-addr")
+	flag.BoolVar(&opts.Stdio, "stdio", getEnvOrDefault("NIKS3_STDIO", "false") == "true",
+		"Serve HTTP on stdin and stdout instead of listening, e.g. as the forced command of an ssh key")
 	flag.StringVar(&opts.S3Endpoint, "s3-endpoint", getEnvOrDefault("NIKS3_S3_ENDPOINT", ""), "S3 endpoint")
 	flag.StringVar(&opts.S3AccessKey, "s3-access-key", getEnvOrDefault("NIKS3_S3_ACCESS_KEY", ""), "S3 access key")
 	flag.StringVar(&opts.S3SecretKey, "s3-secret-key", getEnvOrDefault("NIKS3_S3_SECRET_KEY", ""), "S3 secret key")
 	flag.BoolVar(&opts.S3UseSSL, "s3-use-ssl", getEnvOrDefault("NIKS3_S3_USE_SSL", "true") == "true", "Use SSL for S3")
 	flag.StringVar(&opts.S3BucketName, "s3-bucket-name", getEnvOrDefault("NIKS3_S3_BUCKET_NAME", ""), "S3 bucket name")
+	flag.StringVar(&opts.S3Region, "s3-region", getEnvOrDefault("NIKS3_S3_REGION", ""),
+		"Region of the S3 bucket, default: detected with an extra request")
+	flag.BoolVar(&opts.S3PathStyle, "s3-path-style", getEnvOrDefault("NIKS3_S3_PATH_STYLE", "false") == "true",
+		"Address the bucket as endpoint/bucket instead of bucket.endpoint, e.g. for Ceph RGW")
+	flag.StringVar(&opts.S3Backend, "s3-backend", getEnvOrDefault("NIKS3_S3_BACKEND", S3BackendAuto),
+		"S3 implementation, to avoid features it lacks: generic, r2 (Cloudflare R2) or gcs (Google Cloud Storage). "+
+			"auto detects r2 and gcs by the endpoint")
+	flag.StringVar(&s3Encryption, "s3-sse", getEnvOrDefault("NIKS3_S3_SSE", ""),
+		"Server-side encryption of uploaded objects: s3 (SSE-S3) or kms (SSE-KMS), default: bucket default")
+	flag.StringVar(&s3KMSKeyID, "s3-sse-kms-key-id", getEnvOrDefault("NIKS3_S3_SSE_KMS_KEY_ID", ""),
+		"KMS key ID for --s3-sse=kms, default: the AWS managed key")
+	flag.StringVar(&opts.S3SecondaryEndpoint, "s3-secondary-endpoint", getEnvOrDefault("NIKS3_S3_SECONDARY_ENDPOINT", ""),
+		"Secondary S3 endpoint to fail over to while the primary is unreachable")
+	flag.StringVar(&opts.S3SecondaryAccessKey, "s3-secondary-access-key",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_ACCESS_KEY", ""), "Secondary S3 access key")
+	flag.StringVar(&opts.S3SecondarySecretKey, "s3-secondary-secret-key",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_SECRET_KEY", ""), "Secondary S3 secret key")
+	flag.StringVar(&opts.S3SecondaryBackend, "s3-secondary-backend",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_BACKEND", S3BackendAuto), "S3 implementation of the secondary endpoint")
+	flag.StringVar(&opts.S3SecondaryBucketName, "s3-secondary-bucket-name",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_BUCKET_NAME", ""), "Secondary S3 bucket name, defaults to -s3-bucket-name")
 	flag.StringVar(&s3AccessKeyPath, "s3-access-key-path", getEnvOrDefault("NIKS3_S3_ACCESS_KEY_PATH", ""),
 		"Path to file containing S3 access key")
 	flag.StringVar(&s3SecretKeyPath, "s3-secret-key-path", getEnvOrDefault("NIKS3_S3_SECRET_KEY_PATH", ""),
 		"Path to file containing S3 secret key")
+	flag.StringVar(&s3SecondaryAccessKeyPath, "s3-secondary-access-key-path",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_ACCESS_KEY_PATH", ""), "Path to file containing secondary S3 access key")
+	flag.StringVar(&s3SecondarySecretKeyPath, "s3-secondary-secret-key-path",
+		getEnvOrDefault("NIKS3_S3_SECONDARY_SECRET_KEY_PATH", ""), "Path to file containing secondary S3 secret key")
 	flag.StringVar(&opts.APIToken, "api-token", getEnvOrDefault("NIKS3_API_TOKEN", ""), "API token for authentication")
 	flag.StringVar(&apiTokenPath, "api-token-path", getEnvOrDefault("NIKS3_API_TOKEN_PATH", ""), "API token file path")
-	flag.Parse()
+	flag.StringVar(&opts.TLSCertFile, "tls-cert", getEnvOrDefault("NIKS3_TLS_CERT", ""), "TLS certificate file")
+	flag.StringVar(&opts.TLSKeyFile, "tls-key", getEnvOrDefault("NIKS3_TLS_KEY", ""), "TLS private key file")
+	flag.StringVar(&opts.TLSClientCAFile, "tls-client-ca", getEnvOrDefault("NIKS3_TLS_CLIENT_CA", ""),
+		"CA bundle for client certificates that are accepted instead of the API token (requires --tls-cert)")
+	flag.StringVar(&readClientAuth, "tls-read-client-auth", getEnvOrDefault("NIKS3_TLS_READ_CLIENT_AUTH", ""),
+		"Client certificates on the read address: none, optional or require, default: optional with --tls-client-ca")
+	flag.StringVar(&writeClientAuth, "tls-write-client-auth", getEnvOrDefault("NIKS3_TLS_WRITE_CLIENT_AUTH", ""),
+		"Client certificates on the write address: none, optional or require, default: optional with --tls-client-ca")
+	flag.StringVar(&clientCertNames, "tls-client-names", getEnvOrDefault("NIKS3_TLS_CLIENT_NAMES", ""),
+		"Comma-separated list of client certificate names (CN or SAN) that are allowed, default: any")
+	flag.StringVar(&opts.StoreDir, "store-dir", getEnvOrDefault("NIKS3_STORE_DIR", storepath.DefaultStoreDir),
+		"Store directory of the cache, advertised in nix-cache-info and /cache-info.json")
+	flag.StringVar(&publicKeys, "public-keys", getEnvOrDefault("NIKS3_PUBLIC_KEYS", ""),
+		"Comma-separated list of public keys (name:base64) of the cache, advertised in /cache-info.json")
+	flag.StringVar(&narURLBase, "nar-url-base", getEnvOrDefault("NIKS3_NAR_URL_BASE", ""),
+		"Base URL of a CDN in front of the bucket, e.g. https://cdn.example.com/. Narinfos written by the server "+
+			"get absolute URL fields with it, advertised in /cache-info.json for clients to do the same")
+	flag.StringVar(&trustedKeys, "trusted-keys", getEnvOrDefault("NIKS3_TRUSTED_KEYS", ""),
+		"Comma-separated list of public keys (name:base64). If set, clients must sign narinfos with one of them")
+	flag.StringVar(&identityKeys, "identity-keys", getEnvOrDefault("NIKS3_IDENTITY_KEYS", ""),
+		"Comma-separated list of identity=key name that restricts which of --trusted-keys an identity "+
+			"(client certificate name or api-token) may sign with, e.g. team-a=team-a-1. Unlisted identities may use any")
+	flag.StringVar(&serveKeys, "serve-keys", getEnvOrDefault("NIKS3_SERVE_KEYS", ""),
+		"Comma-separated list of public keys (name:base64) that store paths served through /serve must be signed with, "+
+			"default: --public-keys and --trusted-keys")
+	flag.StringVar(&signingKeyPath, "signing-key-file", getEnvOrDefault("NIKS3_SIGNING_KEY_FILE", ""),
+		"Secret key (name:base64) to sign narinfos with when closures are promoted, and /cache-info.json")
+	flag.BoolVar(&opts.AllowUnsigned, "allow-unsigned", getEnvOrDefault("NIKS3_ALLOW_UNSIGNED", "false") == "true",
+		"Serve store paths through /serve even if they are not signed with one of --serve-keys. "+
+			"Not allowed with --trusted-keys")
+	flag.BoolVar(&opts.AllowMissingReferences, "allow-missing-references",
+		getEnvOrDefault("NIKS3_ALLOW_MISSING_REFERENCES", "false") == "true",
+		"Accept closures that reference store paths not in the cache, e.g. when dependencies come from an upstream cache")
+	flag.BoolVar(&opts.RequireFileHash, "require-file-hash",
+		getEnvOrDefault("NIKS3_REQUIRE_FILE_HASH", "false") == "true",
+		"Reject narinfos without FileHash and FileSize, for compatibility with nix 2.3")
+	flag.StringVar(&logRetention, "gc-log-retention", getEnvOrDefault("NIKS3_GC_LOG_RETENTION", "0s"),
+		"Delete build logs (log/*) this long after their last push, even if their closure is still alive, e.g. 336h")
+	flag.StringVar(&realisationRetention, "gc-realisation-retention",
+		getEnvOrDefault("NIKS3_GC_REALISATION_RETENTION", "0s"),
+		"Delete realisations (realisations/*) this long after their last push, even if their closure is still alive")
+	flag.StringVar(&labelRetentions, "gc-label-retention", getEnvOrDefault("NIKS3_GC_LABEL_RETENTION", ""),
+		"Comma-separated list of label=value=duration, closures with the label are deleted once they were not "+
+			"pushed for the duration, e.g. jobset=nixpkgs:staging=72h")
+	flag.StringVar(&auditRetention, "audit-retention", getEnvOrDefault("NIKS3_AUDIT_RETENTION", "0s"),
+		"Delete audit log entries after this duration during garbage collection, default: keep forever")
+	flag.StringVar(&downloadRetention, "download-retention", getEnvOrDefault("NIKS3_DOWNLOAD_RETENTION", "720h"),
+		"Delete recorded downloads through /serve after this duration during garbage collection, 0s keeps them forever")
+	flag.BoolVar(&opts.ReadOnly, "read-only", getEnvOrDefault("NIKS3_READ_ONLY", "false") == "true",
+		"Serve only read endpoints and don't migrate the database, e.g. when connected to a read replica")
+	flag.BoolVar(&opts.VerifyReads, "verify-reads", getEnvOrDefault("NIKS3_VERIFY_READS", "false") == "true",
+		"Compare NARs served through /serve with the size and sha256 recorded from their narinfo "+
+			"and report mismatches in the log and /api/admin/status")
+	flag.StringVar(&readAccess, "read-access", getEnvOrDefault("NIKS3_READ_ACCESS", ""),
+		"Comma-separated access of the read endpoints per object class (nar, log, cache-info): "+
+			"public, token or deny, e.g. log=token. Unlisted classes are public")
+	flag.StringVar(&maxConcurrentPushes, "max-concurrent-pushes", getEnvOrDefault("NIKS3_MAX_CONCURRENT_PUSHES", "0"),
+		"Maximum number of push requests (create, presign, commit, promote) processed at the same time, default: unlimited. "+
+			"Proxied uploads are not limited")
+	flag.StringVar(&maxQueuedPushes, "max-queued-pushes", getEnvOrDefault("NIKS3_MAX_QUEUED_PUSHES", "100"),
+		"Maximum number of push requests waiting for --max-concurrent-pushes, further requests get 429")
+	flag.StringVar(&maxRequestBodySize, "max-request-body-size",
+		getEnvOrDefault("NIKS3_MAX_REQUEST_BODY_SIZE", strconv.Itoa(defaultMaxRequestBodySize)),
+		"Maximum size in bytes of API request bodies, larger requests get 413, 0 disables the limit")
+	flag.StringVar(&maxClosureObjects, "max-closure-objects",
+		getEnvOrDefault("NIKS3_MAX_CLOSURE_OBJECTS", strconv.Itoa(defaultMaxClosureObjects)),
+		"Maximum number of objects in a single API request, larger requests get 422, 0 disables the limit")
+	flag.StringVar(&maxNarinfoReferences, "max-narinfo-references",
+		getEnvOrDefault("NIKS3_MAX_NARINFO_REFERENCES", strconv.Itoa(defaultMaxNarinfoReferences)),
+		"Maximum number of references of an uploaded narinfo, commits exceeding it get 422, 0 disables the limit")
+	flag.StringVar(&readTimeout, "read-timeout", getEnvOrDefault("NIKS3_READ_TIMEOUT", "1m"),
+		"Maximum duration for reading a request including its body")
+	flag.StringVar(&writeTimeout, "write-timeout", getEnvOrDefault("NIKS3_WRITE_TIMEOUT", "10m"),
+		"Maximum duration for writing a response, except for garbage collection, events and /serve downloads")
+	flag.StringVar(&idleTimeout, "idle-timeout", getEnvOrDefault("NIKS3_IDLE_TIMEOUT", "2m"),
+		"Maximum duration to keep idle keep-alive connections open")
+	flag.StringVar(&presignTimeout, "presign-timeout", getEnvOrDefault("NIKS3_PRESIGN_TIMEOUT", "2m"),
+		"Timeout for creating pending closures and upload URLs")
+	flag.StringVar(&commitTimeout, "commit-timeout", getEnvOrDefault("NIKS3_COMMIT_TIMEOUT", "5m"),
+		"Timeout for committing a pending closure")
+	flag.StringVar(&streamIdleTimeout, "stream-idle-timeout", getEnvOrDefault("NIKS3_STREAM_IDLE_TIMEOUT", "1m"),
+		"Abort /serve downloads and proxied uploads if the client stalls for this long")
+	flag.StringVar(&deletionPollInterval, "deletion-poll-interval",
+		getEnvOrDefault("NIKS3_DELETION_POLL_INTERVAL", "1s"),
+		"How often pushes of objects that are being deleted by garbage collection check whether the deletion finished")
+	flag.StringVar(&deletionWaitWindow, "deletion-wait-window", getEnvOrDefault("NIKS3_DELETION_WAIT_WINDOW", "30s"),
+		"Pushes wait for objects that garbage collection marked for deletion less than this long ago, "+
+			"older ones are uploaded again")
+	flag.StringVar(&deletionWaitTimeout, "deletion-wait-timeout", getEnvOrDefault("NIKS3_DELETION_WAIT_TIMEOUT", "1m"),
+		"Pushes still waiting for garbage collection after this long get 503, 0s waits until --presign-timeout")
+	flag.StringVar(&logLevelName, "log-level", getEnvOrDefault("NIKS3_LOG_LEVEL", "info"),
+		"Log level: debug, info, warn or error. debug includes the timing of each phase of push requests")
+	flag.StringVar(&opts.ImportEpoch, "import-epoch", getEnvOrDefault("NIKS3_IMPORT_EPOCH", ""),
+		"import-bucket: register all objects as a single closure with this key instead of one closure per root")
+	flag.StringVar(&opts.SnapshotOutput, "output", getEnvOrDefault("NIKS3_SNAPSHOT_OUTPUT", "-"),
+		"export-db: file to write the database snapshot to, - for stdout. "+
+			"Pending closures, the audit log and recorded downloads are not included")
+	flag.StringVar(&opts.SnapshotInput, "input", getEnvOrDefault("NIKS3_SNAPSHOT_INPUT", "-"),
+		"import-db: file to read the database snapshot from, - for stdin")
+	flag.BoolVar(&opts.ForceBucketPolicy, "force-bucket-policy",
+		getEnvOrDefault("NIKS3_FORCE_BUCKET_POLICY", "false") == "true",
+		"bootstrap: replace an existing bucket policy instead of adding the public read statement to it")
+
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, fmt.Errorf("failed to parse flags: %w", err)
+	}
+
+	var err error
+
+	if err = opts.LogLevel.UnmarshalText([]byte(logLevelName)); err != nil {
+		return nil, fmt.Errorf("invalid --log-level: %w", err)
+	}
+
+	if opts.LogRetention, err = time.ParseDuration(logRetention); err != nil {
+		return nil, fmt.Errorf("invalid --gc-log-retention: %w", err)
+	}
+
+	if opts.RealisationRetention, err = time.ParseDuration(realisationRetention); err != nil {
+		return nil, fmt.Errorf("invalid --gc-realisation-retention: %w", err)
+	}
+
+	if opts.LabelRetentions, err = parseLabelRetentions(labelRetentions); err != nil {
+		return nil, fmt.Errorf("invalid --gc-label-retention: %w", err)
+	}
+
+	if opts.AuditRetention, err = time.ParseDuration(auditRetention); err != nil {
+		return nil, fmt.Errorf("invalid --audit-retention: %w", err)
+	}
+
+	if opts.DownloadRetention, err = time.ParseDuration(downloadRetention); err != nil {
+		return nil, fmt.Errorf("invalid --download-retention: %w", err)
+	}
+
+	timeouts := []struct {
+		flag   string
+		value  string
+		target *time.Duration
+	}{
+		{"read-timeout", readTimeout, &opts.ReadTimeout},
+		{"write-timeout", writeTimeout, &opts.WriteTimeout},
+		{"idle-timeout", idleTimeout, &opts.IdleTimeout},
+		{"presign-timeout", presignTimeout, &opts.PresignTimeout},
+		{"commit-timeout", commitTimeout, &opts.CommitTimeout},
+		{"stream-idle-timeout", streamIdleTimeout, &opts.StreamIdleTimeout},
+		{"deletion-poll-interval", deletionPollInterval, &opts.DeletionPollInterval},
+		{"deletion-wait-window", deletionWaitWindow, &opts.DeletionWaitWindow},
+		{"deletion-wait-timeout", deletionWaitTimeout, &opts.DeletionWaitTimeout},
+	}
+
+	for _, timeout := range timeouts {
+		if *timeout.target, err = time.ParseDuration(timeout.value); err != nil {
+			return nil, fmt.Errorf("invalid --%s: %w", timeout.flag, err)
+		}
+	}
+
+	if opts.MaxConcurrentPushes, err = strconv.Atoi(maxConcurrentPushes); err != nil {
+		return nil, fmt.Errorf("invalid --max-concurrent-pushes: %w", err)
+	}
+
+	if opts.MaxQueuedPushes, err = strconv.Atoi(maxQueuedPushes); err != nil {
+		return nil, fmt.Errorf("invalid --max-queued-pushes: %w", err)
+	}
 
-	if opts.DBConnectionString == "" {
+	if opts.MaxRequestBodySize, err = strconv.ParseInt(maxRequestBodySize, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid --max-request-body-size: %w", err)
+	}
+
+	if opts.MaxClosureObjects, err = strconv.Atoi(maxClosureObjects); err != nil {
+		return nil, fmt.Errorf("invalid --max-closure-objects: %w", err)
+	}
+
+	if opts.MaxNarinfoReferences, err = strconv.Atoi(maxNarinfoReferences); err != nil {
+		return nil, fmt.Errorf("invalid --max-narinfo-references: %w", err)
+	}
+
+	if err = storepath.ValidateStoreDir(opts.StoreDir); err != nil {
+		return nil, fmt.Errorf("invalid --store-dir: %w", err)
+	}
+
+	if clientCertNames != "" {
+		opts.ClientCertNames = strings.Split(clientCertNames, ",")
+	}
+
+	if publicKeys != "" {
+		opts.PublicKeys = strings.Split(publicKeys, ",")
+	}
+
+	for _, key := range opts.PublicKeys {
+		if name, value, found := strings.Cut(key, ":"); !found || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid public key %q, expected name:base64", key)
+		}
+	}
+
+	if opts.NarURLBase, err = parseNarURLBase(narURLBase); err != nil {
+		return nil, fmt.Errorf("invalid --nar-url-base: %w", err)
+	}
+
+	if err = validateS3Backend(opts.S3Backend); err != nil {
+		return nil, fmt.Errorf("invalid --s3-backend: %w", err)
+	}
+
+	if err = validateS3Backend(opts.S3SecondaryBackend); err != nil {
+		return nil, fmt.Errorf("invalid --s3-secondary-backend: %w", err)
+	}
+
+	if opts.S3Encryption, err = parseServerSideEncryption(s3Encryption, s3KMSKeyID); err != nil {
+		return nil, fmt.Errorf("invalid --s3-sse: %w", err)
+	}
+
+	if opts.ReadAccess, err = parseReadAccess(readAccess); err != nil {
+		return nil, fmt.Errorf("invalid --read-access: %w", err)
+	}
+
+	if trustedKeys != "" {
+		if opts.TrustedKeys, err = parseTrustedKeys(strings.Split(trustedKeys, ",")); err != nil {
+			return nil, fmt.Errorf("invalid --trusted-keys: %w", err)
+		}
+	}
+
+	if opts.IdentityKeys, err = parseIdentityKeys(identityKeys, opts.TrustedKeys); err != nil {
+		return nil, fmt.Errorf("invalid --identity-keys: %w", err)
+	}
+
+	// served store paths must be signed by the cache or a trusted client unless keys are given explicitly
+	serveKeyList := slices.Clone(opts.PublicKeys)
+	if trustedKeys != "" {
+		serveKeyList = append(serveKeyList, strings.Split(trustedKeys, ",")...)
+	}
+
+	if serveKeys != "" {
+		serveKeyList = strings.Split(serveKeys, ",")
+	}
+
+	if opts.ServeKeys, err = parseTrustedKeys(serveKeyList); err != nil {
+		return nil, fmt.Errorf("invalid --serve-keys: %w", err)
+	}
+
+	// upload URLs outlive the verification at commit, so /serve has to verify again
+	if opts.AllowUnsigned && trustedKeys != "" {
+		return nil, errors.New("--allow-unsigned can't be combined with --trusted-keys")
+	}
+
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+
+	if opts.TLSClientCAFile != "" && opts.TLSCertFile == "" {
+		return nil, errors.New("--tls-client-ca requires --tls-cert and --tls-key")
+	}
+
+	if opts.TLSReadClientAuth, err = parseClientAuth(readClientAuth, opts.TLSClientCAFile); err != nil {
+		return nil, fmt.Errorf("invalid --tls-read-client-auth: %w", err)
+	}
+
+	if opts.TLSWriteClientAuth, err = parseClientAuth(writeClientAuth, opts.TLSClientCAFile); err != nil {
+		return nil, fmt.Errorf("invalid --tls-write-client-auth: %w", err)
+	}
+
+	// a single listener can only ask for client certificates in one way
+	if cmp.Or(opts.HTTPReadAddr, opts.HTTPAddr) == cmp.Or(opts.HTTPWriteAddr, opts.HTTPAddr) &&
+		opts.TLSReadClientAuth != opts.TLSWriteClientAuth {
+		return nil, errors.New("--tls-read-client-auth and --tls-write-client-auth differ, " +
+			"but --http-read-addr and --http-write-addr are the same")
+	}
+
+	if opts.ForceBucketPolicy && command != "bootstrap" {
+		return nil, errors.New("--force-bucket-policy can only be used with bootstrap")
+	}
+
+	if opts.DBConnectionString == "" && commandNeedsDB(command) {
 		return nil, errors.New("missing required flag: --db")
 	}
 
@@ -65,6 +422,24 @@ func parseArgs() (*Options, error) {
 		opts.S3SecretKey = string(secretKey)
 	}
 
+	if s3SecondaryAccessKeyPath != "" {
+		accessKey, err := os.ReadFile(s3SecondaryAccessKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secondary S3 access key file: %w", err)
+		}
+
+		opts.S3SecondaryAccessKey = string(accessKey)
+	}
+
+	if s3SecondarySecretKeyPath != "" {
+		secretKey, err := os.ReadFile(s3SecondarySecretKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secondary S3 secret key file: %w", err)
+		}
+
+		opts.S3SecondarySecretKey = string(secretKey)
+	}
+
 	if apiTokenPath != "" {
 		apiToken, err := os.ReadFile(apiTokenPath)
 		if err != nil {
@@ -74,40 +449,119 @@ func parseArgs() (*Options, error) {
 		opts.APIToken = string(apiToken)
 	}
 
+	if signingKeyPath != "" {
+		signingKey, err := os.ReadFile(signingKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key file: %w", err)
+		}
+
+		if opts.SigningKeyName, opts.SigningKey, err = parseSigningKey(string(signingKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.S3BucketName == "" {
+		return nil, errors.New("missing required flag: --s3-bucket-name")
+	}
+
+	if commandNeedsS3Credentials(command) {
+		if err := checkS3Credentials(&opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if commandNeedsAPIToken(command) {
+		if opts.APIToken == "" {
+			return nil, errors.New("missing required flag: --api-token or --api-token-path")
+		}
+
+		if len(opts.APIToken) < minAPITokenLength {
+			return nil, errors.New("API token must be at least 36 characters long")
+		}
+	}
+
+	return &opts, nil
+}
+
+func checkS3Credentials(opts *Options) error {
 	if opts.S3Endpoint == "" {
-		return nil, errors.New("missing required flag: --s3-endpoint")
+		return errors.New("missing required flag: --s3-endpoint")
 	}
 
 	if opts.S3AccessKey == "" {
-		return nil, errors.New("missing required flag: --s3-access-key or --s3-access-key-path")
+		return errors.New("missing required flag: --s3-access-key or --s3-access-key-path")
 	}
 
 	if opts.S3SecretKey == "" {
-		return nil, errors.New("missing required flag: --s3-secret-key or --s3-secret-key-path")
+		return errors.New("missing required flag: --s3-secret-key or --s3-secret-key-path")
 	}
 
-	if opts.S3BucketName == "" {
-		return nil, errors.New("missing required flag: --s3-bucket-name")
+	if opts.S3SecondaryEndpoint != "" && (opts.S3SecondaryAccessKey == "" || opts.S3SecondarySecretKey == "") {
+		return errors.New("--s3-secondary-endpoint requires secondary S3 access and secret keys")
 	}
 
-	if opts.APIToken == "" {
-		return nil, errors.New("missing required flag: --api-token or --api-token-path")
-	}
+	return nil
+}
 
-	if len(opts.APIToken) < minAPITokenLength {
-		return nil, errors.New("API token must be at least 36 characters long")
+// splitCommand returns the subcommand (if any) and the remaining flag arguments.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
 	}
 
-	return &opts, nil
+	return "serve", args
 }
 
 func Main() {
-	opts, err := parseArgs()
+	// log lines of authenticated requests carry the caller
+	logLevel := &slog.LevelVar{}
+	slog.SetDefault(slog.New(identityLogHandler{
+		slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}),
+	}))
+
+	command, args := splitCommand(os.Args[1:])
+
+	opts, err := parseArgs(command, args)
 	if err != nil {
 		log.Fatalf("Failed to parse args: %v", err)
 	}
 
-	if err := RunServer(opts); err != nil {
-		log.Fatalf("Failed to run gc service: %v", err)
+	logLevel.Set(opts.LogLevel)
+
+	switch command {
+	case "serve":
+		err = RunServer(opts)
+	case "backfill-narinfos":
+		err = RunCommand(opts, (*Service).BackfillNarInfos)
+	case "bootstrap":
+		err = RunCommand(opts, (*Service).Bootstrap)
+	case "reconcile-narinfos":
+		err = RunCommand(opts, (*Service).ReconcileNarInfos)
+	case "verify-references":
+		err = RunCommand(opts, (*Service).VerifyReferences)
+	case "verify-bucket":
+		err = RunBucketCommand(opts, func(s *Service, ctx context.Context) error {
+			return s.VerifyBucket(ctx, os.Stdout)
+		})
+	case "s3-policy":
+		err = WriteS3Policy(opts, os.Stdout)
+	case "import-bucket":
+		err = RunCommand(opts, func(s *Service, ctx context.Context) error {
+			return s.ImportBucket(ctx, opts.ImportEpoch)
+		})
+	case "export-db":
+		err = RunCommand(opts, func(s *Service, ctx context.Context) error {
+			return s.ExportDatabaseFile(ctx, opts.SnapshotOutput)
+		})
+	case "import-db":
+		err = RunCommand(opts, func(s *Service, ctx context.Context) error {
+			return s.ImportDatabaseFile(ctx, opts.SnapshotInput)
+		})
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to run %s: %v", command, err)
 	}
 }
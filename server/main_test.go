@@ -4,8 +4,12 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+
+	"github.com/Mic92/niks3/server/testsupport"
 )
 
+var testHarness *testsupport.Harness //nolint:gochecknoglobals
+
 func innerTestMain(m *testing.M) int {
 	var err error
 
@@ -15,23 +19,13 @@ func innerTestMain(m *testing.M) int {
 	os.Unsetenv("PGUSER")
 	os.Unsetenv("PGHOST")
 
-	testPostgresServer, err = startPostgresServer()
-	defer testPostgresServer.Cleanup()
-
-	if err != nil {
-		slog.Error("failed to start postgres", "error", err)
-
-		return 1
-	}
-
-	testMinioServer, err = startMinioServer()
-	defer testMinioServer.Cleanup()
-
+	testHarness, err = testsupport.Start()
 	if err != nil {
-		slog.Error("failed to start minio", "error", err)
+		slog.Error("failed to start test harness", "error", err)
 
 		return 1
 	}
+	defer testHarness.Cleanup()
 
 	return m.Run()
 }
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// incomplete multipart uploads younger than this are left alone by garbage collection.
+const defaultMultipartMinAge = 24 * time.Hour
+
+// abortStaleMultipartUploads aborts incomplete multipart uploads older than minAge,
+// e.g. of proxied uploads that were interrupted or whose pending closure was lost in a database restore.
+// Their parts are billed, but invisible to ListObjects and thus to the sweep of untracked objects.
+// Uploads of objects that a pending closure still waits for are kept.
+func (s *Service) abortStaleMultipartUploads(ctx context.Context, minAge time.Duration) (int, error) {
+	queries := pg.New(s.Pool)
+	cutoff := time.Now().Add(-minAge)
+	aborted := 0
+
+	for _, store := range s.stores() {
+		var stale []minio.ObjectMultipartInfo
+
+		for upload := range store.client.ListIncompleteUploads(ctx, store.bucket, "", true) {
+			// e.g. older R2 versions, whose incomplete uploads need an AbortIncompleteMultipartUpload lifecycle rule
+			if upload.Err != nil && minio.ToErrorResponse(upload.Err).Code == "NotImplemented" {
+				slog.WarnContext(ctx, "S3 backend can't list multipart uploads, not aborting stale ones",
+					"endpoint", store.name)
+
+				break
+			}
+
+			if upload.Err != nil {
+				return aborted, fmt.Errorf("failed to list multipart uploads of %s: %w", store.name, upload.Err)
+			}
+
+			if upload.Initiated.Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+
+		if len(stale) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(stale))
+		for _, upload := range stale {
+			keys = append(keys, upload.Key)
+		}
+
+		pendingKeys, err := queries.GetPendingKeys(ctx, keys)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to get pending keys: %w", err)
+		}
+
+		pending := make(map[string]bool, len(pendingKeys))
+		for _, key := range pendingKeys {
+			pending[key] = true
+		}
+
+		core := minio.Core{Client: store.client}
+
+		for _, upload := range stale {
+			if pending[upload.Key] {
+				continue
+			}
+
+			if err = core.AbortMultipartUpload(ctx, store.bucket, upload.Key, upload.UploadID); err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", upload.Key, err)
+			}
+
+			slog.InfoContext(ctx, "Aborted stale multipart upload", "key", upload.Key, "endpoint", store.name,
+				"initiated", upload.Initiated)
+
+			aborted++
+		}
+	}
+
+	return aborted, nil
+}
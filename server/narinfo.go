@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	minio "github.com/minio/minio-go/v7"
+)
+
+const (
+	narinfoSuffix = ".narinfo"
+
+	// maximum size of a narinfo we are willing to parse.
+	maxNarinfoSize = 1 << 20
+)
+
+// NarInfo is the parsed form of a .narinfo object.
+type NarInfo struct {
+	StorePath   string   `json:"store_path"`
+	URL         string   `json:"url"`
+	Compression string   `json:"compression"`
+	FileHash    string   `json:"file_hash,omitempty"`
+	FileSize    uint64   `json:"file_size,omitempty"`
+	NarHash     string   `json:"nar_hash"`
+	NarSize     uint64   `json:"nar_size"`
+	References  []string `json:"references"`
+	Deriver     string   `json:"deriver,omitempty"`
+	System      string   `json:"system,omitempty"`
+	Signatures  []string `json:"signatures"`
+	CA          string   `json:"ca,omitempty"`
+}
+
+// ParseNarInfo parses the key-value format used by nix for .narinfo files.
+func ParseNarInfo(r io.Reader) (*NarInfo, error) {
+	info := &NarInfo{
+		References: []string{},
+		Signatures: []string{},
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(r, maxNarinfoSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			return nil, fmt.Errorf("invalid narinfo line: %q", line)
+		}
+
+		var err error
+
+		switch key {
+		case "StorePath":
+			info.StorePath = value
+		case "URL":
+			info.URL = value
+		case "Compression":
+			info.Compression = value
+		case "FileHash":
+			info.FileHash = value
+		case "FileSize":
+			info.FileSize, err = strconv.ParseUint(value, 10, 64)
+		case "NarHash":
+			info.NarHash = value
+		case "NarSize":
+			info.NarSize, err = strconv.ParseUint(value, 10, 64)
+		case "References":
+			info.References = strings.Fields(value)
+		case "Deriver":
+			if value != "unknown-deriver" {
+				info.Deriver = value
+			}
+		case "System":
+			info.System = value
+		case "Sig":
+			info.Signatures = append(info.Signatures, value)
+		case "CA":
+			info.CA = value
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read narinfo: %w", err)
+	}
+
+	if info.StorePath == "" {
+		return nil, errors.New("narinfo is missing StorePath")
+	}
+
+	if info.URL == "" {
+		return nil, errors.New("narinfo is missing URL")
+	}
+
+	if info.NarHash == "" {
+		return nil, errors.New("narinfo is missing NarHash")
+	}
+
+	if info.Compression == "" {
+		// nix defaults to bzip2 if the field is missing
+		info.Compression = "bzip2"
+	}
+
+	return info, nil
+}
+
+// String formats the narinfo like nix does. Fields that ParseNarInfo doesn't know are lost.
+func (info *NarInfo) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "StorePath: %s\nURL: %s\nCompression: %s\n", info.StorePath, info.URL, info.Compression)
+
+	if info.FileHash != "" {
+		fmt.Fprintf(&b, "FileHash: %s\n", info.FileHash)
+	}
+
+	if info.FileSize != 0 {
+		fmt.Fprintf(&b, "FileSize: %d\n", info.FileSize)
+	}
+
+	fmt.Fprintf(&b, "NarHash: %s\nNarSize: %d\n", info.NarHash, info.NarSize)
+	fmt.Fprintf(&b, "References: %s\n", strings.Join(info.References, " "))
+
+	if info.Deriver != "" {
+		fmt.Fprintf(&b, "Deriver: %s\n", info.Deriver)
+	}
+
+	if info.System != "" {
+		fmt.Fprintf(&b, "System: %s\n", info.System)
+	}
+
+	for _, sig := range info.Signatures {
+		fmt.Fprintf(&b, "Sig: %s\n", sig)
+	}
+
+	if info.CA != "" {
+		fmt.Fprintf(&b, "CA: %s\n", info.CA)
+	}
+
+	return b.String()
+}
+
+func (s *Service) fetchNarInfo(ctx context.Context, key string) (*NarInfo, error) {
+	obj, err := s.getObject(ctx, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get narinfo '%s': %w", key, err)
+	}
+	defer obj.Close()
+
+	info, err := ParseNarInfo(obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse narinfo '%s': %w", key, err)
+	}
+
+	info.URL = s.narObjectKey(info.URL)
+
+	return info, nil
+}
+
+// parseNarURLBase validates --nar-url-base. The trailing slash is added if missing.
+func parseNarURLBase(rawURL string) (string, error) {
+	if rawURL == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("expected an absolute http or https url, got %q", rawURL)
+	}
+
+	if !strings.HasSuffix(rawURL, "/") {
+		rawURL += "/"
+	}
+
+	return rawURL, nil
+}
+
+// narObjectKey returns the object key of a narinfo URL, which is absolute if it was generated with --nar-url-base.
+func (s *Service) narObjectKey(rawURL string) string {
+	if s.NarURLBase == "" {
+		return rawURL
+	}
+
+	return strings.TrimPrefix(rawURL, s.NarURLBase)
+}
+
+// narURL returns the URL field of a narinfo for an object key, absolute with --nar-url-base.
+func (s *Service) narURL(key string) string {
+	return s.NarURLBase + key
+}
+
+func upsertNarInfo(ctx context.Context, queries *pg.Queries, key string, info *NarInfo) error {
+	err := queries.UpsertNarinfo(ctx, pg.UpsertNarinfoParams{
+		Key:         key,
+		StorePath:   info.StorePath,
+		Url:         info.URL,
+		Compression: info.Compression,
+		NarHash:     info.NarHash,
+		NarSize:     int64(info.NarSize), //nolint:gosec
+		Deriver:     pgtype.Text{String: info.Deriver, Valid: info.Deriver != ""},
+		Refs:        info.References,
+		Signatures:  info.Signatures,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store narinfo '%s': %w", key, err)
+	}
+
+	return storeObjectChecksum(ctx, queries, info)
+}
+
+// rewriteNarInfo uploads a changed narinfo to the store its object is in and updates its metadata.
+func (s *Service) rewriteNarInfo(
+	ctx context.Context,
+	queries *pg.Queries,
+	key string,
+	endpoint string,
+	info *NarInfo,
+) error {
+	// the URL is not part of the fingerprint, so rewriting it keeps the signatures valid
+	uploaded := *info
+	uploaded.URL = s.narURL(info.URL)
+
+	data := uploaded.String()
+	store := s.store(endpoint)
+
+	_, err := store.client.PutObject(ctx, store.bucket, key, strings.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "text/x-nix-narinfo", ServerSideEncryption: s.S3Encryption})
+	if err != nil {
+		return fmt.Errorf("failed to upload narinfo '%s' to %s: %w", key, store.name, err)
+	}
+
+	return upsertNarInfo(ctx, queries, key, info)
+}
+
+// storeNarInfos downloads the given narinfo objects and persists their metadata in the database.
+func (s *Service) storeNarInfos(ctx context.Context, keys []string) error {
+	queries := pg.New(s.Pool)
+
+	for _, key := range keys {
+		info, err := s.fetchNarInfo(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if err = upsertNarInfo(ctx, queries, key, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// narInfoKey returns the narinfo object key for a store path or store path basename.
+func narInfoKey(storePath string) string {
+	return storepath.HashPart(storePath) + narinfoSuffix
+}
+
+// BackfillNarInfos stores the metadata of all narinfo objects that are not yet in the narinfos table.
+func (s *Service) BackfillNarInfos(ctx context.Context) error {
+	queries := pg.New(s.Pool)
+
+	lastKey := ""
+	stored := 0
+	failed := 0
+
+	for {
+		keys, err := queries.GetNarinfoKeysWithoutMetadata(ctx, pg.GetNarinfoKeysWithoutMetadataParams{
+			Key:   lastKey,
+			Limit: DeletionBatchSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get narinfo keys: %w", err)
+		}
+
+		if len(keys) == 0 {
+			break
+		}
+
+		for _, key := range keys {
+			if err = s.storeNarInfos(ctx, []string{key}); err != nil {
+				slog.WarnContext(ctx, "Failed to backfill narinfo", "key", key, "error", err)
+
+				failed++
+
+				continue
+			}
+
+			stored++
+		}
+
+		lastKey = keys[len(keys)-1]
+
+		slog.InfoContext(ctx, "Backfilling narinfos", "stored", stored, "failed", failed)
+	}
+
+	slog.InfoContext(ctx, "Finished backfilling narinfos", "stored", stored, "failed", failed)
+
+	return nil
+}
+
+// getNarInfo returns the narinfo recorded in the database. It is read from S3 if fromS3 is set
+// or if the database has no record of it, e.g. because it was uploaded before niks3 recorded narinfos.
+func (s *Service) getNarInfo(ctx context.Context, key string, fromS3 bool) (*NarInfo, error) {
+	if !fromS3 {
+		row, err := pg.New(s.Pool).GetNarinfo(ctx, key)
+		if err == nil {
+			return narInfoFromRow(row), nil
+		}
+
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("failed to get narinfo '%s': %w", key, err)
+		}
+	}
+
+	return s.fetchNarInfo(ctx, key)
+}
+
+func narInfoFromRow(row pg.Narinfo) *NarInfo {
+	return &NarInfo{
+		StorePath:   row.StorePath,
+		URL:         row.Url,
+		Compression: row.Compression,
+		NarHash:     row.NarHash,
+		NarSize:     uint64(row.NarSize), //nolint:gosec
+		References:  row.Refs,
+		Deriver:     row.Deriver.String,
+		Signatures:  row.Signatures,
+	}
+}
+
+// GET /api/narinfo/{hash}
+// The hash part of a store path, or its base name.
+// Response body:
+//
+//	{
+//	  "store_path": "/nix/store/26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1",
+//	  "url": "nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz",
+//	  "compression": "xz",
+//	  "nar_hash": "sha256:1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp",
+//	  "nar_size": 226560,
+//	  "references": ["26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1"],
+//	  "signatures": ["cache.example.org-1:..."]
+//	}
+//
+// The narinfo is served from the database, which does not record file_hash, file_size, system and ca.
+// With ?source=s3, and for narinfos that the database has no record of, it is read from S3 with all fields.
+func (s *Service) GetNarInfoHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received narinfo request", "method", r.Method, "url", r.URL)
+
+	hash := storepath.HashPart(r.PathValue("hash"))
+	if err := storepath.ValidateHash(hash); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	info, err := s.getNarInfo(r.Context(), hash+narinfoSuffix, r.URL.Query().Get("source") == "s3")
+	if err != nil {
+		if isNoSuchKey(err) {
+			http.Error(w, "narinfo not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(info); err != nil {
+		slog.WarnContext(r.Context(), "Could not write narinfo response", "error", err)
+	}
+}
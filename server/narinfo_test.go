@@ -0,0 +1,206 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestParseNarInfo(t *testing.T) {
+	t.Parallel()
+
+	content := `StorePath: /nix/store/26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1
+URL: nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz
+Compression: xz
+FileHash: sha256:1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp
+FileSize: 50088
+NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80
+NarSize: 226560
+References: 26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1 sl141d1g77wvhr050ah87lcyz2czdxa3-glibc-2.40-36
+Deriver: w19cxz37j5nrkg8w80y91bga89310jgi-hello-2.12.1.drv
+Sig: cache.nixos.org-1:aaaa
+Sig: niks3-1:bbbb
+`
+
+	info, err := server.ParseNarInfo(strings.NewReader(content))
+	ok(t, err)
+
+	if info.StorePath != "/nix/store/26xbg1ndr7hbcncrlf9nhx5is2b25d13-hello-2.12.1" {
+		t.Errorf("unexpected store path: %s", info.StorePath)
+	}
+
+	if info.NarSize != 226560 || info.FileSize != 50088 {
+		t.Errorf("unexpected sizes: nar=%d file=%d", info.NarSize, info.FileSize)
+	}
+
+	if len(info.References) != 2 {
+		t.Errorf("expected 2 references, got %v", info.References)
+	}
+
+	if len(info.Signatures) != 2 {
+		t.Errorf("expected 2 signatures, got %v", info.Signatures)
+	}
+
+	_, err = server.ParseNarInfo(strings.NewReader("URL: nar/foo.nar\n"))
+	if err == nil {
+		t.Error("expected error for narinfo without StorePath")
+	}
+}
+
+func TestService_GetNarInfoHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo": testNarInfo(a, b),
+		b + ".narinfo": testNarInfo(b),
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/narinfo/" + a + "-pkg",
+		handler:    service.GetNarInfoHandler,
+		pathValues: map[string]string{"hash": a + "-pkg"},
+	})
+
+	var info server.NarInfo
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &info))
+
+	if info.StorePath != "/nix/store/"+a+"-pkg" || len(info.References) != 1 {
+		t.Errorf("unexpected narinfo: %+v", info)
+	}
+
+	// the object was replaced behind niks3's back, the recorded narinfo is served unless S3 is asked for
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	replaced := testNarInfo(a)
+	_, err := service.MinioClient.PutObject(ctx, service.BucketName, a+".narinfo",
+		strings.NewReader(replaced), int64(len(replaced)), minio.PutObjectOptions{})
+	ok(t, err)
+
+	for path, references := range map[string]int{
+		"/api/narinfo/" + a:                1,
+		"/api/narinfo/" + a + "?source=s3": 0,
+	} {
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       path,
+			handler:    service.GetNarInfoHandler,
+			pathValues: map[string]string{"hash": a},
+		})
+
+		var info server.NarInfo
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &info))
+
+		if len(info.References) != references {
+			t.Errorf("expected %d references from %s, got %+v", references, path, info)
+		}
+	}
+
+	for hash, status := range map[string]int{
+		"cccccccccccccccccccccccccccccccc": http.StatusNotFound,
+		"not-a-hash":                       http.StatusBadRequest,
+	} {
+		checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != status {
+				t.Errorf("expected status %d for %s, got %d: %s", status, hash, rr.Code, rr.Body.String())
+			}
+		}
+
+		testRequest(t, &TestRequest{
+			method:        "GET",
+			path:          "/api/narinfo/" + hash,
+			handler:       service.GetNarInfoHandler,
+			pathValues:    map[string]string{"hash": hash},
+			checkResponse: &checkResponse,
+		})
+	}
+}
+
+func TestService_narURLBase(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.NarURLBase = "https://cdn.example.com/"
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	absolute := func(narinfo string) string {
+		return strings.Replace(narinfo, "URL: nar/", "URL: "+service.NarURLBase+"nar/", 1)
+	}
+
+	clientPublicKey, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	pushClosure(t, service, "prod", map[string]string{
+		a + ".narinfo":          signNarInfo(t, absolute(testNarInfo(a, b)), "staging-1", clientKey),
+		b + ".narinfo":          signNarInfo(t, testNarInfo(b), "staging-1", clientKey),
+		"nar/" + a + ".nar.zst": "nar",
+		"nar/" + b + ".nar.zst": "nar",
+	})
+
+	// absolute URLs are mapped back to the keys of their objects
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/prod/verify",
+		handler:    service.VerifyClosureHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	var verified server.VerifyClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &verified))
+
+	if len(verified.Missing) != 0 || len(verified.Unreachable) != 0 {
+		t.Errorf("expected a complete closure, got %+v", verified)
+	}
+
+	// narinfos rewritten by the server, here signed on promotion, get absolute URLs
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.SigningKeyName = "production-1"
+	service.SigningKey = privateKey
+	service.TrustedKeys = map[string]ed25519.PublicKey{"staging-1": clientPublicKey}
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/closures/prod/promote",
+		body:       []byte(`{"group": "production"}`),
+		handler:    service.PromoteClosureHandler,
+		pathValues: map[string]string{"key": "prod"},
+	})
+
+	obj, err := service.MinioClient.GetObject(ctx, service.BucketName, a+".narinfo", minio.GetObjectOptions{})
+	ok(t, err)
+
+	defer obj.Close()
+
+	info, err := server.ParseNarInfo(obj)
+	ok(t, err)
+
+	if expected := service.NarURLBase + "nar/" + a + ".nar.zst"; info.URL != expected {
+		t.Errorf("expected URL %s, got %s", expected, info.URL)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultRefsDepth = 1
+	maxRefsDepth     = 64
+)
+
+type ObjectRef struct {
+	Key   string `json:"key"`
+	Depth int32  `json:"depth"`
+}
+
+type ObjectRefsResponse struct {
+	Key  string      `json:"key"`
+	Refs []ObjectRef `json:"refs"`
+}
+
+type refsQuery func(ctx context.Context, key string, depth int32) ([]ObjectRef, error)
+
+func (s *Service) serveObjectRefs(w http.ResponseWriter, r *http.Request, query refsQuery) {
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	depth := int64(defaultRefsDepth)
+
+	if depthParam := r.URL.Query().Get("depth"); depthParam != "" {
+		var err error
+
+		depth, err = strconv.ParseInt(depthParam, 10, 32)
+		if err != nil || depth < 1 || depth > maxRefsDepth {
+			http.Error(w, fmt.Sprintf("depth must be between 1 and %d", maxRefsDepth), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	refs, err := query(r.Context(), key, int32(depth))
+	if err != nil {
+		http.Error(w, "failed to get references: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(ObjectRefsResponse{Key: key, Refs: refs})
+	if err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// GET /api/objects/{key}/refs?depth=1
+// Response body:
+//
+//	{
+//	  "key": "26xbg1ndr7hbcncrlf9nhx5is2b25d13.narinfo",
+//	  "refs": [{"key": "sl141d1g77wvhr050ah87lcyz2czdxa3.narinfo", "depth": 1}]
+//	}
+func (s *Service) GetObjectRefsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received object refs request", "method", r.Method, "url", r.URL)
+
+	s.serveObjectRefs(w, r, s.getObjectRefs)
+}
+
+// GET /api/objects/{key}/referrers?depth=1
+// Response body: same as GET /api/objects/{key}/refs.
+func (s *Service) GetObjectReferrersHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received object referrers request", "method", r.Method, "url", r.URL)
+
+	s.serveObjectRefs(w, r, s.getObjectReferrers)
+}
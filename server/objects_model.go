@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/minio/minio-go/v7"
 )
@@ -14,66 +19,211 @@ const (
 	DeletionBatchSize = 1000
 )
 
+const (
+	// phases of the garbage collection that resume from a cursor when they were cut off by a deadline
+	gcPhaseMark        = "mark"
+	gcPhaseSweep       = "sweep"
+	gcPhaseSweepReport = "sweep-report"
+)
+
+// deadlinePassed reports whether a time-boxed garbage collection has to stop. A zero deadline never passes.
+func deadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// getGCCursor returns the last key a phase has processed, or an empty string to start from the beginning.
+func getGCCursor(ctx context.Context, queries *pg.Queries, phase string) (string, error) {
+	cursor, err := queries.GetGCCursor(ctx, phase)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get gc cursor: %w", err)
+	}
+
+	return cursor, nil
+}
+
+// markObjectsForDeletion marks a batch of unreferenced objects as deleted.
+// Pushes hold shared advisory locks on the objects they rely on, so we only mark objects
+// whose lock we can take and re-check them afterwards, while concurrent pushes wait for us.
+// Batches are taken in key order after the cursor of the mark phase, which is advanced in the same transaction.
+// It returns the last key of the batch, or true once the last batch was marked.
+func markObjectsForDeletion(
+	ctx context.Context, pool *pgxpool.Pool,
+) ([]pg.MarkObjectsForDeletionRow, string, bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	if err = checkGCHolds(ctx, queries); err != nil {
+		return nil, "", false, err
+	}
+
+	var after string
+
+	if after, err = getGCCursor(ctx, queries, gcPhaseMark); err != nil {
+		return nil, "", false, err
+	}
+
+	var candidates []pg.LockStaleObjectsRow
+
+	candidates, err = queries.LockStaleObjects(ctx, pg.LockStaleObjectsParams{After: after, Limit: DeletionBatchSize})
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to lock stale objects: %w", err)
+	}
+
+	locked := make([]string, 0, len(candidates))
+
+	for _, candidate := range candidates {
+		if candidate.Locked {
+			locked = append(locked, candidate.Key)
+		}
+	}
+
+	var marked []pg.MarkObjectsForDeletionRow
+
+	if marked, err = queries.MarkObjectsForDeletion(ctx, locked); err != nil {
+		return nil, "", false, fmt.Errorf("failed to mark objects: %w", err)
+	}
+
+	done := len(candidates) < DeletionBatchSize
+	lastKey := ""
+
+	if done {
+		err = queries.DeleteGCCursor(ctx, gcPhaseMark)
+	} else {
+		lastKey = candidates[len(candidates)-1].Key
+		err = queries.SetGCCursor(ctx, pg.SetGCCursorParams{Phase: gcPhaseMark, LastKey: lastKey})
+	}
+
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to update gc cursor: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, "", false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	committed = true
+
+	return marked, lastKey, done, nil
+}
+
+// getObjectsForDeletion sends the marked objects to the channel of the endpoint they were uploaded to.
+// It stops marking further batches once the deadline passed and sets done once all batches were marked.
+// A run that resumes from the cursor of a run that was cut off wraps around to the keys before the cursor,
+// so that done is only set once every key was visited.
 func getObjectsForDeletion(ctx context.Context,
 	pool *pgxpool.Pool,
-	objectCh chan<- minio.ObjectInfo,
-	s3Error *error,
+	deadline time.Time,
+	objectChs map[string]chan minio.ObjectInfo,
+	s3Failed *atomic.Bool,
+	done *bool,
 	queryErr *error,
 ) {
-	defer close(objectCh)
+	defer func() {
+		for _, objectCh := range objectChs {
+			close(objectCh)
+		}
+	}()
 
 	queries := pg.New(pool)
 
-	for {
-		if *s3Error != nil {
-			break
-		}
+	start, err := getGCCursor(ctx, queries, gcPhaseMark)
+	if err != nil {
+		*queryErr = err
+
+		return
+	}
+
+	wrapped := start == ""
 
-		objs, err := queries.MarkObjectsForDeletion(ctx, DeletionBatchSize)
+	// every run marks at least one batch, so that it makes progress even with a short deadline
+	for !*done && !s3Failed.Load() {
+		objs, lastKey, lastBatch, err := markObjectsForDeletion(ctx, pool)
 		if err != nil {
 			*queryErr = fmt.Errorf("failed to mark objects for deletion: %w", err)
-			slog.Error("failed to mark objects for deletion", "error", err)
+			slog.ErrorContext(ctx, "failed to mark objects for deletion", "error", err)
 
 			break
 		}
 
-		if len(objs) == 0 {
-			break
+		for _, obj := range objs {
+			objectCh, ok := objectChs[obj.Endpoint]
+			if !ok {
+				objectCh = objectChs[endpointPrimary]
+			}
+
+			objectCh <- minio.ObjectInfo{Key: obj.Key}
 		}
 
-		for _, obj := range objs {
-			objectCh <- minio.ObjectInfo{Key: obj}
+		switch {
+		case lastBatch && !wrapped:
+			// continue from the beginning up to the key this run started after
+			wrapped = true
+		case lastBatch:
+			*done = true
+		case start != "" && wrapped && lastKey >= start:
+			// the keys after start were visited before wrapping around
+			if err = queries.DeleteGCCursor(ctx, gcPhaseMark); err != nil {
+				*queryErr = fmt.Errorf("failed to reset gc cursor: %w", err)
+
+				return
+			}
+
+			*done = true
+		}
+
+		if deadlinePassed(deadline) {
+			break
 		}
 	}
 }
 
 func (s *Service) removeS3Objects(ctx context.Context,
 	pool *pgxpool.Pool,
+	store objectStore,
 	objectCh <-chan minio.ObjectInfo,
 	s3Error *error,
+	s3Failed *atomic.Bool,
 ) {
+	// stops getObjectsForDeletion from marking further objects
+	fail := func(err error) {
+		*s3Error = err
+		s3Failed.Store(true)
+	}
+
 	opts := minio.RemoveObjectsOptions{GovernanceBypass: false}
 	failedKeys := make([]string, 0, DeletionBatchSize)
 	deletedKeys := make([]string, 0, DeletionBatchSize)
 
 	queries := pg.New(pool)
 
-	for result := range s.MinioClient.RemoveObjectsWithResult(ctx, s.BucketName, objectCh, opts) {
+	for result := range store.client.RemoveObjectsWithResult(ctx, store.bucket, objectCh, opts) {
 		// if the object was not found, we can ignore it
 		if result.Err != nil {
 			if minio.ToErrorResponse(result.Err).Code == "NoSuchKey" {
 				continue
 			}
 
-			*s3Error = fmt.Errorf("failed to remove object '%s': %w", result.ObjectName, result.Err)
-			slog.Error("failed to remove object", "object", result.ObjectName, "error", s3Error)
+			fail(fmt.Errorf("failed to remove object '%s': %w", result.ObjectName, result.Err))
+			slog.ErrorContext(ctx, "failed to remove object", "object", result.ObjectName, "error", result.Err)
 			failedKeys = append(failedKeys, result.ObjectName)
 
 			if len(failedKeys) >= DeletionBatchSize {
 				err := queries.MarkObjectsAsActive(ctx, failedKeys)
 				if err != nil {
-					slog.Error("failed to mark objects as active", "error", err)
-					*s3Error = fmt.Errorf("failed to mark objects as active: %w", err)
+					slog.ErrorContext(ctx, "failed to mark objects as active", "error", err)
+					fail(fmt.Errorf("failed to mark objects as active: %w", err))
 				}
 
 				failedKeys = failedKeys[:0]
@@ -87,8 +237,8 @@ func (s *Service) removeS3Objects(ctx context.Context,
 		if len(deletedKeys) >= DeletionBatchSize {
 			err := queries.DeleteObjects(ctx, deletedKeys)
 			if err != nil {
-				slog.Error("failed to mark objects as deleted", "error", err)
-				*s3Error = fmt.Errorf("failed to mark objects as deleted: %w", err)
+				slog.ErrorContext(ctx, "failed to mark objects as deleted", "error", err)
+				fail(fmt.Errorf("failed to mark objects as deleted: %w", err))
 			}
 
 			deletedKeys = deletedKeys[:0]
@@ -98,37 +248,293 @@ func (s *Service) removeS3Objects(ctx context.Context,
 	if len(failedKeys) > 0 {
 		err := queries.MarkObjectsAsActive(ctx, failedKeys)
 		if err != nil {
-			*s3Error = fmt.Errorf("failed to mark objects as active: %w", err)
+			fail(fmt.Errorf("failed to mark objects as active: %w", err))
 		}
 	}
 
 	if len(deletedKeys) > 0 {
 		err := queries.DeleteObjects(ctx, deletedKeys)
 		if err != nil {
-			*s3Error = fmt.Errorf("failed to mark objects as deleted: %w", err)
+			fail(fmt.Errorf("failed to mark objects as deleted: %w", err))
 		}
 	}
 }
 
-func (s *Service) cleanupOrphanObjects(ctx context.Context, pool *pgxpool.Pool) error {
+// cleanupOrphanObjects deletes all objects that no closure references anymore.
+// With a non-zero deadline, it returns false if it stopped before all objects were processed.
+func (s *Service) cleanupOrphanObjects(ctx context.Context, pool *pgxpool.Pool, deadline time.Time) (bool, error) {
+	stores := s.stores()
+
 	// limit channel size to 1000, as minio limits to 1000 in one request
-	objectCh := make(chan minio.ObjectInfo, DeletionBatchSize)
+	objectChs := make(map[string]chan minio.ObjectInfo, len(stores))
+	for _, store := range stores {
+		objectChs[store.name] = make(chan minio.ObjectInfo, DeletionBatchSize)
+	}
 
 	var queryErr error
 
-	var s3Error error
+	var s3Failed atomic.Bool
 
-	go getObjectsForDeletion(ctx, pool, objectCh, &s3Error, &queryErr)
+	done := false
 
-	s.removeS3Objects(ctx, pool, objectCh, &s3Error)
+	go getObjectsForDeletion(ctx, pool, deadline, objectChs, &s3Failed, &done, &queryErr)
+
+	s3Errors := make([]error, len(stores))
+
+	var wg sync.WaitGroup
+
+	for i, store := range stores {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			s.removeS3Objects(ctx, pool, store, objectChs[store.name], &s3Errors[i], &s3Failed)
+		}()
+	}
+
+	wg.Wait()
 
 	if queryErr != nil {
-		return queryErr
+		return false, queryErr
+	}
+
+	if err := errors.Join(s3Errors...); err != nil {
+		return false, err
+	}
+
+	return done, nil
+}
+
+// getObjectRefs returns the narinfos referenced by the given narinfo, up to the given depth.
+func (s *Service) getObjectRefs(ctx context.Context, key string, depth int32) ([]ObjectRef, error) {
+	rows, err := pg.New(s.Pool).GetObjectRefs(ctx, pg.GetObjectRefsParams{Key: key, MaxDepth: depth})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object refs: %w", err)
+	}
+
+	refs := make([]ObjectRef, 0, len(rows))
+	for _, row := range rows {
+		refs = append(refs, ObjectRef{Key: row.Key, Depth: row.Depth})
+	}
+
+	return refs, nil
+}
+
+// getObjectReferrers returns the narinfos referencing the given narinfo, up to the given depth.
+func (s *Service) getObjectReferrers(ctx context.Context, key string, depth int32) ([]ObjectRef, error) {
+	rows, err := pg.New(s.Pool).GetObjectReferrers(ctx, pg.GetObjectReferrersParams{Key: key, MaxDepth: depth})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object referrers: %w", err)
+	}
+
+	refs := make([]ObjectRef, 0, len(rows))
+	for _, row := range rows {
+		refs = append(refs, ObjectRef{Key: row.Key, Depth: row.Depth})
+	}
+
+	return refs, nil
+}
+
+func removeKeys(ctx context.Context, store objectStore, keys []string) error {
+	objectCh := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		objectCh <- minio.ObjectInfo{Key: key}
+	}
+
+	close(objectCh)
+
+	var removeErr error
+
+	for result := range store.client.RemoveObjectsWithResult(ctx, store.bucket, objectCh, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil && minio.ToErrorResponse(result.Err).Code != "NoSuchKey" {
+			slog.ErrorContext(ctx, "failed to remove object",
+				"object", result.ObjectName, "store", store.name, "error", result.Err)
+			removeErr = fmt.Errorf("failed to remove object '%s': %w", result.ObjectName, result.Err)
+		}
+	}
+
+	return removeErr
+}
+
+// removeUntrackedKeys returns the keys that are still untracked once their advisory locks are taken
+// and, unless dryRun is set, removes them from the store.
+// Pushes hold shared locks on the objects of the pending closures they create, so keys locked by a push
+// are skipped, and a push that starts while the keys are removed waits until they are gone.
+func (s *Service) removeUntrackedKeys(
+	ctx context.Context, store objectStore, keys []string, dryRun bool,
+) ([]string, error) {
+	tx, err := s.Pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	if !dryRun {
+		if err = checkGCHolds(ctx, queries); err != nil {
+			return nil, err
+		}
+	}
+
+	var locked, untracked []string
+
+	if locked, err = queries.TryLockObjects(ctx, keys); err != nil {
+		return nil, fmt.Errorf("failed to lock objects: %w", err)
+	}
+
+	// a separate statement sees the pending closures that were committed before we got the locks
+	if untracked, err = queries.GetUntrackedKeys(ctx, locked); err != nil {
+		return nil, fmt.Errorf("failed to get untracked keys: %w", err)
+	}
+
+	if !dryRun && len(untracked) > 0 {
+		if err = removeKeys(ctx, store, untracked); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	committed = true
+
+	return untracked, nil
+}
+
+// sweepUntrackedObjects finds objects in the buckets of all stores that are unknown to the database,
+// i.e. left behind by failed uploads or written before niks3 managed the bucket.
+// Objects younger than minAge are skipped, as they might belong to uploads that are not tracked yet.
+// The nix-cache-info and cache-info.json files of the cache are never swept.
+// Unless dryRun is set, untracked objects are deleted.
+// It returns false as second value if the deadline passed before every bucket was listed.
+func (s *Service) sweepUntrackedObjects(
+	ctx context.Context, minAge time.Duration, dryRun bool, deadline time.Time,
+) (int, bool, error) {
+	found := 0
+
+	for _, store := range s.stores() {
+		untracked, complete, err := s.sweepStore(ctx, store, minAge, dryRun, deadline)
+		found += untracked
+
+		if err != nil || !complete {
+			return found, false, err
+		}
+	}
+
+	return found, true, nil
+}
+
+// sweepStore sweeps the untracked objects of one store.
+// The bucket is listed from the cursor of the previous run that was cut off by its deadline
+// and wraps around to the keys before the cursor.
+func (s *Service) sweepStore(
+	ctx context.Context, store objectStore, minAge time.Duration, dryRun bool, deadline time.Time,
+) (int, bool, error) {
+	queries := pg.New(s.Pool)
+	cutoff := time.Now().Add(-minAge)
+	candidates := make([]string, 0, DeletionBatchSize)
+	found := 0
+
+	phase := gcPhaseSweep
+	if dryRun {
+		phase = gcPhaseSweepReport
+	}
+
+	// the primary keeps the cursor of the time when only it was swept
+	if store.name != endpointPrimary {
+		phase += "-" + store.name
+	}
+
+	after, err := getGCCursor(ctx, queries, phase)
+	if err != nil {
+		return 0, false, err
+	}
+
+	flush := func(lastKey string) error {
+		untracked, err := s.removeUntrackedKeys(ctx, store, candidates, dryRun)
+		if err != nil {
+			return err
+		}
+
+		candidates = candidates[:0]
+		found += len(untracked)
+
+		for _, key := range untracked {
+			slog.InfoContext(ctx, "Found untracked object", "key", key, "store", store.name, "dry_run", dryRun)
+		}
+
+		err = queries.SetGCCursor(ctx, pg.SetGCCursorParams{Phase: phase, LastKey: lastKey})
+		if err != nil {
+			return fmt.Errorf("failed to update gc cursor: %w", err)
+		}
+
+		return nil
+	}
+
+	// sweep lists the keys after startAfter up to and including until, or to the end if until is empty.
+	// It returns false if the deadline passed.
+	sweep := func(startAfter, until string) (bool, error) {
+		listCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		opts := minio.ListObjectsOptions{Recursive: true, StartAfter: startAfter}
+
+		for obj := range store.client.ListObjects(listCtx, store.bucket, opts) {
+			if obj.Err != nil {
+				return false, fmt.Errorf("failed to list bucket: %w", obj.Err)
+			}
+
+			if until != "" && obj.Key > until {
+				break
+			}
+
+			if isCacheMetadata(obj.Key) || obj.LastModified.After(cutoff) {
+				continue
+			}
+
+			candidates = append(candidates, obj.Key)
+
+			if len(candidates) >= DeletionBatchSize {
+				if err := flush(obj.Key); err != nil {
+					return false, err
+				}
+
+				if deadlinePassed(deadline) {
+					return false, nil
+				}
+			}
+		}
+
+		if len(candidates) > 0 {
+			if err := flush(candidates[len(candidates)-1]); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	complete, err := sweep(after, "")
+	if err != nil || !complete {
+		return found, false, err
+	}
+
+	// a run that resumed from a cursor has not seen the keys before it yet
+	if after != "" {
+		if complete, err = sweep("", after); err != nil || !complete {
+			return found, false, err
+		}
 	}
 
-	if s3Error != nil {
-		return s3Error
+	if err = queries.DeleteGCCursor(ctx, phase); err != nil {
+		return found, false, fmt.Errorf("failed to reset gc cursor: %w", err)
 	}
 
-	return nil
+	return found, true, nil
 }
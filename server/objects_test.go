@@ -0,0 +1,330 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	"github.com/Mic92/niks3/server/testsupport"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// pushClosure uploads the given objects through the pending closure API and commits the closure.
+func pushClosure(t *testing.T, service *server.Service, closureKey string, objects map[string]string) {
+	t.Helper()
+
+	testsupport.PushFixture(t, service, closureKey, objects)
+}
+
+// uploadClosure uploads the given objects through the pending closure API and returns the pending closure id.
+func uploadClosure(t *testing.T, service *server.Service, closureKey string, objects map[string]string) string {
+	t.Helper()
+
+	return testsupport.UploadFixture(t, service, closureKey, objects)
+}
+
+func testNarInfo(hash string, references ...string) string {
+	return testsupport.NarInfo(hash, references...)
+}
+
+func TestService_objectRefsHandlers(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo": testNarInfo(a, a, b),
+		b + ".narinfo": testNarInfo(b, c),
+		c + ".narinfo": testNarInfo(c),
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/objects/" + a + ".narinfo/refs?depth=2",
+		handler:    service.GetObjectRefsHandler,
+		pathValues: map[string]string{"key": a + ".narinfo"},
+	})
+
+	var refs server.ObjectRefsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &refs))
+
+	if len(refs.Refs) != 2 || refs.Refs[0].Key != b+".narinfo" || refs.Refs[1].Depth != 2 {
+		t.Errorf("unexpected refs: %v", refs.Refs)
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/objects/" + c + ".narinfo/referrers",
+		handler:    service.GetObjectReferrersHandler,
+		pathValues: map[string]string{"key": c + ".narinfo"},
+	})
+
+	var referrers server.ObjectRefsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &referrers))
+
+	if len(referrers.Refs) != 1 || referrers.Refs[0].Key != b+".narinfo" {
+		t.Errorf("unexpected referrers: %v", referrers.Refs)
+	}
+}
+
+func TestService_sweepUntrackedObjects(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.SecondaryMinioClient = service.MinioClient
+	service.SecondaryBucketName = testHarness.Minio.CreateBucket(t)
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	// uploaded, but the pending closure is not committed yet
+	uploadClosure(t, service, b, map[string]string{b + ".narinfo": testNarInfo(b)})
+
+	for _, key := range []string{"untracked", "nix-cache-info", "cache-info.json"} {
+		_, err := service.MinioClient.PutObject(ctx, service.BucketName, key,
+			bytes.NewBufferString(key), int64(len(key)), minio.PutObjectOptions{})
+		ok(t, err)
+	}
+
+	_, err := service.MinioClient.PutObject(ctx, service.SecondaryBucketName, "untracked",
+		bytes.NewBufferString("untracked"), int64(len("untracked")), minio.PutObjectOptions{})
+	ok(t, err)
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=1h&sweep=delete&sweep-min-age=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	// the files describing the cache are not tracked, but must survive
+	for _, key := range []string{"nix-cache-info", "cache-info.json"} {
+		_, err := service.MinioClient.StatObject(ctx, service.BucketName, key, minio.StatObjectOptions{})
+		ok(t, err)
+	}
+
+	for _, bucket := range []string{service.BucketName, service.SecondaryBucketName} {
+		_, err = service.MinioClient.StatObject(ctx, bucket, "untracked", minio.StatObjectOptions{})
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			t.Errorf("expected untracked object to be deleted from %s, got %v", bucket, err)
+		}
+	}
+
+	for _, key := range []string{a + ".narinfo", b + ".narinfo"} {
+		_, err = service.MinioClient.StatObject(ctx, service.BucketName, key, minio.StatObjectOptions{})
+		ok(t, err)
+	}
+}
+
+func TestService_gcKeepsObjectsReusedByNewerClosures(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	time.Sleep(2 * time.Second)
+
+	// b reuses the narinfo of a, which must survive the deletion of closure a
+	pushClosure(t, service, b, map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		b + ".narinfo": testNarInfo(b, a),
+	})
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=1s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	_, err := service.MinioClient.StatObject(ctx, service.BucketName, a+".narinfo", minio.StatObjectOptions{})
+	ok(t, err)
+}
+
+func TestService_gcLogRetention(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.LogRetention = time.Second
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	logKey := "log/" + a + "-pkg.drv"
+	objects := map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		logKey:         "build log",
+	}
+	pushClosure(t, service, a, objects)
+
+	time.Sleep(2 * time.Second)
+
+	// pushing the log again restarts its retention, although the object is older
+	pushClosure(t, service, a, objects)
+
+	gc := func() {
+		testRequest(t, &TestRequest{
+			method:  "DELETE",
+			path:    "/api/closures?older-than=1h",
+			handler: service.CleanupClosuresOlder,
+		})
+	}
+
+	gc()
+
+	_, err := service.MinioClient.StatObject(ctx, service.BucketName, logKey, minio.StatObjectOptions{})
+	ok(t, err)
+
+	time.Sleep(2 * time.Second)
+	gc()
+
+	_, err = service.MinioClient.StatObject(ctx, service.BucketName, logKey, minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Errorf("expected build log to be deleted, got %v", err)
+	}
+
+	_, err = service.MinioClient.StatObject(ctx, service.BucketName, a+".narinfo", minio.StatObjectOptions{})
+	ok(t, err)
+}
+
+func TestService_gcMaxDuration(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "DELETE",
+		path:          "/api/closures?older-than=0s&max-duration=0s",
+		handler:       service.CleanupClosuresOlder,
+		checkResponse: &checkResponse,
+	})
+
+	// even a run that is over its time budget right away deletes one batch
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=0s&max-duration=1ns&sweep=delete&sweep-min-age=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	_, err := service.MinioClient.StatObject(ctx, service.BucketName, a+".narinfo", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Errorf("expected narinfo to be deleted, got %v", err)
+	}
+}
+
+func TestService_gcResumeWrapsAround(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	untracked := testNarInfo(b)
+	_, err := service.MinioClient.PutObject(ctx, service.BucketName, b+".narinfo",
+		strings.NewReader(untracked), int64(len(untracked)), minio.PutObjectOptions{})
+	ok(t, err)
+
+	// cursors left behind by a time-boxed run, after all keys of this test
+	_, err = service.Pool.Exec(ctx,
+		"INSERT INTO gc_cursors (phase, last_key) VALUES ('mark', 'zzz'), ('sweep', 'zzz')")
+	ok(t, err)
+
+	// an untimed run visits the keys before the cursors as well
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=0s&sweep=delete&sweep-min-age=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	for _, key := range []string{a + ".narinfo", b + ".narinfo"} {
+		_, err = service.MinioClient.StatObject(ctx, service.BucketName, key, minio.StatObjectOptions{})
+		if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+			t.Errorf("expected %s to be deleted, got %v", key, err)
+		}
+	}
+}
+
+func TestService_gcAbortsStaleMultipartUploads(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	// a pending closure still waits for this object, its upload may be in progress
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	uploadClosure(t, service, a, map[string]string{"nar/" + a + ".nar": "nar"})
+
+	core := minio.Core{Client: service.MinioClient}
+
+	for _, key := range []string{"nar/" + a + ".nar", "nar/lost.nar"} {
+		_, err := core.NewMultipartUpload(ctx, service.BucketName, key, minio.PutObjectOptions{})
+		ok(t, err)
+	}
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=1h&multipart-min-age=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	var remaining []string
+
+	for upload := range service.MinioClient.ListIncompleteUploads(ctx, service.BucketName, "", true) {
+		ok(t, upload.Err)
+		remaining = append(remaining, upload.Key)
+	}
+
+	if len(remaining) != 1 || remaining[0] != "nar/"+a+".nar" {
+		t.Errorf("expected only the upload of the pending object to remain, got %v", remaining)
+	}
+}
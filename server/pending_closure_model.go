@@ -1,27 +1,46 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
 	pgx "github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
+	minio "github.com/minio/minio-go/v7"
 )
 
 const (
 	maxSignedURLDuration = time.Duration(5) * time.Hour
+
+	// number of presigned URLs generated in parallel per request.
+	presignConcurrency = 16
+	// number of narinfos downloaded in parallel when a pending closure is committed.
+	narinfoFetchConcurrency = 16
+
+	// defaults of --deletion-poll-interval and --deletion-wait-window
+	defaultDeletionPollInterval = time.Second
+	defaultDeletionWaitWindow   = 30 * time.Second
 )
 
 type PendingObject struct {
-	PresignedURL string `json:"presigned_url"`
+	PresignedURL string `json:"presigned_url,omitempty"`
+	// Headers the upload has to send along, e.g. for server-side encryption. They are part of the signature.
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 type PendingClosureResponse struct {
@@ -40,27 +59,56 @@ type PendingClosure struct {
 func rollbackOnError(ctx context.Context, tx *pgx.Tx, err *error, committed *bool) {
 	if p := recover(); p != nil && !*committed {
 		if err := (*tx).Rollback(ctx); err != nil {
-			slog.Error("failed to rollback transaction", "error", err)
+			slog.ErrorContext(ctx, "failed to rollback transaction", "error", err)
 		}
 
 		panic(p) // re-throw after Rollback
 	} else if err != nil && !*committed {
 		if err := (*tx).Rollback(ctx); err != nil {
-			slog.Error("failed to rollback transaction", "error", err)
+			slog.ErrorContext(ctx, "failed to rollback transaction", "error", err)
 		}
 	}
 }
 
-func waitForDeletion(ctx context.Context, pool *pgxpool.Pool, inflightPaths []string) (map[string]bool, error) {
+// errDeletionWaitTimeout is returned if objects that are being deleted by the garbage collector
+// are still not deleted after --deletion-wait-timeout.
+var errDeletionWaitTimeout = errors.New("timed out waiting for the garbage collector to delete objects")
+
+// waitForDeletion waits until objects the garbage collector marked for deletion less than
+// --deletion-wait-window ago are deleted and returns the objects that have to be uploaded again.
+func (s *Service) waitForDeletion(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	inflightPaths []string,
+) (map[string]bool, error) {
 	queries := pg.New(pool)
+	pollInterval := cmp.Or(s.DeletionPollInterval, defaultDeletionPollInterval)
+	window := cmp.Or(s.DeletionWaitWindow, defaultDeletionWaitWindow)
+
+	s.deletionWaits.Add(1)
+	defer s.deletionWaits.Add(-1)
 
 	missingObjects := make(map[string]bool, len(inflightPaths))
 	for _, objectKey := range inflightPaths {
 		missingObjects[objectKey] = true
 	}
 
+	start := time.Now()
+
 	for len(inflightPaths) > 0 {
-		time.Sleep(time.Duration(1) * time.Second)
+		if s.DeletionWaitTimeout > 0 && time.Since(start) >= s.DeletionWaitTimeout {
+			slog.WarnContext(ctx, "Gave up waiting for deletion", "remaining", len(inflightPaths),
+				"elapsed", time.Since(start))
+
+			return nil, fmt.Errorf("%w: %d objects after %s", errDeletionWaitTimeout, len(inflightPaths),
+				s.DeletionWaitTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to wait for deletion: %w", ctx.Err())
+		case <-time.After(pollInterval):
+		}
 
 		existingObjects, err := queries.GetExistingObjects(ctx, inflightPaths)
 		if err != nil {
@@ -76,23 +124,50 @@ func waitForDeletion(ctx context.Context, pool *pgxpool.Pool, inflightPaths []st
 				return nil, fmt.Errorf("deleted_at is not set for object: %s", existingObject.Key)
 			}
 
-			if deletedAt.Months == 0 && deletedAt.Days == 0 && deletedAt.Microseconds < 1000*30 {
+			if deletedAt.Months == 0 && deletedAt.Days == 0 &&
+				time.Duration(deletedAt.Microseconds)*time.Microsecond < window {
 				inflightPaths = append(inflightPaths, existingObject.Key)
 			} else {
 				delete(missingObjects, existingObject.Key)
 			}
 		}
+
+		slog.DebugContext(ctx, "Waiting for deletion", "remaining", len(inflightPaths), "elapsed", time.Since(start))
 	}
 
+	slog.InfoContext(ctx, "Finished waiting for deletion", "missing", len(missingObjects),
+		"elapsed", time.Since(start))
+
 	return missingObjects, nil
 }
 
 func createPendingClosureInner(
 	ctx context.Context,
 	pool *pgxpool.Pool,
-	closureKey string,
+	req *CreatePendingClosureRequest,
 	storePathSet map[string]bool,
+	endpoint string,
+	idempotencyKey string,
 ) (*PendingClosure, error) {
+	// labels are merged into the labels of an existing closure, so they must be an object
+	labelsMap := req.Labels
+	if labelsMap == nil {
+		labelsMap = map[string]string{}
+	}
+
+	labels, err := json.Marshal(labelsMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode labels: %w", err)
+	}
+
+	var provenance []byte
+
+	if req.Provenance != nil {
+		if provenance, err = json.Marshal(req.Provenance); err != nil {
+			return nil, fmt.Errorf("failed to encode provenance: %w", err)
+		}
+	}
+
 	tx, err := pool.Begin(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start transaction: %w", err)
@@ -104,9 +179,26 @@ func createPendingClosureInner(
 
 	queries := pg.New(tx)
 
+	identity, authenticated := IdentityFromContext(ctx)
+
 	var pendingClosure pg.PendingClosure
 
-	if pendingClosure, err = queries.InsertPendingClosure(ctx, closureKey); err != nil {
+	pendingClosure, err = queries.InsertPendingClosure(ctx, pg.InsertPendingClosureParams{
+		Key:            *req.Closure,
+		GroupName:      pgtype.Text{String: req.Group, Valid: req.Group != ""},
+		Labels:         labels,
+		CreatedBy:      pgtype.Text{String: identity.Name, Valid: authenticated},
+		Endpoint:       endpoint,
+		IdempotencyKey: pgtype.Text{String: idempotencyKey, Valid: idempotencyKey != ""},
+		Provenance:     provenance,
+		ReplaceObjects: req.Replace,
+	})
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.ConstraintName == "pending_closures_idempotency_key_idx" {
+			return nil, errIdempotencyKeyExists
+		}
+
 		return nil, fmt.Errorf("failed to insert pending closure: %w", err)
 	}
 
@@ -115,19 +207,27 @@ func createPendingClosureInner(
 		keys = append(keys, k)
 	}
 
+	// Blocks while the garbage collector is marking any of these objects for deletion.
+	if err = queries.LockObjectsShared(ctx, keys); err != nil {
+		return nil, fmt.Errorf("failed to lock objects: %w", err)
+	}
+
 	existingObjects, err := queries.GetExistingObjects(ctx, keys)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get existing objects: %w", err)
 	}
 
 	deletedObjects := make([]string, 0, len(existingObjects))
+	reusedObjects := make([]string, 0, len(existingObjects))
 
 	for _, existingObject := range existingObjects {
 		if existingObject.DeletedAt != nil {
 			deletedObjects = append(deletedObjects, existingObject.Key)
 		} else {
-			delete(storePathSet, existingObject.Key)
+			reusedObjects = append(reusedObjects, existingObject.Key)
 		}
+
+		delete(storePathSet, existingObject.Key)
 	}
 
 	pendingObjects := make([]pg.InsertPendingObjectsParams, 0, len(storePathSet))
@@ -139,7 +239,19 @@ func createPendingClosureInner(
 		})
 	}
 
-	if _, err = queries.InsertPendingObjects(ctx, pendingObjects); err != nil {
+	// Objects we reuse are recorded as pending as well, so the garbage collector
+	// does not delete them before the closure is committed.
+	rows := make([]pg.InsertPendingObjectsParams, 0, len(pendingObjects)+len(reusedObjects))
+	rows = append(rows, pendingObjects...)
+
+	for _, objectKey := range reusedObjects {
+		rows = append(rows, pg.InsertPendingObjectsParams{
+			PendingClosureID: pendingClosure.ID,
+			Key:              objectKey,
+		})
+	}
+
+	if _, err = queries.InsertPendingObjects(ctx, rows); err != nil {
 		return nil, fmt.Errorf("failed to insert pending objects: %w", err)
 	}
 
@@ -157,50 +269,223 @@ func createPendingClosureInner(
 	}, nil
 }
 
-func (s *Service) makePendingObject(ctx context.Context, objectKey string) (PendingObject, error) {
+func (s *Service) makePendingObject(ctx context.Context, store objectStore, objectKey string) (PendingObject, error) {
 	// TODO: multi-part uploads
-	presignedURL, err := s.MinioClient.PresignedPutObject(ctx,
-		s.BucketName,
+	header := s.encryptionHeaders()
+
+	presignedURL, err := store.client.PresignHeader(ctx,
+		http.MethodPut,
+		store.bucket,
 		objectKey,
-		maxSignedURLDuration)
+		maxSignedURLDuration,
+		nil,
+		header)
 	if err != nil {
 		return PendingObject{}, fmt.Errorf("failed to create presigned URL: %w", err)
 	}
 
-	return PendingObject{
+	pendingObject := PendingObject{
 		PresignedURL: presignedURL.String(),
+	}
+
+	if len(header) > 0 {
+		pendingObject.Headers = make(map[string]string, len(header))
+		for name := range header {
+			pendingObject.Headers[name] = header.Get(name)
+		}
+	}
+
+	return pendingObject, nil
+}
+
+// makePendingObjects presigns the given objects for the store with up to presignConcurrency workers.
+func (s *Service) makePendingObjects(
+	ctx context.Context,
+	store objectStore,
+	objectKeys []string,
+) (map[string]PendingObject, error) {
+	type result struct {
+		key string
+		po  PendingObject
+		err error
+	}
+
+	keys := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+
+	for range min(presignConcurrency, len(objectKeys)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range keys {
+				po, err := s.makePendingObject(ctx, store, key)
+				results <- result{key: key, po: po, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(keys)
+
+		for _, key := range objectKeys {
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pendingObjects := make(map[string]PendingObject, len(objectKeys))
+
+	var errs []error
+
+	for r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("failed to create pending object '%s': %w", r.key, r.err))
+
+			continue
+		}
+
+		pendingObjects[r.key] = r.po
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return pendingObjects, nil
+}
+
+// replayPendingClosure answers a retried request with the pending closure created for the idempotency key.
+// The upload URLs are presigned again for the objects that are still missing from the cache.
+func (s *Service) replayPendingClosure(
+	ctx context.Context,
+	req *CreatePendingClosureRequest,
+	idempotencyKey string,
+) (*PendingClosureResponse, error) {
+	queries := pg.New(s.Pool)
+
+	pendingClosure, err := queries.GetPendingClosureByIdempotencyKey(ctx,
+		pgtype.Text{String: idempotencyKey, Valid: true})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errPendingClosureNotFound
+		}
+
+		return nil, fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	if pendingClosure.Key != *req.Closure {
+		return nil, fmt.Errorf("%w: it belongs to closure %s", errIdempotencyKeyReused, pendingClosure.Key)
+	}
+
+	keys, err := queries.GetPendingUploadKeys(ctx, pendingClosure.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	pendingObjects := make(map[string]PendingObject, len(keys))
+	toPresign := keys
+
+	if req.PresignLimit > 0 && len(keys) > req.PresignLimit {
+		toPresign = keys[:req.PresignLimit]
+
+		for _, key := range keys[req.PresignLimit:] {
+			pendingObjects[key] = PendingObject{}
+		}
+	}
+
+	presignedObjects, err := s.makePendingObjects(ctx, s.store(pendingClosure.Endpoint), toPresign)
+	if err != nil {
+		return nil, err
+	}
+
+	for objectKey, po := range presignedObjects {
+		pendingObjects[objectKey] = po
+	}
+
+	return &PendingClosureResponse{
+		ID:             strconv.FormatInt(pendingClosure.ID, 10),
+		StartedAt:      pendingClosure.StartedAt.Time,
+		PendingObjects: pendingObjects,
 	}, nil
 }
 
+// createPendingClosure starts a new pending closure. With an idempotency key,
+// repeats of the request return the same pending closure for as long as it is pending,
+// which is reported by the second return value.
 func (s *Service) createPendingClosure(
 	ctx context.Context,
 	pool *pgxpool.Pool,
-	closureKey string,
+	req *CreatePendingClosureRequest,
 	storePathSet map[string]bool,
-) (*PendingClosureResponse, error) {
-	pendingClosure, err := createPendingClosureInner(ctx, pool, closureKey, storePathSet)
+	idempotencyKey string,
+) (*PendingClosureResponse, bool, error) {
+	if idempotencyKey != "" {
+		resp, err := s.replayPendingClosure(ctx, req, idempotencyKey)
+		if !errors.Is(err, errPendingClosureNotFound) {
+			return resp, err == nil, err
+		}
+	}
+
+	// all objects of a closure are uploaded to the same store, even if the primary recovers meanwhile
+	store := s.uploadStore()
+	timer := newPhaseTimer()
+
+	pendingClosure, err := createPendingClosureInner(ctx, pool, req, storePathSet, store.name, idempotencyKey)
+	if errors.Is(err, errIdempotencyKeyExists) {
+		// a concurrent retry created the pending closure first
+		resp, err := s.replayPendingClosure(ctx, req, idempotencyKey)
+
+		return resp, err == nil, err
+	}
+
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	timer.done("insert")
+
 	pendingObjects := make(map[string]PendingObject, len(pendingClosure.pendingObjects)+len(pendingClosure.deletedObjects))
+	toPresign := make([]string, 0, len(pendingClosure.pendingObjects))
 
-	for _, pendingObject := range pendingClosure.pendingObjects {
-		po, err := s.makePendingObject(ctx, pendingObject.Key)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create pending object: %w", err)
+	// Objects beyond the presign limit are returned without URL.
+	// Clients request those later with POST /api/pending_closures/{id}/urls.
+	addPendingObject := func(objectKey string) {
+		if req.PresignLimit > 0 && len(toPresign) >= req.PresignLimit {
+			pendingObjects[objectKey] = PendingObject{}
+
+			return
 		}
 
-		pendingObjects[pendingObject.Key] = po
+		toPresign = append(toPresign, objectKey)
+	}
+
+	for _, pendingObject := range pendingClosure.pendingObjects {
+		addPendingObject(pendingObject.Key)
 	}
 
 	if len(pendingClosure.deletedObjects) > 0 {
-		slog.Info("Found objects not yet deleted. Waiting for deletion",
+		slog.InfoContext(ctx, "Found objects not yet deleted. Waiting for deletion",
 			"pending_objects", len(pendingClosure.deletedObjects))
 
-		missingObjects, err := waitForDeletion(ctx, pool, pendingClosure.deletedObjects)
+		missingObjects, err := s.waitForDeletion(ctx, pool, pendingClosure.deletedObjects)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		pendingObjectsParams := make([]pg.InsertPendingObjectsParams, 0, len(missingObjects))
@@ -214,43 +499,537 @@ func (s *Service) createPendingClosure(
 		queries := pg.New(pool)
 
 		if _, err = queries.InsertPendingObjects(ctx, pendingObjectsParams); err != nil {
-			return nil, fmt.Errorf("failed to insert pending objects: %w", err)
+			return nil, false, fmt.Errorf("failed to insert pending objects: %w", err)
 		}
 
 		for _, pendingObject := range pendingObjectsParams {
-			po, err := s.makePendingObject(ctx, pendingObject.Key)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create pending object: %w", err)
-			}
-
-			pendingObjects[pendingObject.Key] = po
+			addPendingObject(pendingObject.Key)
 		}
+
+		timer.done("wait_for_deletion")
+	}
+
+	presignedObjects, err := s.makePendingObjects(ctx, store, toPresign)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for objectKey, po := range presignedObjects {
+		pendingObjects[objectKey] = po
 	}
 
+	timer.done("presign")
+	timer.log(ctx, "Created pending closure", "id", pendingClosure.id,
+		"objects", len(req.Objects), "pending_objects", len(pendingObjects), "presigned", len(presignedObjects))
+
 	return &PendingClosureResponse{
 		ID:             strconv.FormatInt(pendingClosure.id, 10),
 		StartedAt:      pendingClosure.startedAt,
 		PendingObjects: pendingObjects,
-	}, nil
+	}, false, nil
+}
+
+var (
+	errPendingClosureNotFound = errors.New("not found")
+	errMissingReferences      = errors.New("narinfos reference objects that are neither part of the closure nor in the cache")
+	errMissingFileHash        = errors.New("narinfos are missing FileHash or FileSize")
+	errUnreadableNarInfo      = errors.New("narinfos could not be fetched or parsed")
+	errWrongStoreDir          = errors.New("narinfos have store paths outside of the store directory of the cache")
+	errIdempotencyKeyExists   = errors.New("idempotency key already exists")
+	errIdempotencyKeyReused   = errors.New("idempotency key was used for another closure")
+	errNotPendingObject       = errors.New("object is not part of the pending closure")
+	errObjectInCache          = errors.New("object is already in the cache")
+	errEndpointMismatch       = errors.New("pending closures upload to different endpoints")
+)
+
+// presignPendingObjects creates upload URLs for objects of a pending closure.
+// Keys that don't belong to the pending closure or that are already in the cache are ignored,
+// so that an upload URL can't overwrite a live object.
+func (s *Service) presignPendingObjects(
+	ctx context.Context,
+	pendingClosureID int64,
+	objectKeys []string,
+) (map[string]PendingObject, error) {
+	queries := pg.New(s.Pool)
+	timer := newPhaseTimer()
+
+	endpoint, err := queries.GetPendingClosureEndpoint(ctx, pendingClosureID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errPendingClosureNotFound
+		}
+
+		return nil, fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	keys, err := queries.GetPendingUploadObjectKeys(ctx, pg.GetPendingUploadObjectKeysParams{
+		PendingClosureID: pendingClosureID,
+		Keys:             objectKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	timer.done("query")
+
+	pendingObjects, err := s.makePendingObjects(ctx, s.store(endpoint), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	timer.done("presign")
+	timer.log(ctx, "Presigned pending objects", "id", pendingClosureID, "presigned", len(pendingObjects))
+
+	return pendingObjects, nil
+}
+
+// attachPendingObjects adds objects that another pending closure uploads to a pending closure,
+// so that a push of several closures uploads shared objects only once.
+// Objects that the other closure committed in the meantime are attached as well.
+// It returns the number of objects that were not part of the pending closure yet.
+func attachPendingObjects(
+	ctx context.Context,
+	pool *pgxpool.Pool,
+	pendingClosureID int64,
+	sourceID int64,
+	objectKeys []string,
+) (int, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	committed := false
+
+	defer rollbackOnError(ctx, &tx, &err, &committed)
+
+	queries := pg.New(tx)
+
+	endpoint, err := queries.GetPendingClosureEndpoint(ctx, pendingClosureID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, errPendingClosureNotFound
+		}
+
+		return 0, fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	sourceEndpoint, err := queries.GetPendingClosureEndpoint(ctx, sourceID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, errPendingClosureNotFound
+		}
+
+		return 0, fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	if endpoint != sourceEndpoint {
+		return 0, errEndpointMismatch
+	}
+
+	// Blocks while the garbage collector is marking any of these objects for deletion.
+	if err = queries.LockObjectsShared(ctx, objectKeys); err != nil {
+		return 0, fmt.Errorf("failed to lock objects: %w", err)
+	}
+
+	pending, err := queries.GetPendingObjectKeys(ctx, pg.GetPendingObjectKeysParams{
+		PendingClosureID: sourceID,
+		Keys:             objectKeys,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	known := make(map[string]bool, len(objectKeys))
+	for _, key := range pending {
+		known[key] = true
+	}
+
+	existingObjects, err := queries.GetExistingObjects(ctx, objectKeys)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get existing objects: %w", err)
+	}
+
+	for _, existingObject := range existingObjects {
+		if existingObject.DeletedAt == nil {
+			known[existingObject.Key] = true
+		}
+	}
+
+	var unknown []string
+
+	for _, key := range objectKeys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+
+		return 0, fmt.Errorf("%w %d: %s", errNotPendingObject, sourceID, strings.Join(unknown, ", "))
+	}
+
+	alreadyPending, err := queries.GetPendingObjectKeys(ctx, pg.GetPendingObjectKeysParams{
+		PendingClosureID: pendingClosureID,
+		Keys:             objectKeys,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	attached := make(map[string]bool, len(objectKeys))
+	for _, key := range alreadyPending {
+		attached[key] = true
+	}
+
+	rows := make([]pg.InsertPendingObjectsParams, 0, len(objectKeys))
+
+	for _, key := range objectKeys {
+		if attached[key] {
+			continue
+		}
+
+		attached[key] = true
+		rows = append(rows, pg.InsertPendingObjectsParams{
+			PendingClosureID: pendingClosureID,
+			Key:              key,
+		})
+	}
+
+	if _, err = queries.InsertPendingObjects(ctx, rows); err != nil {
+		return 0, fmt.Errorf("failed to insert pending objects: %w", err)
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	committed = true
+
+	return len(rows), nil
+}
+
+// part size of uploads proxied through the server without Content-Length.
+// The S3 client buffers one part in memory.
+const proxyUploadPartSize = 16 << 20
+
+// uploadPendingObject writes an object of a pending closure to the store the closure uploads to.
+// Objects that are already in the cache are refused.
+// size is -1 for bodies of unknown length, which are uploaded in parts.
+func (s *Service) uploadPendingObject(
+	ctx context.Context,
+	pendingClosureID int64,
+	objectKey string,
+	body io.Reader,
+	size int64,
+	contentType string,
+) error {
+	queries := pg.New(s.Pool)
+
+	endpoint, err := queries.GetPendingClosureEndpoint(ctx, pendingClosureID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errPendingClosureNotFound
+		}
+
+		return fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	keys, err := queries.GetPendingObjectKeys(ctx, pg.GetPendingObjectKeysParams{
+		PendingClosureID: pendingClosureID,
+		Keys:             []string{objectKey},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return errNotPendingObject
+	}
+
+	// objects that the closure reuses from the cache are pending as well, but must not be overwritten
+	keys, err = queries.GetPendingUploadObjectKeys(ctx, pg.GetPendingUploadObjectKeysParams{
+		PendingClosureID: pendingClosureID,
+		Keys:             []string{objectKey},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get pending objects: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return errObjectInCache
+	}
+
+	store := s.store(endpoint)
+
+	opts := minio.PutObjectOptions{ContentType: contentType, ServerSideEncryption: s.S3Encryption}
+	if size < 0 {
+		opts.PartSize = proxyUploadPartSize
+	}
+
+	if _, err = store.client.PutObject(ctx, store.bucket, objectKey, body, size, opts); err != nil {
+		return fmt.Errorf("failed to upload object to %s: %w", store.name, err)
+	}
+
+	return nil
+}
+
+// fetchPendingNarInfos downloads the narinfos of a pending closure before it is committed.
+// With trusted keys, clients sign narinfos themselves and we refuse unsigned ones.
+// Narinfos that cannot be read are refused as well, their references could not be checked otherwise.
+func (s *Service) fetchPendingNarInfos(ctx context.Context, keys []string) (map[string]*NarInfo, error) {
+	infos, unreadable := s.fetchNarInfos(ctx, keys)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(unreadable) > 0 {
+		slices.Sort(unreadable)
+
+		return nil, fmt.Errorf("%w: %s", errUnreadableNarInfo, strings.Join(unreadable, ", "))
+	}
+
+	if len(s.TrustedKeys) > 0 {
+		if err := verifyNarInfos(infos, s.trustedKeysFor(ctx)); err != nil {
+			return nil, fmt.Errorf("failed to verify narinfos: %w", err)
+		}
+	}
+
+	return infos, nil
+}
+
+// fetchNarInfos downloads the given narinfos with up to narinfoFetchConcurrency workers
+// and returns the keys of the ones that could not be read separately.
+func (s *Service) fetchNarInfos(ctx context.Context, narinfoKeys []string) (map[string]*NarInfo, []string) {
+	type result struct {
+		key  string
+		info *NarInfo
+		err  error
+	}
+
+	keys := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+
+	for range min(narinfoFetchConcurrency, len(narinfoKeys)) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for key := range keys {
+				info, err := s.fetchNarInfo(ctx, key)
+				results <- result{key: key, info: info, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(keys)
+
+		for _, key := range narinfoKeys {
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	infos := make(map[string]*NarInfo, len(narinfoKeys))
+
+	var unreadable []string
+
+	for r := range results {
+		if r.err != nil {
+			if ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to fetch narinfo", "key", r.key, "error", r.err)
+			}
+
+			unreadable = append(unreadable, r.key)
+
+			continue
+		}
+
+		infos[r.key] = r.info
+	}
+
+	return infos, unreadable
 }
 
-var errPendingClosureNotFound = errors.New("not found")
+// checkNarInfoReferences rejects closures whose narinfos reference store paths
+// that are neither part of the closure nor already in the cache.
+// Committing such a closure would leave its references unprotected from garbage collection.
+func checkNarInfoReferences(
+	ctx context.Context,
+	queries *pg.Queries,
+	pendingClosureID int64,
+	narInfos map[string]*NarInfo,
+) error {
+	referrers := make(map[string]string)
+
+	for key, info := range narInfos {
+		for _, ref := range info.References {
+			if refKey := narInfoKey(ref); refKey != key {
+				referrers[refKey] = key
+			}
+		}
+	}
+
+	if len(referrers) == 0 {
+		return nil
+	}
+
+	refKeys := make([]string, 0, len(referrers))
+	for refKey := range referrers {
+		refKeys = append(refKeys, refKey)
+	}
+
+	missing, err := queries.GetMissingObjects(ctx, pg.GetMissingObjectsParams{
+		Keys:             refKeys,
+		PendingClosureID: pendingClosureID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check narinfo references: %w", err)
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	slices.Sort(missing)
+
+	details := make([]string, 0, len(missing))
+	for _, refKey := range missing {
+		details = append(details, fmt.Sprintf("%s (referenced by %s)", refKey, referrers[refKey]))
+	}
+
+	return fmt.Errorf("%w: %s", errMissingReferences, strings.Join(details, ", "))
+}
+
+// checkNarInfoFileHashes rejects narinfos without FileHash and FileSize.
+// Every narinfo has to be readable, since we can't tell otherwise whether the fields are present.
+func checkNarInfoFileHashes(keys []string, narInfos map[string]*NarInfo) error {
+	var invalid []string
+
+	for _, key := range keys {
+		info, ok := narInfos[key]
+		if !ok || info.FileHash == "" || info.FileSize == 0 {
+			invalid = append(invalid, key)
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	slices.Sort(invalid)
+
+	return fmt.Errorf("%w: %s", errMissingFileHash, strings.Join(invalid, ", "))
+}
+
+// checkNarInfoStoreDirs rejects narinfos whose store path is invalid or belongs to another store directory,
+// e.g. a closure built for /gnu/store pushed to a cache of /nix/store.
+func checkNarInfoStoreDirs(storeDir string, narInfos map[string]*NarInfo) error {
+	var invalid []string
+
+	for key, info := range narInfos {
+		storePath, err := storepath.Parse(info.StorePath)
+		if err != nil || storePath.StoreDir != storeDir {
+			invalid = append(invalid, fmt.Sprintf("%s (%s)", key, info.StorePath))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	slices.Sort(invalid)
+
+	return fmt.Errorf("%w %s: %s", errWrongStoreDir, storeDir, strings.Join(invalid, ", "))
+}
+
+// commitPendingClosure commits a pending closure and returns the key of the committed closure.
+func (s *Service) commitPendingClosure(ctx context.Context, pendingClosureID int64) (string, error) {
+	queries := pg.New(s.Pool)
+	timer := newPhaseTimer()
+
+	closureKey, err := queries.GetPendingClosureKey(ctx, pendingClosureID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errPendingClosureNotFound
+		}
+
+		return "", fmt.Errorf("failed to get pending closure: %w", err)
+	}
+
+	narinfoKeys, err := queries.GetPendingNarinfoKeys(ctx, pendingClosureID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get pending narinfos: %w", err)
+	}
+
+	narInfos, err := s.fetchPendingNarInfos(ctx, narinfoKeys)
+	if err != nil {
+		return "", err
+	}
+
+	timer.done("fetch_narinfos")
 
-func commitPendingClosure(ctx context.Context, pool *pgxpool.Pool, pendingClosureID int64) error {
-	if err := pg.New(pool).CommitPendingClosure(ctx, pendingClosureID); err != nil {
+	if err = checkNarInfoStoreDirs(s.StoreDir, narInfos); err != nil {
+		return "", err
+	}
+
+	if err = checkNarInfoReferenceCounts(s.MaxNarinfoReferences, narInfos); err != nil {
+		return "", err
+	}
+
+	if s.RequireFileHash {
+		if err = checkNarInfoFileHashes(narinfoKeys, narInfos); err != nil {
+			return "", err
+		}
+	}
+
+	if !s.AllowMissingReferences {
+		if err = checkNarInfoReferences(ctx, queries, pendingClosureID, narInfos); err != nil {
+			return "", err
+		}
+
+		timer.done("check_references")
+	}
+
+	if err := queries.CommitPendingClosure(ctx, pendingClosureID); err != nil {
 		msg := "Closure does not exist:"
 
 		var pgError *pgconn.PgError
 		ok := errors.As(err, &pgError)
 
 		if ok && strings.Contains(pgError.Message, msg) {
-			return fmt.Errorf("failed to commit pending closure: %w", errPendingClosureNotFound)
+			return "", fmt.Errorf("failed to commit pending closure: %w", errPendingClosureNotFound)
 		}
 
-		return fmt.Errorf("failed to commit pending closure: %w", err)
+		return "", fmt.Errorf("failed to commit pending closure: %w", err)
 	}
 
-	return nil
+	timer.done("commit")
+
+	// The closure is already committed at this point, so we don't fail the request.
+	// Missing metadata can be restored later with the backfill-narinfos command.
+	if err = upsertNarInfos(ctx, queries, narInfos); err != nil {
+		slog.WarnContext(ctx, "Failed to store narinfo metadata", "id", pendingClosureID, "error", err)
+	}
+
+	timer.done("upsert_narinfos")
+	timer.log(ctx, "Committed pending closure", "id", pendingClosureID, "narinfos", len(narinfoKeys))
+
+	return closureKey, nil
 }
 
 func cleanupPendingClosures(ctx context.Context, pool *pgxpool.Pool, duration time.Duration) error {
@@ -261,3 +1040,43 @@ func cleanupPendingClosures(ctx context.Context, pool *pgxpool.Pool, duration ti
 
 	return nil
 }
+
+// abortPendingClosure removes a pending closure and returns how many uploaded objects are left to the garbage collector.
+func abortPendingClosure(ctx context.Context, pool *pgxpool.Pool, pendingClosureID int64) (int64, error) {
+	result, err := pg.New(pool).AbortPendingClosure(ctx, pendingClosureID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to abort pending closure: %w", err)
+	}
+
+	if result.Aborted == 0 {
+		return 0, errPendingClosureNotFound
+	}
+
+	return result.ReleasedObjects, nil
+}
+
+const abortPendingClosuresBatchSize = 1000
+
+// abortPendingClosures removes all pending closures older than the given duration in batches.
+func abortPendingClosures(ctx context.Context, pool *pgxpool.Pool, olderThan time.Duration) (int, error) {
+	queries := pg.New(pool)
+	aborted := 0
+
+	for {
+		ids, err := queries.AbortPendingClosures(ctx, pg.AbortPendingClosuresParams{
+			OlderThanSeconds: int32(olderThan.Seconds()),
+			BatchSize:        abortPendingClosuresBatchSize,
+		})
+		if err != nil {
+			return aborted, fmt.Errorf("failed to abort pending closures: %w", err)
+		}
+
+		aborted += len(ids)
+
+		if len(ids) < abortPendingClosuresBatchSize {
+			return aborted, nil
+		}
+
+		slog.InfoContext(ctx, "Aborting pending closures", "aborted", aborted)
+	}
+}
@@ -9,6 +9,260 @@ import (
 	"context"
 )
 
+// iteratorForImportClosureObjects implements pgx.CopyFromSource.
+type iteratorForImportClosureObjects struct {
+	rows                 []ImportClosureObjectsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportClosureObjects) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportClosureObjects) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].ClosureKey,
+		r.rows[0].ObjectKey,
+		r.rows[0].UpdatedAt,
+	}, nil
+}
+
+func (r iteratorForImportClosureObjects) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportClosureObjects(ctx context.Context, arg []ImportClosureObjectsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"closure_objects"}, []string{"closure_key", "object_key", "updated_at"}, &iteratorForImportClosureObjects{rows: arg})
+}
+
+// iteratorForImportClosureRoots implements pgx.CopyFromSource.
+type iteratorForImportClosureRoots struct {
+	rows                 []ImportClosureRootsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportClosureRoots) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportClosureRoots) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].ClosureKey,
+		r.rows[0].Root,
+		r.rows[0].UpdatedAt,
+	}, nil
+}
+
+func (r iteratorForImportClosureRoots) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportClosureRoots(ctx context.Context, arg []ImportClosureRootsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"closure_roots"}, []string{"closure_key", "root", "updated_at"}, &iteratorForImportClosureRoots{rows: arg})
+}
+
+// iteratorForImportClosures implements pgx.CopyFromSource.
+type iteratorForImportClosures struct {
+	rows                 []ImportClosuresParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportClosures) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportClosures) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].Key,
+		r.rows[0].UpdatedAt,
+		r.rows[0].GroupName,
+		r.rows[0].Labels,
+		r.rows[0].CreatedBy,
+		r.rows[0].Provenance,
+	}, nil
+}
+
+func (r iteratorForImportClosures) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportClosures(ctx context.Context, arg []ImportClosuresParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"closures"}, []string{"key", "updated_at", "group_name", "labels", "created_by", "provenance"}, &iteratorForImportClosures{rows: arg})
+}
+
+// iteratorForImportGCHolds implements pgx.CopyFromSource.
+type iteratorForImportGCHolds struct {
+	rows                 []ImportGCHoldsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportGCHolds) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportGCHolds) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].ID,
+		r.rows[0].Reason,
+		r.rows[0].CreatedAt,
+		r.rows[0].ExpiresAt,
+	}, nil
+}
+
+func (r iteratorForImportGCHolds) Err() error {
+	return nil
+}
+
+// Keeps the ids, so that holds can still be released by the id they were created with.
+func (q *Queries) ImportGCHolds(ctx context.Context, arg []ImportGCHoldsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"gc_holds"}, []string{"id", "reason", "created_at", "expires_at"}, &iteratorForImportGCHolds{rows: arg})
+}
+
+// iteratorForImportNarinfos implements pgx.CopyFromSource.
+type iteratorForImportNarinfos struct {
+	rows                 []ImportNarinfosParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportNarinfos) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportNarinfos) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].Key,
+		r.rows[0].StorePath,
+		r.rows[0].Url,
+		r.rows[0].Compression,
+		r.rows[0].NarHash,
+		r.rows[0].NarSize,
+		r.rows[0].Deriver,
+		r.rows[0].Refs,
+		r.rows[0].Signatures,
+	}, nil
+}
+
+func (r iteratorForImportNarinfos) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportNarinfos(ctx context.Context, arg []ImportNarinfosParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"narinfos"}, []string{"key", "store_path", "url", "compression", "nar_hash", "nar_size", "deriver", "refs", "signatures"}, &iteratorForImportNarinfos{rows: arg})
+}
+
+// iteratorForImportObjects implements pgx.CopyFromSource.
+type iteratorForImportObjects struct {
+	rows                 []ImportObjectsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportObjects) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportObjects) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].Key,
+		r.rows[0].DeletedAt,
+		r.rows[0].CreatedAt,
+		r.rows[0].Endpoint,
+		r.rows[0].Sha256,
+		r.rows[0].Size,
+	}, nil
+}
+
+func (r iteratorForImportObjects) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportObjects(ctx context.Context, arg []ImportObjectsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"objects"}, []string{"key", "deleted_at", "created_at", "endpoint", "sha256", "size"}, &iteratorForImportObjects{rows: arg})
+}
+
+// iteratorForImportRemoteRoots implements pgx.CopyFromSource.
+type iteratorForImportRemoteRoots struct {
+	rows                 []ImportRemoteRootsParams
+	skippedFirstNextCall bool
+}
+
+func (r *iteratorForImportRemoteRoots) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	if !r.skippedFirstNextCall {
+		r.skippedFirstNextCall = true
+		return true
+	}
+	r.rows = r.rows[1:]
+	return len(r.rows) > 0
+}
+
+func (r iteratorForImportRemoteRoots) Values() ([]interface{}, error) {
+	return []interface{}{
+		r.rows[0].Identity,
+		r.rows[0].Name,
+		r.rows[0].ClosureKey,
+		r.rows[0].UpdatedAt,
+		r.rows[0].ExpiresAt,
+	}, nil
+}
+
+func (r iteratorForImportRemoteRoots) Err() error {
+	return nil
+}
+
+func (q *Queries) ImportRemoteRoots(ctx context.Context, arg []ImportRemoteRootsParams) (int64, error) {
+	return q.db.CopyFrom(ctx, []string{"remote_roots"}, []string{"identity", "name", "closure_key", "updated_at", "expires_at"}, &iteratorForImportRemoteRoots{rows: arg})
+}
+
 // iteratorForInsertPendingObjects implements pgx.CopyFromSource.
 type iteratorForInsertPendingObjects struct {
 	rows                 []InsertPendingObjectsParams
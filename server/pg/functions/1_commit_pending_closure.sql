@@ -4,39 +4,69 @@
 CREATE OR REPLACE FUNCTION commit_pending_closure(closure_id bigint)
 RETURNS void AS $$
 DECLARE
-    is_inserted BOOLEAN;
-    closure_key VARCHAR;
+    committed_key VARCHAR;
     now timestamp without time zone := timezone('UTC', now());
 BEGIN
-    -- Commit the pending closure and capture the inserted value
-    INSERT INTO closures (updated_at, key)
-    SELECT now, key FROM pending_closures WHERE id = closure_id
+    -- Commit the pending closure
+    INSERT INTO closures (updated_at, key, group_name, labels, created_by, provenance)
+    SELECT now, key, group_name, labels, created_by, provenance FROM pending_closures WHERE id = closure_id
     ON CONFLICT (key)
-    DO UPDATE SET updated_at = now
-    RETURNING (xmax = 0) AS is_inserted, key AS closure_key
-    INTO is_inserted, closure_key;
+    DO UPDATE SET
+        updated_at = now,
+        group_name = coalesce(excluded.group_name, closures.group_name),
+        labels = closures.labels || excluded.labels,
+        created_by = coalesce(closures.created_by, excluded.created_by),
+        provenance = coalesce(excluded.provenance, closures.provenance)
+    RETURNING key INTO committed_key;
 
-    if closure_key is null then
+    if committed_key is null then
         RAISE EXCEPTION 'Closure does not exist: id=%', closure_id;
     end if;
 
-    -- If the closure was inserted, commit the pending objects
-    IF is_inserted THEN
-        -- Commit the pending objects that we don't already have and the corresponding closure_objects
-        WITH pending_keys AS (
-          SELECT key
-          FROM pending_objects
-          WHERE pending_closure_id = closure_id
-        ), insert_objects AS (
-          INSERT INTO objects (key)
-          SELECT key FROM pending_keys
-          ON CONFLICT (key) DO NOTHING
-          RETURNING key
-        )
-        INSERT INTO closure_objects (closure_key, object_key)
-        SELECT closure_key, key
-        FROM pending_keys;
-    END IF;
+    -- Pushing a closure again, from the same or another group, refreshes or adds a root
+    INSERT INTO closure_roots (closure_key, root, updated_at)
+    SELECT committed_key, coalesce(group_name, ''), now FROM pending_closures WHERE id = closure_id
+    ON CONFLICT (closure_key, root) DO UPDATE SET updated_at = now;
+
+    -- Commit the pending objects that we don't already have, on the endpoint they were uploaded to
+    INSERT INTO objects (key, endpoint)
+    SELECT po.key, pc.endpoint
+    FROM pending_objects AS po
+    JOIN pending_closures AS pc ON po.pending_closure_id = pc.id
+    WHERE pc.id = closure_id
+    ON CONFLICT (key) DO NOTHING;
+
+    -- With replace_objects, the pending objects are the complete closure, so an updated closure
+    -- drops the objects it no longer contains. Those become garbage unless
+    -- another closure references them. Otherwise the pending objects are added.
+    DELETE FROM closure_objects AS co
+    USING pending_closures AS pc
+    WHERE
+        pc.id = closure_id
+        AND pc.replace_objects
+        AND co.closure_key = committed_key
+        AND NOT EXISTS (
+            SELECT 1 FROM pending_objects AS po
+            WHERE po.pending_closure_id = closure_id AND po.key = co.object_key
+        );
+
+    -- Objects pushed again restart their retention
+    UPDATE closure_objects AS co SET updated_at = now
+    FROM pending_objects AS po
+    WHERE
+        po.pending_closure_id = closure_id
+        AND co.closure_key = committed_key
+        AND co.object_key = po.key;
+
+    INSERT INTO closure_objects (closure_key, object_key, updated_at)
+    SELECT committed_key, po.key, now
+    FROM pending_objects AS po
+    WHERE
+        po.pending_closure_id = closure_id
+        AND NOT EXISTS (
+            SELECT 1 FROM closure_objects AS co
+            WHERE co.closure_key = committed_key AND co.object_key = po.key
+        );
 
     -- Delete the pending objects
     DELETE FROM pending_objects WHERE pending_closure_id = closure_id;
@@ -0,0 +1,31 @@
+-- +goose up
+
+-- Advisory locks coordinate garbage collection with concurrent pushes.
+-- Object keys are hashed into a fixed number of slots,
+-- so that a push of a huge closure does not exhaust the lock table.
+
+-- +goose statementbegin
+CREATE OR REPLACE FUNCTION object_lock_slot(key varchar)
+RETURNS int AS $$
+    SELECT hashtext(key) & 255;
+$$ LANGUAGE sql IMMUTABLE;
+-- +goose statementend
+
+-- +goose statementbegin
+CREATE OR REPLACE FUNCTION lock_objects_shared(keys varchar [])
+RETURNS void AS $$
+    SELECT pg_advisory_xact_lock_shared(1851878707, s.slot)
+    FROM (
+        SELECT DISTINCT object_lock_slot(k.key) AS slot
+        FROM unnest(keys) AS k (key)
+    ) AS s
+    ORDER BY s.slot;
+$$ LANGUAGE sql;
+-- +goose statementend
+
+-- +goose statementbegin
+CREATE OR REPLACE FUNCTION try_lock_object(key varchar)
+RETURNS boolean AS $$
+    SELECT pg_try_advisory_xact_lock(1851878707, object_lock_slot(key));
+$$ LANGUAGE sql;
+-- +goose statementend
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- narinfos stores the parsed content of narinfo objects, so that metadata
+-- queries can be answered without reading from the s3 bucket
+CREATE TABLE narinfos
+(
+    key varchar(1024) PRIMARY KEY REFERENCES objects (key) ON DELETE CASCADE,
+    store_path varchar(1024) NOT NULL,
+    url varchar(1024) NOT NULL,
+    compression varchar(32) NOT NULL,
+    nar_hash varchar(128) NOT NULL,
+    nar_size bigint NOT NULL,
+    deriver varchar(1024),
+    -- "references" is a reserved keyword in SQL
+    refs varchar(1024) [] NOT NULL,
+    signatures text [] NOT NULL
+);
+CREATE INDEX narinfos_store_path_idx ON narinfos (store_path);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX narinfos_store_path_idx;
+
+DROP TABLE narinfos;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- created_at allows retention policies that are independent of closures, e.g. for build logs
+ALTER TABLE objects ADD COLUMN created_at timestamp NOT NULL DEFAULT timezone('UTC', now());
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE objects DROP COLUMN created_at;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- groups bundle related closures, e.g. the systems of a fleet of machines
+ALTER TABLE pending_closures ADD COLUMN group_name varchar(1024);
+ALTER TABLE closures ADD COLUMN group_name varchar(1024);
+CREATE INDEX closures_group_name_idx ON closures (group_name);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX closures_group_name_idx;
+
+ALTER TABLE closures DROP COLUMN group_name;
+ALTER TABLE pending_closures DROP COLUMN group_name;
+-- +goose StatementEnd
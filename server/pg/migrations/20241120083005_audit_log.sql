@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- audit_log records every authenticated, mutating API call
+CREATE TABLE audit_log
+(
+    id bigserial PRIMARY KEY,
+    created_at timestamp NOT NULL DEFAULT timezone('UTC', now()),
+    identity varchar(1024) NOT NULL,
+    method varchar(16) NOT NULL,
+    path varchar(4096) NOT NULL,
+    query text NOT NULL,
+    status integer NOT NULL
+);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE audit_log;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- labels are free-form metadata of a closure, e.g. the hydra jobset and evaluation it was built by
+ALTER TABLE pending_closures ADD COLUMN labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE closures ADD COLUMN labels jsonb NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE closures DROP COLUMN labels;
+ALTER TABLE pending_closures DROP COLUMN labels;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- gc_holds pause garbage collection until they expire or are released
+CREATE TABLE gc_holds
+(
+    id bigserial PRIMARY KEY,
+    reason text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT timezone('UTC', now()),
+    expires_at timestamp NOT NULL
+);
+CREATE INDEX gc_holds_expires_at_idx ON gc_holds (expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gc_holds;
+-- +goose StatementEnd
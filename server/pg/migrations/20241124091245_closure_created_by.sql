@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- created_by is the identity that first pushed a closure, NULL for closures pushed before it was recorded
+ALTER TABLE pending_closures ADD COLUMN created_by varchar(1024);
+ALTER TABLE closures ADD COLUMN created_by varchar(1024);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE closures DROP COLUMN created_by;
+ALTER TABLE pending_closures DROP COLUMN created_by;
+-- +goose StatementEnd
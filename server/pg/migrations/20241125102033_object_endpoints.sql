@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- endpoint is the object store an object was uploaded to, 'primary' or 'secondary' during a failover
+ALTER TABLE pending_closures ADD COLUMN endpoint varchar(16) NOT NULL DEFAULT 'primary';
+ALTER TABLE objects ADD COLUMN endpoint varchar(16) NOT NULL DEFAULT 'primary';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE objects DROP COLUMN endpoint;
+ALTER TABLE pending_closures DROP COLUMN endpoint;
+-- +goose StatementEnd
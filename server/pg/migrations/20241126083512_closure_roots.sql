@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- closure_roots are the references that keep a closure alive: one per group that pushed it,
+-- and the empty root for ungrouped pushes. A closure is only deleted with its last root.
+CREATE TABLE closure_roots
+(
+    closure_key varchar(1024) NOT NULL REFERENCES closures (key) ON DELETE CASCADE,
+    root varchar(1024) NOT NULL,
+    updated_at timestamp NOT NULL,
+    PRIMARY KEY (closure_key, root)
+);
+CREATE INDEX closure_roots_root_idx ON closure_roots (root);
+
+INSERT INTO closure_roots (closure_key, root, updated_at)
+SELECT key, coalesce(group_name, ''), updated_at FROM closures;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX closure_roots_root_idx;
+DROP TABLE closure_roots;
+-- +goose StatementEnd
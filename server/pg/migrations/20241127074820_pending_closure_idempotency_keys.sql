@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- idempotency_key is chosen by the client, so a retried request returns the pending closure of the first one
+ALTER TABLE pending_closures ADD COLUMN idempotency_key varchar(255);
+CREATE UNIQUE INDEX pending_closures_idempotency_key_idx ON pending_closures (idempotency_key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX pending_closures_idempotency_key_idx;
+ALTER TABLE pending_closures DROP COLUMN idempotency_key;
+-- +goose StatementEnd
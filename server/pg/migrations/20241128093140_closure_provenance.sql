@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- provenance records where the last push of a closure came from, e.g. the git revision and CI job
+ALTER TABLE pending_closures ADD COLUMN provenance jsonb;
+ALTER TABLE closures ADD COLUMN provenance jsonb;
+CREATE INDEX closures_provenance_revision_idx ON closures ((provenance ->> 'revision'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX closures_provenance_revision_idx;
+
+ALTER TABLE closures DROP COLUMN provenance;
+ALTER TABLE pending_closures DROP COLUMN provenance;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- gc_cursors remember how far a time-boxed garbage collection got in a phase,
+-- so that the next run resumes there instead of starting over
+CREATE TABLE gc_cursors
+(
+    phase varchar(64) PRIMARY KEY,
+    last_key varchar(1024) NOT NULL,
+    updated_at timestamp NOT NULL DEFAULT timezone('UTC', now())
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gc_cursors;
+-- +goose StatementEnd
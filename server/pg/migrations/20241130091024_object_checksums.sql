@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- sha256 (hex) and size of the stored, i.e. compressed, object as announced by the
+-- FileHash and FileSize of its narinfo, used to detect corruption in the bucket
+ALTER TABLE objects ADD COLUMN sha256 char(64);
+ALTER TABLE objects ADD COLUMN size bigint;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE objects DROP COLUMN size;
+ALTER TABLE objects DROP COLUMN sha256;
+-- +goose StatementEnd
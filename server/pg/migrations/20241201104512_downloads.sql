@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- downloads records the files served through /serve to find the most requested store paths
+CREATE TABLE downloads
+(
+    id bigserial PRIMARY KEY,
+    created_at timestamp NOT NULL DEFAULT timezone('UTC', now()),
+    key varchar(1024) NOT NULL,
+    path text NOT NULL,
+    bytes bigint NOT NULL,
+    -- salted hash of the client address, never the address itself
+    client varchar(64) NOT NULL,
+    user_agent text NOT NULL
+);
+CREATE INDEX downloads_created_at_idx ON downloads (created_at);
+CREATE INDEX downloads_key_idx ON downloads (key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE downloads;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- remote_roots protect the closure a host is running, e.g. its current NixOS system,
+-- from garbage collection for as long as the host keeps renewing them.
+-- Each identity has one root per name, re-registering a name moves it to another closure.
+CREATE TABLE remote_roots
+(
+    identity varchar(1024) NOT NULL,
+    name varchar(1024) NOT NULL,
+    closure_key varchar(1024) NOT NULL REFERENCES closures (key) ON DELETE CASCADE,
+    updated_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (identity, name)
+);
+CREATE INDEX remote_roots_closure_key_idx ON remote_roots (closure_key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX remote_roots_closure_key_idx;
+DROP TABLE remote_roots;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- replace_objects makes the objects of the pending closure the complete new contents of the closure on commit,
+-- otherwise they are added to the objects of an existing closure
+ALTER TABLE pending_closures ADD COLUMN replace_objects boolean NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE pending_closures DROP COLUMN replace_objects;
+-- +goose StatementEnd
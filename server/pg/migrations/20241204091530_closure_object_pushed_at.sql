@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- updated_at is when a closure was last pushed with the object, retention of build logs and realisations
+-- counts from there. Existing references start from the last push of their closure.
+ALTER TABLE closure_objects ADD COLUMN updated_at timestamp NOT NULL DEFAULT timezone('UTC', now());
+
+UPDATE closure_objects AS co SET updated_at = c.updated_at
+FROM closures AS c
+WHERE co.closure_key = c.key;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE closure_objects DROP COLUMN updated_at;
+-- +goose StatementEnd
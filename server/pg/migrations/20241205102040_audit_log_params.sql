@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- params is the decoded JSON body of the request, e.g. the closure and objects of a push
+ALTER TABLE audit_log ADD COLUMN params jsonb;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE audit_log DROP COLUMN params;
+-- +goose StatementEnd
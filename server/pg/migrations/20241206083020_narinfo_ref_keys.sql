@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- narinfo_ref_keys maps the references of a narinfo to the keys of the referenced narinfos,
+-- so that referrers of an object can be looked up with an index instead of scanning all narinfos
+CREATE FUNCTION narinfo_ref_keys(refs varchar [])
+RETURNS text [] AS $$
+    SELECT ARRAY(SELECT split_part(r.ref, '-', 1) || '.narinfo' FROM unnest(refs) AS r (ref));
+$$ LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE;
+
+CREATE INDEX narinfos_ref_keys_idx ON narinfos USING gin (narinfo_ref_keys(refs));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX narinfos_ref_keys_idx;
+
+DROP FUNCTION narinfo_ref_keys;
+-- +goose StatementEnd
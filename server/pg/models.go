@@ -8,28 +8,104 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type AuditLog struct {
+	ID        int64            `json:"id"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+	Identity  string           `json:"identity"`
+	Method    string           `json:"method"`
+	Path      string           `json:"path"`
+	Query     string           `json:"query"`
+	Status    int32            `json:"status"`
+	Params    []byte           `json:"params"`
+}
+
 type Closure struct {
+	Key        string           `json:"key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	GroupName  pgtype.Text      `json:"group_name"`
+	Labels     []byte           `json:"labels"`
+	CreatedBy  pgtype.Text      `json:"created_by"`
+	Provenance []byte           `json:"provenance"`
+}
+
+type ClosureObject struct {
+	ClosureKey string           `json:"closure_key"`
+	ObjectKey  string           `json:"object_key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+}
+
+type ClosureRoot struct {
+	ClosureKey string           `json:"closure_key"`
+	Root       string           `json:"root"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+}
+
+type Download struct {
+	ID        int64            `json:"id"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
 	Key       string           `json:"key"`
+	Path      string           `json:"path"`
+	Bytes     int64            `json:"bytes"`
+	Client    string           `json:"client"`
+	UserAgent string           `json:"user_agent"`
+}
+
+type GcCursor struct {
+	Phase     string           `json:"phase"`
+	LastKey   string           `json:"last_key"`
 	UpdatedAt pgtype.Timestamp `json:"updated_at"`
 }
 
-type ClosureObject struct {
-	ClosureKey string `json:"closure_key"`
-	ObjectKey  string `json:"object_key"`
+type GcHold struct {
+	ID        int64            `json:"id"`
+	Reason    string           `json:"reason"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+	ExpiresAt pgtype.Timestamp `json:"expires_at"`
+}
+
+type Narinfo struct {
+	Key         string      `json:"key"`
+	StorePath   string      `json:"store_path"`
+	Url         string      `json:"url"`
+	Compression string      `json:"compression"`
+	NarHash     string      `json:"nar_hash"`
+	NarSize     int64       `json:"nar_size"`
+	Deriver     pgtype.Text `json:"deriver"`
+	Refs        []string    `json:"refs"`
+	Signatures  []string    `json:"signatures"`
 }
 
 type Object struct {
 	Key       string           `json:"key"`
 	DeletedAt pgtype.Timestamp `json:"deleted_at"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+	Endpoint  string           `json:"endpoint"`
+	Sha256    pgtype.Text      `json:"sha256"`
+	Size      pgtype.Int8      `json:"size"`
 }
 
 type PendingClosure struct {
-	ID        int64            `json:"id"`
-	Key       string           `json:"key"`
-	StartedAt pgtype.Timestamp `json:"started_at"`
+	ID             int64            `json:"id"`
+	Key            string           `json:"key"`
+	StartedAt      pgtype.Timestamp `json:"started_at"`
+	GroupName      pgtype.Text      `json:"group_name"`
+	Labels         []byte           `json:"labels"`
+	CreatedBy      pgtype.Text      `json:"created_by"`
+	Endpoint       string           `json:"endpoint"`
+	IdempotencyKey pgtype.Text      `json:"idempotency_key"`
+	Provenance     []byte           `json:"provenance"`
+	ReplaceObjects bool             `json:"replace_objects"`
 }
 
 type PendingObject struct {
 	PendingClosureID int64  `json:"pending_closure_id"`
 	Key              string `json:"key"`
 }
+
+type RemoteRoot struct {
+	Identity   string           `json:"identity"`
+	Name       string           `json:"name"`
+	ClosureKey string           `json:"closure_key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	ExpiresAt  pgtype.Timestamp `json:"expires_at"`
+}
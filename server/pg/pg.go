@@ -38,3 +38,35 @@ func Connect(ctx context.Context, connString string) (*pgxpool.Pool, error) {
 
 	return pool, nil
 }
+
+// ConnectReadOnly connects without migrating the database, e.g. to a read replica.
+// The schema is expected to be migrated by a primary server.
+func ConnectReadOnly(ctx context.Context, connString string) (*pgxpool.Pool, error) {
+	slog.Debug("connecting to read-only database", "connection_string", connString)
+
+	pool, err := pgxpool.New(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+
+	if _, err = MigrationVersion(ctx, pool); err != nil {
+		pool.Close()
+
+		return nil, fmt.Errorf("database is not migrated yet: %w", err)
+	}
+
+	return pool, nil
+}
+
+// MigrationVersion returns the version of the latest applied schema migration.
+func MigrationVersion(ctx context.Context, pool *pgxpool.Pool) (int64, error) {
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
+
+	version, err := goose.GetDBVersionContext(ctx, db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get migration version: %w", err)
+	}
+
+	return version, nil
+}
@@ -1,6 +1,8 @@
 -- name: InsertPendingClosure :one
-INSERT INTO pending_closures (started_at, key)
-VALUES (timezone('UTC', now()), $1)
+INSERT INTO pending_closures (
+    started_at, key, group_name, labels, created_by, endpoint, idempotency_key, provenance, replace_objects
+)
+VALUES (timezone('UTC', now()), $1, $2, $3, $4, $5, $6, $7, $8)
 RETURNING *;
 
 -- name: InsertPendingObjects :copyfrom
@@ -29,7 +31,7 @@ WITH cutoff_time AS (
 ),
 
 old_closures AS (
-    SELECT id
+    SELECT id, endpoint
     FROM pending_closures, cutoff_time
     WHERE started_at < cutoff_time.time
 ),
@@ -37,10 +39,11 @@ old_closures AS (
 -- Insert pending objects into objects table if they don't already exist
 -- We mark them as deleted so they can be cleaned up later
 inserted_objects AS (
-    INSERT INTO objects (key, deleted_at)
+    INSERT INTO objects (key, deleted_at, endpoint)
     SELECT
         po.key,
-        cutoff_time.time
+        cutoff_time.time,
+        oc.endpoint
     FROM pending_objects AS po
     JOIN old_closures oc ON po.pending_closure_id = oc.id, cutoff_time
     ON CONFLICT (key) DO NOTHING
@@ -62,15 +65,94 @@ USING old_closures
 WHERE pending_closures.id = old_closures.id;
 
 -- name: GetClosure :one
-SELECT updated_at FROM closures WHERE key = $1 LIMIT 1;
+SELECT
+    updated_at,
+    labels,
+    created_by,
+    provenance,
+    (SELECT count(*) FROM closure_roots WHERE closure_key = closures.key) AS roots
+FROM closures WHERE key = $1 LIMIT 1;
 
 -- name: GetClosureObjects :many
 SELECT object_key FROM closure_objects WHERE closure_key = $1;
 
 -- name: DeleteClosures :exec
-DELETE FROM closures WHERE updated_at < $1;
+-- Closures with an unexpired remote root are kept regardless of their age.
+DELETE FROM closures AS c
+WHERE
+    c.updated_at < $1
+    AND NOT EXISTS (
+        SELECT 1 FROM remote_roots AS rr
+        WHERE rr.closure_key = c.key AND rr.expires_at > timezone('UTC', now())
+    );
+
+-- name: DeleteClosuresWithLabel :execrows
+-- Deletes closures with the given label that were not pushed since older_than.
+-- Closures with an unexpired remote root are kept regardless of their age.
+DELETE FROM closures AS c
+WHERE
+    c.updated_at < sqlc.arg(older_than)::timestamp
+    AND c.labels @> jsonb_build_object(sqlc.arg(label)::text, sqlc.arg(value)::text)
+    AND NOT EXISTS (
+        SELECT 1 FROM remote_roots AS rr
+        WHERE rr.closure_key = c.key AND rr.expires_at > timezone('UTC', now())
+    );
+
+-- name: MergeClosureLabels :one
+-- Adds labels to a closure, replacing labels with the same name. Returns no row if the closure does not exist.
+UPDATE closures SET labels = labels || sqlc.arg(labels)::jsonb
+WHERE key = sqlc.arg(key)
+RETURNING key;
+
+-- name: LockStaleObjects :many
+-- Returns up to limit stale objects after the given key in key order and takes their advisory locks.
+-- Objects whose lock is held by a push are not locked and skipped until the next run.
+WITH ct AS (
+    SELECT timezone('UTC', now()) AS now
+),
+
+candidates AS MATERIALIZED (
+    SELECT o.key
+    FROM objects AS o, ct
+    WHERE
+        o.key > sqlc.arg(after)
+        AND NOT EXISTS (
+            SELECT 1
+            FROM closure_objects AS co
+            WHERE co.object_key = o.key
+        )
+        AND NOT EXISTS (
+            SELECT 1
+            FROM pending_objects AS po
+            WHERE po.key = o.key
+        )
+        AND (
+            o.deleted_at IS NULL
+            OR o.deleted_at < ct.now - interval '1 hour'
+        )
+    ORDER BY o.key
+    LIMIT sqlc.arg(limit)
+)
+
+SELECT
+    candidates.key,
+    try_lock_object(candidates.key) AS locked
+FROM candidates
+ORDER BY candidates.key;
+
+-- name: LockObjectsShared :exec
+SELECT lock_objects_shared($1::varchar []);
+
+-- name: TryLockObjects :many
+-- Returns the keys whose advisory lock was taken, keys that a push holds a shared lock on are left out.
+SELECT k.key::text AS key
+FROM unnest(sqlc.arg(keys)::varchar []) AS k (key)
+WHERE try_lock_object(k.key)
+ORDER BY k.key;
 
 -- name: MarkObjectsForDeletion :many
+-- Must run in the same transaction as LockStaleObjects.
+-- The conditions are re-checked, as a push might have committed before we got the lock.
 WITH ct AS (
     SELECT timezone('UTC', now()) AS now
 ),
@@ -93,18 +175,652 @@ stale_objects AS (
             o.deleted_at IS NULL
             OR o.deleted_at < ct.now - interval '1 hour'
         )
+        AND o.key = any(sqlc.arg(keys)::varchar [])
     FOR UPDATE
-    LIMIT $1
 )
 
 UPDATE objects
 SET deleted_at = ct.now
 FROM stale_objects, ct
 WHERE objects.key = stale_objects.key
-RETURNING objects.key;
+RETURNING objects.key, objects.endpoint;
 
 -- name: MarkObjectsAsActive :exec
 UPDATE objects SET deleted_at = NULL WHERE key = any($1::varchar []);
 
 -- name: DeleteObjects :exec
 DELETE FROM objects WHERE key = any($1::varchar []);
+
+-- name: GetPendingNarinfoKeys :many
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND po.key LIKE '%.narinfo'
+    AND NOT EXISTS (
+        SELECT 1
+        FROM narinfos AS n
+        WHERE n.key = po.key
+    );
+
+-- name: GetNarinfoKeysWithoutMetadata :many
+SELECT o.key
+FROM objects AS o
+LEFT JOIN narinfos AS n ON o.key = n.key
+WHERE
+    o.key LIKE '%.narinfo'
+    AND o.deleted_at IS NULL
+    AND n.key IS NULL
+    AND o.key > $1
+ORDER BY o.key
+LIMIT $2;
+
+-- name: GetNarinfoReferences :many
+-- Returns the recorded references of live narinfos and the store their object is in, for reconciliation.
+SELECT n.key, n.refs, o.endpoint
+FROM narinfos AS n
+JOIN objects AS o ON n.key = o.key
+WHERE o.deleted_at IS NULL AND n.key > $1
+ORDER BY n.key
+LIMIT $2;
+
+-- name: GetNarinfo :one
+-- Returns the recorded narinfo, unless its object was marked for deletion by garbage collection.
+SELECT n.*
+FROM narinfos AS n
+JOIN objects AS o ON n.key = o.key
+WHERE n.key = $1 AND o.deleted_at IS NULL;
+
+-- name: UpsertNarinfo :exec
+INSERT INTO narinfos (
+    key, store_path, url, compression, nar_hash, nar_size, deriver, refs, signatures
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (key) DO UPDATE SET
+store_path = excluded.store_path,
+url = excluded.url,
+compression = excluded.compression,
+nar_hash = excluded.nar_hash,
+nar_size = excluded.nar_size,
+deriver = excluded.deriver,
+refs = excluded.refs,
+signatures = excluded.signatures;
+
+-- name: GetObjectRefs :many
+WITH RECURSIVE refs AS (
+    SELECT
+        n.key::text AS key,
+        0 AS depth
+    FROM narinfos AS n
+    WHERE n.key = sqlc.arg(key)::varchar
+    UNION
+    SELECT
+        split_part(r.ref, '-', 1) || '.narinfo' AS key,
+        refs.depth + 1 AS depth
+    FROM refs
+    JOIN narinfos AS n ON refs.key = n.key
+    CROSS JOIN LATERAL unnest(n.refs) AS r (ref)
+    WHERE refs.depth < sqlc.arg(max_depth)::int
+)
+
+SELECT
+    refs.key::text AS key,
+    min(refs.depth)::int AS depth
+FROM refs
+WHERE refs.depth > 0 AND refs.key != sqlc.arg(key)::varchar
+GROUP BY refs.key
+ORDER BY depth, refs.key;
+
+-- name: GetObjectReferrers :many
+-- The join matches the expression of narinfos_ref_keys_idx, so that it does not scan all narinfos.
+WITH RECURSIVE referrers AS (
+    SELECT
+        sqlc.arg(key)::text AS key,
+        0 AS depth
+    UNION
+    SELECT
+        n.key::text AS key,
+        referrers.depth + 1 AS depth
+    FROM referrers
+    JOIN narinfos AS n ON narinfo_ref_keys(n.refs) @> ARRAY[referrers.key]
+    WHERE referrers.depth < sqlc.arg(max_depth)::int
+)
+
+SELECT
+    referrers.key::text AS key,
+    min(referrers.depth)::int AS depth
+FROM referrers
+WHERE referrers.depth > 0 AND referrers.key != sqlc.arg(key)::text
+GROUP BY referrers.key
+ORDER BY depth, referrers.key;
+
+-- name: AbortPendingClosures :many
+WITH cutoff_time AS (
+    SELECT
+        timezone('UTC', now())
+        - interval '1 second' * sqlc.arg(older_than_seconds)::int AS time
+),
+
+old_closures AS (
+    SELECT id, endpoint
+    FROM pending_closures, cutoff_time
+    WHERE started_at <= cutoff_time.time
+    ORDER BY id
+    LIMIT sqlc.arg(batch_size)::int
+),
+
+-- Objects might have been uploaded already, so let the garbage collector remove them
+inserted_objects AS (
+    INSERT INTO objects (key, deleted_at, endpoint)
+    SELECT
+        po.key,
+        cutoff_time.time,
+        oc.endpoint
+    FROM pending_objects AS po
+    JOIN old_closures oc ON po.pending_closure_id = oc.id, cutoff_time
+    ON CONFLICT (key) DO NOTHING
+    RETURNING key
+)
+
+DELETE FROM pending_closures
+USING old_closures
+WHERE pending_closures.id = old_closures.id
+RETURNING pending_closures.id;
+
+-- name: InsertObjects :exec
+INSERT INTO objects (key)
+SELECT unnest(sqlc.arg(keys)::varchar [])
+ON CONFLICT (key) DO NOTHING;
+
+-- name: UpsertClosure :exec
+WITH upserted AS (
+    INSERT INTO closures (key, updated_at)
+    VALUES ($1, timezone('UTC', now()))
+    ON CONFLICT (key) DO UPDATE SET updated_at = excluded.updated_at
+    RETURNING key, updated_at
+)
+
+INSERT INTO closure_roots (closure_key, root, updated_at)
+SELECT key, '', updated_at FROM upserted
+ON CONFLICT (closure_key, root) DO UPDATE SET updated_at = excluded.updated_at;
+
+-- name: DeleteClosureObjects :exec
+DELETE FROM closure_objects WHERE closure_key = $1;
+
+-- name: InsertClosureObjects :exec
+INSERT INTO closure_objects (closure_key, object_key)
+SELECT
+    sqlc.arg(closure_key)::varchar,
+    unnest(sqlc.arg(object_keys)::varchar []);
+
+-- name: GetUntrackedKeys :many
+SELECT k.key::text AS key
+FROM unnest(sqlc.arg(keys)::varchar []) AS k (key)
+WHERE
+    NOT EXISTS (
+        SELECT 1
+        FROM objects AS o
+        WHERE o.key = k.key
+    )
+    AND NOT EXISTS (
+        SELECT 1
+        FROM pending_objects AS po
+        WHERE po.key = k.key
+    );
+
+-- name: ExpireClosureObjects :execrows
+-- Detaches objects with the given prefix from their closures once the closure was not pushed with them
+-- for longer than the retention, so that the next mark phase deletes them.
+DELETE FROM closure_objects AS co
+WHERE
+    co.object_key LIKE sqlc.arg(prefix)::text || '%'
+    AND co.updated_at
+    < timezone('UTC', now())
+    - interval '1 second' * sqlc.arg(retention_seconds)::bigint;
+
+-- name: GetClosureRootStorePaths :many
+-- Returns the store paths of all narinfos in a closure that no other narinfo of the closure references.
+SELECT DISTINCT n.store_path
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+WHERE
+    co.closure_key = $1
+    AND NOT EXISTS (
+        SELECT 1
+        FROM closure_objects AS co2
+        JOIN narinfos AS n2 ON co2.object_key = n2.key
+        CROSS JOIN LATERAL unnest(n2.refs) AS r (ref)
+        WHERE
+            co2.closure_key = $1
+            AND n2.key != n.key
+            AND split_part(r.ref, '-', 1) || '.narinfo' = n.key
+    )
+ORDER BY n.store_path;
+
+-- name: GetGroupClosures :many
+SELECT c.key, r.updated_at, c.created_by, c.provenance
+FROM closure_roots AS r
+JOIN closures AS c ON r.closure_key = c.key
+WHERE r.root = $1
+ORDER BY c.key;
+
+-- name: GetClosuresByRevision :many
+SELECT key, updated_at, created_by, provenance FROM closures
+WHERE provenance ->> 'revision' = sqlc.arg(revision)::text
+ORDER BY updated_at DESC, key;
+
+-- name: DeleteGroupClosures :one
+-- Drops the group's roots and deletes the closures that no other root or unexpired remote root references.
+-- The CTEs see the roots before the delete, so the group's own root is excluded explicitly.
+WITH removed_roots AS (
+    DELETE FROM closure_roots
+    WHERE root = sqlc.arg(root) AND updated_at < sqlc.arg(updated_at)
+    RETURNING closure_key
+),
+
+deleted_closures AS (
+    DELETE FROM closures AS c
+    USING removed_roots AS rr
+    WHERE
+        c.key = rr.closure_key
+        AND NOT EXISTS (
+            SELECT 1 FROM closure_roots AS r
+            WHERE r.closure_key = c.key AND r.root != sqlc.arg(root)
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM remote_roots AS remote
+            WHERE remote.closure_key = c.key AND remote.expires_at > timezone('UTC', now())
+        )
+    RETURNING c.key
+)
+
+SELECT
+    (SELECT count(*) FROM removed_roots) AS removed,
+    (SELECT count(*) FROM deleted_closures) AS deleted;
+
+-- name: GetGroupGCPreview :one
+-- Counts what deleting the group would free: its closures that no other root or unexpired remote root
+-- references and the objects that only those closures reference.
+-- Sizes are only known for objects with a recorded checksum.
+WITH deleted AS (
+    SELECT r.closure_key AS key
+    FROM closure_roots AS r
+    WHERE
+        r.root = $1
+        AND NOT EXISTS (
+            SELECT 1 FROM closure_roots AS other
+            WHERE other.closure_key = r.closure_key AND other.root != r.root
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM remote_roots AS remote
+            WHERE remote.closure_key = r.closure_key AND remote.expires_at > timezone('UTC', now())
+        )
+),
+
+released AS (
+    SELECT DISTINCT co.object_key
+    FROM closure_objects AS co
+    JOIN deleted AS d ON co.closure_key = d.key
+    WHERE NOT EXISTS (
+        SELECT 1 FROM closure_objects AS other
+        WHERE
+            other.object_key = co.object_key
+            AND other.closure_key NOT IN (SELECT key FROM deleted)
+    )
+)
+
+SELECT
+    (SELECT count(*) FROM deleted)::bigint AS closures,
+    count(*)::bigint AS objects,
+    coalesce(sum(o.size), 0)::bigint AS bytes,
+    (count(*) FILTER (WHERE o.size IS NULL))::bigint AS unknown_size
+FROM released AS rel
+JOIN objects AS o ON rel.object_key = o.key;
+
+-- name: GetPendingObjectKeys :many
+SELECT key FROM pending_objects
+WHERE pending_closure_id = $1 AND key = any(sqlc.arg(keys)::varchar []);
+
+-- name: GetPendingKeys :many
+-- Returns the keys that any pending closure may still be uploading.
+SELECT DISTINCT key FROM pending_objects
+WHERE key = any(sqlc.arg(keys)::varchar [])
+ORDER BY key;
+
+-- name: GetClosureNarinfos :many
+SELECT n.key, n.url, n.refs
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+WHERE co.closure_key = $1
+ORDER BY n.key;
+
+-- name: GetClosureNarinfoEndpoints :many
+-- Returns the narinfos of a closure and the store their object is in, e.g. to re-sign them.
+SELECT n.key, o.endpoint
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+JOIN objects AS o ON n.key = o.key
+WHERE co.closure_key = $1
+ORDER BY n.key;
+
+-- name: AddClosureRoot :execrows
+-- Adds a root to an existing closure, e.g. the group it is promoted to. Affects no row if the closure does not exist.
+INSERT INTO closure_roots (closure_key, root, updated_at)
+SELECT c.key, sqlc.arg(root), timezone('UTC', now())
+FROM closures AS c
+WHERE c.key = sqlc.arg(closure_key)
+ON CONFLICT (closure_key, root) DO UPDATE SET updated_at = excluded.updated_at;
+
+-- name: GetNarinfoCompressions :many
+SELECT DISTINCT compression FROM narinfos ORDER BY compression;
+
+-- name: InsertAuditLog :exec
+INSERT INTO audit_log (identity, method, path, query, status, params)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: GetAuditLog :many
+SELECT * FROM audit_log
+WHERE
+    (sqlc.narg(identity)::varchar IS NULL OR identity = sqlc.narg(identity)::varchar)
+    AND (sqlc.narg(path_prefix)::varchar IS NULL OR path LIKE sqlc.narg(path_prefix)::varchar || '%' ESCAPE '\')
+    AND created_at >= sqlc.arg(since)::timestamp
+ORDER BY id DESC
+LIMIT sqlc.arg(row_limit)::int;
+
+-- name: DeleteAuditLogOlder :execrows
+DELETE FROM audit_log WHERE created_at < $1;
+
+-- name: InsertDownload :exec
+INSERT INTO downloads (key, path, bytes, client, user_agent)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: GetTopDownloads :many
+-- Aggregates the downloads per narinfo, the most downloaded first.
+SELECT
+    d.key,
+    n.store_path,
+    count(*) AS downloads,
+    sum(d.bytes)::bigint AS bytes,
+    count(DISTINCT d.client) AS clients
+FROM downloads AS d
+LEFT JOIN narinfos AS n ON d.key = n.key
+WHERE d.created_at >= sqlc.arg(since)::timestamp
+GROUP BY d.key, n.store_path
+ORDER BY downloads DESC, d.key
+LIMIT sqlc.arg(row_limit)::int;
+
+-- name: DeleteDownloadsOlder :execrows
+DELETE FROM downloads WHERE created_at < $1;
+
+-- name: GetMissingObjects :many
+-- Returns the keys that are neither part of the pending closure nor alive in the cache.
+SELECT k.key::varchar AS key
+FROM unnest(sqlc.arg(keys)::varchar []) AS k (key)
+WHERE
+    NOT EXISTS (
+        SELECT 1
+        FROM pending_objects AS po
+        WHERE po.pending_closure_id = sqlc.arg(pending_closure_id) AND po.key = k.key
+    )
+    AND NOT EXISTS (
+        SELECT 1
+        FROM objects AS o
+        WHERE o.key = k.key AND o.deleted_at IS NULL
+    );
+
+-- name: InsertGCHold :one
+INSERT INTO gc_holds (reason, expires_at)
+VALUES ($1, timezone('UTC', now()) + interval '1 second' * sqlc.arg(ttl_seconds)::bigint)
+RETURNING *;
+
+-- name: DeleteGCHold :execrows
+DELETE FROM gc_holds WHERE id = $1;
+
+-- name: GetActiveGCHolds :many
+SELECT * FROM gc_holds
+WHERE expires_at > timezone('UTC', now())
+ORDER BY expires_at DESC;
+
+-- name: UpsertRemoteRoot :one
+-- Returns no row if the closure does not exist.
+INSERT INTO remote_roots (identity, name, closure_key, updated_at, expires_at)
+SELECT
+    sqlc.arg(identity),
+    sqlc.arg(name),
+    c.key,
+    timezone('UTC', now()),
+    timezone('UTC', now()) + interval '1 second' * sqlc.arg(ttl_seconds)::bigint
+FROM closures AS c
+WHERE c.key = sqlc.arg(closure_key)
+ON CONFLICT (identity, name) DO UPDATE SET
+    closure_key = excluded.closure_key,
+    updated_at = excluded.updated_at,
+    expires_at = excluded.expires_at
+RETURNING *;
+
+-- name: DeleteRemoteRoot :execrows
+DELETE FROM remote_roots WHERE identity = $1 AND name = $2;
+
+-- name: DeleteExpiredRemoteRoots :execrows
+DELETE FROM remote_roots WHERE expires_at <= timezone('UTC', now());
+
+-- name: GetActiveRemoteRoots :many
+SELECT * FROM remote_roots
+WHERE expires_at > timezone('UTC', now())
+ORDER BY identity, name;
+
+-- name: GetClosureDiff :one
+-- Compares the objects of a closure with the objects it is about to be updated to.
+-- Garbage are objects that leave the closure and are not part of any other closure.
+WITH wanted AS (
+    SELECT DISTINCT k.key::varchar AS key
+    FROM unnest(sqlc.arg(keys)::varchar []) AS k (key)
+),
+
+current_objects AS (
+    SELECT co.object_key AS key
+    FROM closure_objects AS co
+    WHERE co.closure_key = sqlc.arg(closure_key)
+),
+
+garbage AS (
+    SELECT c.key
+    FROM current_objects AS c
+    WHERE
+        NOT EXISTS (SELECT 1 FROM wanted AS w WHERE w.key = c.key)
+        AND NOT EXISTS (
+            SELECT 1
+            FROM closure_objects AS co
+            WHERE co.object_key = c.key AND co.closure_key != sqlc.arg(closure_key)
+        )
+)
+
+SELECT
+    (
+        SELECT count(*)
+        FROM wanted AS w
+        WHERE NOT EXISTS (SELECT 1 FROM current_objects AS c WHERE c.key = w.key)
+    )::bigint AS added,
+    (
+        SELECT count(*)
+        FROM wanted AS w
+        WHERE NOT EXISTS (
+            SELECT 1 FROM objects AS o
+            WHERE o.key = w.key AND o.deleted_at IS NULL
+        )
+    )::bigint AS uploads,
+    (
+        SELECT count(*)
+        FROM current_objects AS c
+        WHERE NOT EXISTS (SELECT 1 FROM wanted AS w WHERE w.key = c.key)
+    )::bigint AS removed,
+    (SELECT count(*) FROM garbage)::bigint AS garbage,
+    (
+        SELECT coalesce(sum(n.nar_size), 0)
+        FROM garbage AS g
+        JOIN narinfos AS n ON g.key = n.key
+    )::bigint AS garbage_nar_size;
+
+-- name: GetPendingClosureEndpoint :one
+SELECT endpoint FROM pending_closures WHERE id = $1;
+
+-- name: GetPendingClosureKey :one
+SELECT key FROM pending_closures WHERE id = $1;
+
+-- name: GetPendingClosureByIdempotencyKey :one
+SELECT * FROM pending_closures WHERE idempotency_key = $1;
+
+-- name: GetPendingUploadObjectKeys :many
+-- Returns the given objects of a pending closure that are not in the cache yet, i.e. that the client may upload.
+-- Live objects are excluded, so that pushes can't overwrite them.
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND po.key = any(sqlc.arg(keys)::varchar [])
+    AND NOT EXISTS (
+        SELECT 1 FROM objects AS o
+        WHERE o.key = po.key AND o.deleted_at IS NULL
+    )
+ORDER BY po.key;
+
+-- name: GetPendingUploadKeys :many
+-- Returns the objects of a pending closure that are not in the cache yet, i.e. that the client uploads.
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND NOT EXISTS (
+        SELECT 1 FROM objects AS o
+        WHERE o.key = po.key AND o.deleted_at IS NULL
+    )
+ORDER BY po.key;
+
+-- name: AbortPendingClosure :one
+-- Objects might have been uploaded already, so let the garbage collector remove them.
+-- Objects that are already in the cache are left untouched.
+WITH aborted AS (
+    DELETE FROM pending_closures
+    WHERE id = $1
+    RETURNING id, endpoint
+),
+
+inserted_objects AS (
+    INSERT INTO objects (key, deleted_at, endpoint)
+    SELECT
+        po.key,
+        timezone('UTC', now()),
+        aborted.endpoint
+    FROM pending_objects AS po
+    JOIN aborted ON po.pending_closure_id = aborted.id
+    ON CONFLICT (key) DO NOTHING
+    RETURNING key
+)
+
+SELECT
+    (SELECT count(*) FROM aborted)::bigint AS aborted,
+    (SELECT count(*) FROM inserted_objects)::bigint AS released_objects;
+
+-- name: ExportObjects :many
+SELECT * FROM objects
+ORDER BY key;
+
+-- name: ExportClosures :many
+SELECT * FROM closures
+ORDER BY key;
+
+-- name: ExportClosureObjects :many
+SELECT * FROM closure_objects
+ORDER BY closure_key, object_key;
+
+-- name: ExportClosureRoots :many
+SELECT * FROM closure_roots
+ORDER BY closure_key, root;
+
+-- name: ExportNarinfos :many
+SELECT * FROM narinfos
+ORDER BY key;
+
+-- name: ExportRemoteRoots :many
+SELECT * FROM remote_roots
+ORDER BY identity, name;
+
+-- name: ExportGCHolds :many
+SELECT * FROM gc_holds
+ORDER BY id;
+
+-- name: IsDatabaseEmpty :one
+SELECT
+    NOT EXISTS (SELECT 1 FROM objects)
+    AND NOT EXISTS (SELECT 1 FROM closures)
+    AND NOT EXISTS (SELECT 1 FROM gc_holds) AS empty;
+
+-- name: ImportObjects :copyfrom
+INSERT INTO objects (key, deleted_at, created_at, endpoint, sha256, size)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ImportClosures :copyfrom
+INSERT INTO closures (key, updated_at, group_name, labels, created_by, provenance)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: ImportClosureObjects :copyfrom
+INSERT INTO closure_objects (closure_key, object_key, updated_at) VALUES ($1, $2, $3);
+
+-- name: ImportClosureRoots :copyfrom
+INSERT INTO closure_roots (closure_key, root, updated_at) VALUES ($1, $2, $3);
+
+-- name: ImportNarinfos :copyfrom
+INSERT INTO narinfos (key, store_path, url, compression, nar_hash, nar_size, deriver, refs, signatures)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+
+-- name: ImportRemoteRoots :copyfrom
+INSERT INTO remote_roots (identity, name, closure_key, updated_at, expires_at) VALUES ($1, $2, $3, $4, $5);
+
+-- name: ImportGCHolds :copyfrom
+-- Keeps the ids, so that holds can still be released by the id they were created with.
+INSERT INTO gc_holds (id, reason, created_at, expires_at) VALUES ($1, $2, $3, $4);
+
+-- name: ResetGCHoldIDs :exec
+-- Continues the ids of new holds after the imported ones.
+SELECT setval(pg_get_serial_sequence('gc_holds', 'id'), coalesce(max(id), 0) + 1, false) FROM gc_holds;
+
+-- name: GetGCCursor :one
+SELECT last_key FROM gc_cursors
+WHERE phase = $1;
+
+-- name: SetGCCursor :exec
+INSERT INTO gc_cursors (phase, last_key) VALUES ($1, $2)
+ON CONFLICT (phase) DO UPDATE
+SET last_key = excluded.last_key, updated_at = timezone('UTC', now());
+
+-- name: DeleteGCCursor :exec
+DELETE FROM gc_cursors
+WHERE phase = $1;
+
+-- name: SetObjectChecksum :exec
+UPDATE objects SET sha256 = $2, size = $3
+WHERE key = $1;
+
+-- name: GetObjectChecksum :one
+SELECT sha256, size FROM objects
+WHERE key = $1 AND sha256 IS NOT NULL;
+
+-- name: DeleteClosure :one
+-- Deletes a closure regardless of its roots and counts the objects no other closure references,
+-- which the next garbage collection removes. The CTEs see closure_objects before the delete.
+WITH deleted AS (
+    DELETE FROM closures
+    WHERE key = $1
+    RETURNING key
+),
+
+released AS (
+    SELECT co.object_key
+    FROM closure_objects AS co
+    JOIN deleted AS d ON co.closure_key = d.key
+    WHERE NOT EXISTS (
+        SELECT 1 FROM closure_objects AS other
+        WHERE other.object_key = co.object_key AND other.closure_key != co.closure_key
+    )
+)
+
+SELECT
+    (SELECT count(*) FROM deleted)::bigint AS deleted,
+    (SELECT count(*) FROM released)::bigint AS released;
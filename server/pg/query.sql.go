@@ -11,18 +11,137 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const abortPendingClosure = `-- name: AbortPendingClosure :one
+WITH aborted AS (
+    DELETE FROM pending_closures
+    WHERE id = $1
+    RETURNING id, endpoint
+),
+
+inserted_objects AS (
+    INSERT INTO objects (key, deleted_at, endpoint)
+    SELECT
+        po.key,
+        timezone('UTC', now()),
+        aborted.endpoint
+    FROM pending_objects AS po
+    JOIN aborted ON po.pending_closure_id = aborted.id
+    ON CONFLICT (key) DO NOTHING
+    RETURNING key
+)
+
+SELECT
+    (SELECT count(*) FROM aborted)::bigint AS aborted,
+    (SELECT count(*) FROM inserted_objects)::bigint AS released_objects
+`
+
+type AbortPendingClosureRow struct {
+	Aborted         int64 `json:"aborted"`
+	ReleasedObjects int64 `json:"released_objects"`
+}
+
+// Objects might have been uploaded already, so let the garbage collector remove them.
+// Objects that are already in the cache are left untouched.
+func (q *Queries) AbortPendingClosure(ctx context.Context, id int64) (AbortPendingClosureRow, error) {
+	row := q.db.QueryRow(ctx, abortPendingClosure, id)
+	var i AbortPendingClosureRow
+	err := row.Scan(&i.Aborted, &i.ReleasedObjects)
+	return i, err
+}
+
+const abortPendingClosures = `-- name: AbortPendingClosures :many
+WITH cutoff_time AS (
+    SELECT
+        timezone('UTC', now())
+        - interval '1 second' * $1::int AS time
+),
+
+old_closures AS (
+    SELECT id, endpoint
+    FROM pending_closures, cutoff_time
+    WHERE started_at <= cutoff_time.time
+    ORDER BY id
+    LIMIT $2::int
+),
+
+inserted_objects AS (
+    INSERT INTO objects (key, deleted_at, endpoint)
+    SELECT
+        po.key,
+        cutoff_time.time,
+        oc.endpoint
+    FROM pending_objects AS po
+    JOIN old_closures oc ON po.pending_closure_id = oc.id, cutoff_time
+    ON CONFLICT (key) DO NOTHING
+    RETURNING key
+)
+
+DELETE FROM pending_closures
+USING old_closures
+WHERE pending_closures.id = old_closures.id
+RETURNING pending_closures.id
+`
+
+type AbortPendingClosuresParams struct {
+	OlderThanSeconds int32 `json:"older_than_seconds"`
+	BatchSize        int32 `json:"batch_size"`
+}
+
+// Objects might have been uploaded already, so let the garbage collector remove them
+func (q *Queries) AbortPendingClosures(ctx context.Context, arg AbortPendingClosuresParams) ([]int64, error) {
+	rows, err := q.db.Query(ctx, abortPendingClosures, arg.OlderThanSeconds, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const addClosureRoot = `-- name: AddClosureRoot :execrows
+INSERT INTO closure_roots (closure_key, root, updated_at)
+SELECT c.key, $1, timezone('UTC', now())
+FROM closures AS c
+WHERE c.key = $2
+ON CONFLICT (closure_key, root) DO UPDATE SET updated_at = excluded.updated_at
+`
+
+type AddClosureRootParams struct {
+	Root       string `json:"root"`
+	ClosureKey string `json:"closure_key"`
+}
+
+// Adds a root to an existing closure, e.g. the group it is promoted to. Affects no row if the closure does not exist.
+func (q *Queries) AddClosureRoot(ctx context.Context, arg AddClosureRootParams) (int64, error) {
+	result, err := q.db.Exec(ctx, addClosureRoot, arg.Root, arg.ClosureKey)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const cleanupPendingClosures = `-- name: CleanupPendingClosures :exec
 WITH cutoff_time AS (
     SELECT timezone('UTC', NOW()) - interval '1 second' * $1 AS time
 ),
 old_closures AS (
-    SELECT id
+    SELECT id, endpoint
     FROM pending_closures, cutoff_time
     WHERE started_at < cutoff_time.time
 ),
 inserted_objects AS (
-    INSERT INTO objects (key, deleted_at)
-    SELECT po.key, cutoff_time.time
+    INSERT INTO objects (key, deleted_at, endpoint)
+    SELECT po.key, cutoff_time.time, oc.endpoint
     FROM pending_objects as po
     JOIN old_closures oc ON po.pending_closure_id = oc.id, cutoff_time
     ON CONFLICT (key) DO NOTHING
@@ -58,15 +177,199 @@ func (q *Queries) CommitPendingClosure(ctx context.Context, dollar_1 int64) erro
 	return err
 }
 
+const deleteAuditLogOlder = `-- name: DeleteAuditLogOlder :execrows
+DELETE FROM audit_log WHERE created_at < $1
+`
+
+func (q *Queries) DeleteAuditLogOlder(ctx context.Context, createdAt pgtype.Timestamp) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteAuditLogOlder, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteClosure = `-- name: DeleteClosure :one
+WITH deleted AS (
+    DELETE FROM closures
+    WHERE key = $1
+    RETURNING key
+),
+
+released AS (
+    SELECT co.object_key
+    FROM closure_objects AS co
+    JOIN deleted AS d ON co.closure_key = d.key
+    WHERE NOT EXISTS (
+        SELECT 1 FROM closure_objects AS other
+        WHERE other.object_key = co.object_key AND other.closure_key != co.closure_key
+    )
+)
+
+SELECT
+    (SELECT count(*) FROM deleted)::bigint AS deleted,
+    (SELECT count(*) FROM released)::bigint AS released
+`
+
+type DeleteClosureRow struct {
+	Deleted  int64 `json:"deleted"`
+	Released int64 `json:"released"`
+}
+
+// Deletes a closure regardless of its roots and counts the objects no other closure references,
+// which the next garbage collection removes. The CTEs see closure_objects before the delete.
+func (q *Queries) DeleteClosure(ctx context.Context, key string) (DeleteClosureRow, error) {
+	row := q.db.QueryRow(ctx, deleteClosure, key)
+	var i DeleteClosureRow
+	err := row.Scan(&i.Deleted, &i.Released)
+	return i, err
+}
+
+const deleteClosureObjects = `-- name: DeleteClosureObjects :exec
+DELETE FROM closure_objects WHERE closure_key = $1
+`
+
+func (q *Queries) DeleteClosureObjects(ctx context.Context, closureKey string) error {
+	_, err := q.db.Exec(ctx, deleteClosureObjects, closureKey)
+	return err
+}
+
 const deleteClosures = `-- name: DeleteClosures :exec
-DELETE FROM closures WHERE updated_at < $1
+DELETE FROM closures AS c
+WHERE
+    c.updated_at < $1
+    AND NOT EXISTS (
+        SELECT 1 FROM remote_roots AS rr
+        WHERE rr.closure_key = c.key AND rr.expires_at > timezone('UTC', now())
+    )
 `
 
+// Closures with an unexpired remote root are kept regardless of their age.
 func (q *Queries) DeleteClosures(ctx context.Context, updatedAt pgtype.Timestamp) error {
 	_, err := q.db.Exec(ctx, deleteClosures, updatedAt)
 	return err
 }
 
+const deleteClosuresWithLabel = `-- name: DeleteClosuresWithLabel :execrows
+DELETE FROM closures AS c
+WHERE
+    c.updated_at < $1::timestamp
+    AND c.labels @> jsonb_build_object($2::text, $3::text)
+    AND NOT EXISTS (
+        SELECT 1 FROM remote_roots AS rr
+        WHERE rr.closure_key = c.key AND rr.expires_at > timezone('UTC', now())
+    )
+`
+
+type DeleteClosuresWithLabelParams struct {
+	OlderThan pgtype.Timestamp `json:"older_than"`
+	Label     string           `json:"label"`
+	Value     string           `json:"value"`
+}
+
+// Deletes closures with the given label that were not pushed since older_than.
+// Closures with an unexpired remote root are kept regardless of their age.
+func (q *Queries) DeleteClosuresWithLabel(ctx context.Context, arg DeleteClosuresWithLabelParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteClosuresWithLabel, arg.OlderThan, arg.Label, arg.Value)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteDownloadsOlder = `-- name: DeleteDownloadsOlder :execrows
+DELETE FROM downloads WHERE created_at < $1
+`
+
+func (q *Queries) DeleteDownloadsOlder(ctx context.Context, createdAt pgtype.Timestamp) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteDownloadsOlder, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteExpiredRemoteRoots = `-- name: DeleteExpiredRemoteRoots :execrows
+DELETE FROM remote_roots WHERE expires_at <= timezone('UTC', now())
+`
+
+func (q *Queries) DeleteExpiredRemoteRoots(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteExpiredRemoteRoots)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteGCCursor = `-- name: DeleteGCCursor :exec
+DELETE FROM gc_cursors
+WHERE phase = $1
+`
+
+func (q *Queries) DeleteGCCursor(ctx context.Context, phase string) error {
+	_, err := q.db.Exec(ctx, deleteGCCursor, phase)
+	return err
+}
+
+const deleteGCHold = `-- name: DeleteGCHold :execrows
+DELETE FROM gc_holds WHERE id = $1
+`
+
+func (q *Queries) DeleteGCHold(ctx context.Context, id int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteGCHold, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteGroupClosures = `-- name: DeleteGroupClosures :one
+WITH removed_roots AS (
+    DELETE FROM closure_roots
+    WHERE root = $1 AND updated_at < $2
+    RETURNING closure_key
+),
+
+deleted_closures AS (
+    DELETE FROM closures AS c
+    USING removed_roots AS rr
+    WHERE
+        c.key = rr.closure_key
+        AND NOT EXISTS (
+            SELECT 1 FROM closure_roots AS r
+            WHERE r.closure_key = c.key AND r.root != $1
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM remote_roots AS remote
+            WHERE remote.closure_key = c.key AND remote.expires_at > timezone('UTC', now())
+        )
+    RETURNING c.key
+)
+
+SELECT
+    (SELECT count(*) FROM removed_roots) AS removed,
+    (SELECT count(*) FROM deleted_closures) AS deleted
+`
+
+type DeleteGroupClosuresParams struct {
+	Root      string           `json:"root"`
+	UpdatedAt pgtype.Timestamp `json:"updated_at"`
+}
+
+type DeleteGroupClosuresRow struct {
+	Removed int64 `json:"removed"`
+	Deleted int64 `json:"deleted"`
+}
+
+// Drops the group's roots and deletes the closures that no other root or unexpired remote root references.
+// The CTEs see the roots before the delete, so the group's own root is excluded explicitly.
+func (q *Queries) DeleteGroupClosures(ctx context.Context, arg DeleteGroupClosuresParams) (DeleteGroupClosuresRow, error) {
+	row := q.db.QueryRow(ctx, deleteGroupClosures, arg.Root, arg.UpdatedAt)
+	var i DeleteGroupClosuresRow
+	err := row.Scan(&i.Removed, &i.Deleted)
+	return i, err
+}
+
 const deleteObjects = `-- name: DeleteObjects :exec
 DELETE FROM objects WHERE key = any($1::varchar [])
 `
@@ -76,34 +379,65 @@ func (q *Queries) DeleteObjects(ctx context.Context, dollar_1 []string) error {
 	return err
 }
 
-const getClosure = `-- name: GetClosure :one
-SELECT updated_at FROM closures WHERE key = $1 LIMIT 1
+const deleteRemoteRoot = `-- name: DeleteRemoteRoot :execrows
+DELETE FROM remote_roots WHERE identity = $1 AND name = $2
 `
 
-func (q *Queries) GetClosure(ctx context.Context, key string) (pgtype.Timestamp, error) {
-	row := q.db.QueryRow(ctx, getClosure, key)
-	var updated_at pgtype.Timestamp
-	err := row.Scan(&updated_at)
-	return updated_at, err
+type DeleteRemoteRootParams struct {
+	Identity string `json:"identity"`
+	Name     string `json:"name"`
 }
 
-const getClosureObjects = `-- name: GetClosureObjects :many
-SELECT object_key FROM closure_objects WHERE closure_key = $1
+func (q *Queries) DeleteRemoteRoot(ctx context.Context, arg DeleteRemoteRootParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteRemoteRoot, arg.Identity, arg.Name)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const expireClosureObjects = `-- name: ExpireClosureObjects :execrows
+DELETE FROM closure_objects AS co
+WHERE
+    co.object_key LIKE $1::text || '%'
+    AND co.updated_at
+    < timezone('UTC', now())
+    - interval '1 second' * $2::bigint
 `
 
-func (q *Queries) GetClosureObjects(ctx context.Context, closureKey string) ([]string, error) {
-	rows, err := q.db.Query(ctx, getClosureObjects, closureKey)
+type ExpireClosureObjectsParams struct {
+	Prefix           string `json:"prefix"`
+	RetentionSeconds int64  `json:"retention_seconds"`
+}
+
+// Detaches objects with the given prefix from their closures once the closure was not pushed with them
+// for longer than the retention, so that the next mark phase deletes them.
+func (q *Queries) ExpireClosureObjects(ctx context.Context, arg ExpireClosureObjectsParams) (int64, error) {
+	result, err := q.db.Exec(ctx, expireClosureObjects, arg.Prefix, arg.RetentionSeconds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const exportClosureObjects = `-- name: ExportClosureObjects :many
+SELECT closure_key, object_key, updated_at FROM closure_objects
+ORDER BY closure_key, object_key
+`
+
+func (q *Queries) ExportClosureObjects(ctx context.Context) ([]ClosureObject, error) {
+	rows, err := q.db.Query(ctx, exportClosureObjects)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []ClosureObject
 	for rows.Next() {
-		var object_key string
-		if err := rows.Scan(&object_key); err != nil {
+		var i ClosureObject
+		if err := rows.Scan(&i.ClosureKey, &i.ObjectKey, &i.UpdatedAt); err != nil {
 			return nil, err
 		}
-		items = append(items, object_key)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -111,36 +445,21 @@ func (q *Queries) GetClosureObjects(ctx context.Context, closureKey string) ([]s
 	return items, nil
 }
 
-const getExistingObjects = `-- name: GetExistingObjects :many
-WITH ct AS (
-    SELECT timezone('UTC', now()) AS now
-)
-
-SELECT
-    o.key AS key,
-    CASE
-        WHEN o.deleted_at IS NULL THEN NULL
-        ELSE ct.now - o.deleted_at
-    END AS deleted_at
-FROM objects AS o, ct
-WHERE key = any($1::varchar [])
+const exportClosureRoots = `-- name: ExportClosureRoots :many
+SELECT closure_key, root, updated_at FROM closure_roots
+ORDER BY closure_key, root
 `
 
-type GetExistingObjectsRow struct {
-	Key       string      `json:"key"`
-	DeletedAt interface{} `json:"deleted_at"`
-}
-
-func (q *Queries) GetExistingObjects(ctx context.Context, dollar_1 []string) ([]GetExistingObjectsRow, error) {
-	rows, err := q.db.Query(ctx, getExistingObjects, dollar_1)
+func (q *Queries) ExportClosureRoots(ctx context.Context) ([]ClosureRoot, error) {
+	rows, err := q.db.Query(ctx, exportClosureRoots)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []GetExistingObjectsRow
+	var items []ClosureRoot
 	for rows.Next() {
-		var i GetExistingObjectsRow
-		if err := rows.Scan(&i.Key, &i.DeletedAt); err != nil {
+		var i ClosureRoot
+		if err := rows.Scan(&i.ClosureKey, &i.Root, &i.UpdatedAt); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -151,83 +470,1862 @@ func (q *Queries) GetExistingObjects(ctx context.Context, dollar_1 []string) ([]
 	return items, nil
 }
 
-const insertPendingClosure = `-- name: InsertPendingClosure :one
-INSERT INTO pending_closures (started_at, key)
-VALUES (timezone('UTC', now()), $1)
-RETURNING id, key, started_at
+const exportClosures = `-- name: ExportClosures :many
+SELECT key, updated_at, group_name, labels, created_by, provenance FROM closures
+ORDER BY key
 `
 
-func (q *Queries) InsertPendingClosure(ctx context.Context, key string) (PendingClosure, error) {
-	row := q.db.QueryRow(ctx, insertPendingClosure, key)
-	var i PendingClosure
-	err := row.Scan(&i.ID, &i.Key, &i.StartedAt)
-	return i, err
-}
-
-type InsertPendingObjectsParams struct {
-	PendingClosureID int64  `json:"pending_closure_id"`
-	Key              string `json:"key"`
+func (q *Queries) ExportClosures(ctx context.Context) ([]Closure, error) {
+	rows, err := q.db.Query(ctx, exportClosures)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Closure
+	for rows.Next() {
+		var i Closure
+		if err := rows.Scan(
+			&i.Key,
+			&i.UpdatedAt,
+			&i.GroupName,
+			&i.Labels,
+			&i.CreatedBy,
+			&i.Provenance,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-const markObjectsAsActive = `-- name: MarkObjectsAsActive :exec
-UPDATE objects SET deleted_at = NULL WHERE key = any($1::varchar [])
+const exportGCHolds = `-- name: ExportGCHolds :many
+SELECT id, reason, created_at, expires_at FROM gc_holds
+ORDER BY id
 `
 
-func (q *Queries) MarkObjectsAsActive(ctx context.Context, dollar_1 []string) error {
-	_, err := q.db.Exec(ctx, markObjectsAsActive, dollar_1)
-	return err
+func (q *Queries) ExportGCHolds(ctx context.Context) ([]GcHold, error) {
+	rows, err := q.db.Query(ctx, exportGCHolds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GcHold
+	for rows.Next() {
+		var i GcHold
+		if err := rows.Scan(
+			&i.ID,
+			&i.Reason,
+			&i.CreatedAt,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-const markObjectsForDeletion = `-- name: MarkObjectsForDeletion :many
-WITH ct AS (
-    SELECT timezone('UTC', now()) AS now
-),
-
-stale_objects AS (
-    SELECT o.key
-    FROM objects AS o, ct
-    WHERE
-        NOT EXISTS (
-            SELECT 1
-            FROM closure_objects AS co
-            WHERE co.object_key = o.key
-        )
-        AND NOT EXISTS (
-            SELECT 1
-            FROM pending_objects AS po
-            WHERE po.key = o.key
-        )
-        AND (
-            o.deleted_at IS NULL
-            OR o.deleted_at < ct.now - interval '1 hour'
-        )
-    FOR UPDATE
-    LIMIT $1
-)
-
-UPDATE objects
-SET deleted_at = ct.now
-FROM stale_objects, ct
-WHERE objects.key = stale_objects.key
-RETURNING objects.key
+const exportNarinfos = `-- name: ExportNarinfos :many
+SELECT key, store_path, url, compression, nar_hash, nar_size, deriver, refs, signatures FROM narinfos
+ORDER BY key
 `
 
-func (q *Queries) MarkObjectsForDeletion(ctx context.Context, limit int32) ([]string, error) {
-	rows, err := q.db.Query(ctx, markObjectsForDeletion, limit)
+func (q *Queries) ExportNarinfos(ctx context.Context) ([]Narinfo, error) {
+	rows, err := q.db.Query(ctx, exportNarinfos)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []string
+	var items []Narinfo
 	for rows.Next() {
-		var key string
-		if err := rows.Scan(&key); err != nil {
+		var i Narinfo
+		if err := rows.Scan(
+			&i.Key,
+			&i.StorePath,
+			&i.Url,
+			&i.Compression,
+			&i.NarHash,
+			&i.NarSize,
+			&i.Deriver,
+			&i.Refs,
+			&i.Signatures,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, key)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 	return items, nil
 }
+
+const exportObjects = `-- name: ExportObjects :many
+SELECT key, deleted_at, created_at, endpoint, sha256, size FROM objects
+ORDER BY key
+`
+
+func (q *Queries) ExportObjects(ctx context.Context) ([]Object, error) {
+	rows, err := q.db.Query(ctx, exportObjects)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Object
+	for rows.Next() {
+		var i Object
+		if err := rows.Scan(
+			&i.Key,
+			&i.DeletedAt,
+			&i.CreatedAt,
+			&i.Endpoint,
+			&i.Sha256,
+			&i.Size,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const exportRemoteRoots = `-- name: ExportRemoteRoots :many
+SELECT identity, name, closure_key, updated_at, expires_at FROM remote_roots
+ORDER BY identity, name
+`
+
+func (q *Queries) ExportRemoteRoots(ctx context.Context) ([]RemoteRoot, error) {
+	rows, err := q.db.Query(ctx, exportRemoteRoots)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RemoteRoot
+	for rows.Next() {
+		var i RemoteRoot
+		if err := rows.Scan(
+			&i.Identity,
+			&i.Name,
+			&i.ClosureKey,
+			&i.UpdatedAt,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getActiveGCHolds = `-- name: GetActiveGCHolds :many
+SELECT id, reason, created_at, expires_at FROM gc_holds
+WHERE expires_at > timezone('UTC', now())
+ORDER BY expires_at DESC
+`
+
+func (q *Queries) GetActiveGCHolds(ctx context.Context) ([]GcHold, error) {
+	rows, err := q.db.Query(ctx, getActiveGCHolds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GcHold
+	for rows.Next() {
+		var i GcHold
+		if err := rows.Scan(
+			&i.ID,
+			&i.Reason,
+			&i.CreatedAt,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getActiveRemoteRoots = `-- name: GetActiveRemoteRoots :many
+SELECT identity, name, closure_key, updated_at, expires_at FROM remote_roots
+WHERE expires_at > timezone('UTC', now())
+ORDER BY identity, name
+`
+
+func (q *Queries) GetActiveRemoteRoots(ctx context.Context) ([]RemoteRoot, error) {
+	rows, err := q.db.Query(ctx, getActiveRemoteRoots)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RemoteRoot
+	for rows.Next() {
+		var i RemoteRoot
+		if err := rows.Scan(
+			&i.Identity,
+			&i.Name,
+			&i.ClosureKey,
+			&i.UpdatedAt,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getAuditLog = `-- name: GetAuditLog :many
+SELECT id, created_at, identity, method, path, query, status, params FROM audit_log
+WHERE
+    ($1::varchar IS NULL OR identity = $1::varchar)
+    AND ($2::varchar IS NULL OR path LIKE $2::varchar || '%' ESCAPE '\')
+    AND created_at >= $3::timestamp
+ORDER BY id DESC
+LIMIT $4::int
+`
+
+type GetAuditLogParams struct {
+	Identity   pgtype.Text      `json:"identity"`
+	PathPrefix pgtype.Text      `json:"path_prefix"`
+	Since      pgtype.Timestamp `json:"since"`
+	RowLimit   int32            `json:"row_limit"`
+}
+
+func (q *Queries) GetAuditLog(ctx context.Context, arg GetAuditLogParams) ([]AuditLog, error) {
+	rows, err := q.db.Query(ctx, getAuditLog,
+		arg.Identity,
+		arg.PathPrefix,
+		arg.Since,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []AuditLog
+	for rows.Next() {
+		var i AuditLog
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.Identity,
+			&i.Method,
+			&i.Path,
+			&i.Query,
+			&i.Status,
+			&i.Params,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getClosure = `-- name: GetClosure :one
+SELECT
+    updated_at,
+    labels,
+    created_by,
+    provenance,
+    (SELECT count(*) FROM closure_roots WHERE closure_key = closures.key) AS roots
+FROM closures WHERE key = $1 LIMIT 1
+`
+
+type GetClosureRow struct {
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	Labels     []byte           `json:"labels"`
+	CreatedBy  pgtype.Text      `json:"created_by"`
+	Provenance []byte           `json:"provenance"`
+	Roots      int64            `json:"roots"`
+}
+
+func (q *Queries) GetClosure(ctx context.Context, key string) (GetClosureRow, error) {
+	row := q.db.QueryRow(ctx, getClosure, key)
+	var i GetClosureRow
+	err := row.Scan(
+		&i.UpdatedAt,
+		&i.Labels,
+		&i.CreatedBy,
+		&i.Provenance,
+		&i.Roots,
+	)
+	return i, err
+}
+
+const getClosureDiff = `-- name: GetClosureDiff :one
+WITH wanted AS (
+    SELECT DISTINCT k.key::varchar AS key
+    FROM unnest($1::varchar []) AS k (key)
+),
+
+current_objects AS (
+    SELECT co.object_key AS key
+    FROM closure_objects AS co
+    WHERE co.closure_key = $2
+),
+
+garbage AS (
+    SELECT c.key
+    FROM current_objects AS c
+    WHERE
+        NOT EXISTS (SELECT 1 FROM wanted AS w WHERE w.key = c.key)
+        AND NOT EXISTS (
+            SELECT 1
+            FROM closure_objects AS co
+            WHERE co.object_key = c.key AND co.closure_key != $2
+        )
+)
+
+SELECT
+    (
+        SELECT count(*)
+        FROM wanted AS w
+        WHERE NOT EXISTS (SELECT 1 FROM current_objects AS c WHERE c.key = w.key)
+    )::bigint AS added,
+    (
+        SELECT count(*)
+        FROM wanted AS w
+        WHERE NOT EXISTS (
+            SELECT 1 FROM objects AS o
+            WHERE o.key = w.key AND o.deleted_at IS NULL
+        )
+    )::bigint AS uploads,
+    (
+        SELECT count(*)
+        FROM current_objects AS c
+        WHERE NOT EXISTS (SELECT 1 FROM wanted AS w WHERE w.key = c.key)
+    )::bigint AS removed,
+    (SELECT count(*) FROM garbage)::bigint AS garbage,
+    (
+        SELECT coalesce(sum(n.nar_size), 0)
+        FROM garbage AS g
+        JOIN narinfos AS n ON g.key = n.key
+    )::bigint AS garbage_nar_size
+`
+
+type GetClosureDiffParams struct {
+	Keys       []string `json:"keys"`
+	ClosureKey string   `json:"closure_key"`
+}
+
+type GetClosureDiffRow struct {
+	Added          int64 `json:"added"`
+	Uploads        int64 `json:"uploads"`
+	Removed        int64 `json:"removed"`
+	Garbage        int64 `json:"garbage"`
+	GarbageNarSize int64 `json:"garbage_nar_size"`
+}
+
+// Compares the objects of a closure with the objects it is about to be updated to.
+// Garbage are objects that leave the closure and are not part of any other closure.
+func (q *Queries) GetClosureDiff(ctx context.Context, arg GetClosureDiffParams) (GetClosureDiffRow, error) {
+	row := q.db.QueryRow(ctx, getClosureDiff, arg.Keys, arg.ClosureKey)
+	var i GetClosureDiffRow
+	err := row.Scan(
+		&i.Added,
+		&i.Uploads,
+		&i.Removed,
+		&i.Garbage,
+		&i.GarbageNarSize,
+	)
+	return i, err
+}
+
+const getClosureNarinfoEndpoints = `-- name: GetClosureNarinfoEndpoints :many
+SELECT n.key, o.endpoint
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+JOIN objects AS o ON n.key = o.key
+WHERE co.closure_key = $1
+ORDER BY n.key
+`
+
+type GetClosureNarinfoEndpointsRow struct {
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Returns the narinfos of a closure and the store their object is in, e.g. to re-sign them.
+func (q *Queries) GetClosureNarinfoEndpoints(ctx context.Context, closureKey string) ([]GetClosureNarinfoEndpointsRow, error) {
+	rows, err := q.db.Query(ctx, getClosureNarinfoEndpoints, closureKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetClosureNarinfoEndpointsRow
+	for rows.Next() {
+		var i GetClosureNarinfoEndpointsRow
+		if err := rows.Scan(&i.Key, &i.Endpoint); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getClosureNarinfos = `-- name: GetClosureNarinfos :many
+SELECT n.key, n.url, n.refs
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+WHERE co.closure_key = $1
+ORDER BY n.key
+`
+
+type GetClosureNarinfosRow struct {
+	Key  string   `json:"key"`
+	Url  string   `json:"url"`
+	Refs []string `json:"refs"`
+}
+
+func (q *Queries) GetClosureNarinfos(ctx context.Context, closureKey string) ([]GetClosureNarinfosRow, error) {
+	rows, err := q.db.Query(ctx, getClosureNarinfos, closureKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetClosureNarinfosRow
+	for rows.Next() {
+		var i GetClosureNarinfosRow
+		if err := rows.Scan(&i.Key, &i.Url, &i.Refs); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getClosureObjects = `-- name: GetClosureObjects :many
+SELECT object_key FROM closure_objects WHERE closure_key = $1
+`
+
+func (q *Queries) GetClosureObjects(ctx context.Context, closureKey string) ([]string, error) {
+	rows, err := q.db.Query(ctx, getClosureObjects, closureKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var object_key string
+		if err := rows.Scan(&object_key); err != nil {
+			return nil, err
+		}
+		items = append(items, object_key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getClosureRootStorePaths = `-- name: GetClosureRootStorePaths :many
+SELECT DISTINCT n.store_path
+FROM closure_objects AS co
+JOIN narinfos AS n ON co.object_key = n.key
+WHERE
+    co.closure_key = $1
+    AND NOT EXISTS (
+        SELECT 1
+        FROM closure_objects AS co2
+        JOIN narinfos AS n2 ON co2.object_key = n2.key
+        CROSS JOIN LATERAL unnest(n2.refs) AS r (ref)
+        WHERE
+            co2.closure_key = $1
+            AND n2.key != n.key
+            AND split_part(r.ref, '-', 1) || '.narinfo' = n.key
+    )
+ORDER BY n.store_path
+`
+
+// Returns the store paths of all narinfos in a closure that no other narinfo of the closure references.
+func (q *Queries) GetClosureRootStorePaths(ctx context.Context, closureKey string) ([]string, error) {
+	rows, err := q.db.Query(ctx, getClosureRootStorePaths, closureKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var store_path string
+		if err := rows.Scan(&store_path); err != nil {
+			return nil, err
+		}
+		items = append(items, store_path)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getClosuresByRevision = `-- name: GetClosuresByRevision :many
+SELECT key, updated_at, created_by, provenance FROM closures
+WHERE provenance ->> 'revision' = $1::text
+ORDER BY updated_at DESC, key
+`
+
+type GetClosuresByRevisionRow struct {
+	Key        string           `json:"key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	CreatedBy  pgtype.Text      `json:"created_by"`
+	Provenance []byte           `json:"provenance"`
+}
+
+func (q *Queries) GetClosuresByRevision(ctx context.Context, revision string) ([]GetClosuresByRevisionRow, error) {
+	rows, err := q.db.Query(ctx, getClosuresByRevision, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetClosuresByRevisionRow
+	for rows.Next() {
+		var i GetClosuresByRevisionRow
+		if err := rows.Scan(
+			&i.Key,
+			&i.UpdatedAt,
+			&i.CreatedBy,
+			&i.Provenance,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getExistingObjects = `-- name: GetExistingObjects :many
+WITH ct AS (
+    SELECT timezone('UTC', now()) AS now
+)
+
+SELECT
+    o.key AS key,
+    CASE
+        WHEN o.deleted_at IS NULL THEN NULL
+        ELSE ct.now - o.deleted_at
+    END AS deleted_at
+FROM objects AS o, ct
+WHERE key = any($1::varchar [])
+`
+
+type GetExistingObjectsRow struct {
+	Key       string      `json:"key"`
+	DeletedAt interface{} `json:"deleted_at"`
+}
+
+func (q *Queries) GetExistingObjects(ctx context.Context, dollar_1 []string) ([]GetExistingObjectsRow, error) {
+	rows, err := q.db.Query(ctx, getExistingObjects, dollar_1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetExistingObjectsRow
+	for rows.Next() {
+		var i GetExistingObjectsRow
+		if err := rows.Scan(&i.Key, &i.DeletedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getGCCursor = `-- name: GetGCCursor :one
+SELECT last_key FROM gc_cursors
+WHERE phase = $1
+`
+
+func (q *Queries) GetGCCursor(ctx context.Context, phase string) (string, error) {
+	row := q.db.QueryRow(ctx, getGCCursor, phase)
+	var last_key string
+	err := row.Scan(&last_key)
+	return last_key, err
+}
+
+const getGroupClosures = `-- name: GetGroupClosures :many
+SELECT c.key, r.updated_at, c.created_by, c.provenance
+FROM closure_roots AS r
+JOIN closures AS c ON r.closure_key = c.key
+WHERE r.root = $1
+ORDER BY c.key
+`
+
+type GetGroupClosuresRow struct {
+	Key        string           `json:"key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	CreatedBy  pgtype.Text      `json:"created_by"`
+	Provenance []byte           `json:"provenance"`
+}
+
+func (q *Queries) GetGroupClosures(ctx context.Context, root string) ([]GetGroupClosuresRow, error) {
+	rows, err := q.db.Query(ctx, getGroupClosures, root)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetGroupClosuresRow
+	for rows.Next() {
+		var i GetGroupClosuresRow
+		if err := rows.Scan(
+			&i.Key,
+			&i.UpdatedAt,
+			&i.CreatedBy,
+			&i.Provenance,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getGroupGCPreview = `-- name: GetGroupGCPreview :one
+WITH deleted AS (
+    SELECT r.closure_key AS key
+    FROM closure_roots AS r
+    WHERE
+        r.root = $1
+        AND NOT EXISTS (
+            SELECT 1 FROM closure_roots AS other
+            WHERE other.closure_key = r.closure_key AND other.root != r.root
+        )
+        AND NOT EXISTS (
+            SELECT 1 FROM remote_roots AS remote
+            WHERE remote.closure_key = r.closure_key AND remote.expires_at > timezone('UTC', now())
+        )
+),
+
+released AS (
+    SELECT DISTINCT co.object_key
+    FROM closure_objects AS co
+    JOIN deleted AS d ON co.closure_key = d.key
+    WHERE NOT EXISTS (
+        SELECT 1 FROM closure_objects AS other
+        WHERE
+            other.object_key = co.object_key
+            AND other.closure_key NOT IN (SELECT key FROM deleted)
+    )
+)
+
+SELECT
+    (SELECT count(*) FROM deleted)::bigint AS closures,
+    count(*)::bigint AS objects,
+    coalesce(sum(o.size), 0)::bigint AS bytes,
+    (count(*) FILTER (WHERE o.size IS NULL))::bigint AS unknown_size
+FROM released AS rel
+JOIN objects AS o ON rel.object_key = o.key
+`
+
+type GetGroupGCPreviewRow struct {
+	Closures    int64 `json:"closures"`
+	Objects     int64 `json:"objects"`
+	Bytes       int64 `json:"bytes"`
+	UnknownSize int64 `json:"unknown_size"`
+}
+
+// Counts what deleting the group would free: its closures that no other root or unexpired remote root
+// references and the objects that only those closures reference.
+// Sizes are only known for objects with a recorded checksum.
+func (q *Queries) GetGroupGCPreview(ctx context.Context, root string) (GetGroupGCPreviewRow, error) {
+	row := q.db.QueryRow(ctx, getGroupGCPreview, root)
+	var i GetGroupGCPreviewRow
+	err := row.Scan(
+		&i.Closures,
+		&i.Objects,
+		&i.Bytes,
+		&i.UnknownSize,
+	)
+	return i, err
+}
+
+const getMissingObjects = `-- name: GetMissingObjects :many
+SELECT k.key::varchar AS key
+FROM unnest($1::varchar []) AS k (key)
+WHERE
+    NOT EXISTS (
+        SELECT 1
+        FROM pending_objects AS po
+        WHERE po.pending_closure_id = $2 AND po.key = k.key
+    )
+    AND NOT EXISTS (
+        SELECT 1
+        FROM objects AS o
+        WHERE o.key = k.key AND o.deleted_at IS NULL
+    )
+`
+
+type GetMissingObjectsParams struct {
+	Keys             []string `json:"keys"`
+	PendingClosureID int64    `json:"pending_closure_id"`
+}
+
+// Returns the keys that are neither part of the pending closure nor alive in the cache.
+func (q *Queries) GetMissingObjects(ctx context.Context, arg GetMissingObjectsParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getMissingObjects, arg.Keys, arg.PendingClosureID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNarinfo = `-- name: GetNarinfo :one
+SELECT n.key, n.store_path, n.url, n.compression, n.nar_hash, n.nar_size, n.deriver, n.refs, n.signatures
+FROM narinfos AS n
+JOIN objects AS o ON n.key = o.key
+WHERE n.key = $1 AND o.deleted_at IS NULL
+`
+
+// Returns the recorded narinfo, unless its object was marked for deletion by garbage collection.
+func (q *Queries) GetNarinfo(ctx context.Context, key string) (Narinfo, error) {
+	row := q.db.QueryRow(ctx, getNarinfo, key)
+	var i Narinfo
+	err := row.Scan(
+		&i.Key,
+		&i.StorePath,
+		&i.Url,
+		&i.Compression,
+		&i.NarHash,
+		&i.NarSize,
+		&i.Deriver,
+		&i.Refs,
+		&i.Signatures,
+	)
+	return i, err
+}
+
+const getNarinfoCompressions = `-- name: GetNarinfoCompressions :many
+SELECT DISTINCT compression FROM narinfos ORDER BY compression
+`
+
+func (q *Queries) GetNarinfoCompressions(ctx context.Context) ([]string, error) {
+	rows, err := q.db.Query(ctx, getNarinfoCompressions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var compression string
+		if err := rows.Scan(&compression); err != nil {
+			return nil, err
+		}
+		items = append(items, compression)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNarinfoKeysWithoutMetadata = `-- name: GetNarinfoKeysWithoutMetadata :many
+SELECT o.key
+FROM objects AS o
+LEFT JOIN narinfos AS n ON o.key = n.key
+WHERE
+    o.key LIKE '%.narinfo'
+    AND o.deleted_at IS NULL
+    AND n.key IS NULL
+    AND o.key > $1
+ORDER BY o.key
+LIMIT $2
+`
+
+type GetNarinfoKeysWithoutMetadataParams struct {
+	Key   string `json:"key"`
+	Limit int32  `json:"limit"`
+}
+
+func (q *Queries) GetNarinfoKeysWithoutMetadata(ctx context.Context, arg GetNarinfoKeysWithoutMetadataParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getNarinfoKeysWithoutMetadata, arg.Key, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNarinfoReferences = `-- name: GetNarinfoReferences :many
+SELECT n.key, n.refs, o.endpoint
+FROM narinfos AS n
+JOIN objects AS o ON n.key = o.key
+WHERE o.deleted_at IS NULL AND n.key > $1
+ORDER BY n.key
+LIMIT $2
+`
+
+type GetNarinfoReferencesParams struct {
+	Key   string `json:"key"`
+	Limit int32  `json:"limit"`
+}
+
+type GetNarinfoReferencesRow struct {
+	Key      string   `json:"key"`
+	Refs     []string `json:"refs"`
+	Endpoint string   `json:"endpoint"`
+}
+
+// Returns the recorded references of live narinfos and the store their object is in, for reconciliation.
+func (q *Queries) GetNarinfoReferences(ctx context.Context, arg GetNarinfoReferencesParams) ([]GetNarinfoReferencesRow, error) {
+	rows, err := q.db.Query(ctx, getNarinfoReferences, arg.Key, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetNarinfoReferencesRow
+	for rows.Next() {
+		var i GetNarinfoReferencesRow
+		if err := rows.Scan(&i.Key, &i.Refs, &i.Endpoint); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getObjectChecksum = `-- name: GetObjectChecksum :one
+SELECT sha256, size FROM objects
+WHERE key = $1 AND sha256 IS NOT NULL
+`
+
+type GetObjectChecksumRow struct {
+	Sha256 pgtype.Text `json:"sha256"`
+	Size   pgtype.Int8 `json:"size"`
+}
+
+func (q *Queries) GetObjectChecksum(ctx context.Context, key string) (GetObjectChecksumRow, error) {
+	row := q.db.QueryRow(ctx, getObjectChecksum, key)
+	var i GetObjectChecksumRow
+	err := row.Scan(&i.Sha256, &i.Size)
+	return i, err
+}
+
+const getObjectReferrers = `-- name: GetObjectReferrers :many
+WITH RECURSIVE referrers AS (
+    SELECT
+        $1::text AS key,
+        0 AS depth
+    UNION
+    SELECT
+        n.key::text AS key,
+        referrers.depth + 1 AS depth
+    FROM referrers
+    JOIN narinfos AS n ON narinfo_ref_keys(n.refs) @> ARRAY[referrers.key]
+    WHERE referrers.depth < $2::int
+)
+
+SELECT
+    referrers.key::text AS key,
+    min(referrers.depth)::int AS depth
+FROM referrers
+WHERE referrers.depth > 0 AND referrers.key != $1::text
+GROUP BY referrers.key
+ORDER BY depth, referrers.key
+`
+
+type GetObjectReferrersParams struct {
+	Key      string `json:"key"`
+	MaxDepth int32  `json:"max_depth"`
+}
+
+type GetObjectReferrersRow struct {
+	Key   string `json:"key"`
+	Depth int32  `json:"depth"`
+}
+
+// The join matches the expression of narinfos_ref_keys_idx, so that it does not scan all narinfos.
+func (q *Queries) GetObjectReferrers(ctx context.Context, arg GetObjectReferrersParams) ([]GetObjectReferrersRow, error) {
+	rows, err := q.db.Query(ctx, getObjectReferrers, arg.Key, arg.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetObjectReferrersRow
+	for rows.Next() {
+		var i GetObjectReferrersRow
+		if err := rows.Scan(&i.Key, &i.Depth); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getObjectRefs = `-- name: GetObjectRefs :many
+WITH RECURSIVE refs AS (
+    SELECT
+        n.key::text AS key,
+        0 AS depth
+    FROM narinfos AS n
+    WHERE n.key = $1::varchar
+    UNION
+    SELECT
+        split_part(r.ref, '-', 1) || '.narinfo' AS key,
+        refs.depth + 1 AS depth
+    FROM refs
+    JOIN narinfos AS n ON refs.key = n.key
+    CROSS JOIN LATERAL unnest(n.refs) AS r (ref)
+    WHERE refs.depth < $2::int
+)
+
+SELECT
+    refs.key::text AS key,
+    min(refs.depth)::int AS depth
+FROM refs
+WHERE refs.depth > 0 AND refs.key != $1::varchar
+GROUP BY refs.key
+ORDER BY depth, refs.key
+`
+
+type GetObjectRefsParams struct {
+	Key      string `json:"key"`
+	MaxDepth int32  `json:"max_depth"`
+}
+
+type GetObjectRefsRow struct {
+	Key   string `json:"key"`
+	Depth int32  `json:"depth"`
+}
+
+func (q *Queries) GetObjectRefs(ctx context.Context, arg GetObjectRefsParams) ([]GetObjectRefsRow, error) {
+	rows, err := q.db.Query(ctx, getObjectRefs, arg.Key, arg.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetObjectRefsRow
+	for rows.Next() {
+		var i GetObjectRefsRow
+		if err := rows.Scan(&i.Key, &i.Depth); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPendingClosureByIdempotencyKey = `-- name: GetPendingClosureByIdempotencyKey :one
+SELECT id, key, started_at, group_name, labels, created_by, endpoint, idempotency_key, provenance, replace_objects FROM pending_closures WHERE idempotency_key = $1
+`
+
+func (q *Queries) GetPendingClosureByIdempotencyKey(ctx context.Context, idempotencyKey pgtype.Text) (PendingClosure, error) {
+	row := q.db.QueryRow(ctx, getPendingClosureByIdempotencyKey, idempotencyKey)
+	var i PendingClosure
+	err := row.Scan(
+		&i.ID,
+		&i.Key,
+		&i.StartedAt,
+		&i.GroupName,
+		&i.Labels,
+		&i.CreatedBy,
+		&i.Endpoint,
+		&i.IdempotencyKey,
+		&i.Provenance,
+		&i.ReplaceObjects,
+	)
+	return i, err
+}
+
+const getPendingClosureEndpoint = `-- name: GetPendingClosureEndpoint :one
+SELECT endpoint FROM pending_closures WHERE id = $1
+`
+
+func (q *Queries) GetPendingClosureEndpoint(ctx context.Context, id int64) (string, error) {
+	row := q.db.QueryRow(ctx, getPendingClosureEndpoint, id)
+	var endpoint string
+	err := row.Scan(&endpoint)
+	return endpoint, err
+}
+
+const getPendingClosureKey = `-- name: GetPendingClosureKey :one
+SELECT key FROM pending_closures WHERE id = $1
+`
+
+func (q *Queries) GetPendingClosureKey(ctx context.Context, id int64) (string, error) {
+	row := q.db.QueryRow(ctx, getPendingClosureKey, id)
+	var key string
+	err := row.Scan(&key)
+	return key, err
+}
+
+const getPendingKeys = `-- name: GetPendingKeys :many
+SELECT DISTINCT key FROM pending_objects
+WHERE key = any($1::varchar [])
+ORDER BY key
+`
+
+// Returns the keys that any pending closure may still be uploading.
+func (q *Queries) GetPendingKeys(ctx context.Context, keys []string) ([]string, error) {
+	rows, err := q.db.Query(ctx, getPendingKeys, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPendingNarinfoKeys = `-- name: GetPendingNarinfoKeys :many
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND po.key LIKE '%.narinfo'
+    AND NOT EXISTS (
+        SELECT 1
+        FROM narinfos AS n
+        WHERE n.key = po.key
+    )
+`
+
+func (q *Queries) GetPendingNarinfoKeys(ctx context.Context, pendingClosureID int64) ([]string, error) {
+	rows, err := q.db.Query(ctx, getPendingNarinfoKeys, pendingClosureID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPendingObjectKeys = `-- name: GetPendingObjectKeys :many
+SELECT key FROM pending_objects
+WHERE pending_closure_id = $1 AND key = any($2::varchar [])
+`
+
+type GetPendingObjectKeysParams struct {
+	PendingClosureID int64    `json:"pending_closure_id"`
+	Keys             []string `json:"keys"`
+}
+
+func (q *Queries) GetPendingObjectKeys(ctx context.Context, arg GetPendingObjectKeysParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getPendingObjectKeys, arg.PendingClosureID, arg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPendingUploadKeys = `-- name: GetPendingUploadKeys :many
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND NOT EXISTS (
+        SELECT 1 FROM objects AS o
+        WHERE o.key = po.key AND o.deleted_at IS NULL
+    )
+ORDER BY po.key
+`
+
+// Returns the objects of a pending closure that are not in the cache yet, i.e. that the client uploads.
+func (q *Queries) GetPendingUploadKeys(ctx context.Context, pendingClosureID int64) ([]string, error) {
+	rows, err := q.db.Query(ctx, getPendingUploadKeys, pendingClosureID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPendingUploadObjectKeys = `-- name: GetPendingUploadObjectKeys :many
+SELECT po.key FROM pending_objects AS po
+WHERE
+    po.pending_closure_id = $1
+    AND po.key = any($2::varchar [])
+    AND NOT EXISTS (
+        SELECT 1 FROM objects AS o
+        WHERE o.key = po.key AND o.deleted_at IS NULL
+    )
+ORDER BY po.key
+`
+
+type GetPendingUploadObjectKeysParams struct {
+	PendingClosureID int64    `json:"pending_closure_id"`
+	Keys             []string `json:"keys"`
+}
+
+// Returns the given objects of a pending closure that are not in the cache yet, i.e. that the client may upload.
+// Live objects are excluded, so that pushes can't overwrite them.
+func (q *Queries) GetPendingUploadObjectKeys(ctx context.Context, arg GetPendingUploadObjectKeysParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getPendingUploadObjectKeys, arg.PendingClosureID, arg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTopDownloads = `-- name: GetTopDownloads :many
+SELECT
+    d.key,
+    n.store_path,
+    count(*) AS downloads,
+    sum(d.bytes)::bigint AS bytes,
+    count(DISTINCT d.client) AS clients
+FROM downloads AS d
+LEFT JOIN narinfos AS n ON d.key = n.key
+WHERE d.created_at >= $1::timestamp
+GROUP BY d.key, n.store_path
+ORDER BY downloads DESC, d.key
+LIMIT $2::int
+`
+
+type GetTopDownloadsParams struct {
+	Since    pgtype.Timestamp `json:"since"`
+	RowLimit int32            `json:"row_limit"`
+}
+
+type GetTopDownloadsRow struct {
+	Key       string      `json:"key"`
+	StorePath pgtype.Text `json:"store_path"`
+	Downloads int64       `json:"downloads"`
+	Bytes     int64       `json:"bytes"`
+	Clients   int64       `json:"clients"`
+}
+
+// Aggregates the downloads per narinfo, the most downloaded first.
+func (q *Queries) GetTopDownloads(ctx context.Context, arg GetTopDownloadsParams) ([]GetTopDownloadsRow, error) {
+	rows, err := q.db.Query(ctx, getTopDownloads, arg.Since, arg.RowLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetTopDownloadsRow
+	for rows.Next() {
+		var i GetTopDownloadsRow
+		if err := rows.Scan(
+			&i.Key,
+			&i.StorePath,
+			&i.Downloads,
+			&i.Bytes,
+			&i.Clients,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUntrackedKeys = `-- name: GetUntrackedKeys :many
+SELECT k.key::text AS key
+FROM unnest($1::varchar []) AS k (key)
+WHERE
+    NOT EXISTS (
+        SELECT 1
+        FROM objects AS o
+        WHERE o.key = k.key
+    )
+    AND NOT EXISTS (
+        SELECT 1
+        FROM pending_objects AS po
+        WHERE po.key = k.key
+    )
+`
+
+func (q *Queries) GetUntrackedKeys(ctx context.Context, keys []string) ([]string, error) {
+	rows, err := q.db.Query(ctx, getUntrackedKeys, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+type ImportClosureObjectsParams struct {
+	ClosureKey string           `json:"closure_key"`
+	ObjectKey  string           `json:"object_key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+}
+
+type ImportClosureRootsParams struct {
+	ClosureKey string           `json:"closure_key"`
+	Root       string           `json:"root"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+}
+
+type ImportClosuresParams struct {
+	Key        string           `json:"key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	GroupName  pgtype.Text      `json:"group_name"`
+	Labels     []byte           `json:"labels"`
+	CreatedBy  pgtype.Text      `json:"created_by"`
+	Provenance []byte           `json:"provenance"`
+}
+
+type ImportNarinfosParams struct {
+	Key         string      `json:"key"`
+	StorePath   string      `json:"store_path"`
+	Url         string      `json:"url"`
+	Compression string      `json:"compression"`
+	NarHash     string      `json:"nar_hash"`
+	NarSize     int64       `json:"nar_size"`
+	Deriver     pgtype.Text `json:"deriver"`
+	Refs        []string    `json:"refs"`
+	Signatures  []string    `json:"signatures"`
+}
+
+type ImportObjectsParams struct {
+	Key       string           `json:"key"`
+	DeletedAt pgtype.Timestamp `json:"deleted_at"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+	Endpoint  string           `json:"endpoint"`
+	Sha256    pgtype.Text      `json:"sha256"`
+	Size      pgtype.Int8      `json:"size"`
+}
+
+type ImportGCHoldsParams struct {
+	ID        int64            `json:"id"`
+	Reason    string           `json:"reason"`
+	CreatedAt pgtype.Timestamp `json:"created_at"`
+	ExpiresAt pgtype.Timestamp `json:"expires_at"`
+}
+
+type ImportRemoteRootsParams struct {
+	Identity   string           `json:"identity"`
+	Name       string           `json:"name"`
+	ClosureKey string           `json:"closure_key"`
+	UpdatedAt  pgtype.Timestamp `json:"updated_at"`
+	ExpiresAt  pgtype.Timestamp `json:"expires_at"`
+}
+
+const insertAuditLog = `-- name: InsertAuditLog :exec
+INSERT INTO audit_log (identity, method, path, query, status, params)
+VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+type InsertAuditLogParams struct {
+	Identity string `json:"identity"`
+	Method   string `json:"method"`
+	Path     string `json:"path"`
+	Query    string `json:"query"`
+	Status   int32  `json:"status"`
+	Params   []byte `json:"params"`
+}
+
+func (q *Queries) InsertAuditLog(ctx context.Context, arg InsertAuditLogParams) error {
+	_, err := q.db.Exec(ctx, insertAuditLog,
+		arg.Identity,
+		arg.Method,
+		arg.Path,
+		arg.Query,
+		arg.Status,
+		arg.Params,
+	)
+	return err
+}
+
+const insertClosureObjects = `-- name: InsertClosureObjects :exec
+INSERT INTO closure_objects (closure_key, object_key)
+SELECT
+    $1::varchar,
+    unnest($2::varchar [])
+`
+
+type InsertClosureObjectsParams struct {
+	ClosureKey string   `json:"closure_key"`
+	ObjectKeys []string `json:"object_keys"`
+}
+
+func (q *Queries) InsertClosureObjects(ctx context.Context, arg InsertClosureObjectsParams) error {
+	_, err := q.db.Exec(ctx, insertClosureObjects, arg.ClosureKey, arg.ObjectKeys)
+	return err
+}
+
+const insertDownload = `-- name: InsertDownload :exec
+INSERT INTO downloads (key, path, bytes, client, user_agent)
+VALUES ($1, $2, $3, $4, $5)
+`
+
+type InsertDownloadParams struct {
+	Key       string `json:"key"`
+	Path      string `json:"path"`
+	Bytes     int64  `json:"bytes"`
+	Client    string `json:"client"`
+	UserAgent string `json:"user_agent"`
+}
+
+func (q *Queries) InsertDownload(ctx context.Context, arg InsertDownloadParams) error {
+	_, err := q.db.Exec(ctx, insertDownload,
+		arg.Key,
+		arg.Path,
+		arg.Bytes,
+		arg.Client,
+		arg.UserAgent,
+	)
+	return err
+}
+
+const insertGCHold = `-- name: InsertGCHold :one
+INSERT INTO gc_holds (reason, expires_at)
+VALUES ($1, timezone('UTC', now()) + interval '1 second' * $2::bigint)
+RETURNING id, reason, created_at, expires_at
+`
+
+type InsertGCHoldParams struct {
+	Reason     string `json:"reason"`
+	TtlSeconds int64  `json:"ttl_seconds"`
+}
+
+func (q *Queries) InsertGCHold(ctx context.Context, arg InsertGCHoldParams) (GcHold, error) {
+	row := q.db.QueryRow(ctx, insertGCHold, arg.Reason, arg.TtlSeconds)
+	var i GcHold
+	err := row.Scan(
+		&i.ID,
+		&i.Reason,
+		&i.CreatedAt,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
+
+const insertObjects = `-- name: InsertObjects :exec
+INSERT INTO objects (key)
+SELECT unnest($1::varchar [])
+ON CONFLICT (key) DO NOTHING
+`
+
+func (q *Queries) InsertObjects(ctx context.Context, keys []string) error {
+	_, err := q.db.Exec(ctx, insertObjects, keys)
+	return err
+}
+
+const insertPendingClosure = `-- name: InsertPendingClosure :one
+INSERT INTO pending_closures (
+    started_at, key, group_name, labels, created_by, endpoint, idempotency_key, provenance, replace_objects
+)
+VALUES (timezone('UTC', now()), $1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING id, key, started_at, group_name, labels, created_by, endpoint, idempotency_key, provenance, replace_objects
+`
+
+type InsertPendingClosureParams struct {
+	Key            string      `json:"key"`
+	GroupName      pgtype.Text `json:"group_name"`
+	Labels         []byte      `json:"labels"`
+	CreatedBy      pgtype.Text `json:"created_by"`
+	Endpoint       string      `json:"endpoint"`
+	IdempotencyKey pgtype.Text `json:"idempotency_key"`
+	Provenance     []byte      `json:"provenance"`
+	ReplaceObjects bool        `json:"replace_objects"`
+}
+
+func (q *Queries) InsertPendingClosure(ctx context.Context, arg InsertPendingClosureParams) (PendingClosure, error) {
+	row := q.db.QueryRow(ctx, insertPendingClosure,
+		arg.Key,
+		arg.GroupName,
+		arg.Labels,
+		arg.CreatedBy,
+		arg.Endpoint,
+		arg.IdempotencyKey,
+		arg.Provenance,
+		arg.ReplaceObjects,
+	)
+	var i PendingClosure
+	err := row.Scan(
+		&i.ID,
+		&i.Key,
+		&i.StartedAt,
+		&i.GroupName,
+		&i.Labels,
+		&i.CreatedBy,
+		&i.Endpoint,
+		&i.IdempotencyKey,
+		&i.Provenance,
+		&i.ReplaceObjects,
+	)
+	return i, err
+}
+
+type InsertPendingObjectsParams struct {
+	PendingClosureID int64  `json:"pending_closure_id"`
+	Key              string `json:"key"`
+}
+
+const isDatabaseEmpty = `-- name: IsDatabaseEmpty :one
+SELECT
+    NOT EXISTS (SELECT 1 FROM objects)
+    AND NOT EXISTS (SELECT 1 FROM closures)
+    AND NOT EXISTS (SELECT 1 FROM gc_holds) AS empty
+`
+
+func (q *Queries) IsDatabaseEmpty(ctx context.Context) (bool, error) {
+	row := q.db.QueryRow(ctx, isDatabaseEmpty)
+	var empty bool
+	err := row.Scan(&empty)
+	return empty, err
+}
+
+const lockObjectsShared = `-- name: LockObjectsShared :exec
+SELECT lock_objects_shared($1::varchar [])
+`
+
+func (q *Queries) LockObjectsShared(ctx context.Context, dollar_1 []string) error {
+	_, err := q.db.Exec(ctx, lockObjectsShared, dollar_1)
+	return err
+}
+
+const lockStaleObjects = `-- name: LockStaleObjects :many
+WITH ct AS (
+    SELECT timezone('UTC', now()) AS now
+),
+
+candidates AS MATERIALIZED (
+    SELECT o.key
+    FROM objects AS o, ct
+    WHERE
+        o.key > $1
+        AND NOT EXISTS (
+            SELECT 1
+            FROM closure_objects AS co
+            WHERE co.object_key = o.key
+        )
+        AND NOT EXISTS (
+            SELECT 1
+            FROM pending_objects AS po
+            WHERE po.key = o.key
+        )
+        AND (
+            o.deleted_at IS NULL
+            OR o.deleted_at < ct.now - interval '1 hour'
+        )
+    ORDER BY o.key
+    LIMIT $2
+)
+
+SELECT
+    candidates.key,
+    try_lock_object(candidates.key) AS locked
+FROM candidates
+ORDER BY candidates.key
+`
+
+type LockStaleObjectsParams struct {
+	After string `json:"after"`
+	Limit int32  `json:"limit"`
+}
+
+type LockStaleObjectsRow struct {
+	Key    string `json:"key"`
+	Locked bool   `json:"locked"`
+}
+
+// Returns up to limit stale objects after the given key in key order and takes their advisory locks.
+// Objects whose lock is held by a push are not locked and skipped until the next run.
+func (q *Queries) LockStaleObjects(ctx context.Context, arg LockStaleObjectsParams) ([]LockStaleObjectsRow, error) {
+	rows, err := q.db.Query(ctx, lockStaleObjects, arg.After, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []LockStaleObjectsRow
+	for rows.Next() {
+		var i LockStaleObjectsRow
+		if err := rows.Scan(&i.Key, &i.Locked); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const markObjectsAsActive = `-- name: MarkObjectsAsActive :exec
+UPDATE objects SET deleted_at = NULL WHERE key = any($1::varchar [])
+`
+
+func (q *Queries) MarkObjectsAsActive(ctx context.Context, dollar_1 []string) error {
+	_, err := q.db.Exec(ctx, markObjectsAsActive, dollar_1)
+	return err
+}
+
+const markObjectsForDeletion = `-- name: MarkObjectsForDeletion :many
+WITH ct AS (
+    SELECT timezone('UTC', now()) AS now
+),
+
+stale_objects AS (
+    SELECT o.key
+    FROM objects AS o, ct
+    WHERE
+        NOT EXISTS (
+            SELECT 1
+            FROM closure_objects AS co
+            WHERE co.object_key = o.key
+        )
+        AND NOT EXISTS (
+            SELECT 1
+            FROM pending_objects AS po
+            WHERE po.key = o.key
+        )
+        AND (
+            o.deleted_at IS NULL
+            OR o.deleted_at < ct.now - interval '1 hour'
+        )
+        AND o.key = any($1::varchar [])
+    FOR UPDATE
+)
+
+UPDATE objects
+SET deleted_at = ct.now
+FROM stale_objects, ct
+WHERE objects.key = stale_objects.key
+RETURNING objects.key, objects.endpoint
+`
+
+type MarkObjectsForDeletionRow struct {
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Must run in the same transaction as LockStaleObjects.
+// The conditions are re-checked, as a push might have committed before we got the lock.
+func (q *Queries) MarkObjectsForDeletion(ctx context.Context, keys []string) ([]MarkObjectsForDeletionRow, error) {
+	rows, err := q.db.Query(ctx, markObjectsForDeletion, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []MarkObjectsForDeletionRow
+	for rows.Next() {
+		var i MarkObjectsForDeletionRow
+		if err := rows.Scan(&i.Key, &i.Endpoint); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const mergeClosureLabels = `-- name: MergeClosureLabels :one
+UPDATE closures SET labels = labels || $1::jsonb
+WHERE key = $2
+RETURNING key
+`
+
+type MergeClosureLabelsParams struct {
+	Labels []byte `json:"labels"`
+	Key    string `json:"key"`
+}
+
+// Adds labels to a closure, replacing labels with the same name. Returns no row if the closure does not exist.
+func (q *Queries) MergeClosureLabels(ctx context.Context, arg MergeClosureLabelsParams) (string, error) {
+	row := q.db.QueryRow(ctx, mergeClosureLabels, arg.Labels, arg.Key)
+	var key string
+	err := row.Scan(&key)
+	return key, err
+}
+
+const resetGCHoldIDs = `-- name: ResetGCHoldIDs :exec
+SELECT setval(pg_get_serial_sequence('gc_holds', 'id'), coalesce(max(id), 0) + 1, false) FROM gc_holds
+`
+
+// Continues the ids of new holds after the imported ones.
+func (q *Queries) ResetGCHoldIDs(ctx context.Context) error {
+	_, err := q.db.Exec(ctx, resetGCHoldIDs)
+	return err
+}
+
+const setGCCursor = `-- name: SetGCCursor :exec
+INSERT INTO gc_cursors (phase, last_key) VALUES ($1, $2)
+ON CONFLICT (phase) DO UPDATE
+SET last_key = excluded.last_key, updated_at = timezone('UTC', now())
+`
+
+type SetGCCursorParams struct {
+	Phase   string `json:"phase"`
+	LastKey string `json:"last_key"`
+}
+
+func (q *Queries) SetGCCursor(ctx context.Context, arg SetGCCursorParams) error {
+	_, err := q.db.Exec(ctx, setGCCursor, arg.Phase, arg.LastKey)
+	return err
+}
+
+const setObjectChecksum = `-- name: SetObjectChecksum :exec
+UPDATE objects SET sha256 = $2, size = $3
+WHERE key = $1
+`
+
+type SetObjectChecksumParams struct {
+	Key    string      `json:"key"`
+	Sha256 pgtype.Text `json:"sha256"`
+	Size   pgtype.Int8 `json:"size"`
+}
+
+func (q *Queries) SetObjectChecksum(ctx context.Context, arg SetObjectChecksumParams) error {
+	_, err := q.db.Exec(ctx, setObjectChecksum, arg.Key, arg.Sha256, arg.Size)
+	return err
+}
+
+const tryLockObjects = `-- name: TryLockObjects :many
+SELECT k.key::text AS key
+FROM unnest($1::varchar []) AS k (key)
+WHERE try_lock_object(k.key)
+ORDER BY k.key
+`
+
+// Returns the keys whose advisory lock was taken, keys that a push holds a shared lock on are left out.
+func (q *Queries) TryLockObjects(ctx context.Context, keys []string) ([]string, error) {
+	rows, err := q.db.Query(ctx, tryLockObjects, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		items = append(items, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const upsertClosure = `-- name: UpsertClosure :exec
+WITH upserted AS (
+    INSERT INTO closures (key, updated_at)
+    VALUES ($1, timezone('UTC', now()))
+    ON CONFLICT (key) DO UPDATE SET updated_at = excluded.updated_at
+    RETURNING key, updated_at
+)
+
+INSERT INTO closure_roots (closure_key, root, updated_at)
+SELECT key, '', updated_at FROM upserted
+ON CONFLICT (closure_key, root) DO UPDATE SET updated_at = excluded.updated_at
+`
+
+func (q *Queries) UpsertClosure(ctx context.Context, key string) error {
+	_, err := q.db.Exec(ctx, upsertClosure, key)
+	return err
+}
+
+const upsertNarinfo = `-- name: UpsertNarinfo :exec
+INSERT INTO narinfos (
+    key, store_path, url, compression, nar_hash, nar_size, deriver, refs, signatures
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (key) DO UPDATE SET
+store_path = excluded.store_path,
+url = excluded.url,
+compression = excluded.compression,
+nar_hash = excluded.nar_hash,
+nar_size = excluded.nar_size,
+deriver = excluded.deriver,
+refs = excluded.refs,
+signatures = excluded.signatures
+`
+
+type UpsertNarinfoParams struct {
+	Key         string      `json:"key"`
+	StorePath   string      `json:"store_path"`
+	Url         string      `json:"url"`
+	Compression string      `json:"compression"`
+	NarHash     string      `json:"nar_hash"`
+	NarSize     int64       `json:"nar_size"`
+	Deriver     pgtype.Text `json:"deriver"`
+	Refs        []string    `json:"refs"`
+	Signatures  []string    `json:"signatures"`
+}
+
+func (q *Queries) UpsertNarinfo(ctx context.Context, arg UpsertNarinfoParams) error {
+	_, err := q.db.Exec(ctx, upsertNarinfo,
+		arg.Key,
+		arg.StorePath,
+		arg.Url,
+		arg.Compression,
+		arg.NarHash,
+		arg.NarSize,
+		arg.Deriver,
+		arg.Refs,
+		arg.Signatures,
+	)
+	return err
+}
+
+const upsertRemoteRoot = `-- name: UpsertRemoteRoot :one
+INSERT INTO remote_roots (identity, name, closure_key, updated_at, expires_at)
+SELECT
+    $1,
+    $2,
+    c.key,
+    timezone('UTC', now()),
+    timezone('UTC', now()) + interval '1 second' * $3::bigint
+FROM closures AS c
+WHERE c.key = $4
+ON CONFLICT (identity, name) DO UPDATE SET
+    closure_key = excluded.closure_key,
+    updated_at = excluded.updated_at,
+    expires_at = excluded.expires_at
+RETURNING identity, name, closure_key, updated_at, expires_at
+`
+
+type UpsertRemoteRootParams struct {
+	Identity   string `json:"identity"`
+	Name       string `json:"name"`
+	TtlSeconds int64  `json:"ttl_seconds"`
+	ClosureKey string `json:"closure_key"`
+}
+
+// Returns no row if the closure does not exist.
+func (q *Queries) UpsertRemoteRoot(ctx context.Context, arg UpsertRemoteRootParams) (RemoteRoot, error) {
+	row := q.db.QueryRow(ctx, upsertRemoteRoot,
+		arg.Identity,
+		arg.Name,
+		arg.TtlSeconds,
+		arg.ClosureKey,
+	)
+	var i RemoteRoot
+	err := row.Scan(
+		&i.Identity,
+		&i.Name,
+		&i.ClosureKey,
+		&i.UpdatedAt,
+		&i.ExpiresAt,
+	)
+	return i, err
+}
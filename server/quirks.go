@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// S3 implementations with known differences to AWS S3, selected with --s3-backend.
+const (
+	S3BackendAuto    = "auto"
+	S3BackendGeneric = "generic"
+	S3BackendR2      = "r2"
+	S3BackendGCS     = "gcs"
+)
+
+// s3Quirks are the parts of the S3 API a backend lacks.
+type s3Quirks struct {
+	// HEAD requests with x-amz-checksum-mode are rejected, objects have no sha256 checksum.
+	noChecksumMode bool
+	// Public access is configured in the console of the provider, not with a bucket policy.
+	noBucketPolicy bool
+	// SSE-S3 and SSE-KMS headers are rejected, objects are always encrypted at rest.
+	noServerSideEncryption bool
+}
+
+var backendQuirks = map[string]s3Quirks{
+	S3BackendGeneric: {},
+	S3BackendR2:      {noBucketPolicy: true, noServerSideEncryption: true},
+	S3BackendGCS:     {noChecksumMode: true, noBucketPolicy: true, noServerSideEncryption: true},
+}
+
+func validateS3Backend(backend string) error {
+	if _, ok := backendQuirks[backend]; !ok && backend != S3BackendAuto {
+		return fmt.Errorf("unknown S3 backend %q, expected %s, %s, %s or %s",
+			backend, S3BackendAuto, S3BackendGeneric, S3BackendR2, S3BackendGCS)
+	}
+
+	return nil
+}
+
+// detectS3Backend recognizes the backend by the hostname of its endpoint.
+func detectS3Backend(endpoint string) string {
+	host := endpoint
+	if h, _, err := net.SplitHostPort(endpoint); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+
+	switch {
+	case strings.HasSuffix(host, ".r2.cloudflarestorage.com"):
+		return S3BackendR2
+	case host == "storage.googleapis.com":
+		return S3BackendGCS
+	default:
+		return S3BackendGeneric
+	}
+}
+
+// quirksFor returns the quirks of the backend of an endpoint, detecting it for auto or an empty backend.
+func quirksFor(backend, endpoint string) s3Quirks {
+	if backend == "" || backend == S3BackendAuto {
+		backend = detectS3Backend(endpoint)
+	}
+
+	return backendQuirks[backend]
+}
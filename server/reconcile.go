@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/Mic92/niks3/server/pg"
+)
+
+// sameReferences compares references regardless of their order.
+func sameReferences(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+
+	return slices.Equal(a, b)
+}
+
+// reconcileNarInfo updates the references recorded in the database for a narinfo object whose references
+// differ from them, e.g. after another push overwrote it. The object is what clients substitute, so it wins
+// and garbage collection follows it. The object itself is never rewritten, it may carry fields and signatures
+// that would not survive a round trip. It returns false if the database already matched.
+func (s *Service) reconcileNarInfo(
+	ctx context.Context,
+	queries *pg.Queries,
+	row pg.GetNarinfoReferencesRow,
+) (bool, error) {
+	info, err := s.fetchNarInfo(ctx, row.Key)
+	if err != nil {
+		return false, err
+	}
+
+	if sameReferences(info.References, row.Refs) {
+		return false, nil
+	}
+
+	slog.InfoContext(ctx, "Narinfo references diverge from the database", "key", row.Key,
+		"object", strings.Join(info.References, " "), "database", strings.Join(row.Refs, " "))
+
+	if err = upsertNarInfo(ctx, queries, row.Key, info); err != nil {
+		return false, err
+	}
+
+	missing, err := missingReferences(ctx, queries, row.Key, info.References)
+	if err != nil {
+		return false, err
+	}
+
+	if len(missing) > 0 {
+		slog.WarnContext(ctx, "Narinfo references objects that are not in the cache", "key", row.Key,
+			"missing", strings.Join(missing, " "))
+	}
+
+	return true, nil
+}
+
+// missingReferences returns the narinfo keys of references that are not live in the cache.
+func missingReferences(ctx context.Context, queries *pg.Queries, key string, references []string) ([]string, error) {
+	refKeys := make([]string, 0, len(references))
+
+	for _, ref := range references {
+		if refKey := narInfoKey(ref); refKey != key {
+			refKeys = append(refKeys, refKey)
+		}
+	}
+
+	existing, err := queries.GetExistingObjects(ctx, refKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing objects: %w", err)
+	}
+
+	live := make(map[string]bool, len(existing))
+
+	for _, object := range existing {
+		if object.DeletedAt == nil {
+			live[object.Key] = true
+		}
+	}
+
+	var missing []string
+
+	for _, refKey := range refKeys {
+		if !live[refKey] {
+			missing = append(missing, refKey)
+		}
+	}
+
+	slices.Sort(missing)
+
+	return missing, nil
+}
+
+// ReconcileNarInfos updates the recorded references of narinfos whose objects diverge from the database.
+func (s *Service) ReconcileNarInfos(ctx context.Context) error {
+	queries := pg.New(s.Pool)
+
+	lastKey := ""
+	updated := 0
+	failed := 0
+
+	for {
+		rows, err := queries.GetNarinfoReferences(ctx, pg.GetNarinfoReferencesParams{
+			Key:   lastKey,
+			Limit: DeletionBatchSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get narinfo references: %w", err)
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			changed, err := s.reconcileNarInfo(ctx, queries, row)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to reconcile narinfo", "key", row.Key, "error", err)
+
+				failed++
+
+				continue
+			}
+
+			if changed {
+				updated++
+			}
+		}
+
+		lastKey = rows[len(rows)-1].Key
+
+		slog.InfoContext(ctx, "Reconciling narinfos", "updated", updated, "failed", failed)
+	}
+
+	slog.InfoContext(ctx, "Finished reconciling narinfos", "updated", updated, "failed", failed)
+
+	return nil
+}
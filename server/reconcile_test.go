@@ -0,0 +1,73 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_ReconcileNarInfos(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo": testNarInfo(a, b),
+		b + ".narinfo": testNarInfo(b),
+	})
+
+	refs := func() []server.ObjectRef {
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/api/objects/" + a + ".narinfo/refs",
+			handler:    service.GetObjectRefsHandler,
+			pathValues: map[string]string{"key": a + ".narinfo"},
+		})
+
+		var response server.ObjectRefsResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+		return response.Refs
+	}
+
+	if refs := refs(); len(refs) != 1 || refs[0].Key != b+".narinfo" {
+		t.Fatalf("expected a to reference b, got %+v", refs)
+	}
+
+	// a later upload dropped the reference to b, fields unknown to niks3 must survive
+	stale := testNarInfo(a) + "Extra: field\n"
+	_, err := service.MinioClient.PutObject(ctx, service.BucketName, a+".narinfo",
+		strings.NewReader(stale), int64(len(stale)), minio.PutObjectOptions{})
+	ok(t, err)
+
+	ok(t, service.ReconcileNarInfos(ctx))
+
+	if refs := refs(); len(refs) != 0 {
+		t.Errorf("expected the database to follow the object, got %+v", refs)
+	}
+
+	obj, err := service.MinioClient.GetObject(ctx, service.BucketName, a+".narinfo", minio.GetObjectOptions{})
+	ok(t, err)
+
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	ok(t, err)
+
+	if string(data) != stale {
+		t.Errorf("expected the narinfo object to be left as it is, got %q", data)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
+	"github.com/klauspost/compress/zstd"
+	minio "github.com/minio/minio-go/v7"
+)
+
+var errUndeclaredReferences = errors.New("nars reference store paths that their narinfo does not declare")
+
+// openNar returns a reader for the whole uncompressed NAR of a narinfo.
+func (s *Service) openNar(ctx context.Context, info *NarInfo) (io.ReadCloser, error) {
+	obj, err := s.getObject(ctx, info.URL, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nar: %w", err)
+	}
+
+	switch info.Compression {
+	case "none":
+		return obj, nil
+	case "bzip2":
+		return struct {
+			io.Reader
+			io.Closer
+		}{bzip2.NewReader(obj), obj}, nil
+	case "zstd":
+		decoder, err := zstd.NewReader(obj)
+		if err != nil {
+			obj.Close()
+
+			return nil, fmt.Errorf("failed to decompress nar: %w", err)
+		}
+
+		return &zstdRangeReader{Reader: decoder, decoder: decoder, obj: obj}, nil
+	default:
+		obj.Close()
+
+		return nil, fmt.Errorf("%w: %s", errUnsupportedCompression, info.Compression)
+	}
+}
+
+// scanStoreReferences returns the hash parts of all store paths that occur in r.
+// Nix scans for the hashes of a known set of candidate paths. We don't know the candidates,
+// so only hashes directly after the store directory are found.
+func scanStoreReferences(r io.Reader, storeDir string) (map[string]bool, error) {
+	prefix := []byte(storeDir + "/")
+	// an occurrence can span two reads, so the end of the previous read is scanned again
+	overlap := len(prefix) + storepath.HashLen - 1
+
+	hashes := map[string]bool{}
+	buf := make([]byte, 0, 64*1024+overlap)
+
+	for {
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		for i := 0; ; {
+			j := bytes.Index(buf[i:], prefix)
+			if j < 0 {
+				break
+			}
+
+			start := i + j + len(prefix)
+			if start+storepath.HashLen > len(buf) {
+				break
+			}
+
+			hash := string(buf[start : start+storepath.HashLen])
+			if storepath.ValidateHash(hash) == nil {
+				hashes[hash] = true
+			}
+
+			i = start
+		}
+
+		if len(buf) > overlap {
+			buf = buf[:copy(buf, buf[len(buf)-overlap:])]
+		}
+
+		if errors.Is(err, io.EOF) {
+			return hashes, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read nar: %w", err)
+		}
+	}
+}
+
+// undeclaredReferences downloads the NAR of a narinfo and returns the store paths
+// it contains that are missing from the References of the narinfo.
+func (s *Service) undeclaredReferences(ctx context.Context, key string) ([]string, error) {
+	info, err := s.fetchNarInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nar, err := s.openNar(ctx, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nar of '%s': %w", key, err)
+	}
+	defer nar.Close()
+
+	found, err := scanStoreReferences(nar, s.StoreDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan nar of '%s': %w", key, err)
+	}
+
+	// self references may or may not be declared
+	delete(found, storepath.HashPart(info.StorePath))
+
+	for _, ref := range info.References {
+		delete(found, storepath.HashPart(ref))
+	}
+
+	missing := make([]string, 0, len(found))
+	for hash := range found {
+		missing = append(missing, hash)
+	}
+
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// VerifyReferences downloads the NARs of all narinfos and checks that every store path they contain
+// is declared as a reference. Undeclared references are missing at substitution time.
+func (s *Service) VerifyReferences(ctx context.Context) error {
+	queries := pg.New(s.Pool)
+
+	lastKey := ""
+	checked := 0
+	undeclared := 0
+	failed := 0
+
+	for {
+		rows, err := queries.GetNarinfoReferences(ctx, pg.GetNarinfoReferencesParams{
+			Key:   lastKey,
+			Limit: DeletionBatchSize,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get narinfo references: %w", err)
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		for _, row := range rows {
+			missing, err := s.undeclaredReferences(ctx, row.Key)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to verify references", "key", row.Key, "error", err)
+
+				failed++
+
+				continue
+			}
+
+			checked++
+
+			if len(missing) > 0 {
+				slog.ErrorContext(ctx, "Nar references undeclared store paths", "key", row.Key, "hashes", missing)
+
+				undeclared++
+			}
+		}
+
+		lastKey = rows[len(rows)-1].Key
+
+		slog.InfoContext(ctx, "Verifying references", "checked", checked, "undeclared", undeclared, "failed", failed)
+	}
+
+	slog.InfoContext(ctx, "Finished verifying references", "checked", checked, "undeclared", undeclared,
+		"failed", failed)
+
+	if undeclared > 0 {
+		return fmt.Errorf("%w: %d narinfos", errUndeclaredReferences, undeclared)
+	}
+
+	return nil
+}
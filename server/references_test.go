@@ -0,0 +1,52 @@
+package server_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_VerifyReferences(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	// the reference to c spans several reads of the decompressed NAR
+	nar := "/nix/store/" + a + "-pkg/bin /nix/store/" + b + "-pkg/lib" +
+		strings.Repeat("x", 70000) + "/nix/store/" + c + "-pkg/share"
+
+	pushClosure(t, service, a, map[string]string{
+		a + ".narinfo":          testNarInfo(a, b),
+		b + ".narinfo":          testNarInfo(b),
+		"nar/" + a + ".nar.zst": string(seekableZstd(t, []byte(nar), 4096)),
+		"nar/" + b + ".nar.zst": string(seekableZstd(t, []byte("no references"), 4096)),
+	})
+
+	err := service.VerifyReferences(ctx)
+	if err == nil || !strings.Contains(err.Error(), "1 narinfos") {
+		t.Fatalf("expected the undeclared reference to c to be reported, got %v", err)
+	}
+
+	pushClosure(t, service, c, map[string]string{
+		c + ".narinfo":          testNarInfo(c),
+		"nar/" + c + ".nar.zst": string(seekableZstd(t, []byte("no references"), 4096)),
+	})
+
+	fixed := testNarInfo(a, b, c)
+	_, err = service.MinioClient.PutObject(ctx, service.BucketName, a+".narinfo",
+		strings.NewReader(fixed), int64(len(fixed)), minio.PutObjectOptions{})
+	ok(t, err)
+
+	ok(t, service.VerifyReferences(ctx))
+}
@@ -3,61 +3,22 @@ package server_test
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"os/exec"
-	"strconv"
 	"testing"
 	"time"
 
 	"github.com/Mic92/niks3/server"
-	"github.com/Mic92/niks3/server/pg"
-	minio "github.com/minio/minio-go/v7"
 )
 
 func createTestService(t *testing.T) *server.Service {
 	t.Helper()
 
-	if testPostgresServer == nil {
-		t.Fatal("postgres server not started")
+	if testHarness == nil {
+		t.Fatal("test harness not started")
 	}
 
-	if testMinioServer == nil {
-		t.Fatal("minio server not started")
-	}
-
-	// create database for test
-	dbName := "db" + strconv.Itoa(int(testDBCount.Add(1)))
-	//nolint:gosec
-	command := exec.Command("createdb", "-h", testPostgresServer.tempDir, "-U", "postgres", dbName)
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
-	err := command.Run()
-	ok(t, err)
-
-	connectionString := fmt.Sprintf("postgres://?dbname=%s&user=postgres&host=%s", dbName, testPostgresServer.tempDir)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	pool, err := pg.Connect(ctx, connectionString)
-	if err != nil {
-		ok(t, err)
-	}
-	// create bucket for test
-	bucketName := "bucket" + strconv.Itoa(int(testBucketCount.Add(1)))
-	minioClient := testMinioServer.Client(t)
-
-	err = minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
-	ok(t, err)
-
-	return &server.Service{
-		Pool:        pool,
-		BucketName:  bucketName,
-		MinioClient: minioClient,
-	}
+	return testHarness.CreateTestCache(t)
 }
 
 type TestRequest struct {
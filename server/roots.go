@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// a host that stops renewing its root, e.g. because it was decommissioned, releases its closure after at most this.
+const maxRemoteRootTTL = 30 * 24 * time.Hour
+
+type RegisterRemoteRootRequest struct {
+	Name    string `json:"name"`
+	Closure string `json:"closure"`
+	TTL     string `json:"ttl"`
+}
+
+type RemoteRootsResponse struct {
+	Roots []RemoteRoot `json:"roots"`
+}
+
+// POST /api/roots
+// Registers or renews a root of the caller that keeps a closure from being garbage collected,
+// e.g. the current system of a host. Registering the name again moves the root to the new closure.
+// closure can also be a store path of a closure registered under its hash.
+// Request body:
+//
+//	{
+//	  "name": "web1",
+//	  "closure": "/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-nixos-system-web1-24.11",
+//	  "ttl": "72h"
+//	}
+//
+// Response body:
+//
+//	{
+//	  "identity": "web1.example.com",
+//	  "name": "web1",
+//	  "closure": "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n",
+//	  "updated_at": "2024-12-02T08:00:00Z",
+//	  "expires_at": "2024-12-05T08:00:00Z"
+//	}
+func (s *Service) RegisterRemoteRootHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received register root request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	req := &RegisterRemoteRootRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	if req.Name == "" || req.Closure == "" {
+		http.Error(w, "missing name or closure", http.StatusBadRequest)
+
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		http.Error(w, "failed to parse ttl: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if ttl < time.Second || ttl > maxRemoteRootTTL {
+		http.Error(w, fmt.Sprintf("ttl must be between 1s and %s", maxRemoteRootTTL), http.StatusBadRequest)
+
+		return
+	}
+
+	identity, _ := IdentityFromContext(r.Context())
+
+	root, err := registerRemoteRoot(r.Context(), s.Pool, identity.Name, req.Name, req.Closure, ttl)
+	if err != nil {
+		if errors.Is(err, errClosureNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(root); err != nil {
+		slog.WarnContext(r.Context(), "Could not write root response", "error", err)
+	}
+}
+
+// DELETE /api/roots/{name}
+// Removes a root of the caller.
+// Request body: -
+// Response body: -.
+func (s *Service) UnregisterRemoteRootHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received unregister root request", "method", r.Method, "url", r.URL)
+
+	identity, _ := IdentityFromContext(r.Context())
+
+	deleted, err := unregisterRemoteRoot(r.Context(), s.Pool, identity.Name, r.PathValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if !deleted {
+		http.Error(w, "root not found", http.StatusNotFound)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/roots
+// Response body:
+//
+//	{
+//	  "roots": [{"identity": "web1.example.com", "name": "web1", ...}]
+//	}
+func (s *Service) GetRemoteRootsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received roots request", "method", r.Method, "url", r.URL)
+
+	roots, err := getActiveRemoteRoots(r.Context(), s.Pool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(RemoteRootsResponse{Roots: roots}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
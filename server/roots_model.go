@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type RemoteRoot struct {
+	Identity  string    `json:"identity"`
+	Name      string    `json:"name"`
+	Closure   string    `json:"closure"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func remoteRootFromRow(row pg.RemoteRoot) RemoteRoot {
+	return RemoteRoot{
+		Identity:  row.Identity,
+		Name:      row.Name,
+		Closure:   row.ClosureKey,
+		UpdatedAt: row.UpdatedAt.Time,
+		ExpiresAt: row.ExpiresAt.Time,
+	}
+}
+
+// registerRemoteRoot points the root of an identity at a closure, or renews it, until the ttl passes.
+// closureKey can also be a store path of a closure registered under its hash.
+func registerRemoteRoot(
+	ctx context.Context, pool *pgxpool.Pool, identity, name, closureKey string, ttl time.Duration,
+) (*RemoteRoot, error) {
+	queries := pg.New(pool)
+
+	for _, candidate := range closureKeyCandidates(closureKey) {
+		row, err := queries.UpsertRemoteRoot(ctx, pg.UpsertRemoteRootParams{
+			Identity:   identity,
+			Name:       name,
+			TtlSeconds: int64(ttl.Seconds()),
+			ClosureKey: candidate,
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to register remote root: %w", err)
+		}
+
+		root := remoteRootFromRow(row)
+
+		return &root, nil
+	}
+
+	return nil, errClosureNotFound
+}
+
+// unregisterRemoteRoot deletes a root of an identity and reports whether it existed.
+func unregisterRemoteRoot(ctx context.Context, pool *pgxpool.Pool, identity, name string) (bool, error) {
+	deleted, err := pg.New(pool).DeleteRemoteRoot(ctx, pg.DeleteRemoteRootParams{Identity: identity, Name: name})
+	if err != nil {
+		return false, fmt.Errorf("failed to unregister remote root: %w", err)
+	}
+
+	return deleted > 0, nil
+}
+
+// getActiveRemoteRoots returns the roots of all identities that have not expired yet.
+func getActiveRemoteRoots(ctx context.Context, pool *pgxpool.Pool) ([]RemoteRoot, error) {
+	rows, err := pg.New(pool).GetActiveRemoteRoots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get remote roots: %w", err)
+	}
+
+	roots := make([]RemoteRoot, 0, len(rows))
+	for _, row := range rows {
+		roots = append(roots, remoteRootFromRow(row))
+	}
+
+	return roots, nil
+}
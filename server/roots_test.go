@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_remoteRoots(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+	pushClosure(t, service, b, map[string]string{b + ".narinfo": testNarInfo(b)})
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/roots",
+		body:    []byte(`{"name": "web1", "closure": "/nix/store/` + a + `-pkg", "ttl": "1h"}`),
+		handler: service.RegisterRemoteRootHandler,
+	})
+
+	var root server.RemoteRoot
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &root))
+
+	if root.Name != "web1" || root.Closure != a || !root.ExpiresAt.After(root.UpdatedAt) {
+		t.Errorf("unexpected root: %+v", root)
+	}
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	checkStatus := func(status int) *func(*testing.T, *httptest.ResponseRecorder) {
+		check := func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != status {
+				t.Errorf("expected status %d, got %d: %s", status, rr.Code, rr.Body.String())
+			}
+		}
+
+		return &check
+	}
+
+	// the rooted closure survives, the other one is collected
+	for key, status := range map[string]int{a: http.StatusOK, b: http.StatusNotFound} {
+		testRequest(t, &TestRequest{
+			method:        "GET",
+			path:          "/api/closures/" + key,
+			handler:       service.GetClosureHandler,
+			pathValues:    map[string]string{"key": key},
+			checkResponse: checkStatus(status),
+		})
+	}
+
+	rr = testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/roots",
+		handler: service.GetRemoteRootsHandler,
+	})
+
+	var roots server.RemoteRootsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &roots))
+
+	if len(roots.Roots) != 1 || roots.Roots[0].Closure != a {
+		t.Errorf("unexpected roots: %+v", roots)
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/roots",
+		body:          []byte(`{"name": "web1", "closure": "` + b + `", "ttl": "1h"}`),
+		handler:       service.RegisterRemoteRootHandler,
+		checkResponse: checkStatus(http.StatusNotFound),
+	})
+
+	testRequest(t, &TestRequest{
+		method:     "DELETE",
+		path:       "/api/roots/web1",
+		handler:    service.UnregisterRemoteRootHandler,
+		pathValues: map[string]string{"name": "web1"},
+	})
+
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/closures?older-than=0s",
+		handler: service.CleanupClosuresOlder,
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/api/closures/" + a,
+		handler:       service.GetClosureHandler,
+		pathValues:    map[string]string{"key": a},
+		checkResponse: checkStatus(http.StatusNotFound),
+	})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func newMinioClient(endpoint, accessKey, secretKey string, opts *Options) (*minio.Client, error) {
+	lookup := minio.BucketLookupAuto
+	if opts.S3PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:       opts.S3UseSSL,
+		Region:       opts.S3Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create minio s3 client: %w", err)
+	}
+
+	return client, nil
+}
+
+// checkS3Access makes a test call against the bucket, so that a misconfigured endpoint fails at startup
+// with a hint at the flag to change instead of with a signature error on the first push.
+// Other errors, e.g. an unreachable endpoint, are only logged, since the secondary may take over.
+// The bucket does not need to exist yet, e.g. before bootstrap.
+func checkS3Access(ctx context.Context, store objectStore, pathStyle bool) error {
+	_, err := store.client.BucketExists(ctx, store.bucket)
+	if err == nil {
+		return nil
+	}
+
+	hint := s3ErrorHint(err, pathStyle)
+	if hint == "" {
+		slog.WarnContext(ctx, "Failed to access bucket", "bucket", store.bucket, "endpoint", store.name, "error", err)
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to access bucket %s of the %s endpoint: %w (%s)", store.bucket, store.name, err, hint)
+}
+
+// s3ErrorHint explains S3 errors that are caused by the configuration rather than by the request.
+func s3ErrorHint(err error, pathStyle bool) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && !pathStyle {
+		return "the bucket is addressed as a subdomain of the endpoint, set --s3-path-style if it doesn't resolve"
+	}
+
+	resp := minio.ToErrorResponse(err)
+
+	switch resp.Code {
+	case "AuthorizationHeaderMalformed", "PermanentRedirect", "IllegalLocationConstraintException":
+		if resp.Region != "" {
+			return "the bucket is in another region, set --s3-region=" + resp.Region
+		}
+
+		return "the bucket is in another region, set --s3-region"
+	case "SignatureDoesNotMatch":
+		return "check --s3-secret-key, S3-compatible stores like Ceph RGW may also need --s3-region and --s3-path-style"
+	case "InvalidAccessKeyId":
+		return "check --s3-access-key"
+	}
+
+	return ""
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+// object uploaded and deleted again to check that the credentials may write
+const s3PermissionProbeKey = ".niks3-permission-check"
+
+// S3 actions of the server on objects and on the bucket, and those that only bootstrap needs.
+var (
+	s3ObjectActions = []string{
+		"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload",
+	}
+	s3BucketActions = []string{
+		"s3:ListBucket", "s3:ListBucketMultipartUploads", "s3:GetBucketLocation",
+	}
+	s3BootstrapActions = []string{
+		"s3:CreateBucket", "s3:GetBucketPolicy", "s3:PutBucketPolicy", "s3:PutBucketCORS", "s3:GetLifecycleConfiguration",
+	}
+)
+
+// s3Policy returns the least-privilege IAM policy for the credentials of the server. Presigned URLs
+// are signed with them, so clients can't do more with the URLs than the server itself.
+// The Bootstrap statement can be dropped if bootstrap runs with other credentials.
+func s3Policy(buckets []string) (string, error) {
+	bucketResources := make([]string, 0, len(buckets))
+	objectResources := make([]string, 0, len(buckets))
+
+	for _, bucket := range buckets {
+		bucketResources = append(bucketResources, "arn:aws:s3:::"+bucket)
+		objectResources = append(objectResources, "arn:aws:s3:::"+bucket+"/*")
+	}
+
+	policy := bucketPolicy{
+		Version: "2012-10-17",
+		Statement: []bucketPolicyStatement{
+			{Sid: "Objects", Effect: "Allow", Action: s3ObjectActions, Resource: objectResources},
+			{Sid: "Bucket", Effect: "Allow", Action: s3BucketActions, Resource: bucketResources},
+			{Sid: "Bootstrap", Effect: "Allow", Action: s3BootstrapActions, Resource: bucketResources},
+		},
+	}
+
+	b, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode policy: %w", err)
+	}
+
+	return string(b) + "\n", nil
+}
+
+// WriteS3Policy writes the IAM policy for the configured buckets to w, see s3Policy.
+func WriteS3Policy(opts *Options, w io.Writer) error {
+	buckets := []string{opts.S3BucketName}
+	if opts.S3SecondaryEndpoint != "" {
+		buckets = append(buckets, cmp.Or(opts.S3SecondaryBucketName, opts.S3BucketName))
+	}
+
+	policy, err := s3Policy(slices.Compact(buckets))
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, policy); err != nil {
+		return fmt.Errorf("failed to write policy: %w", err)
+	}
+
+	return nil
+}
+
+func isAccessDenied(err error) bool {
+	return minio.ToErrorResponse(err).Code == "AccessDenied"
+}
+
+// missingS3Permissions probes the actions of s3Policy that the server needs at runtime and returns
+// those that are denied. Writes are probed with an empty object that is deleted again,
+// in read-only mode they are not probed.
+func (s *Service) missingS3Permissions(ctx context.Context, store objectStore, readOnly bool) []string {
+	var missing []string
+
+	probe := func(action string, err error) {
+		if isAccessDenied(err) {
+			missing = append(missing, action)
+		} else if err != nil {
+			slog.DebugContext(ctx, "Permission probe failed", "action", action, "endpoint", store.name, "error", err)
+		}
+	}
+
+	for object := range store.client.ListObjects(ctx, store.bucket, minio.ListObjectsOptions{MaxKeys: 1}) {
+		probe("s3:ListBucket", object.Err)
+
+		break
+	}
+
+	for upload := range store.client.ListIncompleteUploads(ctx, store.bucket, s3PermissionProbeKey, false) {
+		probe("s3:ListBucketMultipartUploads", upload.Err)
+
+		break
+	}
+
+	if readOnly {
+		_, err := store.client.StatObject(ctx, store.bucket, nixCacheInfoKey, minio.StatObjectOptions{})
+		if !isNoSuchKey(err) {
+			probe("s3:GetObject", err)
+		}
+
+		return missing
+	}
+
+	// bucket policies may require server-side encryption
+	putOpts := minio.PutObjectOptions{ServerSideEncryption: s.S3Encryption}
+
+	_, err := store.client.PutObject(ctx, store.bucket, s3PermissionProbeKey, bytes.NewReader(nil), 0, putOpts)
+	probe("s3:PutObject", err)
+
+	if err == nil {
+		_, err = store.client.StatObject(ctx, store.bucket, s3PermissionProbeKey, minio.StatObjectOptions{})
+		probe("s3:GetObject", err)
+
+		core := minio.Core{Client: store.client}
+
+		uploadID, err := core.NewMultipartUpload(ctx, store.bucket, s3PermissionProbeKey, putOpts)
+		if err == nil {
+			err = core.AbortMultipartUpload(ctx, store.bucket, s3PermissionProbeKey, uploadID)
+			probe("s3:AbortMultipartUpload", err)
+		}
+	}
+
+	// deleting a missing object succeeds as well, so this is probed even if the upload was denied
+	probe("s3:DeleteObject", store.client.RemoveObject(ctx, store.bucket, s3PermissionProbeKey,
+		minio.RemoveObjectOptions{}))
+
+	return missing
+}
+
+// warnMissingS3Permissions logs the permissions that the S3 credentials lack, pointing at s3-policy.
+func (s *Service) warnMissingS3Permissions(ctx context.Context, readOnly bool) {
+	for _, store := range s.stores() {
+		if missing := s.missingS3Permissions(ctx, store, readOnly); len(missing) > 0 {
+			slog.WarnContext(ctx, "S3 credentials lack permissions, see niks3-server s3-policy for the ones needed",
+				"endpoint", store.name, "bucket", store.bucket, "missing", missing)
+		}
+	}
+}
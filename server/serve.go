@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	minio "github.com/minio/minio-go/v7"
+)
+
+const listingSuffix = ".ls"
+
+var errNoSuchPath = errors.New("no such file or directory")
+
+// narListingEntry is a node of the .ls file that nix writes next to the narinfo with write-nar-listing=1.
+type narListingEntry struct {
+	Type       string                      `json:"type"`
+	Size       uint64                      `json:"size,omitempty"`
+	Executable bool                        `json:"executable,omitempty"`
+	NarOffset  *uint64                     `json:"narOffset,omitempty"`
+	Target     string                      `json:"target,omitempty"`
+	Entries    map[string]*narListingEntry `json:"entries,omitempty"`
+}
+
+type narListing struct {
+	Version int             `json:"version"`
+	Root    narListingEntry `json:"root"`
+}
+
+// lookup resolves a slash separated path inside of the NAR. Symlinks are not followed.
+func (l *narListing) lookup(path string) (*narListingEntry, error) {
+	entry := &l.Root
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		if entry.Type != "directory" {
+			return nil, errNoSuchPath
+		}
+
+		child, ok := entry.Entries[name]
+		if !ok {
+			return nil, errNoSuchPath
+		}
+
+		entry = child
+	}
+
+	return entry, nil
+}
+
+func (s *Service) fetchNarListing(ctx context.Context, hash string) (*narListing, error) {
+	obj, err := s.getObject(ctx, hash+listingSuffix, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get listing: %w", err)
+	}
+	defer obj.Close()
+
+	listing := &narListing{}
+	if err = json.NewDecoder(obj).Decode(listing); err != nil {
+		return nil, fmt.Errorf("failed to decode listing: %w", err)
+	}
+
+	return listing, nil
+}
+
+// openNarRange returns a reader for size bytes at offset of the uncompressed NAR.
+func (s *Service) openNarRange(ctx context.Context, info *NarInfo, offset, size uint64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+
+	switch info.Compression {
+	case "none":
+		if size == 0 {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+
+		if err := opts.SetRange(int64(offset), int64(offset+size-1)); err != nil { //nolint:gosec
+			return nil, fmt.Errorf("failed to set range: %w", err)
+		}
+
+		obj, err := s.getObject(ctx, info.URL, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get nar: %w", err)
+		}
+
+		return obj, nil
+	case "zstd":
+		return s.openZstdRange(ctx, info.URL, offset, size)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedCompression, info.Compression)
+	}
+}
+
+var errUnsupportedCompression = errors.New("unsupported nar compression")
+
+func isNoSuchKey(err error) bool {
+	var errResponse minio.ErrorResponse
+
+	return errors.As(err, &errResponse) && errResponse.Code == "NoSuchKey"
+}
+
+// GET /serve/{hash}/{path...}
+// Response body: the contents of a regular file, or for directories a JSON object of entry names to types:
+//
+//	{"bin": "directory", "README": "regular"}
+//
+// Requires a .ls listing with nar offsets and an uncompressed or zstd compressed NAR.
+// Store paths without a signature of one of the serve keys are refused with 403, unless unsigned paths are allowed.
+// With trusted keys they are always refused: signatures are verified when a closure is committed, but its
+// upload URLs stay valid for hours afterwards and could replace a narinfo with an unsigned one.
+func (s *Service) ServeNarFileHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received serve request", "method", r.Method, "url", r.URL)
+
+	hash := r.PathValue("hash")
+	if hash == "" {
+		http.Error(w, "missing hash", http.StatusBadRequest)
+
+		return
+	}
+
+	info, err := s.fetchNarInfo(r.Context(), hash+narinfoSuffix)
+	if err != nil {
+		if isNoSuchKey(err) {
+			http.Error(w, "store path not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to get narinfo: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if keys := s.serveKeys(); len(keys) > 0 && (!s.AllowUnsigned || len(s.TrustedKeys) > 0) {
+		if err = verifyNarInfo(info, keys); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+
+			return
+		}
+	}
+
+	listing, err := s.fetchNarListing(r.Context(), hash)
+	if err != nil {
+		if isNoSuchKey(err) {
+			http.Error(w, "store path has no listing", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to get listing: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	entry, err := listing.lookup(r.PathValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	switch entry.Type {
+	case "directory":
+		serveNarDirectory(w, entry)
+	case "symlink":
+		http.Error(w, "path is a symlink to "+entry.Target, http.StatusBadRequest)
+	case "regular":
+		if s.VerifyReads {
+			s.spotCheckObject(r.Context(), info.URL)
+		}
+
+		s.serveNarFile(w, r, info, entry)
+	default:
+		http.Error(w, "unknown entry type "+entry.Type, http.StatusInternalServerError)
+	}
+}
+
+func serveNarDirectory(w http.ResponseWriter, entry *narListingEntry) {
+	entries := make(map[string]string, len(entry.Entries))
+	for name, child := range entry.Entries {
+		entries[name] = child.Type
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Service) serveNarFile(w http.ResponseWriter, r *http.Request, info *NarInfo, entry *narListingEntry) {
+	if entry.NarOffset == nil {
+		http.Error(w, "listing has no nar offsets", http.StatusNotImplemented)
+
+		return
+	}
+
+	reader, err := s.openNarRange(r.Context(), info, *entry.NarOffset, entry.Size)
+	if err != nil {
+		if errors.Is(err, errUnsupportedCompression) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+
+			return
+		}
+
+		http.Error(w, "failed to read nar: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(entry.Size, 10))
+
+	if _, err = io.Copy(&idleTimeoutWriter{ResponseWriter: w, timeout: s.StreamIdleTimeout}, reader); err != nil {
+		slog.WarnContext(r.Context(), "Failed to stream file from nar", "url", r.URL, "error", err)
+	}
+}
@@ -0,0 +1,205 @@
+package server_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func narString(nar []byte, s string) []byte {
+	nar = binary.LittleEndian.AppendUint64(nar, uint64(len(s)))
+	nar = append(nar, s...)
+
+	return append(nar, make([]byte, (8-len(s)%8)%8)...)
+}
+
+// singleFileNar returns a NAR of a directory with one regular file and the offset of its contents.
+func singleFileNar(name, contents string) ([]byte, int) {
+	var nar []byte
+
+	for _, s := range []string{
+		"nix-archive-1", "(", "type", "directory", "entry", "(", "name", name, "node", "(",
+		"type", "regular", "contents",
+	} {
+		nar = narString(nar, s)
+	}
+
+	offset := len(nar) + 8
+	nar = narString(nar, contents)
+
+	for _, s := range []string{")", ")", ")"} {
+		nar = narString(nar, s)
+	}
+
+	return nar, offset
+}
+
+// seekableZstd compresses data in frames of frameSize bytes and appends a seek table.
+func seekableZstd(t *testing.T, data []byte, frameSize int) []byte {
+	t.Helper()
+
+	encoder, err := zstd.NewWriter(nil)
+	ok(t, err)
+
+	defer encoder.Close()
+
+	var compressed, table []byte
+
+	numFrames := 0
+
+	for start := 0; start < len(data); start += frameSize {
+		frame := encoder.EncodeAll(data[start:min(start+frameSize, len(data))], nil)
+		compressed = append(compressed, frame...)
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(min(frameSize, len(data)-start)))
+		numFrames++
+	}
+
+	// footer: number of frames, descriptor, seekable magic
+	table = binary.LittleEndian.AppendUint32(table, uint32(numFrames))
+	table = append(table, 0)
+	table = binary.LittleEndian.AppendUint32(table, 0x8F92EAB1)
+
+	// skippable frame header
+	compressed = binary.LittleEndian.AppendUint32(compressed, 0x184D2A5E)
+	compressed = binary.LittleEndian.AppendUint32(compressed, uint32(len(table)))
+
+	return append(compressed, table...)
+}
+
+func TestService_ServeNarFileHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	contents := "hello world\n"
+	nar, offset := singleFileNar("README", contents)
+
+	listing, err := json.Marshal(map[string]any{
+		"version": 1,
+		"root": map[string]any{
+			"type": "directory",
+			"entries": map[string]any{
+				"README": map[string]any{"type": "regular", "size": len(contents), "narOffset": offset},
+			},
+		},
+	})
+	ok(t, err)
+
+	encoder, err := zstd.NewWriter(nil)
+	ok(t, err)
+
+	compressedNar := encoder.EncodeAll(nar, nil)
+	ok(t, encoder.Close())
+
+	for _, tc := range []struct {
+		hash, compression string
+		narFile           []byte
+	}{
+		{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "none", nar},
+		{"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "zstd", compressedNar},
+		{"cccccccccccccccccccccccccccccccc", "zstd", seekableZstd(t, nar, 16)},
+	} {
+		hash, compression := tc.hash, tc.compression
+
+		narinfo := fmt.Sprintf(`StorePath: /nix/store/%s-pkg
+URL: nar/%s.nar
+Compression: %s
+NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80
+NarSize: %d
+References: 
+`, hash, hash, compression, len(nar))
+
+		pushClosure(t, service, hash, map[string]string{
+			hash + ".narinfo":      narinfo,
+			hash + ".ls":           string(listing),
+			"nar/" + hash + ".nar": string(tc.narFile),
+		})
+
+		rr := testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/serve/" + hash + "/README",
+			handler:    service.ServeNarFileHandler,
+			pathValues: map[string]string{"hash": hash, "path": "README"},
+		})
+
+		if rr.Body.String() != contents {
+			t.Errorf("%s: unexpected file contents: %q", compression, rr.Body.String())
+		}
+
+		rr = testRequest(t, &TestRequest{
+			method:     "GET",
+			path:       "/serve/" + hash + "/",
+			handler:    service.ServeNarFileHandler,
+			pathValues: map[string]string{"hash": hash, "path": ""},
+		})
+
+		var entries map[string]string
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+
+		if entries["README"] != "regular" {
+			t.Errorf("%s: unexpected directory listing: %v", compression, entries)
+		}
+	}
+}
+
+func TestService_ServeNarFileHandlerSeekTableLimit(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	contents := "hello world\n"
+	nar, offset := singleFileNar("README", contents)
+
+	listing, err := json.Marshal(map[string]any{
+		"version": 1,
+		"root": map[string]any{
+			"type": "directory",
+			"entries": map[string]any{
+				"README": map[string]any{"type": "regular", "size": len(contents), "narOffset": offset},
+			},
+		},
+	})
+	ok(t, err)
+
+	// a footer claiming far more frames than the object holds
+	narFile := seekableZstd(t, nar, 16)
+	binary.LittleEndian.PutUint32(narFile[len(narFile)-9:], 0xFFFFFFFF)
+
+	hash := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	pushClosure(t, service, hash, map[string]string{
+		hash + ".narinfo": fmt.Sprintf(`StorePath: /nix/store/%s-pkg
+URL: nar/%s.nar
+Compression: zstd
+NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80
+NarSize: %d
+References: 
+`, hash, hash, len(nar)),
+		hash + ".ls":           string(listing),
+		"nar/" + hash + ".nar": string(narFile),
+	})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "seek table") {
+			t.Errorf("expected the seek table to be rejected, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "GET",
+		path:          "/serve/" + hash + "/README",
+		handler:       service.ServeNarFileHandler,
+		pathValues:    map[string]string{"hash": hash, "path": "README"},
+		checkResponse: &checkResponse,
+	})
+}
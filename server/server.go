@@ -1,23 +1,38 @@
 package server
 
 import (
+	"cmp"
 	"context"
+	"crypto/ed25519"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
 	"github.com/jackc/pgx/v5/pgxpool"
 	minio "github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 type Options struct {
 	DBConnectionString string
 	HTTPAddr           string
+	// Public read endpoints and the /api endpoints can listen on separate addresses,
+	// so that a firewall can keep the API internal. Both default to HTTPAddr.
+	HTTPReadAddr  string
+	HTTPWriteAddr string
+	// Serve a single connection on stdin and stdout instead of listening, e.g. as the command of an ssh session.
+	Stdio bool
 
 	// TODO: Document how to use this with AWS.
 	S3Endpoint   string
@@ -25,8 +40,135 @@ type Options struct {
 	S3SecretKey  string
 	S3UseSSL     bool
 	S3BucketName string
+	// Region of the bucket and path-style addressing (endpoint/bucket instead of bucket.endpoint),
+	// which S3-compatible stores like Ceph RGW may need. They apply to the secondary endpoint as well.
+	S3Region    string
+	S3PathStyle bool
+	// Implementation of the S3 API, e.g. r2, whose missing features are not used. auto detects it by the endpoint.
+	S3Backend string
+
+	// Optional secondary endpoint that uploads and reads fail over to while the primary is down.
+	S3SecondaryEndpoint   string
+	S3SecondaryAccessKey  string
+	S3SecondarySecretKey  string
+	S3SecondaryBucketName string
+	S3SecondaryBackend    string
+
+	// Server-side encryption of uploaded objects, e.g. for buckets that require SSE-KMS. Nil leaves it to the bucket.
+	// Applies to both the primary and the secondary endpoint.
+	S3Encryption encrypt.ServerSide
 
 	APIToken string
+
+	// TLS is enabled if both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Client certificates signed by this CA are accepted instead of the API token.
+	TLSClientCAFile string
+	// Whether the read and the write listener ask for client certificates,
+	// e.g. to require them on an internal API port while /serve stays public.
+	TLSReadClientAuth  ClientAuth
+	TLSWriteClientAuth ClientAuth
+	// If not empty, only client certificates with one of these names (CN or SAN) are accepted.
+	ClientCertNames []string
+
+	// Build logs and realisations are deleted after this duration since they were last pushed,
+	// even if their closure is still alive. Zero means they live as long as their closures.
+	LogRetention         time.Duration
+	RealisationRetention time.Duration
+
+	// Closures with one of these labels are deleted once they were not pushed for the retention of the label,
+	// e.g. the builds of a staging jobset, unless a remote root keeps them.
+	LabelRetentions []LabelRetention
+
+	// Audit log entries are deleted after this duration during garbage collection. Zero keeps them forever.
+	AuditRetention time.Duration
+
+	// Downloads through /serve are deleted after this duration during garbage collection. Zero keeps them forever.
+	DownloadRetention time.Duration
+
+	// Store directory of the cache, e.g. /gnu/store for a store outside of /nix/store.
+	// Narinfos of other store directories are rejected.
+	StoreDir string
+
+	// Public keys of the cache, advertised in /cache-info.json.
+	PublicKeys []string
+
+	// If not empty, e.g. the URL of a CDN in front of the bucket, narinfos written by the server get absolute URL
+	// fields with this prefix, so substitution fetches NARs from it. URLs with the prefix are mapped back to keys.
+	NarURLBase string
+
+	// If not empty, narinfos are signed by the client and must carry a signature of one of these keys.
+	TrustedKeys map[string]ed25519.PublicKey
+	// Restricts the trusted keys per identity, e.g. so that each team signs with its own key.
+	// Identities that are not listed may sign with any trusted key.
+	IdentityKeys map[string][]string
+
+	// Key of the cache to sign narinfos with when closures are promoted.
+	SigningKeyName string
+	SigningKey     ed25519.PrivateKey
+
+	// If not empty, files are only served through /serve if their narinfo carries a signature of one of these keys.
+	ServeKeys map[string]ed25519.PublicKey
+	// Serve files through /serve even if their narinfo is not signed by one of ServeKeys.
+	// Ignored with TrustedKeys, whose signatures could otherwise be bypassed through upload URLs after the commit.
+	AllowUnsigned bool
+
+	// Accept closures whose narinfos reference paths that are not in the cache,
+	// e.g. because dependencies are substituted from an upstream cache.
+	AllowMissingReferences bool
+
+	// Reject narinfos without FileHash and FileSize, which nix 2.3 and some other tools require.
+	RequireFileHash bool
+
+	// Serve only read endpoints from a database that is not migrated by this server, e.g. a read replica.
+	ReadOnly bool
+
+	// Access to the object classes of the read endpoints, classes that are not listed are public.
+	ReadAccess map[string]ReadAccess
+
+	// Compare NARs served through /serve with the size and sha256 recorded from their narinfo.
+	VerifyReads bool
+
+	// Maximum number of concurrent requests to push endpoints and of requests waiting for a slot.
+	// Zero disables the limit.
+	MaxConcurrentPushes int
+	MaxQueuedPushes     int
+
+	// Limits of API requests, zero disables them. Closures that legitimately exceed them need higher limits.
+	MaxRequestBodySize   int64
+	MaxClosureObjects    int
+	MaxNarinfoReferences int
+
+	// Timeouts of the HTTP server. Long-running endpoints lift the write timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// Per-endpoint timeouts for creating pending closures or upload URLs and for committing pending closures.
+	PresignTimeout time.Duration
+	CommitTimeout  time.Duration
+	// Downloads from /serve and uploads through the server are aborted if the client stalls for this long.
+	StreamIdleTimeout time.Duration
+
+	// Pushes of objects the garbage collector marked for deletion less than DeletionWaitWindow ago
+	// poll every DeletionPollInterval until the deletion finished, for at most DeletionWaitTimeout.
+	// Zero waits as long as the request.
+	DeletionPollInterval time.Duration
+	DeletionWaitWindow   time.Duration
+	DeletionWaitTimeout  time.Duration
+
+	// Closure key used by import-bucket to register all objects as one closure.
+	ImportEpoch string
+	// Database snapshot written by export-db and read by import-db, "-" for stdout or stdin.
+	SnapshotOutput string
+	SnapshotInput  string
+	// bootstrap replaces an existing bucket policy instead of adding the public read statement to it.
+	ForceBucketPolicy bool
+
+	// Minimum level of log messages. Debug logs the timing of each phase of push requests.
+	LogLevel slog.Level
 }
 
 type Service struct {
@@ -34,14 +176,80 @@ type Service struct {
 	MinioClient *minio.Client
 	BucketName  string
 	APIToken    string
+
+	SecondaryMinioClient *minio.Client
+	SecondaryBucketName  string
+
+	S3Encryption encrypt.ServerSide
+
+	ClientCertNames []string
+	StoreDir        string
+	PublicKeys      []string
+	NarURLBase      string
+	TrustedKeys     map[string]ed25519.PublicKey
+	IdentityKeys    map[string][]string
+	ServeKeys       map[string]ed25519.PublicKey
+	AllowUnsigned   bool
+	SigningKeyName  string
+	SigningKey      ed25519.PrivateKey
+
+	AllowMissingReferences bool
+	RequireFileHash        bool
+	ReadOnly               bool
+
+	ReadAccess  map[string]ReadAccess
+	VerifyReads bool
+
+	// Bootstrap replaces the bucket policy instead of merging the public read statement into it.
+	ForceBucketPolicy bool
+
+	LogRetention         time.Duration
+	RealisationRetention time.Duration
+	LabelRetentions      []LabelRetention
+	AuditRetention       time.Duration
+	DownloadRetention    time.Duration
+
+	MaxConcurrentPushes int
+	MaxQueuedPushes     int
+
+	MaxRequestBodySize   int64
+	MaxClosureObjects    int
+	MaxNarinfoReferences int
+
+	StreamIdleTimeout time.Duration
+
+	DeletionPollInterval time.Duration
+	DeletionWaitWindow   time.Duration
+	DeletionWaitTimeout  time.Duration
+
+	// missing features of the primary and secondary S3 backend
+	quirks          s3Quirks
+	secondaryQuirks s3Quirks
+
+	events      eventBroker
+	pushes      concurrencyLimiter
+	primaryDown atomic.Bool
+	// number of pushes waiting for the garbage collector to delete objects
+	deletionWaits atomic.Int64
+	// number of objects that did not match their recorded checksum when they were served
+	checksumMismatches atomic.Int64
 }
 
 const (
 	dbConnectionTimeout = 10 * time.Second
+	// time for in-flight requests to finish after SIGTERM before connections are closed.
+	shutdownTimeout = 30 * time.Second
 )
 
 func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := s.authenticateClientCert(r); ok {
+			slog.Debug("Authenticated with client certificate", "identity", name)
+			s.serveAudited(w, r, next, Identity{Name: name, Provider: identityProviderClientCert})
+
+			return
+		}
+
 		authToken := r.Header.Get("Authorization")
 		if authToken == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -63,54 +271,358 @@ func (s *Service) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		s.serveAudited(w, r, next, Identity{Name: apiTokenIdentity, Provider: identityProviderAPIToken})
+	}
+}
+
+func newService(ctx context.Context, opts *Options) (*Service, error) {
+	connect := pg.Connect
+	if opts.ReadOnly {
+		connect = pg.ConnectReadOnly
+	}
+
+	pool, err := connect(ctx, opts.DBConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	s, err := newBucketService(ctx, opts)
+	if err != nil {
+		pool.Close()
+
+		return nil, err
+	}
+
+	s.Pool = pool
+
+	return s, nil
+}
+
+// newBucketService returns a service without a database connection, for commands that only use the bucket.
+func newBucketService(ctx context.Context, opts *Options) (*Service, error) {
+	minioClient, err := newMinioClient(opts.S3Endpoint, opts.S3AccessKey, opts.S3SecretKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var secondaryClient *minio.Client
+
+	if opts.S3SecondaryEndpoint != "" {
+		secondaryClient, err = newMinioClient(opts.S3SecondaryEndpoint,
+			opts.S3SecondaryAccessKey, opts.S3SecondarySecretKey, opts)
+		if err != nil {
+			return nil, fmt.Errorf("secondary endpoint: %w", err)
+		}
+	}
+
+	s := &Service{
+		MinioClient: minioClient,
+		BucketName:  opts.S3BucketName,
+		APIToken:    opts.APIToken,
+
+		SecondaryMinioClient: secondaryClient,
+		SecondaryBucketName:  cmp.Or(opts.S3SecondaryBucketName, opts.S3BucketName),
+
+		S3Encryption: opts.S3Encryption,
+
+		ClientCertNames: opts.ClientCertNames,
+		StoreDir:        cmp.Or(opts.StoreDir, storepath.DefaultStoreDir),
+		PublicKeys:      opts.PublicKeys,
+		NarURLBase:      opts.NarURLBase,
+		TrustedKeys:     opts.TrustedKeys,
+		IdentityKeys:    opts.IdentityKeys,
+		ServeKeys:       opts.ServeKeys,
+		AllowUnsigned:   opts.AllowUnsigned,
+		SigningKeyName:  opts.SigningKeyName,
+		SigningKey:      opts.SigningKey,
+
+		AllowMissingReferences: opts.AllowMissingReferences,
+		RequireFileHash:        opts.RequireFileHash,
+		ReadOnly:               opts.ReadOnly,
+		ReadAccess:             opts.ReadAccess,
+		VerifyReads:            opts.VerifyReads,
+		ForceBucketPolicy:      opts.ForceBucketPolicy,
+
+		LogRetention:         opts.LogRetention,
+		RealisationRetention: opts.RealisationRetention,
+		LabelRetentions:      opts.LabelRetentions,
+		AuditRetention:       opts.AuditRetention,
+		DownloadRetention:    opts.DownloadRetention,
+
+		MaxConcurrentPushes: opts.MaxConcurrentPushes,
+		MaxQueuedPushes:     opts.MaxQueuedPushes,
+
+		MaxRequestBodySize:   opts.MaxRequestBodySize,
+		MaxClosureObjects:    opts.MaxClosureObjects,
+		MaxNarinfoReferences: opts.MaxNarinfoReferences,
+
+		StreamIdleTimeout: opts.StreamIdleTimeout,
+
+		DeletionPollInterval: opts.DeletionPollInterval,
+		DeletionWaitWindow:   opts.DeletionWaitWindow,
+		DeletionWaitTimeout:  opts.DeletionWaitTimeout,
+	}
+
+	s.quirks = quirksFor(opts.S3Backend, opts.S3Endpoint)
+	s.secondaryQuirks = quirksFor(opts.S3SecondaryBackend, opts.S3SecondaryEndpoint)
+
+	for _, store := range s.stores() {
+		if store.quirks.noServerSideEncryption && s.S3Encryption != nil {
+			return nil, fmt.Errorf("the %s endpoint does not support --s3-sse, its objects are always encrypted",
+				store.name)
+		}
+
+		if err = checkS3Access(ctx, store, opts.S3PathStyle); err != nil {
+			return nil, err
+		}
 	}
+
+	return s, nil
 }
 
 func RunServer(opts *Options) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbConnectionTimeout)
 	defer cancel()
 
-	pool, err := pg.Connect(ctx, opts.DBConnectionString)
+	service, err := newService(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+		return err
 	}
-	defer pool.Close()
+	defer service.Close()
 
-	minioClient, err := minio.New(opts.S3Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(opts.S3AccessKey, opts.S3SecretKey, ""),
-		Secure: opts.S3UseSSL,
-	})
+	service.warnMissingS3Permissions(ctx, opts.ReadOnly)
+
+	if !opts.ReadOnly {
+		service.refreshCacheInfo(ctx)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if service.SecondaryMinioClient != nil {
+		go service.watchPrimary(ctx)
+	}
+
+	if opts.Stdio {
+		return service.ServeStdio(ctx, opts, os.Stdin, os.Stdout)
+	}
+
+	readAddr := cmp.Or(opts.HTTPReadAddr, opts.HTTPAddr)
+	writeAddr := cmp.Or(opts.HTTPWriteAddr, opts.HTTPAddr)
+
+	readMux := http.NewServeMux()
+	service.registerReadRoutes(readMux)
+
+	readServer, err := newHTTPServer(opts, readAddr,
+		service.FaultMiddleware(service.APIVersionMiddleware(readMux)), opts.TLSReadClientAuth)
 	if err != nil {
-		return fmt.Errorf("failed to create minio s3 client: %w", err)
+		return err
+	}
+
+	servers := []*http.Server{readServer}
+
+	if writeAddr == readAddr {
+		service.registerAPIRoutes(readMux, opts)
+	} else {
+		writeMux := http.NewServeMux()
+		service.registerHealthRoutes(writeMux)
+		service.registerAPIRoutes(writeMux, opts)
+
+		writeServer, err := newHTTPServer(opts, writeAddr,
+			service.FaultMiddleware(service.APIVersionMiddleware(writeMux)), opts.TLSWriteClientAuth)
+		if err != nil {
+			return err
+		}
+
+		servers = append(servers, writeServer)
+	}
+
+	errs := make(chan error, len(servers))
+
+	for i, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, started := range servers[:i] {
+				started.Close()
+			}
+
+			return fmt.Errorf("failed to listen on %s: %w", server.Addr, err)
+		}
+
+		go func() { errs <- serveHTTP(opts, server, listener) }()
+	}
+
+	// migrations ran in newService and all addresses are bound
+	if err = sdNotify("READY=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	if interval := watchdogInterval(); interval > 0 {
+		go service.runWatchdog(ctx, interval)
+	}
+
+	select {
+	case err = <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down")
+
+	if err = sdNotify("STOPPING=1"); err != nil {
+		slog.Warn("Failed to notify systemd", "error", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	shutdownErrs := make([]error, 0, len(servers))
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			shutdownErrs = append(shutdownErrs, fmt.Errorf("failed to shut down %s: %w", server.Addr, err))
+
+			server.Close()
+		}
 	}
 
-	service := &Service{Pool: pool, MinioClient: minioClient, BucketName: opts.S3BucketName, APIToken: opts.APIToken}
+	return errors.Join(shutdownErrs...)
+}
+
+func (s *Service) registerHealthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /health", s.HealthCheckHandler)
+	mux.HandleFunc("GET /health/ready", s.ReadinessHandler)
+}
+
+// registerReadRoutes registers the public, unauthenticated endpoints.
+func (s *Service) registerReadRoutes(mux *http.ServeMux) {
+	s.registerHealthRoutes(mux)
+	mux.HandleFunc("GET /cache-info.json", s.ReadAccessMiddleware(ReadClassCacheInfo, s.CacheInfoHandler))
+	mux.HandleFunc("GET /serve/{hash}/{path...}",
+		s.ReadAccessMiddleware(ReadClassNar, withTimeout(0, s.DownloadLogMiddleware(s.ServeNarFileHandler))))
+	mux.HandleFunc("GET /log/{drv}", s.ReadAccessMiddleware(ReadClassLog, withTimeout(0, s.BuildLogHandler)))
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /health", service.HealthCheckHandler)
+// registerAPIRoutes registers the authenticated /api endpoints.
+func (s *Service) registerAPIRoutes(mux *http.ServeMux, opts *Options) {
+	mux.HandleFunc("GET /api/version", s.AuthMiddleware(s.VersionHandler))
+	mux.HandleFunc("GET /api/admin/status", s.AuthMiddleware(s.StatusHandler))
+	mux.HandleFunc("GET /api/admin/audit", s.AuthMiddleware(s.AuditLogHandler))
+	s.registerFaultRoutes(mux)
+	mux.HandleFunc("GET /api/stats/top-downloads", s.AuthMiddleware(s.TopDownloadsHandler))
+	mux.HandleFunc("GET /api/closures", s.AuthMiddleware(s.SearchClosuresHandler))
+	mux.HandleFunc("GET /api/closures/{key}", s.AuthMiddleware(s.GetClosureHandler))
+	mux.HandleFunc("GET /api/closures/{key}/store-path", s.AuthMiddleware(s.GetClosureStorePathHandler))
+	mux.HandleFunc("POST /api/closures/{key}/verify", s.AuthMiddleware(withTimeout(0, s.VerifyClosureHandler)))
+	mux.HandleFunc("POST /api/closures/{key}/diff", s.AuthMiddleware(s.DiffClosureHandler))
+	mux.HandleFunc("GET /api/groups/{name}", s.AuthMiddleware(s.GetGroupHandler))
+	mux.HandleFunc("GET /api/groups/{name}/gc-preview", s.AuthMiddleware(s.GetGroupGCPreviewHandler))
+	mux.HandleFunc("GET /api/gc/holds", s.AuthMiddleware(s.GetGCHoldsHandler))
+	mux.HandleFunc("GET /api/roots", s.AuthMiddleware(s.GetRemoteRootsHandler))
+	mux.HandleFunc("GET /api/objects/{key}/refs", s.AuthMiddleware(s.GetObjectRefsHandler))
+	mux.HandleFunc("GET /api/objects/{key}/referrers", s.AuthMiddleware(s.GetObjectReferrersHandler))
+	mux.HandleFunc("GET /api/narinfo/{hash}", s.AuthMiddleware(s.GetNarInfoHandler))
 
-	mux.HandleFunc("POST /api/pending_closures", service.AuthMiddleware(service.CreatePendingClosureHandler))
-	mux.HandleFunc("DELETE /api/pending_closures", service.AuthMiddleware(service.CleanupPendingClosuresHandler))
-	mux.HandleFunc("POST /api/pending_closures/{id}/complete", service.AuthMiddleware(service.CommitPendingClosureHandler))
-	mux.HandleFunc("GET /api/closures/{key}", service.AuthMiddleware(service.GetClosureHandler))
-	mux.HandleFunc("DELETE /api/closures", service.AuthMiddleware(service.CleanupClosuresOlder))
+	if opts.ReadOnly {
+		slog.Info("Running in read-only mode, write endpoints are disabled")
 
+		return
+	}
+
+	mux.HandleFunc("POST /api/pending_closures", s.AuthMiddleware(s.PushLimitMiddleware(
+		withTimeout(opts.PresignTimeout, s.CreatePendingClosureHandler))))
+	mux.HandleFunc("DELETE /api/pending_closures", s.AuthMiddleware(s.CleanupPendingClosuresHandler))
+	mux.HandleFunc("POST /api/pending_closures/{id}/complete", s.AuthMiddleware(s.PushLimitMiddleware(
+		withTimeout(opts.CommitTimeout, s.CommitPendingClosureHandler))))
+	mux.HandleFunc("POST /api/pending_closures/{id}/urls", s.AuthMiddleware(s.PushLimitMiddleware(
+		withTimeout(opts.PresignTimeout, s.PresignPendingObjectsHandler))))
+	mux.HandleFunc("POST /api/pending_closures/{id}/attach", s.AuthMiddleware(s.AttachPendingObjectsHandler))
+	mux.HandleFunc("POST /api/pending_closures/{id}/abort", s.AuthMiddleware(s.AbortPendingClosureHandler))
+	// not push limited, a streaming upload would hold a slot for the whole transfer
+	mux.HandleFunc("PUT /api/objects/{key...}", s.AuthMiddleware(withTimeout(0, s.UploadPendingObjectHandler)))
+	mux.HandleFunc("POST /api/admin/pending_closures/abort-all",
+		s.AuthMiddleware(withTimeout(0, s.AbortPendingClosuresHandler)))
+	mux.HandleFunc("DELETE /api/closures", s.AuthMiddleware(withTimeout(0, s.CleanupClosuresOlder)))
+	mux.HandleFunc("DELETE /api/closures/{key}", s.AuthMiddleware(s.DeleteClosureHandler))
+	mux.HandleFunc("POST /api/closures/{key}/promote", s.AuthMiddleware(s.PushLimitMiddleware(
+		withTimeout(0, s.PromoteClosureHandler))))
+	mux.HandleFunc("DELETE /api/groups/{name}", s.AuthMiddleware(s.DeleteGroupHandler))
+	mux.HandleFunc("POST /api/gc/hold", s.AuthMiddleware(s.CreateGCHoldHandler))
+	mux.HandleFunc("DELETE /api/gc/hold/{id}", s.AuthMiddleware(s.ReleaseGCHoldHandler))
+	mux.HandleFunc("POST /api/roots", s.AuthMiddleware(s.RegisterRemoteRootHandler))
+	mux.HandleFunc("DELETE /api/roots/{name}", s.AuthMiddleware(s.UnregisterRemoteRootHandler))
+	mux.HandleFunc("POST /api/hydra/notify", s.AuthMiddleware(s.HydraNotifyHandler))
+	// events are published by the server that handles the writes
+	mux.HandleFunc("GET /api/events", s.AuthMiddleware(withTimeout(0, s.EventsHandler)))
+}
+
+func newHTTPServer(opts *Options, addr string, handler http.Handler, auth ClientAuth) (*http.Server, error) {
 	server := &http.Server{
-		Addr:              opts.HTTPAddr,
-		Handler:           mux,
+		Addr:              addr,
+		Handler:           handler,
 		ReadHeaderTimeout: 1 * time.Second,
+		ReadTimeout:       opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
 	}
 
-	slog.Info("Starting HTTP server", "address", opts.HTTPAddr)
+	if auth != ClientAuthNone {
+		var err error
+
+		if server.TLSConfig, err = loadClientCAs(opts.TLSClientCAFile, auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
+// serveHTTP serves on an already bound listener until the server is shut down.
+func serveHTTP(opts *Options, server *http.Server, listener net.Listener) error {
+	var err error
+
+	if opts.TLSCertFile != "" && opts.TLSKeyFile != "" {
+		slog.Info("Starting HTTPS server", "address", server.Addr)
+		err = server.ServeTLS(listener, opts.TLSCertFile, opts.TLSKeyFile)
+	} else {
+		slog.Info("Starting HTTP server", "address", server.Addr)
+		err = server.Serve(listener)
+	}
 
-	if err = server.ListenAndServe(); err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
 	return nil
 }
 
+// RunCommand connects to the database and S3 and runs a one-off maintenance command.
+func RunCommand(opts *Options, command func(*Service, context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbConnectionTimeout)
+	defer cancel()
+
+	service, err := newService(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	return command(service, context.Background())
+}
+
+// RunBucketCommand is like RunCommand for commands that don't need the database, e.g. to check a backup of the bucket.
+func RunBucketCommand(opts *Options, command func(*Service, context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbConnectionTimeout)
+	defer cancel()
+
+	service, err := newBucketService(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	return command(service, context.Background())
+}
+
 func (s *Service) Close() {
 	s.Pool.Close()
 }
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Mic92/niks3/server/pg"
+)
+
+var errInvalidSignature = errors.New("no valid signature from a trusted key")
+
+// parseTrustedKeys parses public keys in the format of nix-store --generate-binary-cache-key (name:base64).
+func parseTrustedKeys(keys []string) (map[string]ed25519.PublicKey, error) {
+	trustedKeys := make(map[string]ed25519.PublicKey, len(keys))
+
+	for _, key := range keys {
+		name, value, found := strings.Cut(key, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid public key %q, expected name:base64", key)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key '%s': %w", name, err)
+		}
+
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key '%s': expected %d bytes, got %d",
+				name, ed25519.PublicKeySize, len(decoded))
+		}
+
+		trustedKeys[name] = ed25519.PublicKey(decoded)
+	}
+
+	return trustedKeys, nil
+}
+
+// parseIdentityKeys parses a comma separated list of identity=key name, e.g. "team-a=team-a-1,team-b=team-b-1",
+// that restricts the trusted keys an identity may sign narinfos with. An identity may be listed multiple times.
+func parseIdentityKeys(spec string, trustedKeys map[string]ed25519.PublicKey) (map[string][]string, error) {
+	identityKeys := map[string][]string{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		if entry == "" {
+			continue
+		}
+
+		identity, keyName, found := strings.Cut(entry, "=")
+		if !found || identity == "" || keyName == "" {
+			return nil, fmt.Errorf("invalid identity key %q, expected identity=key name", entry)
+		}
+
+		if _, ok := trustedKeys[keyName]; !ok {
+			return nil, fmt.Errorf("key '%s' of identity '%s' is not one of the trusted keys", keyName, identity)
+		}
+
+		identityKeys[identity] = append(identityKeys[identity], keyName)
+	}
+
+	return identityKeys, nil
+}
+
+// trustedKeysFor returns the keys the caller of the request may sign narinfos with.
+// Identities without an entry in IdentityKeys may use all trusted keys.
+func (s *Service) trustedKeysFor(ctx context.Context) map[string]ed25519.PublicKey {
+	identity, ok := IdentityFromContext(ctx)
+	if !ok {
+		return s.TrustedKeys
+	}
+
+	keyNames, ok := s.IdentityKeys[identity.Name]
+	if !ok {
+		return s.TrustedKeys
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(keyNames))
+	for _, name := range keyNames {
+		keys[name] = s.TrustedKeys[name]
+	}
+
+	return keys
+}
+
+// parseSigningKey parses a secret key in the format of nix-store --generate-binary-cache-key (name:base64).
+func parseSigningKey(key string) (string, ed25519.PrivateKey, error) {
+	name, value, found := strings.Cut(strings.TrimSpace(key), ":")
+	if !found || name == "" {
+		return "", nil, errors.New("invalid signing key, expected name:base64")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid signing key '%s': %w", name, err)
+	}
+
+	if len(decoded) != ed25519.PrivateKeySize {
+		return "", nil, fmt.Errorf("invalid signing key '%s': expected %d bytes, got %d",
+			name, ed25519.PrivateKeySize, len(decoded))
+	}
+
+	return name, ed25519.PrivateKey(decoded), nil
+}
+
+// signNarInfo adds a signature of the given key, replacing an older signature of the same key.
+func signNarInfo(info *NarInfo, name string, key ed25519.PrivateKey) {
+	signatures := make([]string, 0, len(info.Signatures)+1)
+
+	for _, sig := range info.Signatures {
+		if sigName, _, _ := strings.Cut(sig, ":"); sigName != name {
+			signatures = append(signatures, sig)
+		}
+	}
+
+	sig := ed25519.Sign(key, []byte(info.Fingerprint()))
+	info.Signatures = append(signatures, name+":"+base64.StdEncoding.EncodeToString(sig))
+}
+
+// Fingerprint returns the string that nix signs for a narinfo.
+func (info *NarInfo) Fingerprint() string {
+	storeDir := path.Dir(info.StorePath)
+
+	refs := make([]string, 0, len(info.References))
+	for _, ref := range info.References {
+		refs = append(refs, storeDir+"/"+ref)
+	}
+
+	return "1;" + info.StorePath + ";" + info.NarHash + ";" +
+		strconv.FormatUint(info.NarSize, 10) + ";" + strings.Join(refs, ",")
+}
+
+// verifyNarInfo succeeds if at least one signature of the narinfo was made by a trusted key.
+func verifyNarInfo(info *NarInfo, trustedKeys map[string]ed25519.PublicKey) error {
+	fingerprint := []byte(info.Fingerprint())
+
+	for _, sig := range info.Signatures {
+		name, value, found := strings.Cut(sig, ":")
+		if !found {
+			continue
+		}
+
+		key, ok := trustedKeys[name]
+		if !ok {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+
+		if ed25519.Verify(key, fingerprint, decoded) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", info.StorePath, errInvalidSignature)
+}
+
+// verifyNarInfos checks the signatures of downloaded narinfos against the given trusted keys.
+// Narinfos are checked in key order, so the error does not depend on the order of the downloads.
+func verifyNarInfos(infos map[string]*NarInfo, trustedKeys map[string]ed25519.PublicKey) error {
+	keys := make([]string, 0, len(infos))
+	for key := range infos {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if err := verifyNarInfo(infos[key], trustedKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveKeys returns the keys that narinfos served through /serve must be signed with,
+// the trusted keys of the clients if none were configured.
+func (s *Service) serveKeys() map[string]ed25519.PublicKey {
+	if len(s.ServeKeys) == 0 {
+		return s.TrustedKeys
+	}
+
+	return s.ServeKeys
+}
+
+func upsertNarInfos(ctx context.Context, queries *pg.Queries, infos map[string]*NarInfo) error {
+	for key, info := range infos {
+		if err := upsertNarInfo(ctx, queries, key, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
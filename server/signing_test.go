@@ -0,0 +1,175 @@
+package server_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func signNarInfo(t *testing.T, narinfo string, name string, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	info, err := server.ParseNarInfo(strings.NewReader(narinfo))
+	ok(t, err)
+
+	sig := ed25519.Sign(key, []byte(info.Fingerprint()))
+
+	return narinfo + "Sig: " + name + ":" + base64.StdEncoding.EncodeToString(sig) + "\n"
+}
+
+func TestService_trustedKeys(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.TrustedKeys = map[string]ed25519.PublicKey{"cache.example.com-1": publicKey}
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, "signed", map[string]string{
+		a + ".narinfo": signNarInfo(t, testNarInfo(a), "cache.example.com-1", privateKey),
+	})
+
+	id := uploadClosure(t, service, "forged", map[string]string{
+		b + ".narinfo": signNarInfo(t, testNarInfo(b), "cache.example.com-1", otherKey),
+	})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+}
+
+func TestService_identityKeys(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.APIToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	teamAPublic, teamAKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	teamBPublic, teamBKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.TrustedKeys = map[string]ed25519.PublicKey{"team-a-1": teamAPublic, "team-b-1": teamBPublic}
+	// requests authenticated with the API token act as team b
+	service.IdentityKeys = map[string][]string{"api-token": {"team-b-1"}}
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	header := map[string]string{"Authorization": "Bearer " + service.APIToken}
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+	}
+
+	id := uploadClosure(t, service, "team-a", map[string]string{
+		a + ".narinfo": signNarInfo(t, testNarInfo(a), "team-a-1", teamAKey),
+	})
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.AuthMiddleware(service.CommitPendingClosureHandler),
+		pathValues:    map[string]string{"id": id},
+		header:        header,
+		checkResponse: &checkResponse,
+	})
+
+	id = uploadClosure(t, service, "team-b", map[string]string{
+		b + ".narinfo": signNarInfo(t, testNarInfo(b), "team-b-1", teamBKey),
+	})
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + id + "/complete",
+		handler:    service.AuthMiddleware(service.CommitPendingClosureHandler),
+		pathValues: map[string]string{"id": id},
+		header:     header,
+	})
+}
+
+func TestService_serveKeys(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	service.ServeKeys = map[string]ed25519.PublicKey{"cache.example.com-1": publicKey}
+
+	signed := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	unsigned := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	listing := `{"version": 1, "root": {"type": "directory", "entries": {}}}`
+
+	pushClosure(t, service, "serve", map[string]string{
+		signed + ".narinfo":   signNarInfo(t, testNarInfo(signed), "cache.example.com-1", privateKey),
+		signed + ".ls":        listing,
+		unsigned + ".narinfo": testNarInfo(unsigned),
+		unsigned + ".ls":      listing,
+	})
+
+	serve := func(hash string, status int) {
+		checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != status {
+				t.Errorf("%s: expected status %d, got %d: %s", hash, status, rr.Code, rr.Body.String())
+			}
+		}
+
+		testRequest(t, &TestRequest{
+			method:        "GET",
+			path:          "/serve/" + hash + "/",
+			handler:       service.ServeNarFileHandler,
+			pathValues:    map[string]string{"hash": hash, "path": ""},
+			checkResponse: &checkResponse,
+		})
+	}
+
+	serve(signed, http.StatusOK)
+	serve(unsigned, http.StatusForbidden)
+
+	service.AllowUnsigned = true
+
+	serve(unsigned, http.StatusOK)
+
+	// with trusted keys, a narinfo replaced through an upload URL after the commit is never served
+	service.TrustedKeys = map[string]ed25519.PublicKey{"cache.example.com-1": publicKey}
+
+	serve(unsigned, http.StatusForbidden)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/Mic92/niks3/server/pg"
+)
+
+type ComponentStatus struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type StatusResponse struct {
+	Database         ComponentStatus `json:"database"`
+	MigrationVersion int64           `json:"migration_version"`
+	S3               ComponentStatus `json:"s3"`
+	Bucket           string          `json:"bucket"`
+	// Only set if a secondary endpoint is configured.
+	SecondaryS3    *ComponentStatus `json:"secondary_s3,omitempty"`
+	UploadEndpoint string           `json:"upload_endpoint"`
+	Pushes         PushStatus       `json:"pushes"`
+	GCHolds        []GCHold         `json:"gc_holds"`
+	// Objects served with --verify-reads that did not match their recorded size or sha256.
+	ChecksumMismatches int64 `json:"checksum_mismatches"`
+}
+
+// PushStatus shows the load of the requests limited by --max-concurrent-pushes: create, presign, commit and promote.
+type PushStatus struct {
+	// requests being processed, at most --max-concurrent-pushes
+	Active int `json:"active"`
+	// requests waiting for a free slot. A queue that stays non-empty is the signal to raise
+	// --max-concurrent-pushes or to add servers, once it reaches --max-queued-pushes requests get 429.
+	Queued int `json:"queued"`
+	// pushes waiting for the garbage collector to delete objects they contain
+	WaitingForDeletion int64 `json:"waiting_for_deletion"`
+}
+
+func componentStatus(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{OK: false, Error: err.Error()}
+	}
+
+	return ComponentStatus{OK: true}
+}
+
+// checkS3 checks the primary store.
+func (s *Service) checkS3(ctx context.Context) error {
+	return checkStore(ctx, s.primaryStore())
+}
+
+// checkStore does a cheap authenticated call, which fails if the credentials are invalid or expired.
+func checkStore(ctx context.Context, store objectStore) error {
+	exists, err := store.client.BucketExists(ctx, store.bucket)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+
+	if !exists {
+		return errors.New("bucket does not exist")
+	}
+
+	return nil
+}
+
+// GET /api/admin/status
+// Response body:
+//
+//	{
+//	  "database": {"ok": true},
+//	  "migration_version": 20241109103512,
+//	  "s3": {"ok": false, "error": "The Access Key Id you provided does not exist in our records."},
+//	  "bucket": "nix-cache",
+//	  "secondary_s3": {"ok": true},
+//	  "upload_endpoint": "primary",
+//	  "pushes": {"active": 8, "queued": 3, "waiting_for_deletion": 1},
+//	  "gc_holds": [{"id": 1, "reason": "deploying release 24.11", ...}],
+//	  "checksum_mismatches": 0
+//	}
+func (s *Service) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received status request", "method", r.Method, "url", r.URL)
+
+	status := StatusResponse{Bucket: s.BucketName}
+
+	version, err := pg.MigrationVersion(r.Context(), s.Pool)
+	status.Database = componentStatus(err)
+	status.MigrationVersion = version
+
+	status.S3 = componentStatus(s.checkS3(r.Context()))
+	status.UploadEndpoint = s.uploadStore().name
+
+	if s.SecondaryMinioClient != nil {
+		secondary := componentStatus(checkStore(r.Context(), s.secondaryStore()))
+		status.SecondaryS3 = &secondary
+	}
+
+	status.Pushes.Active, status.Pushes.Queued = s.pushes.stats()
+	status.Pushes.WaitingForDeletion = s.deletionWaits.Load()
+	status.ChecksumMismatches = s.checksumMismatches.Load()
+
+	if status.GCHolds, err = getActiveGCHolds(r.Context(), s.Pool); err != nil {
+		slog.WarnContext(r.Context(), "Failed to get gc holds", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
@@ -0,0 +1,32 @@
+package server_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_StatusHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	rr := testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/admin/status",
+		handler: service.StatusHandler,
+	})
+
+	var status server.StatusResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &status))
+
+	if !status.Database.OK || status.MigrationVersion == 0 {
+		t.Errorf("unexpected database status: %v", status)
+	}
+
+	if !status.S3.OK {
+		t.Errorf("unexpected s3 status: %v", status.S3)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is the single connection of --stdio. Deadlines are not supported,
+// the ssh session that started the server ends when its client goes away.
+type stdioConn struct {
+	io.Reader
+	w io.WriteCloser
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.w.Write(p) //nolint:wrapcheck
+}
+
+func (c *stdioConn) Close() error {
+	err := net.ErrClosed
+
+	c.closeOnce.Do(func() {
+		err = c.w.Close()
+		close(c.closed)
+	})
+
+	return err //nolint:wrapcheck
+}
+
+func (c *stdioConn) LocalAddr() net.Addr              { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr             { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(time.Time) error { return nil }
+
+// stdioListener accepts its connection once and fails once it is closed, which stops the server.
+type stdioListener struct {
+	conn     *stdioConn
+	accepted sync.Once
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+
+	l.accepted.Do(func() { conn = l.conn })
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.conn.closed
+
+	return nil, net.ErrClosed
+}
+
+func (l *stdioListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *stdioListener) Addr() net.Addr {
+	return stdioAddr{}
+}
+
+// ServeStdio serves all endpoints as HTTP on a single connection over r and w, e.g. stdin and stdout of
+// "ssh cache.example.com niks3-server --stdio", for builders that may only reach the cache over ssh.
+// Requests are authenticated like on the HTTP port. It returns once the client closes the connection.
+func (s *Service) ServeStdio(ctx context.Context, opts *Options, r io.Reader, w io.WriteCloser) error {
+	mux := http.NewServeMux()
+	s.registerReadRoutes(mux)
+	s.registerAPIRoutes(mux, opts)
+
+	// the connection is plain HTTP, there is no TLS handshake to ask for client certificates
+	server, err := newHTTPServer(opts, stdioAddr{}.String(), s.FaultMiddleware(s.APIVersionMiddleware(mux)),
+		ClientAuthNone)
+	if err != nil {
+		return err
+	}
+
+	conn := &stdioConn{Reader: r, w: w, closed: make(chan struct{})}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.Close()
+		case <-conn.closed:
+		}
+	}()
+
+	slog.InfoContext(ctx, "Serving HTTP on stdin and stdout")
+
+	err = server.Serve(&stdioListener{conn: conn})
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve on stdio: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_ServeStdio(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	done := make(chan error, 1)
+
+	go func() { done <- service.ServeStdio(ctx, &server.Options{}, stdinReader, stdoutWriter) }()
+
+	responses := bufio.NewReader(stdoutReader)
+
+	// several requests share the connection
+	for range 2 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://stdio/health", nil)
+		ok(t, err)
+
+		go func() { _ = req.Write(stdinWriter) }()
+
+		resp, err := http.ReadResponse(responses, req)
+		ok(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		ok(t, err)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+			t.Fatalf("expected OK, got %d: %s", resp.StatusCode, body)
+		}
+	}
+
+	// the server stops when the client closes the connection
+	ok(t, stdinWriter.Close())
+
+	select {
+	case err := <-done:
+		ok(t, err)
+	case <-ctx.Done():
+		t.Fatal("server did not stop after the connection was closed")
+	}
+}
@@ -0,0 +1,86 @@
+package storepath
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidContentHash = errors.New("invalid hash")
+
+// digestSizes are the hash algorithms supported by nix and their digest sizes in bytes.
+var digestSizes = map[string]int{
+	"md5":    16,
+	"sha1":   20,
+	"sha256": 32,
+	"sha512": 64,
+}
+
+// Hash is a content hash like the NarHash and FileHash of a narinfo.
+type Hash struct {
+	Algo   string
+	Digest []byte
+}
+
+// ParseHash parses a hash in one of the formats nix accepts: algo:digest with a nix32,
+// hex or base64 encoded digest, or an SRI hash algo-base64.
+func ParseHash(s string) (*Hash, error) {
+	if algo, digest, found := strings.Cut(s, ":"); found {
+		return parseDigest(algo, digest, false)
+	}
+
+	if algo, digest, found := strings.Cut(s, "-"); found {
+		return parseDigest(algo, digest, true)
+	}
+
+	return nil, fmt.Errorf("%w %q: expected algo:digest or algo-base64", ErrInvalidContentHash, s)
+}
+
+func parseDigest(algo, digest string, sri bool) (*Hash, error) {
+	size, ok := digestSizes[algo]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown algorithm %q", ErrInvalidContentHash, algo)
+	}
+
+	var (
+		decoded []byte
+		err     error
+	)
+
+	switch {
+	case len(digest) == base64.StdEncoding.EncodedLen(size):
+		decoded, err = base64.StdEncoding.DecodeString(digest)
+	case sri:
+		return nil, fmt.Errorf("%w: SRI digest of %s must be %d base64 characters",
+			ErrInvalidContentHash, algo, base64.StdEncoding.EncodedLen(size))
+	case len(digest) == hex.EncodedLen(size):
+		decoded, err = hex.DecodeString(digest)
+	case len(digest) == Nix32EncodedLen(size):
+		decoded, err = DecodeNix32(digest)
+	default:
+		return nil, fmt.Errorf("%w: digest of %s has unexpected length %d", ErrInvalidContentHash, algo, len(digest))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidContentHash, err)
+	}
+
+	return &Hash{Algo: algo, Digest: decoded}, nil
+}
+
+// String returns the hash in the algo:nix32 format used in narinfos.
+func (h *Hash) String() string {
+	return h.Algo + ":" + EncodeNix32(h.Digest)
+}
+
+// Hex returns the hash in the algo:hex format.
+func (h *Hash) Hex() string {
+	return h.Algo + ":" + hex.EncodeToString(h.Digest)
+}
+
+// SRI returns the hash in the subresource integrity format, e.g. sha256-base64.
+func (h *Hash) SRI() string {
+	return h.Algo + "-" + base64.StdEncoding.EncodeToString(h.Digest)
+}
@@ -0,0 +1,85 @@
+package storepath
+
+import (
+	"errors"
+	"fmt"
+)
+
+// nix32Alphabet omits e, o, u and t to avoid accidental words in hashes.
+const nix32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+var ErrInvalidNix32 = errors.New("invalid nix32 string")
+
+// Nix32EncodedLen returns the length of the nix32 encoding of n bytes.
+func Nix32EncodedLen(n int) int {
+	if n == 0 {
+		return 0
+	}
+
+	return (n*8-1)/5 + 1
+}
+
+// EncodeNix32 encodes data in the base32 variant of nix. Unlike RFC 4648, the
+// least significant bits come first and the string is written in reverse.
+func EncodeNix32(data []byte) string {
+	out := make([]byte, Nix32EncodedLen(len(data)))
+
+	for n := len(out) - 1; n >= 0; n-- {
+		b := n * 5
+		i := b / 8
+		j := b % 8
+
+		c := data[i] >> j
+		if i+1 < len(data) {
+			c |= data[i+1] << (8 - j)
+		}
+
+		out[len(out)-1-n] = nix32Alphabet[c&0x1f]
+	}
+
+	return string(out)
+}
+
+// DecodeNix32 decodes a string written by EncodeNix32.
+func DecodeNix32(s string) ([]byte, error) {
+	size := len(s) * 5 / 8
+	if Nix32EncodedLen(size) != len(s) {
+		return nil, fmt.Errorf("%w: invalid length %d", ErrInvalidNix32, len(s))
+	}
+
+	out := make([]byte, size)
+
+	for n := range len(s) {
+		c := s[len(s)-1-n]
+
+		digit := indexNix32(c)
+		if digit < 0 {
+			return nil, fmt.Errorf("%w: invalid character %q", ErrInvalidNix32, c)
+		}
+
+		b := n * 5
+		i := b / 8
+		j := b % 8
+
+		out[i] |= byte(digit << j)
+
+		carry := byte(digit >> (8 - j))
+		if i+1 < size {
+			out[i+1] |= carry
+		} else if carry != 0 {
+			return nil, fmt.Errorf("%w: excess bits", ErrInvalidNix32)
+		}
+	}
+
+	return out, nil
+}
+
+func indexNix32(c byte) int {
+	for i := range len(nix32Alphabet) {
+		if nix32Alphabet[i] == c {
+			return i
+		}
+	}
+
+	return -1
+}
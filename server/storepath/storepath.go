@@ -0,0 +1,144 @@
+// Package storepath parses and validates nix store paths and converts the hash
+// formats used in narinfos, without depending on the nix command line tools.
+package storepath
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// DefaultStoreDir is the store directory of a standard nix installation.
+	DefaultStoreDir = "/nix/store"
+
+	// HashLen is the length of the nix32 encoded hash part of a store path.
+	HashLen = 32
+
+	// MaxNameLen is the maximum length of the name part of a store path.
+	MaxNameLen = 211
+)
+
+var (
+	ErrInvalidHash     = errors.New("invalid store path hash")
+	ErrInvalidName     = errors.New("invalid store path name")
+	ErrInvalidStoreDir = errors.New("invalid store directory")
+)
+
+// StorePath is a parsed store path like /nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1.
+type StorePath struct {
+	StoreDir string
+	Hash     string
+	Name     string
+}
+
+// Parse parses an absolute store path.
+func Parse(p string) (*StorePath, error) {
+	if !path.IsAbs(p) {
+		return nil, fmt.Errorf("%q: %w, store paths must be absolute", p, ErrInvalidStoreDir)
+	}
+
+	storeDir, base := path.Split(p)
+	storeDir = strings.TrimSuffix(storeDir, "/")
+
+	if ValidateStoreDir(storeDir) != nil {
+		return nil, fmt.Errorf("%q: %w", p, ErrInvalidStoreDir)
+	}
+
+	storePath, err := ParseBaseName(base)
+	if err != nil {
+		return nil, err
+	}
+
+	storePath.StoreDir = storeDir
+
+	return storePath, nil
+}
+
+// ValidateStoreDir checks that a store directory is absolute, clean and not the root directory.
+func ValidateStoreDir(storeDir string) error {
+	if storeDir == "" || storeDir == "/" || !path.IsAbs(storeDir) || path.Clean(storeDir) != storeDir {
+		return fmt.Errorf("%q: %w", storeDir, ErrInvalidStoreDir)
+	}
+
+	return nil
+}
+
+// ParseBaseName parses the last component of a store path, e.g. the references of a narinfo.
+// The store directory of the result is empty.
+func ParseBaseName(base string) (*StorePath, error) {
+	hash, name, found := strings.Cut(base, "-")
+	if !found {
+		return nil, fmt.Errorf("%q: %w, expected hash-name", base, ErrInvalidName)
+	}
+
+	if err := ValidateHash(hash); err != nil {
+		return nil, fmt.Errorf("%q: %w", base, err)
+	}
+
+	if err := ValidateName(name); err != nil {
+		return nil, fmt.Errorf("%q: %w", base, err)
+	}
+
+	return &StorePath{Hash: hash, Name: name}, nil
+}
+
+// ValidateHash checks that hash is a nix32 encoded hash part of a store path.
+func ValidateHash(hash string) error {
+	if len(hash) != HashLen {
+		return fmt.Errorf("%w: expected %d characters, got %d", ErrInvalidHash, HashLen, len(hash))
+	}
+
+	for i := range len(hash) {
+		if strings.IndexByte(nix32Alphabet, hash[i]) < 0 {
+			return fmt.Errorf("%w: invalid character %q", ErrInvalidHash, hash[i])
+		}
+	}
+
+	return nil
+}
+
+// ValidateName checks the name part of a store path against the rules of nix.
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	case len(name) > MaxNameLen:
+		return fmt.Errorf("%w: longer than %d characters", ErrInvalidName, MaxNameLen)
+	case name[0] == '.':
+		return fmt.Errorf("%w: must not start with a dot", ErrInvalidName)
+	}
+
+	for i := range len(name) {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.IndexByte("+-._?=", c) >= 0 {
+			continue
+		}
+
+		return fmt.Errorf("%w: invalid character %q", ErrInvalidName, c)
+	}
+
+	return nil
+}
+
+// HashPart returns the hash part of a store path or its base name without validating it.
+func HashPart(p string) string {
+	hash, _, _ := strings.Cut(path.Base(p), "-")
+
+	return hash
+}
+
+// BaseName returns the last component of the store path, i.e. hash-name.
+func (p *StorePath) BaseName() string {
+	return p.Hash + "-" + p.Name
+}
+
+func (p *StorePath) String() string {
+	if p.StoreDir == "" {
+		return p.BaseName()
+	}
+
+	return p.StoreDir + "/" + p.BaseName()
+}
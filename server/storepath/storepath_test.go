@@ -0,0 +1,169 @@
+package storepath_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/Mic92/niks3/server/storepath"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	p, err := storepath.Parse("/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.StoreDir != "/nix/store" || p.Hash != "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n" || p.Name != "hello-2.12.1" {
+		t.Errorf("unexpected store path %#v", p)
+	}
+
+	if p.String() != "/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1" {
+		t.Errorf("unexpected string %q", p.String())
+	}
+
+	for _, tc := range []struct {
+		path string
+		err  error
+	}{
+		{"nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello", storepath.ErrInvalidStoreDir},
+		{"/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello", storepath.ErrInvalidStoreDir},
+		{"/nix//store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello", storepath.ErrInvalidStoreDir},
+		{"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n", storepath.ErrInvalidName},
+		{"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-", storepath.ErrInvalidName},
+		{"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-.hidden", storepath.ErrInvalidName},
+		{"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-a b", storepath.ErrInvalidName},
+		{"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4-hello", storepath.ErrInvalidHash},
+		{"/nix/store/evsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello", storepath.ErrInvalidHash},
+	} {
+		if _, err := storepath.Parse(tc.path); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.path, tc.err, err)
+		}
+	}
+}
+
+func TestValidateStoreDir(t *testing.T) {
+	t.Parallel()
+
+	for _, dir := range []string{"/nix/store", "/gnu/store", "/home/user/.nix/store"} {
+		if err := storepath.ValidateStoreDir(dir); err != nil {
+			t.Errorf("%s: unexpected error %v", dir, err)
+		}
+	}
+
+	for _, dir := range []string{"", "/", "nix/store", "/nix/store/", "/nix/../store"} {
+		if err := storepath.ValidateStoreDir(dir); !errors.Is(err, storepath.ErrInvalidStoreDir) {
+			t.Errorf("%s: expected %v, got %v", dir, storepath.ErrInvalidStoreDir, err)
+		}
+	}
+}
+
+func TestHashPart(t *testing.T) {
+	t.Parallel()
+
+	for _, p := range []string{
+		"/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1",
+		"bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1",
+		"bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n",
+	} {
+		if hash := storepath.HashPart(p); hash != "bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n" {
+			t.Errorf("%s: unexpected hash part %q", p, hash)
+		}
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	t.Parallel()
+
+	digest := sha256.Sum256(nil)
+
+	for _, s := range []string{
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"sha256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+	} {
+		hash, err := storepath.ParseHash(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+
+		if hash.Algo != "sha256" || !bytes.Equal(hash.Digest, digest[:]) {
+			t.Errorf("%s: unexpected hash %v", s, hash)
+		}
+
+		if hash.String() != "sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73" {
+			t.Errorf("%s: unexpected nix32 form %s", s, hash.String())
+		}
+
+		if hash.SRI() != "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+			t.Errorf("%s: unexpected SRI form %s", s, hash.SRI())
+		}
+	}
+
+	for _, s := range []string{
+		"sha256",
+		"sha3:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7",
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7e",
+		"sha256-0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+	} {
+		if _, err := storepath.ParseHash(s); !errors.Is(err, storepath.ErrInvalidContentHash) {
+			t.Errorf("%s: expected invalid hash, got %v", s, err)
+		}
+	}
+}
+
+func FuzzNix32(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0xff})
+	f.Add([]byte("hello world"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		encoded := storepath.EncodeNix32(data)
+
+		decoded, err := storepath.DecodeNix32(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode %q: %v", encoded, err)
+		}
+
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("roundtrip of %x returned %x", data, decoded)
+		}
+	})
+}
+
+func FuzzDecodeNix32(f *testing.F) {
+	f.Add("0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73")
+	f.Add("zz")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		decoded, err := storepath.DecodeNix32(s)
+		if err != nil {
+			return
+		}
+
+		if encoded := storepath.EncodeNix32(decoded); encoded != s {
+			t.Fatalf("%q decoded to %x, which encodes to %q", s, decoded, encoded)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add("/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-hello-2.12.1")
+	f.Add("/nix/store/bvsvq7ds1d5rlhjz9khq94yfzbnmqx4n-")
+
+	f.Fuzz(func(t *testing.T, s string) {
+		p, err := storepath.Parse(s)
+		if err != nil {
+			return
+		}
+
+		if p.String() != s {
+			t.Fatalf("%q parsed to %#v, which formats as %q", s, p, p.String())
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state change to the service manager, see sd_notify(3).
+// Without NOTIFY_SOCKET, i.e. when not started by systemd with Type=notify, it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// a leading @ denotes an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to send %q to notify socket: %w", state, err)
+	}
+
+	return nil
+}
+
+// watchdogInterval returns how often to send keepalives if systemd's WatchdogSec= is set
+// for this process, or zero otherwise. Half the timeout leaves room for a slow health check.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog sends keepalives while the readiness check passes,
+// so that systemd restarts instances that hang or lost their database or bucket.
+func (s *Service) runWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		err := s.checkReady(checkCtx)
+
+		cancel()
+
+		if err != nil {
+			slog.Warn("Health check failed, skipping watchdog keepalive", "error", err)
+
+			if err = sdNotify("STATUS=" + err.Error()); err != nil {
+				slog.Warn("Failed to notify systemd", "error", err)
+			}
+
+			continue
+		}
+
+		if err = sdNotify("WATCHDOG=1"); err != nil {
+			slog.Warn("Failed to notify systemd", "error", err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package testsupport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Minio is a throw-away minio server listening on a random local port.
+type Minio struct {
+	cmd         *exec.Cmd
+	tempDir     string
+	secret      string
+	port        uint16
+	bucketCount atomic.Int32
+}
+
+// Endpoint returns the host:port the server listens on.
+func (s *Minio) Endpoint() string {
+	return fmt.Sprintf("localhost:%d", s.port)
+}
+
+// Credentials returns the access key and secret key of the root user.
+func (s *Minio) Credentials() (string, string) {
+	return "minioadmin", s.secret
+}
+
+func (s *Minio) Client(tb testing.TB) *minio.Client {
+	tb.Helper()
+
+	accessKey, secretKey := s.Credentials()
+
+	minioClient, err := minio.New(s.Endpoint(), &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: false,
+	})
+	if err != nil {
+		tb.Fatalf("failed to create minio client: %v", err)
+	}
+
+	return minioClient
+}
+
+// CreateBucket creates a new empty bucket and returns its name.
+func (s *Minio) CreateBucket(tb testing.TB) string {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bucketName := "bucket" + strconv.Itoa(int(s.bucketCount.Add(1)))
+
+	if err := s.Client(tb).MakeBucket(ctx, bucketName, minio.MakeBucketOptions{}); err != nil {
+		tb.Fatalf("failed to create bucket %s: %v", bucketName, err)
+	}
+
+	return bucketName
+}
+
+func (s *Minio) Cleanup() {
+	defer os.RemoveAll(s.tempDir)
+
+	terminateProcess(s.cmd)
+}
+
+// StartMinio starts a minio server. minio has to be in PATH.
+func StartMinio() (*Minio, error) {
+	tempDir, err := os.MkdirTemp("", "minio")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tempDir)
+		}
+	}()
+
+	port, err := randPort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find free port: %w", err)
+	}
+
+	//nolint:gosec
+	minioProc := exec.Command("minio", "server", "--address", fmt.Sprintf(":%d", port), filepath.Join(tempDir, "data"))
+	minioProc.Stdout = os.Stdout
+	minioProc.Stderr = os.Stderr
+	minioProc.SysProcAttr = &syscall.SysProcAttr{}
+	minioProc.SysProcAttr.Setsid = true
+
+	// random hex string
+	secret, err := randToken(20)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access key: %w", err)
+	}
+
+	env := os.Environ()
+	env = append(env, "MINIO_ROOT_USER=minioadmin")
+	env = append(env, "MINIO_ROOT_PASSWORD="+secret)
+	env = append(env, "AWS_ACCESS_KEY_ID=minioadmin")
+	env = append(env, "AWS_SECRET_ACCESS_KEY="+secret)
+	minioProc.Env = env
+
+	if err = minioProc.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start minio: %w", err)
+	}
+
+	// wait for server to start
+	for range 200 {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+
+		if err == nil {
+			conn.Close()
+
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to minio server: %w", err)
+	}
+
+	server := &Minio{
+		cmd:     minioProc,
+		tempDir: tempDir,
+		secret:  secret,
+		port:    port,
+	}
+
+	defer func() {
+		if err != nil {
+			server.Cleanup()
+		}
+	}()
+
+	return server, nil
+}
@@ -1,36 +1,53 @@
-package server_test
+package testsupport
 
 import (
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"sync/atomic"
 	"syscall"
+	"testing"
 	"time"
 )
 
-var (
-	testPostgresServer *postgresServer //nolint:gochecknoglobals
-	testDBCount        atomic.Int32    //nolint:gochecknoglobals
-)
-
 const (
 	debugPostgres = false
 )
 
-type postgresServer struct {
+// Postgres is a throw-away postgres server listening on a unix socket in a temporary directory.
+type Postgres struct {
 	cmd     *exec.Cmd
 	tempDir string
+	dbCount atomic.Int32
 }
 
-func (s *postgresServer) Cleanup() {
+func (s *Postgres) Cleanup() {
 	defer os.RemoveAll(s.tempDir)
 
 	terminateProcess(s.cmd)
 }
 
-func startPostgresServer() (*postgresServer, error) {
+// CreateDatabase creates a new empty database and returns its connection string.
+func (s *Postgres) CreateDatabase(tb testing.TB) string {
+	tb.Helper()
+
+	dbName := "db" + strconv.Itoa(int(s.dbCount.Add(1)))
+	//nolint:gosec
+	command := exec.Command("createdb", "-h", s.tempDir, "-U", "postgres", dbName)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	if err := command.Run(); err != nil {
+		tb.Fatalf("failed to create database %s: %v", dbName, err)
+	}
+
+	return fmt.Sprintf("postgres://?dbname=%s&user=postgres&host=%s", dbName, s.tempDir)
+}
+
+// StartPostgres starts a postgres server. initdb, postgres and pg_isready have to be in PATH.
+func StartPostgres() (*Postgres, error) {
 	tempDir, err := os.MkdirTemp("", "postgres")
 	if err != nil {
 		return nil, fmt.Errorf("failed to create temp dir: %w", err)
@@ -67,7 +84,7 @@ func startPostgresServer() (*postgresServer, error) {
 		return nil, fmt.Errorf("failed to start postgres: %w", err)
 	}
 
-	server := &postgresServer{
+	server := &Postgres{
 		cmd:     postgresProc,
 		tempDir: tempDir,
 	}
@@ -0,0 +1,70 @@
+package testsupport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+func randToken(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+func randPort() (uint16, error) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	ln.Close()
+	time.Sleep(1 * time.Second)
+
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("failed to get port: %w", err)
+	}
+
+	return (uint16)(addr.Port), nil //nolint:gosec
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	if err != nil {
+		slog.Error("failed to get pgid", "error", err)
+
+		return
+	}
+
+	time.AfterFunc(10*time.Second, func() {
+		err = syscall.Kill(pgid, syscall.SIGKILL)
+		if err != nil {
+			slog.Error("failed to kill process", "error", err, "cmd", cmd.Path)
+
+			return
+		}
+
+		slog.Info("killed process", "cmd", cmd.Path)
+	})
+
+	err = syscall.Kill(pgid, syscall.SIGTERM)
+	if err != nil {
+		slog.Error("failed to kill process", "error", err, "cmd", cmd.Path)
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		slog.Error("failed to wait for process", "error", err, "cmd", cmd.Path)
+
+		return
+	}
+}
@@ -0,0 +1,201 @@
+// Package testsupport boots throw-away postgres and minio servers and wires them into a
+// server.Service, so that integration tests, including those of downstream projects, can
+// run against a real cache.
+//
+// The postgres (initdb, postgres, pg_isready, createdb) and minio binaries have to be in PATH.
+// Start the harness once from TestMain and create a fresh cache per test:
+//
+//	var harness *testsupport.Harness
+//
+//	func TestMain(m *testing.M) {
+//		var err error
+//		if harness, err = testsupport.Start(); err != nil {
+//			log.Fatal(err)
+//		}
+//		code := m.Run()
+//		harness.Cleanup()
+//		os.Exit(code)
+//	}
+//
+//	func TestPush(t *testing.T) {
+//		service := harness.CreateTestCache(t)
+//		defer service.Close()
+//		testsupport.PushFixture(t, service, "my-closure", map[string]string{
+//			hash + ".narinfo": testsupport.NarInfo(hash),
+//		})
+//	}
+package testsupport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	"github.com/Mic92/niks3/server/pg"
+	"github.com/Mic92/niks3/server/storepath"
+)
+
+// Harness owns a postgres and a minio server shared by all caches created from it.
+type Harness struct {
+	Postgres *Postgres
+	Minio    *Minio
+}
+
+// Start boots postgres and minio. Call Cleanup once all tests are done.
+func Start() (*Harness, error) {
+	postgres, err := StartPostgres()
+	if err != nil {
+		return nil, err
+	}
+
+	minio, err := StartMinio()
+	if err != nil {
+		postgres.Cleanup()
+
+		return nil, err
+	}
+
+	return &Harness{Postgres: postgres, Minio: minio}, nil
+}
+
+func (h *Harness) Cleanup() {
+	h.Minio.Cleanup()
+	h.Postgres.Cleanup()
+}
+
+// CreateTestCache returns a service backed by its own database and bucket.
+// The caller is responsible for calling Close on it.
+func (h *Harness) CreateTestCache(tb testing.TB) *server.Service {
+	tb.Helper()
+
+	connectionString := h.Postgres.CreateDatabase(tb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	pool, err := pg.Connect(ctx, connectionString)
+	if err != nil {
+		tb.Fatalf("failed to connect to database: %v", err)
+	}
+
+	return &server.Service{
+		Pool:        pool,
+		BucketName:  h.Minio.CreateBucket(tb),
+		MinioClient: h.Minio.Client(tb),
+		StoreDir:    storepath.DefaultStoreDir,
+	}
+}
+
+// NarInfo returns a minimal narinfo for /nix/store/<hash>-pkg referencing the given hashes.
+func NarInfo(hash string, references ...string) string {
+	refs := make([]string, 0, len(references))
+	for _, ref := range references {
+		refs = append(refs, ref+"-pkg")
+	}
+
+	// like nix, the separator is kept without references
+	return fmt.Sprintf(`StorePath: /nix/store/%s-pkg
+URL: nar/%s.nar.zst
+Compression: zstd
+NarHash: sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80
+NarSize: 1024
+References: %s
+`, hash, hash, strings.Join(refs, " "))
+}
+
+// PushFixture uploads the given objects as closure closureKey and commits it.
+func PushFixture(tb testing.TB, service *server.Service, closureKey string, objects map[string]string) {
+	tb.Helper()
+
+	id := UploadFixture(tb, service, closureKey, objects)
+
+	serve(tb, service.CommitPendingClosureHandler, http.MethodPost,
+		fmt.Sprintf("/api/pending_closures/%s/complete", id), nil, map[string]string{"id": id})
+}
+
+// UploadFixture uploads the given objects through the pending closure API without committing
+// it and returns the pending closure id.
+func UploadFixture(tb testing.TB, service *server.Service, closureKey string, objects map[string]string) string {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": closureKey,
+		"objects": keys,
+	})
+	if err != nil {
+		tb.Fatalf("failed to encode request: %v", err)
+	}
+
+	rr := serve(tb, service.CreatePendingClosureHandler, http.MethodPost, "/api/pending_closures", body, nil)
+
+	var pendingClosureResponse server.PendingClosureResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse); err != nil {
+		tb.Fatalf("failed to decode response: %v", err)
+	}
+
+	for key, pendingObject := range pendingClosureResponse.PendingObjects {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, pendingObject.PresignedURL,
+			bytes.NewBufferString(objects[key]))
+		if err != nil {
+			tb.Fatalf("failed to create upload request for %s: %v", key, err)
+		}
+
+		for name, value := range pendingObject.Headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			tb.Fatalf("failed to upload %s: %v", key, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			tb.Fatalf("failed to upload %s: status %d", key, resp.StatusCode)
+		}
+	}
+
+	return pendingClosureResponse.ID
+}
+
+func serve(tb testing.TB, handler http.HandlerFunc, method, path string, body []byte,
+	pathValues map[string]string,
+) *httptest.ResponseRecorder {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewBuffer(body))
+	if err != nil {
+		tb.Fatalf("failed to create request: %v", err)
+	}
+
+	for k, v := range pathValues {
+		req.SetPathValue(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code < 200 || rr.Code >= 300 {
+		tb.Fatalf("%s %s: unexpected http status=%d body=%s", method, path, rr.Code, rr.Body.String())
+	}
+
+	return rr
+}
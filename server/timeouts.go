@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// withTimeout bounds the handler's context and write deadline by timeout.
+// Zero lifts the server-wide write timeout, e.g. for garbage collection or event streams.
+func withTimeout(timeout time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+
+			ctx, cancel := context.WithDeadline(r.Context(), deadline)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+		}
+
+		setWriteDeadline(w, deadline)
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+func setWriteDeadline(w http.ResponseWriter, deadline time.Time) {
+	err := http.NewResponseController(w).SetWriteDeadline(deadline)
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to set write deadline", "error", err)
+	}
+}
+
+// idleTimeoutWriter extends the write deadline with every write,
+// so that long downloads only fail if the client stops reading.
+type idleTimeoutWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+}
+
+func (w *idleTimeoutWriter) Write(b []byte) (int, error) {
+	if w.timeout > 0 {
+		setWriteDeadline(w.ResponseWriter, time.Now().Add(w.timeout))
+	}
+
+	return w.ResponseWriter.Write(b) //nolint:wrapcheck
+}
+
+func setReadDeadline(w http.ResponseWriter, deadline time.Time) {
+	err := http.NewResponseController(w).SetReadDeadline(deadline)
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to set read deadline", "error", err)
+	}
+}
+
+// idleTimeoutReader extends the read deadline with every read,
+// so that long uploads only fail if the client stops sending.
+type idleTimeoutReader struct {
+	io.Reader
+	w       http.ResponseWriter
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(b []byte) (int, error) {
+	if r.timeout > 0 {
+		setReadDeadline(r.w, time.Now().Add(r.timeout))
+	}
+
+	return r.Reader.Read(b) //nolint:wrapcheck
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// phaseTimer measures the phases of a push request, e.g. database work vs. S3 calls,
+// and logs them at debug level to localize slow pushes.
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []any
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+
+	return &phaseTimer{start: now, last: now}
+}
+
+// done records the time since the previous phase ended.
+func (t *phaseTimer) done(phase string) {
+	now := time.Now()
+	t.phases = append(t.phases, phase, now.Sub(t.last))
+	t.last = now
+}
+
+func (t *phaseTimer) log(ctx context.Context, msg string, args ...any) {
+	args = append(args, t.phases...)
+	args = append(args, "total", time.Since(t.start))
+
+	slog.DebugContext(ctx, msg, args...)
+}
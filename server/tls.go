@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// ClientAuth is how a listener asks for client certificates.
+type ClientAuth string
+
+const (
+	// ClientAuthNone doesn't ask for client certificates.
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthOptional verifies client certificates if given, so token authentication keeps working.
+	ClientAuthOptional ClientAuth = "optional"
+	// ClientAuthRequire refuses TLS connections without a client certificate signed by the CA.
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// parseClientAuth parses a client auth mode. Without a mode, certificates are optional if a CA is configured.
+func parseClientAuth(value, caFile string) (ClientAuth, error) {
+	if value == "" {
+		if caFile == "" {
+			return ClientAuthNone, nil
+		}
+
+		return ClientAuthOptional, nil
+	}
+
+	switch auth := ClientAuth(value); auth {
+	case ClientAuthNone:
+		return auth, nil
+	case ClientAuthOptional, ClientAuthRequire:
+		if caFile == "" {
+			return "", fmt.Errorf("%q requires --tls-client-ca", value)
+		}
+
+		return auth, nil
+	default:
+		return "", fmt.Errorf("unknown client auth %q, expected %s, %s or %s",
+			value, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+}
+
+// loadClientCAs returns a TLS config that verifies client certificates against the given CA bundle.
+// With ClientAuthOptional, token authentication keeps working on the same listener.
+func loadClientCAs(caFile string, auth ClientAuth) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if auth == ClientAuthRequire {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		ClientAuth: clientAuth,
+		ClientCAs:  pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// clientCertIdentity returns the names of a verified client certificate:
+// the subject common name followed by DNS, email and URI SANs.
+func clientCertIdentity(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// authenticateClientCert reports whether the request carries a verified client certificate
+// that is allowed to use the API. If no names are configured, any certificate signed by the CA is accepted.
+func (s *Service) authenticateClientCert(r *http.Request) (string, bool) {
+	names := clientCertIdentity(r)
+	if len(names) == 0 {
+		return "", false
+	}
+
+	if len(s.ClientCertNames) == 0 {
+		return names[0], true
+	}
+
+	for _, name := range names {
+		if slices.Contains(s.ClientCertNames, name) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
@@ -12,14 +12,39 @@ import (
 
 type CreatePendingClosureRequest struct {
 	Closure *string  `json:"closure"`
+	Group   string   `json:"group,omitempty"`
 	Objects []string `json:"objects"`
+	// Free-form metadata stored with the closure, e.g. {"jobset": "nixpkgs:trunk", "eval": "1234"}.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Where the closure was built, replaces the provenance of earlier pushes.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Maximum number of upload URLs to create upfront, 0 means all.
+	PresignLimit int `json:"presign_limit,omitempty"`
+	// Makes the objects the complete new contents of an existing closure on commit, e.g. to swap a channel pin.
+	// Objects that the closure no longer contains become garbage. By default objects are added to the closure.
+	Replace bool `json:"replace,omitempty"`
 }
 
+// maximum length of the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
 // POST /pending_closures
+// Request headers:
+//
+//	Idempotency-Key: 9b2f6a1e-4c1d-4f5e-8a43-0c5d3b7e2a10 (optional)
+//
+// Retries with the same Idempotency-Key return the pending closure of the first request
+// for as long as it is pending, marked with the Idempotent-Replayed: true response header.
+//
 // Request body:
 //
 //	{
 //	 "closure": "26xbg1ndr7hbcncrlf9nhx5is2b25d13",
+//	 "group": "nixos-hosts", (optional)
+//	 "presign_limit": 100, (optional)
+//	 "replace": true, (optional)
+//	 "labels": {"jobset": "nixpkgs:trunk", "eval": "1809585"}, (optional)
+//	 "provenance": {"revision": "3f7340e", "ci_job_url": "https://ci.example.com/jobs/42"}, (optional)
 //	 "objects": [
 //		 "26xbg1ndr7hbcncrlf9nhx5is2b25d13.narinfo",
 //		 "nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz"
@@ -36,13 +61,11 @@ type CreatePendingClosureRequest struct {
 //	   }
 //	}
 func (s *Service) CreatePendingClosureHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Received uploads request", "method", r.Method, "url", r.URL)
+	slog.InfoContext(r.Context(), "Received uploads request", "method", r.Method, "url", r.URL)
 	defer r.Body.Close()
 
 	req := &CreatePendingClosureRequest{}
-	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		http.Error(w, "failed to decode request: "+err.Error(), http.StatusBadRequest)
-
+	if !s.decodeRequest(w, r, req) {
 		return
 	}
 
@@ -58,19 +81,54 @@ func (s *Service) CreatePendingClosureHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if !s.checkObjectKeys(w, req.Objects) {
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("idempotency key is longer than %d characters", maxIdempotencyKeyLength),
+			http.StatusBadRequest)
+
+		return
+	}
+
 	storePathSet := make(map[string]bool)
 
 	for _, object := range req.Objects {
 		storePathSet[object] = true
 	}
 
-	upload, err := s.createPendingClosure(r.Context(), s.Pool, *req.Closure, storePathSet)
+	upload, replayed, err := s.createPendingClosure(r.Context(), s.Pool, req, storePathSet, idempotencyKey)
 	if err != nil {
+		if errors.Is(err, errIdempotencyKeyReused) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+			return
+		}
+
+		if errors.Is(err, errDeletionWaitTimeout) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+
 		http.Error(w, "failed to start upload: "+err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
+	if replayed {
+		slog.InfoContext(r.Context(), "Replayed pending closure", "id", upload.ID, "idempotency_key", idempotencyKey)
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else {
+		s.publishEvent(r.Context(), Event{
+			Type:    eventPendingOpen,
+			Closure: *req.Closure,
+			Data:    map[string]any{"id": upload.ID, "pending_objects": len(upload.PendingObjects)},
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	err = json.NewEncoder(w).Encode(upload)
@@ -87,7 +145,7 @@ func (s *Service) CreatePendingClosureHandler(w http.ResponseWriter, r *http.Req
 // Request body: -
 // Response body: -.
 func (s *Service) CommitPendingClosureHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Received complete upload request", "method", r.Method, "url", r.URL)
+	slog.InfoContext(r.Context(), "Received complete upload request", "method", r.Method, "url", r.URL)
 
 	pendingClosureValue := r.PathValue("id")
 	if pendingClosureValue == "" {
@@ -103,19 +161,263 @@ func (s *Service) CommitPendingClosureHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if err = commitPendingClosure(r.Context(), s.Pool, parsedUploadID); err != nil {
+	closureKey, err := s.commitPendingClosure(r.Context(), parsedUploadID)
+	if err != nil {
 		if errors.Is(err, errPendingClosureNotFound) {
 			http.Error(w, "pending closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		if errors.Is(err, errInvalidSignature) || errors.Is(err, errMissingReferences) ||
+			errors.Is(err, errMissingFileHash) || errors.Is(err, errWrongStoreDir) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if errors.Is(err, errTooManyReferences) {
+			writeLimitError(w, http.StatusUnprocessableEntity, err.Error(), int64(s.MaxNarinfoReferences))
+
+			return
 		}
 
-		slog.Error("Failed to complete upload", "id", parsedUploadID, "error", err)
+		if errors.Is(err, errUnreadableNarInfo) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "Failed to complete upload", "id", parsedUploadID, "error", err)
 
 		http.Error(w, fmt.Sprintf("failed to complete upload: %v", err), http.StatusInternalServerError)
 
 		return
 	}
 
-	slog.Info("Completed upload", "id", parsedUploadID)
+	slog.InfoContext(r.Context(), "Completed upload", "id", parsedUploadID)
+
+	s.publishEvent(r.Context(), Event{
+		Type: eventCommitted, Closure: closureKey, Data: map[string]any{"id": pendingClosureValue},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type PresignPendingObjectsRequest struct {
+	Objects []string `json:"objects"`
+}
+
+type PresignPendingObjectsResponse struct {
+	PendingObjects map[string]PendingObject `json:"pending_objects"`
+}
+
+// POST /pending_closures/{id}/urls
+// Request body:
+//
+//	{
+//	 "objects": [
+//		 "nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz"
+//	 ]
+//	}
+//
+// Response body:
+//
+//	{
+//	  "pending_objects": {
+//		  "nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz": "https://yours3endpoint?authkey=...",
+//	   }
+//	}
+func (s *Service) PresignPendingObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received presign request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	parsedUploadID, err := strconv.ParseInt(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	req := &PresignPendingObjectsRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	if len(req.Objects) == 0 {
+		http.Error(w, "missing objects key", http.StatusBadRequest)
+
+		return
+	}
+
+	if !s.checkObjectKeys(w, req.Objects) {
+		return
+	}
+
+	pendingObjects, err := s.presignPendingObjects(r.Context(), parsedUploadID, req.Objects)
+	if err != nil {
+		if errors.Is(err, errPendingClosureNotFound) {
+			http.Error(w, "pending closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, "failed to presign objects: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(PresignPendingObjectsResponse{PendingObjects: pendingObjects})
+	if err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+type AttachPendingObjectsRequest struct {
+	// ID of the pending closure that uploads the objects.
+	PendingClosure string   `json:"pending_closure"`
+	Objects        []string `json:"objects"`
+}
+
+type AttachPendingObjectsResponse struct {
+	Attached int `json:"attached"`
+}
+
+// POST /api/pending_closures/{id}/attach
+// Request body:
+//
+//	{
+//	  "pending_closure": "1",
+//	  "objects": ["nar/1ngi2dxw1f7khrrjamzkkdai393lwcm8s78gvs1ag8k3n82w7bvp.nar.xz"]
+//	}
+//
+// Response body:
+//
+//	{
+//	  "attached": 1
+//	}
+//
+// Adds objects that another pending closure of the same push uploads, so they are uploaded only once.
+// The closure must not be committed before the other closure has uploaded them.
+func (s *Service) AttachPendingObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received attach request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	parsedUploadID, err := strconv.ParseInt(r.PathValue("id"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	req := &AttachPendingObjectsRequest{}
+	if !s.decodeRequest(w, r, req) {
+		return
+	}
+
+	sourceID, err := strconv.ParseInt(req.PendingClosure, 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pending_closure: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	if len(req.Objects) == 0 {
+		http.Error(w, "missing objects key", http.StatusBadRequest)
+
+		return
+	}
+
+	if !s.checkObjectKeys(w, req.Objects) {
+		return
+	}
+
+	attached, err := attachPendingObjects(r.Context(), s.Pool, parsedUploadID, sourceID, req.Objects)
+	if err != nil {
+		if errors.Is(err, errPendingClosureNotFound) {
+			http.Error(w, "pending closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		if errors.Is(err, errNotPendingObject) || errors.Is(err, errEndpointMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		http.Error(w, "failed to attach objects: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(AttachPendingObjectsResponse{Attached: attached}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+// PUT /api/objects/{key...}?pending_closure=1
+// Request body: the object, e.g. a NAR. Without Content-Length, chunked bodies are streamed to S3 in parts.
+// Response body: -.
+// Fallback for clients that can reach the server but not the S3 endpoint of the presigned URLs.
+// Only objects of the given pending closure are accepted, objects that are already in the cache are refused with 409.
+// Uploads don't count against --max-concurrent-pushes, the pending closure was already admitted when it was created.
+func (s *Service) UploadPendingObjectHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received proxied upload request", "method", r.Method, "url", r.URL)
+	defer r.Body.Close()
+
+	key := r.PathValue("key")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+
+		return
+	}
+
+	pendingClosureID, err := strconv.ParseInt(r.URL.Query().Get("pending_closure"), 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid pending_closure: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	// the body can take longer than the server-wide read timeout
+	setReadDeadline(w, time.Time{})
+	body := &idleTimeoutReader{Reader: r.Body, w: w, timeout: s.StreamIdleTimeout}
+
+	err = s.uploadPendingObject(r.Context(), pendingClosureID, key, body, r.ContentLength, r.Header.Get("Content-Type"))
+	if err != nil {
+		if errors.Is(err, errPendingClosureNotFound) {
+			http.Error(w, "pending closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		if errors.Is(err, errNotPendingObject) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if errors.Is(err, errObjectInCache) {
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		}
+
+		http.Error(w, "failed to upload object: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Uploaded object through the server", "id", pendingClosureID, "key", key)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -124,7 +426,7 @@ func (s *Service) CommitPendingClosureHandler(w http.ResponseWriter, r *http.Req
 // Request body: -
 // Response body: -.
 func (s *Service) CleanupPendingClosuresHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Received cleanup request", "method", r.Method, "url", r.URL)
+	slog.InfoContext(r.Context(), "Received cleanup request", "method", r.Method, "url", r.URL)
 
 	olderThanParam := r.URL.Query().Get("older-than")
 	if olderThanParam == "" {
@@ -144,5 +446,111 @@ func (s *Service) CleanupPendingClosuresHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	s.publishEvent(r.Context(), Event{Type: eventPendingClean, Data: map[string]any{"older_than": olderThan.String()}})
+
 	w.WriteHeader(http.StatusNoContent)
 }
+
+type AbortPendingClosureResponse struct {
+	ID string `json:"id"`
+	// Objects of the pending closure that were not in the cache yet.
+	// They are deleted by the next garbage collection, in case they were uploaded already.
+	ReleasedObjects int64 `json:"released_objects"`
+}
+
+// POST /api/pending_closures/{id}/abort
+// Request body: -
+// Response body:
+//
+//	{
+//	  "id": "1",
+//	  "released_objects": 3
+//	}
+//
+// Clients call this when a push is interrupted, instead of leaving the pending closure to expire.
+func (s *Service) AbortPendingClosureHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received abort pending closure request", "method", r.Method, "url", r.URL)
+
+	pendingClosureValue := r.PathValue("id")
+
+	parsedUploadID, err := strconv.ParseInt(pendingClosureValue, 10, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	released, err := abortPendingClosure(r.Context(), s.Pool, parsedUploadID)
+	if err != nil {
+		if errors.Is(err, errPendingClosureNotFound) {
+			http.Error(w, "pending closure not found", http.StatusNotFound)
+
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Aborted pending closure", "id", parsedUploadID, "released_objects", released)
+
+	s.publishEvent(r.Context(), Event{Type: eventPendingStop, Data: map[string]any{"id": pendingClosureValue}})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(AbortPendingClosureResponse{ID: pendingClosureValue, ReleasedObjects: released})
+	if err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
+
+type AbortPendingClosuresResponse struct {
+	Aborted int `json:"aborted"`
+}
+
+// POST /api/admin/pending_closures/abort-all?older-than=0s
+// Request body: -
+// Response body:
+//
+//	{
+//	  "aborted": 42
+//	}
+func (s *Service) AbortPendingClosuresHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received abort pending closures request", "method", r.Method, "url", r.URL)
+
+	olderThan := time.Duration(0)
+
+	if olderThanParam := r.URL.Query().Get("older-than"); olderThanParam != "" {
+		var err error
+
+		olderThan, err = time.ParseDuration(olderThanParam)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	aborted, err := abortPendingClosures(r.Context(), s.Pool, olderThan)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to abort pending closures", "aborted", aborted, "error", err)
+		http.Error(w, fmt.Sprintf("failed to abort pending closures: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Aborted pending closures", "aborted", aborted)
+
+	s.publishEvent(r.Context(), Event{Type: eventPendingAbort, Data: map[string]any{"aborted": aborted}})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = json.NewEncoder(w).Encode(AbortPendingClosuresResponse{Aborted: aborted}); err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/Mic92/niks3/server"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
 func TestService_cleanupPendingClosuresHandler(t *testing.T) {
@@ -222,3 +224,795 @@ func TestService_createPendingClosureHandler(t *testing.T) {
 		},
 	})
 }
+
+func TestService_abortPendingClosuresHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	for _, closureKey := range []string{"00000000000000000000000000000000", "11111111111111111111111111111111"} {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": closureKey,
+			"objects": []string{closureKey + ".narinfo"},
+		})
+		ok(t, err)
+
+		testRequest(t, &TestRequest{
+			method:  "POST",
+			path:    "/api/pending_closures",
+			body:    body,
+			handler: service.CreatePendingClosureHandler,
+		})
+	}
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/admin/pending_closures/abort-all",
+		handler: service.AbortPendingClosuresHandler,
+	})
+
+	var response server.AbortPendingClosuresResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if response.Aborted != 2 {
+		t.Errorf("expected 2 aborted pending closures, got %d", response.Aborted)
+	}
+}
+
+func TestService_abortPendingClosureHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	// a is already in the cache and must survive the abort
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	id := uploadClosure(t, service, b, map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		b + ".narinfo": testNarInfo(b),
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + id + "/abort",
+		handler:    service.AbortPendingClosureHandler,
+		pathValues: map[string]string{"id": id},
+	})
+
+	var response server.AbortPendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if response.ID != id || response.ReleasedObjects != 1 {
+		t.Errorf("unexpected abort response: %+v", response)
+	}
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+}
+
+func TestService_presignPendingObjectsHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	closureKey := "00000000000000000000000000000000"
+	objects := []string{closureKey + ".narinfo", "nar/" + closureKey + ".nar.xz", closureKey + ".ls"}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure":       closureKey,
+		"objects":       objects,
+		"presign_limit": 1,
+	})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var upload server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+
+	if len(upload.PendingObjects) != len(objects) {
+		t.Fatalf("expected %d pending objects, got %d", len(objects), len(upload.PendingObjects))
+	}
+
+	var unsigned []string
+
+	for key, po := range upload.PendingObjects {
+		if po.PresignedURL == "" {
+			unsigned = append(unsigned, key)
+		}
+	}
+
+	if len(unsigned) != len(objects)-1 {
+		t.Fatalf("expected %d objects without presigned url, got %d", len(objects)-1, len(unsigned))
+	}
+
+	body, err = json.Marshal(map[string]interface{}{
+		"objects": append(unsigned, "not-part-of-closure.narinfo"),
+	})
+	ok(t, err)
+
+	rr = testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + upload.ID + "/urls",
+		body:       body,
+		handler:    service.PresignPendingObjectsHandler,
+		pathValues: map[string]string{"id": upload.ID},
+	})
+
+	var response server.PresignPendingObjectsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if len(response.PendingObjects) != len(unsigned) {
+		t.Fatalf("expected %d presigned objects, got %d", len(unsigned), len(response.PendingObjects))
+	}
+
+	for _, key := range unsigned {
+		if response.PendingObjects[key].PresignedURL == "" {
+			t.Errorf("expected presigned url for %s", key)
+		}
+	}
+}
+
+func TestService_presignPendingObjectsNotFound(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"objects": []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.narinfo"},
+	})
+	ok(t, err)
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d: %s", http.StatusNotFound, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/2147483647/urls",
+		body:          body,
+		handler:       service.PresignPendingObjectsHandler,
+		pathValues:    map[string]string{"id": "2147483647"},
+		checkResponse: &checkResponse,
+	})
+}
+
+func TestService_presignPendingObjectsLive(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": b,
+		"objects": []string{a + ".narinfo", b + ".narinfo"},
+	})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var upload server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+
+	// a is reused from the cache, an upload URL would allow to overwrite it
+	body, err = json.Marshal(map[string]interface{}{
+		"objects": []string{a + ".narinfo", b + ".narinfo"},
+	})
+	ok(t, err)
+
+	rr = testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + upload.ID + "/urls",
+		body:       body,
+		handler:    service.PresignPendingObjectsHandler,
+		pathValues: map[string]string{"id": upload.ID},
+	})
+
+	var response server.PresignPendingObjectsResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	if _, found := response.PendingObjects[a+".narinfo"]; found {
+		t.Errorf("expected no presigned url for live object %s", a+".narinfo")
+	}
+
+	if response.PendingObjects[b+".narinfo"].PresignedURL == "" {
+		t.Errorf("expected presigned url for %s", b+".narinfo")
+	}
+}
+
+func TestService_commitPendingClosureMissingReferences(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	id := uploadClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a, b)})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), b+".narinfo") {
+			t.Errorf("expected status %d mentioning %s, got %d: %s",
+				http.StatusBadRequest, b+".narinfo", rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+
+	// once b is in the cache, a can reference it
+	pushClosure(t, service, b, map[string]string{b + ".narinfo": testNarInfo(b)})
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + id + "/complete",
+		handler:    service.CommitPendingClosureHandler,
+		pathValues: map[string]string{"id": id},
+	})
+}
+
+func TestService_commitPendingClosureUnreadableNarInfo(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	// the references of a narinfo that can't be parsed can't be checked
+	id := uploadClosure(t, service, a, map[string]string{
+		a + ".narinfo": testNarInfo(a),
+		b + ".narinfo": "not a narinfo",
+	})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), b+".narinfo") {
+			t.Errorf("expected status %d mentioning %s, got %d: %s",
+				http.StatusUnprocessableEntity, b+".narinfo", rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+}
+
+func TestService_commitPendingClosureRequireFileHash(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.RequireFileHash = true
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	id := uploadClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a)})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), a+".narinfo") {
+			t.Errorf("expected status %d mentioning %s, got %d: %s",
+				http.StatusBadRequest, a+".narinfo", rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+
+	narinfo := testNarInfo(a) +
+		"FileHash: sha256:1b8m03r63zqhnjf7l5wnldhh7c134ap5vpj0850ymkq1iyzicy5s\nFileSize: 512\n"
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": narinfo})
+}
+
+func TestService_commitPendingClosureStoreDir(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	narinfo := strings.Replace(testNarInfo(a), "/nix/store/", "/gnu/store/", 1)
+	id := uploadClosure(t, service, a, map[string]string{a + ".narinfo": narinfo})
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "/gnu/store/"+a) {
+			t.Errorf("expected status %d mentioning /gnu/store/%s, got %d: %s",
+				http.StatusBadRequest, a, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &checkResponse,
+	})
+
+	service.StoreDir = "/gnu/store"
+	pushClosure(t, service, a, map[string]string{a + ".narinfo": narinfo})
+}
+
+func TestService_requestLimits(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.MaxRequestBodySize = 1024
+	service.MaxClosureObjects = 2
+	service.MaxNarinfoReferences = 1
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	expectLimit := func(status int, limit int64) func(*testing.T, *httptest.ResponseRecorder) {
+		return func(t *testing.T, rr *httptest.ResponseRecorder) {
+			t.Helper()
+
+			if rr.Code != status {
+				t.Fatalf("expected status %d, got %d: %s", status, rr.Code, rr.Body.String())
+			}
+
+			var limitErr server.LimitError
+			ok(t, json.Unmarshal(rr.Body.Bytes(), &limitErr))
+
+			if limitErr.Limit != limit || limitErr.Error == "" {
+				t.Errorf("expected error with limit %d, got %+v", limit, limitErr)
+			}
+		}
+	}
+
+	tooLarge := expectLimit(http.StatusRequestEntityTooLarge, 1024)
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures",
+		body:          []byte(`{"closure": "` + strings.Repeat(a, 64) + `"}`),
+		handler:       service.CreatePendingClosureHandler,
+		checkResponse: &tooLarge,
+	})
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": a,
+		"objects": []string{a + ".narinfo", b + ".narinfo", c + ".narinfo"},
+	})
+	ok(t, err)
+
+	tooManyObjects := expectLimit(http.StatusUnprocessableEntity, 2)
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures",
+		body:          body,
+		handler:       service.CreatePendingClosureHandler,
+		checkResponse: &tooManyObjects,
+	})
+
+	id := uploadClosure(t, service, a, map[string]string{a + ".narinfo": testNarInfo(a, b, c)})
+
+	tooManyReferences := expectLimit(http.StatusUnprocessableEntity, 1)
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures/" + id + "/complete",
+		handler:       service.CommitPendingClosureHandler,
+		pathValues:    map[string]string{"id": id},
+		checkResponse: &tooManyReferences,
+	})
+}
+
+func TestService_createPendingClosureEncryption(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	service.S3Encryption = encrypt.NewSSE()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": a,
+		"objects": []string{a + ".narinfo"},
+	})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var pendingClosure server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosure))
+
+	pendingObject := pendingClosure.PendingObjects[a+".narinfo"]
+	if pendingObject.Headers[encrypt.SseGenericHeader] != "AES256" {
+		t.Errorf("expected upload headers for SSE-S3, got %v", pendingObject.Headers)
+	}
+
+	// the header has to be signed, otherwise S3 rejects it
+	if !strings.Contains(strings.ToLower(pendingObject.PresignedURL), "x-amz-server-side-encryption") {
+		t.Errorf("expected the encryption header to be signed: %s", pendingObject.PresignedURL)
+	}
+}
+
+func TestService_AttachPendingObjectsHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+
+	first := uploadClosure(t, service, a, map[string]string{
+		a + ".narinfo": testNarInfo(a, b),
+		b + ".narinfo": testNarInfo(b),
+	})
+	second := uploadClosure(t, service, c, map[string]string{c + ".narinfo": testNarInfo(c, b)})
+
+	attach := func(objects []string, checkResponse *func(*testing.T, *httptest.ResponseRecorder)) {
+		body, err := json.Marshal(map[string]any{"pending_closure": first, "objects": objects})
+		ok(t, err)
+
+		testRequest(t, &TestRequest{
+			method:        "POST",
+			path:          "/api/pending_closures/" + second + "/attach",
+			body:          body,
+			handler:       service.AttachPendingObjectsHandler,
+			pathValues:    map[string]string{"id": second},
+			checkResponse: checkResponse,
+		})
+	}
+
+	checkBadRequest := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "nar/unknown.nar") {
+			t.Errorf("expected status %d mentioning the unknown object, got %d: %s",
+				http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+	}
+
+	attach([]string{b + ".narinfo", "nar/unknown.nar"}, &checkBadRequest)
+
+	checkAttached := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		var resp server.AttachPendingObjectsResponse
+		ok(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+
+		if resp.Attached != 1 {
+			t.Errorf("expected 1 attached object, got %d", resp.Attached)
+		}
+	}
+
+	attach([]string{b + ".narinfo"}, &checkAttached)
+
+	// the reference to b is satisfied by the attached object
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + second + "/complete",
+		handler:    service.CommitPendingClosureHandler,
+		pathValues: map[string]string{"id": second},
+	})
+
+	rr := testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + c,
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": c},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	if len(closure.Objects) != 2 {
+		t.Errorf("expected the attached object in the closure, got %v", closure.Objects)
+	}
+}
+
+func TestService_createPendingClosureIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	header := map[string]string{"Idempotency-Key": "9b2f6a1e-4c1d-4f5e-8a43-0c5d3b7e2a10"}
+
+	createPendingClosure := func(
+		closure string, checkResponse *func(*testing.T, *httptest.ResponseRecorder),
+	) *httptest.ResponseRecorder {
+		body, err := json.Marshal(map[string]interface{}{
+			"closure": closure,
+			"objects": []string{closure + ".narinfo", "nar/" + closure + ".nar"},
+		})
+		ok(t, err)
+
+		return testRequest(t, &TestRequest{
+			method:        "POST",
+			path:          "/api/pending_closures",
+			body:          body,
+			handler:       service.CreatePendingClosureHandler,
+			header:        header,
+			checkResponse: checkResponse,
+		})
+	}
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	rr := createPendingClosure(a, nil)
+	if rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("unexpected replay of the first request")
+	}
+
+	var first server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &first))
+
+	// the retry gets the same pending closure instead of a second one
+	rr = createPendingClosure(a, nil)
+	if rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the retry to be replayed")
+	}
+
+	var retry server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &retry))
+
+	if retry.ID != first.ID || len(retry.PendingObjects) != 2 || retry.PendingObjects[a+".narinfo"].PresignedURL == "" {
+		t.Errorf("unexpected replayed response: %+v, first: %+v", retry, first)
+	}
+
+	checkUnprocessable := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+		}
+	}
+
+	createPendingClosure("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", &checkUnprocessable)
+}
+
+func TestService_uploadPendingObjectHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": a,
+		"objects": []string{a + ".narinfo"},
+	})
+	ok(t, err)
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var pendingClosureResponse server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+	id := pendingClosureResponse.ID
+
+	checkNoContent := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("expected status %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "PUT",
+		path:          "/api/objects/" + a + ".narinfo?pending_closure=" + id,
+		body:          []byte(testNarInfo(a)),
+		handler:       service.UploadPendingObjectHandler,
+		pathValues:    map[string]string{"key": a + ".narinfo"},
+		checkResponse: &checkNoContent,
+	})
+
+	// objects outside of the pending closure are refused
+	checkBadRequest := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d: %s", http.StatusBadRequest, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "PUT",
+		path:          "/api/objects/nix-cache-info?pending_closure=" + id,
+		body:          []byte("StoreDir: /tmp\n"),
+		handler:       service.UploadPendingObjectHandler,
+		pathValues:    map[string]string{"key": "nix-cache-info"},
+		checkResponse: &checkBadRequest,
+	})
+
+	testRequest(t, &TestRequest{
+		method:     "POST",
+		path:       "/api/pending_closures/" + id + "/complete",
+		handler:    service.CommitPendingClosureHandler,
+		pathValues: map[string]string{"id": id},
+	})
+
+	rr = testRequest(t, &TestRequest{
+		method:     "GET",
+		path:       "/api/closures/" + a,
+		handler:    service.GetClosureHandler,
+		pathValues: map[string]string{"key": a},
+	})
+
+	var closure server.ClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &closure))
+
+	if len(closure.Objects) != 1 || closure.Objects[0] != a+".narinfo" {
+		t.Errorf("unexpected closure objects: %v", closure.Objects)
+	}
+
+	// another closure reuses a from the cache and must not overwrite it
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+
+	body, err = json.Marshal(map[string]interface{}{
+		"closure": b,
+		"objects": []string{a + ".narinfo", b + ".narinfo"},
+	})
+	ok(t, err)
+
+	rr = testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+	checkConflict := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d: %s", http.StatusConflict, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "PUT",
+		path:          "/api/objects/" + a + ".narinfo?pending_closure=" + pendingClosureResponse.ID,
+		body:          []byte(testNarInfo(a, b)),
+		handler:       service.UploadPendingObjectHandler,
+		pathValues:    map[string]string{"key": a + ".narinfo"},
+		checkResponse: &checkConflict,
+	})
+}
+
+func TestService_createPendingClosureWaitForDeletion(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"closure": "00000000000000000000000000000000",
+		"objects": []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+	})
+	ok(t, err)
+
+	testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	// abandoned pending objects are marked for deletion
+	testRequest(t, &TestRequest{
+		method:  "DELETE",
+		path:    "/api/pending_closures?older-than=0s",
+		handler: service.CleanupPendingClosuresHandler,
+	})
+
+	service.DeletionPollInterval = 10 * time.Millisecond
+	service.DeletionWaitTimeout = 50 * time.Millisecond
+
+	checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected status %d, got %d: %s", http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+		}
+	}
+
+	testRequest(t, &TestRequest{
+		method:        "POST",
+		path:          "/api/pending_closures",
+		body:          body,
+		handler:       service.CreatePendingClosureHandler,
+		checkResponse: &checkResponse,
+	})
+
+	// objects marked for deletion before the window are uploaded again
+	service.DeletionWaitWindow = time.Nanosecond
+
+	rr := testRequest(t, &TestRequest{
+		method:  "POST",
+		path:    "/api/pending_closures",
+		body:    body,
+		handler: service.CreatePendingClosureHandler,
+	})
+
+	var pendingClosureResponse server.PendingClosureResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &pendingClosureResponse))
+
+	if _, found := pendingClosureResponse.PendingObjects["aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"]; !found {
+		t.Errorf("expected object to be uploaded again, got %v", pendingClosureResponse.PendingObjects)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+
+	"github.com/Mic92/niks3/server/storepath"
+)
+
+var errBucketProblems = errors.New("bucket has problems")
+
+// Kinds of problems found by verify-bucket.
+const (
+	ProblemUnparseable      = "unparseable"
+	ProblemInvalidSignature = "invalid-signature"
+	ProblemUnreadableNar    = "unreadable-nar"
+	ProblemNarMismatch      = "nar-mismatch"
+	ProblemMissingReference = "missing-reference"
+)
+
+// BucketProblem is a problem of one narinfo, the detail is e.g. the missing reference.
+type BucketProblem struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// BucketReport is the machine-readable result of verify-bucket.
+type BucketReport struct {
+	Narinfos int `json:"narinfos"`
+	// narinfos whose NAR uses a compression that can't be decompressed here, e.g. xz
+	Unverified []string        `json:"unverified"`
+	Problems   []BucketProblem `json:"problems"`
+}
+
+// verifyNarContent compares the uncompressed NAR of a narinfo with its NarHash and NarSize.
+func (s *Service) verifyNarContent(ctx context.Context, info *NarInfo) error {
+	expected, err := storepath.ParseHash(info.NarHash)
+	if err != nil {
+		return fmt.Errorf("invalid NarHash: %w", err)
+	}
+
+	// nix always writes sha256 NarHashes
+	if expected.Algo != "sha256" {
+		return fmt.Errorf("unsupported NarHash algorithm %s", expected.Algo)
+	}
+
+	hasher := sha256.New()
+
+	nar, err := s.openNar(ctx, info)
+	if err != nil {
+		return err
+	}
+	defer nar.Close()
+
+	size, err := io.Copy(hasher, nar)
+	if err != nil {
+		return fmt.Errorf("failed to read nar: %w", err)
+	}
+
+	if uint64(size) != info.NarSize { //nolint:gosec
+		return fmt.Errorf("%w: %s has %d bytes, expected %d", errChecksumMismatch, info.URL, size, info.NarSize)
+	}
+
+	if actual := hasher.Sum(nil); !bytes.Equal(actual, expected.Digest) {
+		return fmt.Errorf("%w: %s has NarHash %s, expected %s", errChecksumMismatch, info.URL,
+			(&storepath.Hash{Algo: expected.Algo, Digest: actual}).String(), info.NarHash)
+	}
+
+	return nil
+}
+
+// verifyBucketNarInfo checks one narinfo of the bucket and adds its problems to the report.
+func (s *Service) verifyBucketNarInfo(ctx context.Context, inv *bucketInventory, key string, report *BucketReport) {
+	info := inv.narinfos[key]
+
+	if len(s.TrustedKeys) > 0 {
+		if err := verifyNarInfo(info, s.TrustedKeys); err != nil {
+			report.Problems = append(report.Problems, BucketProblem{Key: key, Problem: ProblemInvalidSignature})
+		}
+	}
+
+	for _, ref := range info.References {
+		if refKey := narInfoKey(ref); refKey != key && inv.narinfos[refKey] == nil {
+			report.Problems = append(report.Problems, BucketProblem{
+				Key: key, Problem: ProblemMissingReference, Detail: ref,
+			})
+		}
+	}
+
+	err := s.verifyNarContent(ctx, info)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errUnsupportedCompression):
+		report.Unverified = append(report.Unverified, key)
+	case errors.Is(err, errChecksumMismatch):
+		report.Problems = append(report.Problems, BucketProblem{
+			Key: key, Problem: ProblemNarMismatch, Detail: err.Error(),
+		})
+	default:
+		report.Problems = append(report.Problems, BucketProblem{
+			Key: key, Problem: ProblemUnreadableNar, Detail: err.Error(),
+		})
+	}
+}
+
+// VerifyBucket checks the narinfos of the bucket without the database, e.g. of a backup: their signatures
+// against the trusted keys, if any are configured, the NARs against their NarHash and that all references
+// are in the bucket. The report is written to w as JSON.
+func (s *Service) VerifyBucket(ctx context.Context, w io.Writer) error {
+	inv, err := s.listBucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(s.TrustedKeys) == 0 {
+		slog.WarnContext(ctx, "No trusted keys configured, signatures are not verified")
+	}
+
+	keys := make([]string, 0, len(inv.narinfos))
+	for key := range inv.narinfos {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	report := BucketReport{
+		Narinfos:   len(keys) + len(inv.unparseable),
+		Unverified: []string{},
+		Problems:   []BucketProblem{},
+	}
+
+	for _, key := range inv.unparseable {
+		report.Problems = append(report.Problems, BucketProblem{Key: key, Problem: ProblemUnparseable})
+	}
+
+	for i, key := range keys {
+		s.verifyBucketNarInfo(ctx, inv, key, &report)
+
+		if (i+1)%DeletionBatchSize == 0 {
+			slog.InfoContext(ctx, "Verifying bucket", "checked", i+1, "problems", len(report.Problems))
+		}
+	}
+
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Finished verifying bucket", "narinfos", report.Narinfos,
+		"unverified", len(report.Unverified), "problems", len(report.Problems))
+
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%w: %d", errBucketProblems, len(report.Problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mic92/niks3/server"
+	"github.com/Mic92/niks3/server/storepath"
+	minio "github.com/minio/minio-go/v7"
+)
+
+func TestService_VerifyBucket(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	nar := []byte("nar contents")
+	digest := sha256.Sum256(nar)
+	narHash := "sha256:" + storepath.EncodeNix32(digest[:])
+
+	narInfo := func(hash, compression, narHash string, references ...string) string {
+		refs := make([]string, 0, len(references))
+		for _, ref := range references {
+			refs = append(refs, ref+"-pkg")
+		}
+
+		return fmt.Sprintf("StorePath: /nix/store/%s-pkg\nURL: nar/%s.nar\nCompression: %s\n"+
+			"NarHash: %s\nNarSize: %d\nReferences: %s\n", hash, hash, compression, narHash, len(nar),
+			strings.Join(refs, " "))
+	}
+
+	a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	c := "cccccccccccccccccccccccccccccccc"
+	d := "dddddddddddddddddddddddddddddddd"
+	f := "ffffffffffffffffffffffffffffffff"
+
+	objects := map[string]string{
+		a + ".narinfo":      narInfo(a, "zstd", narHash, b),
+		b + ".narinfo":      narInfo(b, "zstd", "sha256:0yzhigwjl6bws649vcs2asa4lbs8hg93hyix187gc7s7a74w5h80"),
+		c + ".narinfo":      narInfo(c, "none", narHash, d),
+		f + ".narinfo":      narInfo(f, "xz", narHash),
+		"nar/" + a + ".nar": string(seekableZstd(t, nar, 4)),
+		"nar/" + b + ".nar": string(seekableZstd(t, nar, 4)),
+		"nar/" + c + ".nar": string(nar),
+		"nar/" + f + ".nar": "xz",
+	}
+
+	for key, content := range objects {
+		_, err := service.MinioClient.PutObject(ctx, service.BucketName, key,
+			strings.NewReader(content), int64(len(content)), minio.PutObjectOptions{})
+		ok(t, err)
+	}
+
+	var out bytes.Buffer
+	if err := service.VerifyBucket(ctx, &out); err == nil {
+		t.Error("expected problems to be reported")
+	}
+
+	var report server.BucketReport
+	ok(t, json.Unmarshal(out.Bytes(), &report))
+
+	if report.Narinfos != 4 || len(report.Unverified) != 1 || report.Unverified[0] != f+".narinfo" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	expected := []server.BucketProblem{
+		{Key: b + ".narinfo", Problem: server.ProblemNarMismatch},
+		{Key: c + ".narinfo", Problem: server.ProblemMissingReference, Detail: d + "-pkg"},
+	}
+
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected problems %v, got %v", expected, report.Problems)
+	}
+
+	for i, problem := range report.Problems {
+		if problem.Key != expected[i].Key || problem.Problem != expected[i].Problem ||
+			(expected[i].Detail != "" && problem.Detail != expected[i].Detail) {
+			t.Errorf("expected problem %v, got %v", expected[i], problem)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// APIVersion is incremented on incompatible changes of the /api endpoints.
+// Servers still accept clients down to MinAPIVersion.
+const (
+	APIVersion    = 1
+	MinAPIVersion = 1
+)
+
+// APIVersionHeader carries the API version of the client in requests and of the server in responses.
+const APIVersionHeader = "Niks3-Api-Version"
+
+// Capabilities that depend on the configuration of the server, returned by GET /api/version.
+const (
+	// write endpoints are registered, false with --read-only
+	CapabilityWrite = "write"
+	// POST /api/pending_closures/{id}/urls hands out presigned upload URLs for objects that are not yet uploaded
+	CapabilityUploadURLs = "upload_urls"
+	// PUT /api/objects/{key} uploads through the server, for clients that can't reach S3
+	CapabilityUploadThroughServer = "upload_through_server"
+	// narinfos must be signed by the client with one of the trusted keys
+	CapabilityClientSignatures = "client_signatures"
+	// the server has a signing key to sign narinfos of promoted closures
+	CapabilityServerSigning = "server_signing"
+	// NARs served through /serve are checked against their recorded checksums
+	CapabilityVerifyReads = "verify_reads"
+	// uploads fail over to a secondary bucket
+	CapabilityFailover = "failover"
+	// files of store paths are served at /serve, possibly only with the API token (see --read-access)
+	CapabilityServe = "serve"
+)
+
+// VersionResponse is returned by GET /api/version.
+type VersionResponse struct {
+	APIVersion    int             `json:"api_version"`
+	MinAPIVersion int             `json:"min_api_version"`
+	Capabilities  map[string]bool `json:"capabilities"`
+}
+
+func (s *Service) capabilities() map[string]bool {
+	return map[string]bool{
+		CapabilityWrite:               !s.ReadOnly,
+		CapabilityUploadURLs:          !s.ReadOnly,
+		CapabilityUploadThroughServer: !s.ReadOnly,
+		CapabilityClientSignatures:    len(s.TrustedKeys) > 0,
+		CapabilityServerSigning:       s.SigningKey != nil,
+		CapabilityVerifyReads:         s.VerifyReads,
+		CapabilityFailover:            s.SecondaryMinioClient != nil,
+		CapabilityServe:               s.ReadAccess[ReadClassNar] != ReadAccessDeny,
+	}
+}
+
+// APIVersionMiddleware announces the API version of the server in every response and rejects clients
+// that announce an API version the server doesn't speak, instead of letting them fail on changed endpoints.
+// Clients that don't send the header are not checked.
+func (s *Service) APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(APIVersionHeader, strconv.Itoa(APIVersion))
+
+		header := r.Header.Get(APIVersionHeader)
+		if header == "" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		version, err := strconv.Atoi(header)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s header: %q", APIVersionHeader, header), http.StatusBadRequest)
+
+			return
+		}
+
+		if version < MinAPIVersion {
+			http.Error(w, fmt.Sprintf("client too old: it speaks API version %d, the server requires at least %d",
+				version, MinAPIVersion), http.StatusBadRequest)
+
+			return
+		}
+
+		if version > APIVersion {
+			http.Error(w, fmt.Sprintf("server too old: it speaks API version %d, the client requires %d",
+				APIVersion, version), http.StatusBadRequest)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET /api/version
+// Response body:
+//
+//	{
+//	  "api_version": 1,
+//	  "min_api_version": 1,
+//	  "capabilities": {"write": true, "upload_urls": true, "client_signatures": false, ...}
+//	}
+func (s *Service) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Received version request", "method", r.Method, "url", r.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(VersionResponse{
+		APIVersion:    APIVersion,
+		MinAPIVersion: MinAPIVersion,
+		Capabilities:  s.capabilities(),
+	})
+	if err != nil {
+		http.Error(w, "failed to encode response: "+err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+}
@@ -0,0 +1,89 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/Mic92/niks3/server"
+)
+
+func TestService_VersionHandler(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	rr := testRequest(t, &TestRequest{
+		method:  "GET",
+		path:    "/api/version",
+		handler: service.VersionHandler,
+	})
+
+	var version server.VersionResponse
+	ok(t, json.Unmarshal(rr.Body.Bytes(), &version))
+
+	if version.APIVersion != server.APIVersion || version.MinAPIVersion != server.MinAPIVersion {
+		t.Errorf("unexpected versions: %+v", version)
+	}
+
+	if !version.Capabilities[server.CapabilityWrite] {
+		t.Errorf("expected write capability, got %v", version.Capabilities)
+	}
+}
+
+func TestService_APIVersionMiddleware(t *testing.T) {
+	t.Parallel()
+
+	service := createTestService(t)
+	defer service.Close()
+
+	handler := service.APIVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP
+
+	tests := []struct {
+		name    string
+		version string
+		code    int
+	}{
+		{"no header", "", http.StatusNoContent},
+		{"current", strconv.Itoa(server.APIVersion), http.StatusNoContent},
+		{"too old", strconv.Itoa(server.MinAPIVersion - 1), http.StatusBadRequest},
+		{"too new", strconv.Itoa(server.APIVersion + 1), http.StatusBadRequest},
+		{"invalid", "v1", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := map[string]string{}
+			if tt.version != "" {
+				header[server.APIVersionHeader] = tt.version
+			}
+
+			checkResponse := func(t *testing.T, rr *httptest.ResponseRecorder) {
+				t.Helper()
+
+				if rr.Code != tt.code {
+					t.Errorf("expected status %d, got %d: %s", tt.code, rr.Code, rr.Body.String())
+				}
+
+				if rr.Header().Get(server.APIVersionHeader) != strconv.Itoa(server.APIVersion) {
+					t.Errorf("expected %s header in response", server.APIVersionHeader)
+				}
+			}
+
+			testRequest(t, &TestRequest{
+				method:        "GET",
+				path:          "/api/closures",
+				handler:       handler,
+				header:        header,
+				checkResponse: &checkResponse,
+			})
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	minio "github.com/minio/minio-go/v7"
+)
+
+// Constants of the zstd seekable format, see
+// https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md
+const (
+	seekTableFooterSize      = 9
+	seekTableMagic           = 0x8F92EAB1
+	skippableFrameHeaderSize = 8
+	seekTableChecksumFlag    = 1 << 7
+	// maxSeekTableFrames bounds the seek table read from the footer of an untrusted object to 12 MiB.
+	maxSeekTableFrames = 1 << 20
+)
+
+// seekTableFrame locates one independently decompressable zstd frame.
+type seekTableFrame struct {
+	compressedOffset   uint64
+	compressedSize     uint64
+	decompressedOffset uint64
+	decompressedSize   uint64
+}
+
+func (s *Service) getObjectSuffix(ctx context.Context, key string, length int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, -length); err != nil {
+		return nil, fmt.Errorf("failed to set range: %w", err)
+	}
+
+	obj, err := s.getObject(ctx, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj, length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %w", err)
+	}
+
+	return data, nil
+}
+
+// fetchSeekTable returns the frames of a NAR compressed in the zstd seekable format.
+// Plain zstd NARs have no seek table, in which case nil is returned.
+func (s *Service) fetchSeekTable(ctx context.Context, key string) ([]seekTableFrame, error) {
+	footer, err := s.getObjectSuffix(ctx, key, seekTableFooterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(footer) != seekTableFooterSize || binary.LittleEndian.Uint32(footer[5:]) != seekTableMagic {
+		return nil, nil
+	}
+
+	numFrames := int64(binary.LittleEndian.Uint32(footer))
+	if numFrames > maxSeekTableFrames {
+		return nil, fmt.Errorf("seek table in '%s' has %d frames, more than the supported %d",
+			key, numFrames, maxSeekTableFrames)
+	}
+
+	entrySize := int64(8)
+	if footer[4]&seekTableChecksumFlag != 0 {
+		entrySize = 12
+	}
+
+	tableSize := skippableFrameHeaderSize + numFrames*entrySize + seekTableFooterSize
+
+	table, err := s.getObjectSuffix(ctx, key, tableSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(table)) != tableSize {
+		return nil, fmt.Errorf("truncated seek table in '%s'", key)
+	}
+
+	frames := make([]seekTableFrame, 0, numFrames)
+
+	var compressedOffset, decompressedOffset uint64
+
+	for i := range numFrames {
+		entry := table[skippableFrameHeaderSize+i*entrySize:]
+		frame := seekTableFrame{
+			compressedOffset:   compressedOffset,
+			compressedSize:     uint64(binary.LittleEndian.Uint32(entry)),
+			decompressedOffset: decompressedOffset,
+			decompressedSize:   uint64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		frames = append(frames, frame)
+
+		compressedOffset += frame.compressedSize
+		decompressedOffset += frame.decompressedSize
+	}
+
+	return frames, nil
+}
+
+// framesFor returns the compressed byte range and its decompressed start offset that covers [offset, offset+size).
+func framesFor(frames []seekTableFrame, offset, size uint64) (start, end, decompressedStart uint64, ok bool) {
+	var first, last *seekTableFrame
+
+	for i := range frames {
+		frame := &frames[i]
+		if frame.decompressedOffset+frame.decompressedSize <= offset {
+			continue
+		}
+
+		if first == nil {
+			first = frame
+		}
+
+		last = frame
+
+		if frame.decompressedOffset+frame.decompressedSize >= offset+size {
+			break
+		}
+	}
+
+	if first == nil {
+		return 0, 0, 0, false
+	}
+
+	return first.compressedOffset, last.compressedOffset + last.compressedSize - 1, first.decompressedOffset, true
+}
+
+type zstdRangeReader struct {
+	io.Reader
+	decoder *zstd.Decoder
+	obj     *minio.Object
+}
+
+func (r *zstdRangeReader) Close() error {
+	r.decoder.Close()
+
+	return r.obj.Close() //nolint:wrapcheck
+}
+
+// openZstdRange decompresses size bytes at offset of a zstd compressed object.
+// With a seek table only the frames containing the range are downloaded,
+// otherwise everything before the range is decompressed and discarded.
+func (s *Service) openZstdRange(ctx context.Context, key string, offset, size uint64) (io.ReadCloser, error) {
+	frames, err := s.fetchSeekTable(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.GetObjectOptions{}
+	skip := offset
+
+	if start, end, decompressedStart, ok := framesFor(frames, offset, size); ok {
+		if err = opts.SetRange(int64(start), int64(end)); err != nil { //nolint:gosec
+			return nil, fmt.Errorf("failed to set range: %w", err)
+		}
+
+		skip = offset - decompressedStart
+	}
+
+	obj, err := s.getObject(ctx, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nar: %w", err)
+	}
+
+	// the seek table is a skippable frame, which the decoder ignores
+	decoder, err := zstd.NewReader(obj)
+	if err != nil {
+		obj.Close()
+
+		return nil, fmt.Errorf("failed to decompress nar: %w", err)
+	}
+
+	if _, err = io.CopyN(io.Discard, decoder, int64(skip)); err != nil { //nolint:gosec
+		decoder.Close()
+		obj.Close()
+
+		return nil, fmt.Errorf("failed to seek in nar: %w", err)
+	}
+
+	return &zstdRangeReader{
+		Reader:  io.LimitReader(decoder, int64(size)), //nolint:gosec
+		decoder: decoder,
+		obj:     obj,
+	}, nil
+}